@@ -0,0 +1,185 @@
+// Package acl implements an in-memory store of ACL bindings that's used as
+// the broker's built-in authorizer.
+package acl
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/travisjeffery/jocko"
+)
+
+// PatternType is how a binding's resource name is matched, using Kafka's pattern type codes.
+type PatternType int8
+
+const (
+	// PatternAny is used by filters to match bindings with any pattern type.
+	PatternAny PatternType = 1
+	// PatternMatch is used by filters to match the bindings that would apply
+	// to the resource: literal, wildcard, and prefixed bindings.
+	PatternMatch PatternType = 2
+	// PatternLiteral matches the resource with the exact name, or every
+	// resource if the name is the wildcard.
+	PatternLiteral PatternType = 3
+	// PatternPrefixed matches resources whose names start with the name.
+	PatternPrefixed PatternType = 4
+)
+
+// PermissionType is whether a binding allows or denies, using Kafka's permission type codes.
+type PermissionType int8
+
+const (
+	PermissionAny   PermissionType = 1
+	PermissionDeny  PermissionType = 2
+	PermissionAllow PermissionType = 3
+)
+
+// Wildcard matches every resource name or principal.
+const Wildcard = "*"
+
+// Binding binds a principal's permission for an operation to resources.
+type Binding struct {
+	ResourceType jocko.ResourceType
+	ResourceName string
+	PatternType  PatternType
+	Principal    string
+	Operation    jocko.Operation
+	Permission   PermissionType
+}
+
+// Filter is used to describe and delete bindings. Zero valued fields match
+// any binding, as do PatternAny and PermissionAny.
+type Filter struct {
+	ResourceType jocko.ResourceType
+	ResourceName string
+	PatternType  PatternType
+	Principal    string
+	Operation    jocko.Operation
+	Permission   PermissionType
+}
+
+// Store is an in-memory store of bindings. It implements jocko.Authorizer.
+type Store struct {
+	mu       sync.RWMutex
+	bindings []Binding
+}
+
+// NewStore is used to create an empty store.
+func NewStore() *Store {
+	return &Store{}
+}
+
+// Add is used to add the bindings to the store.
+func (s *Store) Add(bindings ...Binding) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, b := range bindings {
+		if b.PatternType == 0 {
+			b.PatternType = PatternLiteral
+		}
+		s.bindings = append(s.bindings, b)
+	}
+}
+
+// Describe is used to get the bindings matching the filter.
+func (s *Store) Describe(f Filter) []Binding {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var found []Binding
+	for _, b := range s.bindings {
+		if f.matches(b) {
+			found = append(found, b)
+		}
+	}
+	return found
+}
+
+// Delete is used to delete the bindings matching the filter. It returns the
+// deleted bindings.
+func (s *Store) Delete(f Filter) []Binding {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var deleted []Binding
+	kept := s.bindings[:0]
+	for _, b := range s.bindings {
+		if f.matches(b) {
+			deleted = append(deleted, b)
+		} else {
+			kept = append(kept, b)
+		}
+	}
+	s.bindings = kept
+	return deleted
+}
+
+// Authorize returns whether the principal is allowed to do the operation on the
+// resource. Like Kafka, deny bindings take precedence over allow bindings, and
+// principals without a matching allow binding are denied.
+func (s *Store) Authorize(principal string, operation jocko.Operation, resource jocko.Resource) bool {
+	bindings := s.Describe(Filter{
+		ResourceType: resource.Type,
+		ResourceName: resource.Name,
+		PatternType:  PatternMatch,
+	})
+	allowed := false
+	for _, b := range bindings {
+		if b.Principal != principal && b.Principal != "User:"+Wildcard {
+			continue
+		}
+		switch b.Permission {
+		case PermissionDeny:
+			if b.Operation == operation || b.Operation == jocko.OpAll {
+				return false
+			}
+		case PermissionAllow:
+			if b.Operation == operation || b.Operation == jocko.OpAll || implies(b.Operation, operation) {
+				allowed = true
+			}
+		}
+	}
+	return allowed
+}
+
+// implies returns whether allowing op implies allowing other, e.g. being allowed
+// to read a topic implies being allowed to describe it.
+func implies(op, other jocko.Operation) bool {
+	switch other {
+	case jocko.OpDescribe:
+		return op == jocko.OpRead || op == jocko.OpWrite || op == jocko.OpDelete || op == jocko.OpAlter
+	case jocko.OpDescribeConfigs:
+		return op == jocko.OpAlterConfigs
+	}
+	return false
+}
+
+func (f Filter) matches(b Binding) bool {
+	if f.ResourceType != 0 && f.ResourceType != b.ResourceType {
+		return false
+	}
+	if f.Principal != "" && f.Principal != b.Principal {
+		return false
+	}
+	if f.Operation != 0 && f.Operation != b.Operation {
+		return false
+	}
+	if f.Permission != 0 && f.Permission != PermissionAny && f.Permission != b.Permission {
+		return false
+	}
+	if f.ResourceName == "" {
+		return f.PatternType == 0 || f.PatternType == PatternAny || f.PatternType == PatternMatch || f.PatternType == b.PatternType
+	}
+	switch f.PatternType {
+	case 0, PatternAny:
+		return f.ResourceName == b.ResourceName
+	case PatternMatch:
+		switch b.PatternType {
+		case PatternLiteral:
+			return b.ResourceName == f.ResourceName || b.ResourceName == Wildcard
+		case PatternPrefixed:
+			return strings.HasPrefix(f.ResourceName, b.ResourceName)
+		}
+		return false
+	default:
+		return f.PatternType == b.PatternType && f.ResourceName == b.ResourceName
+	}
+}
@@ -0,0 +1,115 @@
+package acl
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/jocko"
+)
+
+func TestStore_Describe(t *testing.T) {
+	literal := Binding{
+		ResourceType: jocko.ResourceTopic,
+		ResourceName: "payments",
+		PatternType:  PatternLiteral,
+		Principal:    "User:alice",
+		Operation:    jocko.OpRead,
+		Permission:   PermissionAllow,
+	}
+	prefixed := Binding{
+		ResourceType: jocko.ResourceTopic,
+		ResourceName: "order-",
+		PatternType:  PatternPrefixed,
+		Principal:    "User:alice",
+		Operation:    jocko.OpRead,
+		Permission:   PermissionAllow,
+	}
+	wildcard := Binding{
+		ResourceType: jocko.ResourceTopic,
+		ResourceName: Wildcard,
+		PatternType:  PatternLiteral,
+		Principal:    "User:bob",
+		Operation:    jocko.OpDescribe,
+		Permission:   PermissionAllow,
+	}
+	s := NewStore()
+	s.Add(literal, prefixed, wildcard)
+
+	tests := []struct {
+		name   string
+		filter Filter
+		want   []Binding
+	}{
+		{
+			name:   "literal match",
+			filter: Filter{ResourceType: jocko.ResourceTopic, ResourceName: "payments", PatternType: PatternMatch},
+			want:   []Binding{literal, wildcard},
+		},
+		{
+			name:   "prefix match",
+			filter: Filter{ResourceType: jocko.ResourceTopic, ResourceName: "order-events", PatternType: PatternMatch},
+			want:   []Binding{prefixed, wildcard},
+		},
+		{
+			name:   "wildcard match",
+			filter: Filter{ResourceType: jocko.ResourceTopic, ResourceName: "anything", PatternType: PatternMatch},
+			want:   []Binding{wildcard},
+		},
+		{
+			name:   "exact prefixed pattern",
+			filter: Filter{ResourceType: jocko.ResourceTopic, ResourceName: "order-", PatternType: PatternPrefixed},
+			want:   []Binding{prefixed},
+		},
+		{
+			name:   "non-match",
+			filter: Filter{ResourceType: jocko.ResourceGroup, ResourceName: "payments", PatternType: PatternMatch},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, s.Describe(tt.filter))
+		})
+	}
+}
+
+func TestStore_Authorize(t *testing.T) {
+	s := NewStore()
+	s.Add(
+		Binding{
+			ResourceType: jocko.ResourceTopic,
+			ResourceName: "order-",
+			PatternType:  PatternPrefixed,
+			Principal:    "User:alice",
+			Operation:    jocko.OpWrite,
+			Permission:   PermissionAllow,
+		},
+		Binding{
+			ResourceType: jocko.ResourceTopic,
+			ResourceName: "order-audit",
+			PatternType:  PatternLiteral,
+			Principal:    "User:alice",
+			Operation:    jocko.OpAll,
+			Permission:   PermissionDeny,
+		},
+	)
+	topic := func(name string) jocko.Resource {
+		return jocko.Resource{Type: jocko.ResourceTopic, Name: name}
+	}
+	require.True(t, s.Authorize("User:alice", jocko.OpWrite, topic("order-events")))
+	require.True(t, s.Authorize("User:alice", jocko.OpDescribe, topic("order-events")))
+	require.False(t, s.Authorize("User:alice", jocko.OpRead, topic("order-events")))
+	require.False(t, s.Authorize("User:alice", jocko.OpWrite, topic("order-audit")))
+	require.False(t, s.Authorize("User:bob", jocko.OpWrite, topic("order-events")))
+	require.False(t, s.Authorize("User:alice", jocko.OpWrite, topic("payments")))
+}
+
+func TestStore_Delete(t *testing.T) {
+	s := NewStore()
+	s.Add(
+		Binding{ResourceType: jocko.ResourceTopic, ResourceName: "a", Principal: "User:alice", Operation: jocko.OpRead, Permission: PermissionAllow},
+		Binding{ResourceType: jocko.ResourceTopic, ResourceName: "b", Principal: "User:alice", Operation: jocko.OpRead, Permission: PermissionAllow},
+	)
+	deleted := s.Delete(Filter{ResourceType: jocko.ResourceTopic, ResourceName: "a"})
+	require.Equal(t, 1, len(deleted))
+	require.Equal(t, 1, len(s.Describe(Filter{})))
+}
@@ -0,0 +1,53 @@
+package broker
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"sort"
+)
+
+// assignReplicas is used to assign the partitions' replicas to the brokers, the same way as Kafka's
+// AdminUtils.assignReplicasToBrokers when brokers don't have racks. The first replica of each
+// partition, its preferred leader, is assigned round-robin from the broker at startIndex, so
+// leaders are spread evenly. The other replicas follow the first at a distance of replicaShift,
+// which is bumped after every round of brokers so the followers of a broker's partitions aren't
+// all on the same broker. The brokers must be sorted and replicationFactor at most len(brokers).
+func assignReplicas(brokers []int32, partitions int32, replicationFactor int16, startIndex, replicaShift int) [][]int32 {
+	n := len(brokers)
+	assignment := make([][]int32, partitions)
+	for i := range assignment {
+		if i > 0 && i%n == 0 {
+			replicaShift++
+		}
+		first := (i + startIndex) % n
+		replicas := []int32{brokers[first]}
+		for j := 0; j < int(replicationFactor)-1; j++ {
+			replicas = append(replicas, brokers[replicaIndex(first, replicaShift, j, n)])
+		}
+		assignment[i] = replicas
+	}
+	return assignment
+}
+
+// replicaIndex returns the index of the broker of the partition's j-th follower. The shift's
+// always between 1 and n-1 so followers are never on the first replica's broker.
+func replicaIndex(first, replicaShift, j, n int) int {
+	shift := 1 + (replicaShift+j)%(n-1)
+	return (first + shift) % n
+}
+
+// topicAssignment is used to assign the topic's partitions to the brokers. The start index and
+// replica shift are picked pseudo-randomly, so topics' partition 0 leaders aren't all on the same
+// broker, but deterministically from the topic's name, so the controller assigns a topic the same
+// way every time.
+func topicAssignment(topic string, brokers []int32, partitions int32, replicationFactor int16) [][]int32 {
+	sorted := make([]int32, len(brokers))
+	copy(sorted, brokers)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	h := fnv.New64a()
+	h.Write([]byte(topic))
+	r := rand.New(rand.NewSource(int64(h.Sum64())))
+	startIndex := r.Intn(len(sorted))
+	replicaShift := r.Intn(len(sorted))
+	return assignReplicas(sorted, partitions, replicationFactor, startIndex, replicaShift)
+}
@@ -0,0 +1,49 @@
+package broker
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAssignReplicas(t *testing.T) {
+	// same as Kafka's assignment of 10 partitions to 5 brokers with start index 0 and replica shift 0.
+	got := assignReplicas([]int32{0, 1, 2, 3, 4}, 10, 3, 0, 0)
+	want := [][]int32{
+		{0, 1, 2}, {1, 2, 3}, {2, 3, 4}, {3, 4, 0}, {4, 0, 1},
+		{0, 2, 3}, {1, 3, 4}, {2, 4, 0}, {3, 0, 1}, {4, 1, 2},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("assignReplicas() = %v, want %v", got, want)
+	}
+}
+
+func TestTopicAssignment(t *testing.T) {
+	brokers := []int32{3, 1, 5, 2, 4}
+	first := topicAssignment("first", brokers, 10, 3)
+	second := topicAssignment("second", brokers, 10, 3)
+	// the topics' partitions are led by different brokers.
+	if first[0][0] == second[0][0] {
+		t.Errorf("topics' partition 0 have the same leader, %v and %v", first, second)
+	}
+	if again := topicAssignment("first", brokers, 10, 3); !reflect.DeepEqual(first, again) {
+		t.Errorf("topicAssignment() = %v, want %v", again, first)
+	}
+	for _, assignment := range [][][]int32{first, second} {
+		leaders := make(map[int32]int)
+		for _, replicas := range assignment {
+			leaders[replicas[0]]++
+			seen := make(map[int32]bool)
+			for _, r := range replicas {
+				if seen[r] {
+					t.Errorf("replicas %v have duplicates", replicas)
+				}
+				seen[r] = true
+			}
+		}
+		for _, id := range brokers {
+			if leaders[id] != 2 {
+				t.Errorf("broker %d leads %d partitions of %v, want 2", id, leaders[id], assignment)
+			}
+		}
+	}
+}
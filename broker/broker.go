@@ -3,9 +3,15 @@ package broker
 import (
 	"bytes"
 	"context"
+	"fmt"
 	"io"
-	"math/rand"
+	"io/ioutil"
+	"net"
+	"os"
 	"path"
+	"path/filepath"
+	"runtime/debug"
+	"sort"
 	"sync"
 	"time"
 
@@ -18,7 +24,35 @@ import (
 )
 
 var (
-	ErrTopicExists = errors.New("topic exists already")
+	ErrTopicExists   = errors.New("topic exists already")
+	ErrLeaderTimeout = errors.New("timed out waiting for leader")
+)
+
+const (
+	// defaultReplicaSocketTimeout is the default read/write timeout of followers' connections
+	// to leaders, same as Kafka's replica.socket.timeout.ms.
+	defaultReplicaSocketTimeout = 30 * time.Second
+	// defaultCheckpointInterval is the default interval partitions' high watermarks,
+	// recovery points, and log start offsets are checkpointed at, same as Kafka's
+	// replica.high.watermark.checkpoint.interval.ms.
+	defaultCheckpointInterval = 5 * time.Second
+	// defaultLeaderImbalancePercentage is the default percentage of a broker's partitions
+	// that can be led by other brokers, same as Kafka's leader.imbalance.per.broker.percentage.
+	defaultLeaderImbalancePercentage = 10
+	// defaultRequestHandlerThreads is the default number of goroutines handling requests, same
+	// as Kafka's num.io.threads.
+	defaultRequestHandlerThreads = 8
+	// defaultNumRecoveryThreads is the default number of goroutines recovering partitions' logs
+	// when the broker starts, same as Kafka's num.recovery.threads.per.data.dir.
+	defaultNumRecoveryThreads = 1
+	// autoCreateTopicPartitions and autoCreateTopicReplicationFactor are the number of partitions and
+	// the replication factor of auto-created topics, same as Kafka's num.partitions and
+	// default.replication.factor.
+	autoCreateTopicPartitions        = 1
+	autoCreateTopicReplicationFactor = 1
+	// controlledShutdownRetryBackoff is how long the broker waits between attempts to shut down
+	// in a controlled way, same as Kafka's controlled.shutdown.retry.backoff.ms.
+	controlledShutdownRetryBackoff = 5 * time.Second
 )
 
 // Broker represents a broker in a Jocko cluster, like a broker in a Kafka cluster.
@@ -32,8 +66,143 @@ type Broker struct {
 	brokerAddr  string
 	logDir      string
 
+	// advertisedAddr is the address clients should connect to the broker at,
+	// if it differs from the address the broker's listening at.
+	advertisedAddr string
+	// advertisedListeners are the addresses clients connecting on the
+	// server's other listeners should connect to the broker at, by listener.
+	advertisedListeners map[string]string
+
+	mutationQuota *mutationQuota
+	authorizer    jocko.Authorizer
+	metrics       *metrics
+
+	// replicaSocketTimeout is the read/write timeout of followers' connections to leaders.
+	replicaSocketTimeout time.Duration
+	// replicaSocketReceiveBufferBytes and replicaSocketSendBufferBytes are the sizes of the
+	// socket buffers of followers' connections to leaders. Sizes that aren't positive leave the
+	// OS's.
+	replicaSocketReceiveBufferBytes int
+	replicaSocketSendBufferBytes    int
+	// replicaSocketKeepAlivePeriod is how often followers' connections to leaders send TCP
+	// keepalives. Negative periods disable them, zero leaves Go's default.
+	replicaSocketKeepAlivePeriod time.Duration
+
+	// checkpointInterval is how often partitions' high watermarks, recovery
+	// points, and log start offsets are checkpointed. Zero disables checkpointing them.
+	checkpointInterval time.Duration
+
+	// flushInterval is how often partitions' logs are flushed to stable
+	// storage. Zero leaves flushing them to the OS.
+	flushInterval time.Duration
+
+	// singleWriterLogs is whether partitions' logs skip the append lock until
+	// appends to them overlap.
+	singleWriterLogs bool
+	// preallocateSegments is whether partitions' log segments are reserved up
+	// to their max bytes when they're created.
+	preallocateSegments bool
+
+	// sampledRequests counts the requests handled, to log one in every request.log.sample.rate.
+	sampledRequests uint32
+
+	// slowRequestThreshold is how long a request can take to handle before
+	// it's logged as slow. Zero disables the slow request log.
+	slowRequestThreshold time.Duration
+
+	// leaderImbalanceCheckInterval is how often the controller checks for
+	// leadership imbalance. Zero disables automatic leader rebalancing.
+	leaderImbalanceCheckInterval time.Duration
+	// leaderImbalancePercentage is the percentage of a broker's partitions
+	// that can be led by another broker before the controller moves their
+	// leadership back to it.
+	leaderImbalancePercentage float64
+
+	// followerThrottle limits the rate this broker replicates the replicas
+	// listed by topics' follower.replication.throttled.replicas, and
+	// leaderThrottle the rate it serves follower fetches of the replicas
+	// listed by their leader.replication.throttled.replicas. If nil,
+	// replication isn't throttled.
+	followerThrottle *replicationThrottle
+	leaderThrottle   *replicationThrottle
+
+	// requestHandlerThreads is the number of goroutines handling requests.
+	requestHandlerThreads int
+
+	// maxPartitionsPerTopic is the most partitions a topic can be created
+	// with, and maxPartitionsPerBroker the most replicas a broker can host.
+	// Zero means unlimited.
+	maxPartitionsPerTopic  int32
+	maxPartitionsPerBroker int
+
+	// allowAutoTopicCreation is whether topics that don't exist are created
+	// when they're requested in metadata or produced to.
+	allowAutoTopicCreation bool
+
+	// controlledShutdownMaxRetries is the number of times the broker asks the
+	// controller to move its partitions' leadership when it shuts down. Zero
+	// disables controlled shutdown.
+	controlledShutdownMaxRetries int
+
+	// transactionStateLogNumPartitions is the number of partitions of the
+	// transaction state log, zero if it's disabled.
+	transactionStateLogNumPartitions int32
+
+	// brokerRegistrations are the brokers' registrations, by broker ID,
+	// and lastBrokerEpoch the epoch of the latest registration.
+	brokerRegistrations map[int32]brokerRegistration
+	lastBrokerEpoch     int64
+
+	// clusterID is the cluster's ID, empty until the controller's generated it.
+	clusterID string
+
+	// configs are the configs explicitly set on topics and brokers.
+	configs map[configResource]map[string]string
+
+	// replicaOffsets are the offsets followers fetch the partitions this broker leads from.
+	replicaOffsets replicaOffsets
+	// replicaLag tracks when the followers of the partitions this broker leads last caught up, and
+	// replicaLagTimeMax is how long they can go without catching up before they're removed from
+	// the partitions' ISRs. Zero disables shrinking ISRs.
+	replicaLag        replicaLag
+	replicaLagTimeMax time.Duration
+	// delayedProduces are the acks=all produces waiting on the partitions this broker leads.
+	delayedProduces delayedProduces
+	// producerStates are the sequences idempotent producers last appended to the partitions this
+	// broker leads, and producerIDExpiration how long they're kept after a producer last appended.
+	// Zero keeps them until the partition's leadership changes.
+	producerStates       producerStates
+	producerIDExpiration time.Duration
+
+	// internalTopics are the topics the controller creates when it starts.
+	internalTopics []InternalTopic
+
 	raft jocko.Raft
 	serf jocko.Serf
+	// seeds are the serf addresses of brokers the broker joins the cluster through when it starts,
+	// trying for up to seedsJoinTimeout. Without seeds it starts a new cluster.
+	seeds            []string
+	seedsJoinTimeout time.Duration
+	// raftApplyRetries is how many times raft commands that weren't committed are retried, and
+	// raftApplyRetryBackoff how long to first wait before checking a leader's been elected.
+	raftApplyRetries      int
+	raftApplyRetryBackoff time.Duration
+
+	// numRecoveryThreads is the number of goroutines recovering partitions'
+	// logs when the broker starts, and recoveryFailureThreshold the number
+	// of logs that can fail to recover before the broker fails to start.
+	// Zero means it starts however many fail.
+	numRecoveryThreads       int
+	recoveryFailureThreshold int
+	// recoveredLogs are the logs recovered when the broker started, by path,
+	// until their partitions' replicas are started, and recoveryFailures the
+	// errors of the ones that failed, whose partitions are offline.
+	recoveredLogs    map[string]jocko.CommitLog
+	recoveryFailures map[string]error
+
+	// newCommitLog is used to create a partition's commit log at the given
+	// path. If nil, a commitlog.CommitLog is created.
+	newCommitLog func(path string) (jocko.CommitLog, error)
 
 	shutdownCh   chan struct{}
 	shutdown     bool
@@ -43,16 +212,35 @@ type Broker struct {
 // New is used to instantiate a new broker.
 func New(id int32, opts ...BrokerFn) (*Broker, error) {
 	b := &Broker{
-		id:          id,
-		topicMap:    make(map[string][]*jocko.Partition),
-		replicators: make(map[*jocko.Partition]*Replicator),
-		shutdownCh:  make(chan struct{}),
+		id:                        id,
+		topicMap:                  make(map[string][]*jocko.Partition),
+		replicators:               make(map[*jocko.Partition]*Replicator),
+		mutationQuota:             newMutationQuota(),
+		replicaSocketTimeout:      defaultReplicaSocketTimeout,
+		checkpointInterval:        defaultCheckpointInterval,
+		leaderImbalancePercentage: defaultLeaderImbalancePercentage,
+		requestHandlerThreads:     defaultRequestHandlerThreads,
+		numRecoveryThreads:        defaultNumRecoveryThreads,
+		seedsJoinTimeout:          defaultSeedsJoinTimeout,
+		raftApplyRetries:          defaultRaftApplyRetries,
+		raftApplyRetryBackoff:     defaultRaftApplyRetryBackoff,
+		replicaLagTimeMax:         defaultReplicaLagTimeMax,
+		producerIDExpiration:      defaultProducerIDExpiration,
+		shutdownCh:                make(chan struct{}),
 	}
 
 	for _, o := range opts {
 		o(b)
 	}
 
+	if err := checkLogDir(b.logDir); err != nil {
+		return nil, err
+	}
+
+	if err := b.recoverLogs(); err != nil {
+		return nil, err
+	}
+
 	port, err := addrPort(b.brokerAddr)
 	if err != nil {
 		return nil, err
@@ -64,9 +252,32 @@ func New(id int32, opts ...BrokerFn) (*Broker, error) {
 	}
 
 	conn := &jocko.ClusterMember{
-		ID:       b.id,
-		Port:     port,
-		RaftPort: raftPort,
+		ID:          b.id,
+		Port:        port,
+		RaftPort:    raftPort,
+		Incarnation: time.Now().UnixNano(),
+	}
+	if b.advertisedAddr != "" {
+		if conn.AdvertisedHost, _, err = net.SplitHostPort(b.advertisedAddr); err != nil {
+			return nil, err
+		}
+		if conn.AdvertisedPort, err = addrPort(b.advertisedAddr); err != nil {
+			return nil, err
+		}
+	}
+	for name, addr := range b.advertisedListeners {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		port, err := addrPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		if conn.Listeners == nil {
+			conn.Listeners = make(map[string]jocko.Endpoint)
+		}
+		conn.Listeners[name] = jocko.Endpoint{Host: host, Port: port}
 	}
 
 	reconcileCh := make(chan *jocko.ClusterMember, 32)
@@ -74,58 +285,186 @@ func New(id int32, opts ...BrokerFn) (*Broker, error) {
 		b.logger.Info("failed to start serf: %s", err)
 		return nil, err
 	}
+	if err := b.joinSeeds(); err != nil {
+		b.logger.Info("failed to join the cluster: %s", err)
+		b.serf.Shutdown()
+		return nil, err
+	}
 
 	commandCh := make(chan jocko.RaftCommand, 16)
+	// raft replays its snapshot's commands while it bootstraps, so they're handled from the start.
+	go b.handleRaftCommmands(commandCh)
 	if err := b.raft.Bootstrap(b.serf, reconcileCh, commandCh); err != nil {
+		b.logger.Info("failed to start raft: %s", err)
+		// stop handling raft's commands.
+		close(b.shutdownCh)
+		b.serf.Shutdown()
 		return nil, err
 	}
 
-	go b.handleRaftCommmands(commandCh)
+	go b.registerBrokers()
+
+	if b.checkpointInterval > 0 {
+		go b.checkpointOffsets()
+	}
+
+	if b.flushInterval > 0 {
+		go b.flushPartitions()
+	}
+
+	if b.leaderImbalanceCheckInterval > 0 {
+		go b.rebalanceLeaders()
+	}
+
+	if b.replicaLagTimeMax > 0 {
+		go b.shrinkISRs()
+	}
+
+	if b.producerIDExpiration > 0 {
+		go b.expireProducerIDs()
+	}
+
+	if len(b.internalTopics) > 0 {
+		go b.monitorInternalTopics()
+	}
 
 	return b, nil
 }
 
 // jocko.Broker API.
 
-// Run starts a loop to handle requests send back responses.
+// Run starts the broker's request handlers, which handle requests from the shared request channel
+// and send back responses, until the context is done. Responses are sent on the request's response
+// channel if it has one, otherwise on responsec.
 func (b *Broker) Run(ctx context.Context, requestc <-chan jocko.Request, responsec chan<- jocko.Response) {
-	var conn io.ReadWriter
-	var header *protocol.RequestHeader
-	var resp protocol.ResponseBody
+	n := b.requestHandlerThreads
+	if n < 1 {
+		n = 1
+	}
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func() {
+			defer wg.Done()
+			b.handleRequests(ctx, requestc, responsec)
+		}()
+	}
+	wg.Wait()
+}
 
+// handleRequests is a request handler's loop, handling requests until the context is done.
+func (b *Broker) handleRequests(ctx context.Context, requestc <-chan jocko.Request, responsec chan<- jocko.Response) {
 	for {
+		var request jocko.Request
 		select {
-		case request := <-requestc:
-			conn = request.Conn
-			header = request.Header
-
-			switch req := request.Request.(type) {
-			case *protocol.APIVersionsRequest:
-				resp = b.handleAPIVersions(header, req)
-			case *protocol.ProduceRequest:
-				resp = b.handleProduce(header, req)
-			case *protocol.FetchRequest:
-				resp = b.handleFetch(header, req)
-			case *protocol.OffsetsRequest:
-				resp = b.handleOffsets(header, req)
-			case *protocol.MetadataRequest:
-				resp = b.handleMetadata(header, req)
-			case *protocol.CreateTopicRequests:
-				resp = b.handleCreateTopic(header, req)
-			case *protocol.DeleteTopicsRequest:
-				resp = b.handleDeleteTopics(header, req)
-			case *protocol.LeaderAndISRRequest:
-				resp = b.handleLeaderAndISR(header, req)
-			}
+		case request = <-requestc:
 		case <-ctx.Done():
 			return
 		}
 
-		responsec <- jocko.Response{Conn: conn, Header: header, Response: &protocol.Response{
-			CorrelationID: header.CorrelationID,
-			Body:          resp,
-		}}
+		start := time.Now()
+		header := request.Header
+		principal := request.Principal
+		if principal == "" {
+			principal = jocko.AnonymousPrincipal
+		}
+		respc := responsec
+		if request.Response != nil {
+			respc = request.Response
+		}
+		// delayed requests are responded to later, by whatever completes them.
+		respond := func(resp protocol.ResponseBody) {
+			b.logSlowRequest(header, time.Since(start))
+			b.logSampledRequest(header, resp)
+			response := jocko.Response{Conn: request.Conn, Header: header}
+			if expectsResponse(request.Request) {
+				response.Response = &protocol.Response{
+					CorrelationID: header.CorrelationID,
+					HeaderVersion: protocol.ResponseHeaderVersion(header.APIKey, header.APIVersion),
+					Body:          resp,
+				}
+			}
+			select {
+			case respc <- response:
+			case <-ctx.Done():
+			}
+		}
+		// the request's stopped if its connection's closed.
+		reqCtx := ctx
+		if request.Context != nil {
+			reqCtx = request.Context
+		}
+		if resp := b.handle(reqCtx, header, principal, request.Listener, request.Request, respond); resp != nil {
+			respond(resp)
+		}
+	}
+}
+
+// expectsResponse returns whether the client expects a response to the request. Produce requests
+// with acks=0 don't get one, writing one would corrupt the client's stream since it would read it
+// as the response to its next request.
+func expectsResponse(request interface{}) bool {
+	if req, ok := request.(*protocol.ProduceRequest); ok && req.Acks == 0 {
+		return false
+	}
+	return true
+}
+
+// handle is used to handle the request. If handling the request panics, the panic's recovered and
+// logged, and an ErrUnknown response is returned so the connection and broker keep running. Nil's
+// returned if the request's delayed, its response is passed to respond once it completes.
+func (b *Broker) handle(ctx context.Context, header *protocol.RequestHeader, principal, listener string, request interface{}, respond func(protocol.ResponseBody)) (resp protocol.ResponseBody) {
+	defer func() {
+		if r := recover(); r != nil {
+			// simplelog has no error level, so the message is tagged instead.
+			b.logger.Info("ERROR panic handling request: api key: %d, correlation id: %d, client id: %s: %v\n%s", header.APIKey, header.CorrelationID, header.ClientID, r, debug.Stack())
+			resp = errorResponse(request, protocol.ErrUnknown)
+		}
+	}()
+
+	switch req := request.(type) {
+	case *protocol.APIVersionsRequest:
+		return b.handleAPIVersions(header, req)
+	case *protocol.ProduceRequest:
+		if resp := b.handleProduce(header, principal, req, respond); resp != nil {
+			return resp
+		}
+		return nil
+	case *protocol.FetchRequest:
+		return b.handleFetch(ctx, header, req)
+	case *protocol.OffsetsRequest:
+		return b.handleOffsets(header, req)
+	case *protocol.DeleteRecordsRequest:
+		return b.handleDeleteRecords(header, principal, req)
+	case *protocol.MetadataRequest:
+		return b.handleMetadata(header, listener, req)
+	case *protocol.CreateTopicRequests:
+		return b.handleCreateTopic(header, principal, req)
+	case *protocol.DeleteTopicsRequest:
+		return b.handleDeleteTopics(header, principal, req)
+	case *protocol.LeaderAndISRRequest:
+		return b.handleLeaderAndISR(header, req)
+	case *protocol.GroupCoordinatorRequest:
+		return b.handleFindCoordinator(header, listener, req)
+	case *protocol.AlterPartitionRequest:
+		return b.handleAlterPartition(header, req)
+	case *protocol.ControlledShutdownRequest:
+		return b.handleControlledShutdown(header, req)
+	case *protocol.IncrementalAlterConfigsRequest:
+		return b.handleIncrementalAlterConfigs(header, principal, req)
+	case *protocol.DescribeConfigsRequest:
+		return b.handleDescribeConfigs(header, principal, req)
+	}
+	return nil
+}
+
+// logSlowRequest is used to log the request if it took longer than the slow request threshold to handle.
+func (b *Broker) logSlowRequest(header *protocol.RequestHeader, d time.Duration) {
+	if b.slowRequestThreshold <= 0 || d < b.slowRequestThreshold {
+		return
 	}
+	// simplelog has no warn level, so the message is tagged instead.
+	b.logger.Info("WARN slow request: api key: %d, correlation id: %d, client id: %s, duration: %s", header.APIKey, header.CorrelationID, header.ClientID, d)
 }
 
 // Join is used to have the broker join the gossip ring.
@@ -142,13 +481,14 @@ func (b *Broker) Join(addrs ...string) protocol.Error {
 func (b *Broker) handleAPIVersions(header *protocol.RequestHeader, req *protocol.APIVersionsRequest) *protocol.APIVersionsResponse {
 	return &protocol.APIVersionsResponse{
 		APIVersions: []protocol.APIVersion{
-			{APIKey: protocol.ProduceKey, MinVersion: 2, MaxVersion: 2},
-			{APIKey: protocol.FetchKey},
-			{APIKey: protocol.OffsetsKey},
-			{APIKey: protocol.MetadataKey},
+			{APIKey: protocol.ProduceKey, MinVersion: 2, MaxVersion: 3},
+			{APIKey: protocol.FetchKey, MinVersion: 0, MaxVersion: 9},
+			{APIKey: protocol.OffsetsKey, MinVersion: 0, MaxVersion: 4},
+			{APIKey: protocol.MetadataKey, MinVersion: 0, MaxVersion: 2},
 			{APIKey: protocol.LeaderAndISRKey},
 			{APIKey: protocol.StopReplicaKey},
-			{APIKey: protocol.GroupCoordinatorKey},
+			{APIKey: protocol.ControlledShutdownKey, MinVersion: 1, MaxVersion: 2},
+			{APIKey: protocol.GroupCoordinatorKey, MinVersion: 0, MaxVersion: 1},
 			{APIKey: protocol.JoinGroupKey},
 			{APIKey: protocol.HeartbeatKey},
 			{APIKey: protocol.LeaveGroupKey},
@@ -156,21 +496,40 @@ func (b *Broker) handleAPIVersions(header *protocol.RequestHeader, req *protocol
 			{APIKey: protocol.DescribeGroupsKey},
 			{APIKey: protocol.ListGroupsKey},
 			{APIKey: protocol.APIVersionsKey},
-			{APIKey: protocol.CreateTopicsKey},
-			{APIKey: protocol.DeleteTopicsKey},
+			{APIKey: protocol.CreateTopicsKey, MinVersion: 0, MaxVersion: 6},
+			{APIKey: protocol.DeleteTopicsKey, MinVersion: 0, MaxVersion: 5},
+			{APIKey: protocol.DeleteRecordsKey, MinVersion: 0, MaxVersion: 1},
+			{APIKey: protocol.DescribeConfigsKey, MinVersion: 0, MaxVersion: 1},
+			{APIKey: protocol.IncrementalAlterConfigsKey, MinVersion: 0, MaxVersion: 0},
+			{APIKey: protocol.AlterPartitionKey, MinVersion: 0, MaxVersion: 0},
 		},
 	}
 }
 
-func (b *Broker) handleCreateTopic(header *protocol.RequestHeader, reqs *protocol.CreateTopicRequests) *protocol.CreateTopicsResponse {
+func (b *Broker) handleCreateTopic(header *protocol.RequestHeader, principal string, reqs *protocol.CreateTopicRequests) *protocol.CreateTopicsResponse {
 	resp := new(protocol.CreateTopicsResponse)
+	resp.APIVersion = reqs.APIVersion
 	resp.TopicErrorCodes = make([]*protocol.TopicErrorCode, len(reqs.Requests))
-	isController := b.isController()
+	if err := b.controllerOnly(); err != protocol.ErrNone {
+		for i, req := range reqs.Requests {
+			resp.TopicErrorCodes[i] = &protocol.TopicErrorCode{
+				Topic:        req.Topic,
+				ErrorCode:    err.Code(),
+				ErrorMessage: err.Error(),
+			}
+		}
+		return resp
+	}
+	// like kafka, every entry for a topic listed more than once is invalid.
+	counts := make(map[string]int, len(reqs.Requests))
+	for _, req := range reqs.Requests {
+		counts[req.Topic]++
+	}
 	for i, req := range reqs.Requests {
-		if !isController {
+		if counts[req.Topic] > 1 {
 			resp.TopicErrorCodes[i] = &protocol.TopicErrorCode{
 				Topic:     req.Topic,
-				ErrorCode: protocol.ErrNotController.Code(),
+				ErrorCode: protocol.ErrInvalidRequest.Code(),
 			}
 			continue
 		}
@@ -181,28 +540,79 @@ func (b *Broker) handleCreateTopic(header *protocol.RequestHeader, reqs *protoco
 			}
 			continue
 		}
+		if reqs.ValidateOnly {
+			// nothing's created, so no mutations are counted against the quota.
+			_, err := b.validateTopic(req.Topic, req.NumPartitions, req.ReplicationFactor)
+			resp.TopicErrorCodes[i] = &protocol.TopicErrorCode{
+				Topic:     req.Topic,
+				ErrorCode: err.Code(),
+			}
+			continue
+		}
+		if exceeded, throttle := b.mutationQuota.exceeded(principal); exceeded && reqs.APIVersion >= minStrictCreateTopicsVersion {
+			if ms := throttleTimeMs(throttle); ms > resp.ThrottleTimeMs {
+				resp.ThrottleTimeMs = ms
+			}
+			resp.TopicErrorCodes[i] = &protocol.TopicErrorCode{
+				Topic:     req.Topic,
+				ErrorCode: protocol.ErrThrottlingQuotaExceeded.Code(),
+			}
+			continue
+		}
 		err := b.createTopic(req.Topic, req.NumPartitions, req.ReplicationFactor)
-		resp.TopicErrorCodes[i] = &protocol.TopicErrorCode{
+		tec := &protocol.TopicErrorCode{
 			Topic:     req.Topic,
 			ErrorCode: err.Code(),
 		}
+		// only the partitions created count against the quota.
+		var mutations int
+		if err == protocol.ErrNone {
+			mutations = int(req.NumPartitions)
+			tec.NumPartitions, tec.ReplicationFactor = req.NumPartitions, req.ReplicationFactor
+		}
+		if ms := throttleTimeMs(b.mutationQuota.record(principal, mutations)); ms > resp.ThrottleTimeMs {
+			resp.ThrottleTimeMs = ms
+		}
+		resp.TopicErrorCodes[i] = tec
 	}
 	return resp
 }
 
-func (b *Broker) handleDeleteTopics(header *protocol.RequestHeader, reqs *protocol.DeleteTopicsRequest) *protocol.DeleteTopicsResponse {
+func (b *Broker) handleDeleteTopics(header *protocol.RequestHeader, principal string, reqs *protocol.DeleteTopicsRequest) *protocol.DeleteTopicsResponse {
 	resp := new(protocol.DeleteTopicsResponse)
+	resp.APIVersion = reqs.APIVersion
 	resp.TopicErrorCodes = make([]*protocol.TopicErrorCode, len(reqs.Topics))
-	isController := b.isController()
+	if err := b.controllerOnly(); err != protocol.ErrNone {
+		for i, topic := range reqs.Topics {
+			resp.TopicErrorCodes[i] = &protocol.TopicErrorCode{
+				Topic:     topic,
+				ErrorCode: err.Code(),
+			}
+		}
+		return resp
+	}
 	for i, topic := range reqs.Topics {
-		if !isController {
+		partitions, _ := b.topicPartitions(topic)
+		if exceeded, throttle := b.mutationQuota.exceeded(principal); exceeded && reqs.APIVersion >= minStrictDeleteTopicsVersion {
+			if ms := throttleTimeMs(throttle); ms > resp.ThrottleTimeMs {
+				resp.ThrottleTimeMs = ms
+			}
 			resp.TopicErrorCodes[i] = &protocol.TopicErrorCode{
 				Topic:     topic,
-				ErrorCode: protocol.ErrNotController.Code(),
+				ErrorCode: protocol.ErrThrottlingQuotaExceeded.Code(),
 			}
 			continue
 		}
-		if err := b.deleteTopic(topic); err != protocol.ErrNone {
+		err := b.deleteTopic(topic)
+		// only the partitions deleted count against the quota.
+		var mutations int
+		if err == protocol.ErrNone {
+			mutations = len(partitions)
+		}
+		if ms := throttleTimeMs(b.mutationQuota.record(principal, mutations)); ms > resp.ThrottleTimeMs {
+			resp.ThrottleTimeMs = ms
+		}
+		if err != protocol.ErrNone {
 			resp.TopicErrorCodes[i] = &protocol.TopicErrorCode{
 				Topic:     topic,
 				ErrorCode: protocol.ErrUnknown.Code(),
@@ -217,6 +627,162 @@ func (b *Broker) handleDeleteTopics(header *protocol.RequestHeader, reqs *protoc
 	return resp
 }
 
+func (b *Broker) handleFindCoordinator(header *protocol.RequestHeader, listener string, req *protocol.GroupCoordinatorRequest) *protocol.GroupCoordinatorResponse {
+	resp := &protocol.GroupCoordinatorResponse{
+		APIVersion:  req.APIVersion,
+		Coordinator: &protocol.Coordinator{NodeID: -1, Port: -1},
+	}
+	var coordinator *jocko.ClusterMember
+	err := protocol.ErrNone
+	switch req.CoordinatorType {
+	case protocol.CoordinatorTransaction:
+		coordinator, err = b.transactionCoordinator(req.GroupID)
+	case protocol.CoordinatorGroup:
+		// the broker has no group coordinator.
+		err = protocol.ErrCoordinatorNotAvailable
+	default:
+		err = protocol.ErrInvalidRequest
+	}
+	if err != protocol.ErrNone {
+		resp.ErrorCode = err.Code()
+		resp.ErrorMessage = err.Error()
+		return resp
+	}
+	host, port := coordinator.ListenerAddr(listener)
+	resp.Coordinator = &protocol.Coordinator{
+		NodeID: coordinator.ID,
+		Host:   host,
+		Port:   int32(port),
+	}
+	return resp
+}
+
+// handleAlterPartition is used by the controller to change partitions' ISRs as proposed by their
+// leaders. Changes from brokers that aren't the partition's leader, or whose leader or partition
+// epoch is stale, are rejected.
+func (b *Broker) handleAlterPartition(header *protocol.RequestHeader, req *protocol.AlterPartitionRequest) *protocol.AlterPartitionResponse {
+	resp := &protocol.AlterPartitionResponse{APIVersion: req.APIVersion}
+	if err := b.controllerOnly(); err != protocol.ErrNone {
+		resp.ErrorCode = err.Code()
+		return resp
+	}
+	if req.BrokerEpoch != -1 && req.BrokerEpoch < b.brokerEpoch(req.BrokerID) {
+		// the request's from before the broker last registered, e.g. before it restarted.
+		resp.ErrorCode = protocol.ErrStaleBrokerEpoch.Code()
+		return resp
+	}
+	resp.Topics = make([]*protocol.AlterPartitionTopicResponse, len(req.Topics))
+	for i, t := range req.Topics {
+		tresp := &protocol.AlterPartitionTopicResponse{
+			Topic:      t.Topic,
+			Partitions: make([]*protocol.AlterPartitionPartitionResponse, len(t.Partitions)),
+		}
+		for j, pp := range t.Partitions {
+			presp := &protocol.AlterPartitionPartitionResponse{Partition: pp.Partition}
+			tresp.Partitions[j] = presp
+			p, err := b.partition(t.Topic, pp.Partition)
+			if err != protocol.ErrNone {
+				presp.ErrorCode = err.Code()
+				continue
+			}
+			b.RLock()
+			altered := &jocko.Partition{
+				Topic:          p.Topic,
+				ID:             p.ID,
+				Leader:         p.Leader,
+				LeaderEpoch:    p.LeaderEpoch,
+				ISR:            pp.NewISR,
+				PartitionEpoch: p.PartitionEpoch + 1,
+			}
+			replicas := p.Replicas
+			b.RUnlock()
+			switch {
+			case req.BrokerID != altered.Leader:
+				err = protocol.ErrNotLeaderForPartition
+			case pp.LeaderEpoch != altered.LeaderEpoch:
+				err = protocol.ErrFencedLeaderEpoch
+			case pp.PartitionEpoch != altered.PartitionEpoch-1:
+				err = protocol.ErrInvalidUpdateVersion
+			case !contains(pp.NewISR, altered.Leader) || !subset(pp.NewISR, replicas):
+				err = protocol.ErrInvalidRequest
+			}
+			if err != protocol.ErrNone {
+				presp.ErrorCode = err.Code()
+				continue
+			}
+			if err := b.raftApply(alterISR, altered); err != nil {
+				presp.ErrorCode = protocol.ErrUnknown.Code()
+				continue
+			}
+			presp.LeaderID = altered.Leader
+			presp.LeaderEpoch = altered.LeaderEpoch
+			presp.ISR = altered.ISR
+			presp.PartitionEpoch = altered.PartitionEpoch
+		}
+		resp.Topics[i] = tresp
+	}
+	return resp
+}
+
+// handleControlledShutdown is used by the controller to move the leadership of the partitions led
+// by a broker that's shutting down to other brokers in their ISRs. The partitions that couldn't be
+// moved, because no other broker in their ISR is a cluster member, are returned so the broker can
+// try again.
+func (b *Broker) handleControlledShutdown(header *protocol.RequestHeader, req *protocol.ControlledShutdownRequest) *protocol.ControlledShutdownResponse {
+	resp := &protocol.ControlledShutdownResponse{APIVersion: req.APIVersion}
+	if err := b.controllerOnly(); err != protocol.ErrNone {
+		resp.ErrorCode = err.Code()
+		return resp
+	}
+	if b.clusterMember(req.BrokerID) == nil {
+		resp.ErrorCode = protocol.ErrBrokerNotAvailable.Code()
+		return resp
+	}
+	if req.APIVersion >= 2 && req.BrokerEpoch != -1 && req.BrokerEpoch < b.brokerEpoch(req.BrokerID) {
+		resp.ErrorCode = protocol.ErrStaleBrokerEpoch.Code()
+		return resp
+	}
+	var led []*jocko.Partition
+	b.RLock()
+	for _, partitions := range b.topicMap {
+		for _, p := range partitions {
+			if p.Leader == req.BrokerID {
+				led = append(led, &jocko.Partition{Topic: p.Topic, ID: p.ID, ISR: p.ISRSnapshot()})
+			}
+		}
+	}
+	b.RUnlock()
+	for _, p := range led {
+		leader := int32(-1)
+		for _, id := range p.ISR {
+			if id != req.BrokerID && b.clusterMember(id) != nil {
+				leader = id
+				break
+			}
+		}
+		if leader == -1 || b.raftApply(electLeader, &jocko.Partition{Topic: p.Topic, ID: p.ID, Leader: leader}) != nil {
+			resp.RemainingPartitions = append(resp.RemainingPartitions, &protocol.ControlledShutdownPartition{
+				Topic:     p.Topic,
+				Partition: p.ID,
+			})
+		}
+	}
+	return resp
+}
+
+// alterISR is used to apply the change to the partition's ISR made by the controller.
+func (b *Broker) alterISR(altered *jocko.Partition) protocol.Error {
+	p, err := b.partition(altered.Topic, altered.ID)
+	if err != protocol.ErrNone {
+		return err
+	}
+	b.Lock()
+	defer b.Unlock()
+	p.SetISR(altered.ISR)
+	p.PartitionEpoch = altered.PartitionEpoch
+	return protocol.ErrNone
+}
+
 func (b *Broker) handleLeaderAndISR(header *protocol.RequestHeader, req *protocol.LeaderAndISRRequest) *protocol.LeaderAndISRResponse {
 	resp := &protocol.LeaderAndISRResponse{
 		Partitions: make([]*protocol.LeaderAndISRPartition, len(req.PartitionStates)),
@@ -243,6 +809,7 @@ func (b *Broker) handleLeaderAndISR(header *protocol.RequestHeader, req *protoco
 				ISR:                     p.ISR,
 				Leader:                  p.Leader,
 				PreferredLeader:         p.Leader,
+				LeaderEpoch:             p.LeaderEpoch,
 				LeaderAndISRVersionInZK: p.ZKVersion,
 			}
 			if err := b.startReplica(partition); err != protocol.ErrNone {
@@ -267,75 +834,314 @@ func (b *Broker) handleLeaderAndISR(header *protocol.RequestHeader, req *protoco
 	return resp
 }
 
+// handleOffsets is used to find the partitions' earliest or latest offsets, or the offsets of the
+// first messages at or after the requested timestamps. v4+ responses include the leader epoch of
+// the offset: the partition's current leader epoch for the earliest and latest offsets, and the
+// epoch the message was appended in, from the leader epoch cache, for timestamps.
 func (b *Broker) handleOffsets(header *protocol.RequestHeader, req *protocol.OffsetsRequest) *protocol.OffsetsResponse {
-	oResp := new(protocol.OffsetsResponse)
+	oResp := &protocol.OffsetsResponse{APIVersion: req.APIVersion}
 	oResp.Responses = make([]*protocol.OffsetResponse, len(req.Topics))
 	for i, t := range req.Topics {
 		oResp.Responses[i] = new(protocol.OffsetResponse)
 		oResp.Responses[i].Topic = t.Topic
 		oResp.Responses[i].PartitionResponses = make([]*protocol.PartitionResponse, len(t.Partitions))
 		for j, p := range t.Partitions {
-			pResp := new(protocol.PartitionResponse)
-			pResp.Partition = p.Partition
+			pResp := &protocol.PartitionResponse{Partition: p.Partition, Timestamp: -1, Offset: -1, LeaderEpoch: -1}
+			oResp.Responses[i].PartitionResponses[j] = pResp
 			partition, err := b.partition(t.Topic, p.Partition)
 			if err != protocol.ErrNone {
 				pResp.ErrorCode = err.Code()
 				continue
 			}
+			if req.APIVersion >= 4 {
+				if err := b.checkLeaderEpoch(partition, p.CurrentLeaderEpoch); err != protocol.ErrNone {
+					pResp.ErrorCode = err.Code()
+					continue
+				}
+			}
+			if !partition.IsOpen() {
+				// the partition's log is still being recovered, or failed to open.
+				pResp.ErrorCode = protocol.ErrKafkaStorageError.Code()
+				continue
+			}
 			var offset int64
-			if p.Timestamp == -2 {
+			b.RLock()
+			epoch := partition.LeaderEpoch
+			b.RUnlock()
+			switch p.Timestamp {
+			case -2:
 				offset = partition.LowWatermark()
-			} else {
+			case -1:
 				offset = partition.HighWatermark()
+			default:
+				o, ts, err := partition.OffsetForTimestamp(p.Timestamp)
+				if err != nil {
+					pResp.ErrorCode = protocol.ErrUnknown.Code()
+					continue
+				}
+				if o == -1 {
+					// there's no message at or after the timestamp.
+					continue
+				}
+				offset = o
+				// the found message set's max timestamp is returned, like Kafka, rather than the
+				// requested one.
+				pResp.Timestamp = ts
+				b.RLock()
+				epoch = partition.EpochForOffset(offset)
+				b.RUnlock()
 			}
 			pResp.Offsets = []int64{offset}
-			oResp.Responses[i].PartitionResponses[j] = pResp
+			pResp.Offset = offset
+			pResp.LeaderEpoch = epoch
 		}
 	}
 	return oResp
 }
 
-func (b *Broker) handleProduce(header *protocol.RequestHeader, req *protocol.ProduceRequest) *protocol.ProduceResponses {
+// handleDeleteRecords is used to delete the records before the requested offsets of the partitions
+// this broker leads, advancing their log start offsets. Fetches for offsets before a partition's
+// log start offset fail with ErrOffsetOutOfRange, with the log start offset so consumers reset.
+func (b *Broker) handleDeleteRecords(header *protocol.RequestHeader, principal string, req *protocol.DeleteRecordsRequest) *protocol.DeleteRecordsResponse {
+	resp := &protocol.DeleteRecordsResponse{APIVersion: req.APIVersion}
+	resp.Topics = make([]*protocol.DeleteRecordsTopicResponse, len(req.Topics))
+	for i, t := range req.Topics {
+		tr := &protocol.DeleteRecordsTopicResponse{
+			Topic:      t.Topic,
+			Partitions: make([]*protocol.DeleteRecordsPartitionResponse, len(t.Partitions)),
+		}
+		authorized := b.authorize(principal, jocko.OpDelete, jocko.Resource{Type: jocko.ResourceTopic, Name: t.Topic})
+		for j, p := range t.Partitions {
+			pr := &protocol.DeleteRecordsPartitionResponse{Partition: p.Partition, LowWatermark: -1}
+			tr.Partitions[j] = pr
+			if !authorized {
+				pr.ErrorCode = protocol.ErrTopicAuthorizationFailed.Code()
+				continue
+			}
+			partition, err := b.partition(t.Topic, p.Partition)
+			if err != protocol.ErrNone {
+				pr.ErrorCode = err.Code()
+				continue
+			}
+			if !partition.IsLeader(b.id) {
+				pr.ErrorCode = protocol.ErrNotLeaderForPartition.Code()
+				continue
+			}
+			if !partition.IsOpen() {
+				pr.ErrorCode = protocol.ErrKafkaStorageError.Code()
+				continue
+			}
+			// records can only be deleted up to the high watermark, -1 means all of them.
+			offset, hw := p.Offset, partition.HighWatermark()
+			if offset == -1 {
+				offset = hw
+			}
+			if offset < 0 || offset > hw {
+				pr.ErrorCode = protocol.ErrOffsetOutOfRange.Code()
+				continue
+			}
+			if err := partition.DeleteRecords(offset); err != nil {
+				pr.ErrorCode = protocol.ErrUnknown.Code()
+				continue
+			}
+			pr.LowWatermark = partition.LowWatermark()
+		}
+		resp.Topics[i] = tr
+	}
+	return resp
+}
+
+// handleProduce is used to append the request's record sets to the partitions this broker leads.
+// acks=all produces wait for the partitions' ISRs to replicate their records until the request's
+// timeout without holding up the handler: nil's returned and the response is passed to respond
+// once they're done waiting.
+func (b *Broker) handleProduce(header *protocol.RequestHeader, principal string, req *protocol.ProduceRequest, respond func(protocol.ResponseBody)) *protocol.ProduceResponses {
+	var pending []pendingProduce
 	resp := new(protocol.ProduceResponses)
 	resp.Responses = make([]*protocol.ProduceResponse, len(req.TopicData))
 	for i, td := range req.TopicData {
 		presps := make([]*protocol.ProducePartitionResponse, len(td.Data))
+		authorized := b.authorize(principal, jocko.OpWrite, jocko.Resource{Type: jocko.ResourceTopic, Name: td.Topic})
+		topicErr := protocol.ErrNone
+		if _, err := b.topicPartitions(td.Topic); authorized && err == protocol.ErrUnknownTopicOrPartition && b.allowAutoTopicCreation {
+			topicErr = b.autoCreateTopic(td.Topic)
+		}
 		for j, p := range td.Data {
-			partition := jocko.NewPartition(td.Topic, p.Partition)
-			presp := &protocol.ProducePartitionResponse{}
+			// each partition's handled on its own, so one failing doesn't fail the others.
+			presp := &protocol.ProducePartitionResponse{Partition: p.Partition, BaseOffset: -1}
+			presps[j] = presp
+			if !authorized {
+				presp.ErrorCode = protocol.ErrTopicAuthorizationFailed.Code()
+				continue
+			}
+			if topicErr != protocol.ErrNone {
+				presp.ErrorCode = topicErr.Code()
+				continue
+			}
 			partition, err := b.partition(td.Topic, p.Partition)
 			if err != protocol.ErrNone {
 				presp.ErrorCode = err.Code()
+				continue
+			}
+			if b.offline(partition) {
+				presp.ErrorCode = protocol.ErrLeaderNotAvailable.Code()
+				continue
 			}
 			if !partition.IsLeader(b.id) {
 				presp.ErrorCode = protocol.ErrNotLeaderForPartition.Code()
-				// break ?
+				continue
 			}
-			offset, appendErr := partition.Append(p.RecordSet)
-			if appendErr != nil {
-				b.logger.Info("commitlog/append failed: %v", err)
-				presp.ErrorCode = protocol.ErrUnknown.Code()
+			if !partition.IsOpen() {
+				presp.ErrorCode = protocol.ErrKafkaStorageError.Code()
+				continue
+			}
+			if !commitlog.MessageSet(p.RecordSet).SupportedFormat() {
+				// the bytes can't be interpreted, don't append them to the log.
+				presp.ErrorCode = protocol.ErrUnsupportedForMessageFormat.Code()
+				continue
+			}
+			// producers that track the partition's leader epoch set it as their batches' partition
+			// leader epoch. Others leave it at -1, or 0 like sarama, and aren't fenced.
+			if epoch := commitlog.MessageSet(p.RecordSet).PartitionLeaderEpoch(); epoch > 0 {
+				if err := b.checkLeaderEpoch(partition, epoch); err != protocol.ErrNone {
+					presp.ErrorCode = err.Code()
+					continue
+				}
+			}
+			// under LogAppendTime the records' timestamps are the time the broker appended them.
+			appendTime := int64(-1)
+			if b.topicConfig(td.Topic, "message.timestamp.type") == "LogAppendTime" {
+				appendTime = time.Now().UnixNano() / int64(time.Millisecond)
+				commitlog.MessageSet(p.RecordSet).SetLogAppendTime(appendTime)
+			}
+			offset, appendErr := b.appendRecords(partition, p.RecordSet)
+			if appendErr != protocol.ErrNone {
+				presp.ErrorCode = appendErr.Code()
+				continue
 			}
-			presp.Partition = p.Partition
 			presp.BaseOffset = offset
-			presp.Timestamp = time.Now().Unix()
-			presps[j] = presp
+			presp.Timestamp = appendTime
+			if req.Acks == -1 {
+				pending = append(pending, pendingProduce{
+					tp:    topicPartition{Topic: td.Topic, Partition: p.Partition},
+					presp: presp,
+				})
+			}
 		}
 		resp.Responses[i] = &protocol.ProduceResponse{
 			Topic:              td.Topic,
 			PartitionResponses: presps,
 		}
 	}
-	return resp
+	if len(pending) == 0 {
+		return resp
+	}
+	d := &delayedProduce{resp: resp, pending: pending, respond: respond}
+	b.delayedProduces.add(d, time.Duration(req.Timeout)*time.Millisecond, func() {
+		if b.delayedProduces.expire(d) {
+			d.respond(d.resp)
+		}
+	})
+	// the followers may have replicated the records already, e.g. there are none in the ISR.
+	for _, pp := range pending {
+		b.completeDelayedProduces(pp.tp)
+	}
+	return nil
+}
+
+// completeDelayedProduces is used to respond to the acks=all produces waiting on the partition
+// whose ISR has replicated their records, e.g. after a follower's fetched them or the ISR shrank,
+// or that can't be, e.g. because this broker's no longer its leader.
+func (b *Broker) completeDelayedProduces(tp topicPartition) {
+	completed := b.delayedProduces.complete(tp, func(presp *protocol.ProducePartitionResponse) (protocol.Error, bool) {
+		partition, err := b.partition(tp.Topic, tp.Partition)
+		if err != protocol.ErrNone {
+			return err, true
+		}
+		if !partition.IsLeader(b.id) {
+			return protocol.ErrNotLeaderForPartition, true
+		}
+		// the ISR's read on every check, so followers that dropped out of it don't hold up the
+		// produce.
+		for _, id := range partition.ISRSnapshot() {
+			if id == b.id {
+				continue
+			}
+			// the followers have the record once they fetch from after it.
+			if offset, ok := b.replicaOffsets.offset(tp, id); !ok || offset <= presp.BaseOffset {
+				return protocol.ErrNone, false
+			}
+		}
+		return protocol.ErrNone, true
+	})
+	for _, d := range completed {
+		d.respond(d.resp)
+	}
+}
+
+// appendRecords is used to append the record set to the partition this broker leads. A batch an
+// idempotent producer retries isn't appended again, the offset it was first appended at is
+// returned instead.
+func (b *Broker) appendRecords(partition *jocko.Partition, recordSet []byte) (int64, protocol.Error) {
+	var producers *partitionProducers
+	batch, idempotent := commitlog.MessageSet(recordSet).ProducerBatch()
+	if idempotent {
+		producers = b.producerStates.partition(topicPartition{Topic: partition.Topic, Partition: partition.ID})
+		producers.Lock()
+		defer producers.Unlock()
+		offset, duplicate, err := producers.check(batch)
+		if err != protocol.ErrNone {
+			return 0, err
+		}
+		if duplicate {
+			return offset, protocol.ErrNone
+		}
+	}
+	start := time.Now()
+	offset, err := partition.AppendAsLeader(recordSet)
+	b.metrics.observeProduce(partition.Topic, partition.ID, start)
+	if err != nil {
+		b.logger.Info("commitlog/append failed: %v", err)
+		return 0, protocol.ErrUnknown.WithErr(err)
+	}
+	if idempotent {
+		producers.update(batch, offset, time.Now())
+	}
+	return offset, protocol.ErrNone
+}
+
+// maybeIncrementHighWatermark is used to advance the high watermark of a partition this broker
+// leads to the lowest log end offset of the replicas in its ISR, the leader included, since
+// they've all got the messages before it. The high watermark never moves back.
+func (b *Broker) maybeIncrementHighWatermark(partition *jocko.Partition) bool {
+	tp := topicPartition{Topic: partition.Topic, Partition: partition.ID}
+	hw := partition.CommitLog.NewestOffset()
+	for _, id := range partition.ISRSnapshot() {
+		if id == b.id {
+			continue
+		}
+		offset, ok := b.replicaOffsets.offset(tp, id)
+		if !ok {
+			// the follower hasn't fetched since it joined, we don't know what it's got.
+			return false
+		}
+		if offset < hw {
+			hw = offset
+		}
+	}
+	return partition.AdvanceHighWatermark(hw)
 }
 
-func (b *Broker) handleMetadata(header *protocol.RequestHeader, req *protocol.MetadataRequest) *protocol.MetadataResponse {
+// handleMetadata is used to respond with the cluster's brokers and the topics' partitions. The
+// brokers' addresses are the ones they advertise for the listener the request arrived on.
+func (b *Broker) handleMetadata(header *protocol.RequestHeader, listener string, req *protocol.MetadataRequest) *protocol.MetadataResponse {
 	brokers := make([]*protocol.Broker, 0, len(b.clusterMembers()))
 	for _, b := range b.clusterMembers() {
+		host, port := b.ListenerAddr(listener)
 		brokers = append(brokers, &protocol.Broker{
 			NodeID: b.ID,
-			Host:   b.IP,
-			Port:   int32(b.Port),
+			Host:   host,
+			Port:   int32(port),
 		})
 	}
 	var topicMetadata []*protocol.TopicMetadata
@@ -344,15 +1150,22 @@ func (b *Broker) handleMetadata(header *protocol.RequestHeader, req *protocol.Me
 		for i, p := range partitions {
 			partitionMetadata[i] = &protocol.PartitionMetadata{
 				ParititionID: p.ID,
+				Leader:       p.Leader,
+				Replicas:     p.Replicas,
+				ISR:          p.ISRSnapshot(),
+			}
+			if b.offline(p) {
+				partitionMetadata[i].PartitionErrorCode = protocol.ErrLeaderNotAvailable.Code()
 			}
 		}
 		return &protocol.TopicMetadata{
 			TopicErrorCode:    err.Code(),
 			Topic:             topic,
+			IsInternal:        b.isInternalTopic(topic),
 			PartitionMetadata: partitionMetadata,
 		}
 	}
-	if len(req.Topics) == 0 {
+	if req.AllTopics() {
 		// Respond with metadata for all topics
 		topics := b.topics()
 		topicMetadata = make([]*protocol.TopicMetadata, len(topics))
@@ -365,21 +1178,40 @@ func (b *Broker) handleMetadata(header *protocol.RequestHeader, req *protocol.Me
 		topicMetadata = make([]*protocol.TopicMetadata, len(req.Topics))
 		for i, topic := range req.Topics {
 			partitions, err := b.topicPartitions(topic)
+			if err == protocol.ErrUnknownTopicOrPartition && b.allowAutoTopicCreation {
+				err = b.autoCreateTopic(topic)
+			}
 			topicMetadata[i] = topicMetadataFn(topic, partitions, err)
 		}
 	}
 	resp := &protocol.MetadataResponse{
+		APIVersion:    req.APIVersion,
 		Brokers:       brokers,
+		ClusterID:     b.ClusterID(),
+		ControllerID:  b.controllerID(),
 		TopicMetadata: topicMetadata,
 	}
 	return resp
 }
 
-func (b *Broker) handleFetch(header *protocol.RequestHeader, r *protocol.FetchRequest) *protocol.FetchResponses {
+// handleFetch is used to read the fetched partitions' logs from the fetch offsets. If there's less
+// than min bytes across the partitions the fetch waits for records to be appended, up to max wait
+// time, or until the context's done or the broker shuts down.
+func (b *Broker) handleFetch(ctx context.Context, header *protocol.RequestHeader, r *protocol.FetchRequest) *protocol.FetchResponses {
 	fresp := &protocol.FetchResponses{
-		Responses: make([]*protocol.FetchResponse, len(r.Topics)),
+		APIVersion: r.APIVersion,
+		Responses:  make([]*protocol.FetchResponse, len(r.Topics)),
+	}
+	if r.APIVersion >= 7 && r.SessionID != 0 {
+		// the broker doesn't create fetch sessions, so there's none to fetch incrementally in.
+		// the fetcher falls back to full fetches.
+		fresp.ErrorCode = protocol.ErrFetchSessionIDNotFound.Code()
+		fresp.Responses = nil
+		return fresp
 	}
-	received := time.Now()
+	deadline := time.Now().Add(time.Duration(r.MaxWaitTime) * time.Millisecond)
+	// the partitions' logs are read once they've all been checked, ordered by where the logs are.
+	var reads []*fetchRead
 	for i, topic := range r.Topics {
 		fr := &protocol.FetchResponse{
 			Topic:              topic.Topic,
@@ -395,53 +1227,232 @@ func (b *Broker) handleFetch(header *protocol.RequestHeader, r *protocol.FetchRe
 				}
 				continue
 			}
-			if !partition.IsLeader(b.id) {
-				fr.PartitionResponses[j] = &protocol.FetchPartitionResponse{
-					Partition: p.Partition,
-					ErrorCode: protocol.ErrNotLeaderForPartition.Code(),
-				}
-				continue
-			}
-			rdr, rdrErr := partition.NewReader(p.FetchOffset, p.MaxBytes)
-			if rdrErr != nil {
+			if b.offline(partition) {
 				fr.PartitionResponses[j] = &protocol.FetchPartitionResponse{
 					Partition: p.Partition,
-					ErrorCode: protocol.ErrUnknown.Code(),
+					ErrorCode: protocol.ErrLeaderNotAvailable.Code(),
 				}
 				continue
 			}
-			b := new(bytes.Buffer)
-			var n int32
-			for n < r.MinBytes {
-				if r.MaxWaitTime != 0 && int32(time.Since(received).Nanoseconds()/1e6) > r.MaxWaitTime {
-					break
-				}
-				// TODO: copy these bytes to outer bytes
-				nn, err := io.Copy(b, rdr)
-				if err != nil && err != io.EOF {
+			if r.APIVersion >= 9 {
+				if err := b.checkLeaderEpoch(partition, p.CurrentLeaderEpoch); err != protocol.ErrNone {
 					fr.PartitionResponses[j] = &protocol.FetchPartitionResponse{
 						Partition: p.Partition,
-						ErrorCode: protocol.ErrUnknown.Code(),
+						ErrorCode: err.Code(),
 					}
-					break
+					continue
 				}
-				n += int32(nn)
-				if err == io.EOF {
-					break
+			}
+			if !partition.IsLeader(b.id) {
+				fr.PartitionResponses[j] = &protocol.FetchPartitionResponse{
+					Partition: p.Partition,
+					ErrorCode: protocol.ErrNotLeaderForPartition.Code(),
 				}
+				continue
 			}
-
-			fr.PartitionResponses[j] = &protocol.FetchPartitionResponse{
-				Partition:     p.Partition,
-				ErrorCode:     protocol.ErrNone.Code(),
-				HighWatermark: partition.HighWatermark(),
-				RecordSet:     b.Bytes(),
+			if !partition.IsOpen() {
+				fr.PartitionResponses[j] = &protocol.FetchPartitionResponse{
+					Partition: p.Partition,
+					ErrorCode: protocol.ErrKafkaStorageError.Code(),
+				}
+				continue
+			}
+			if r.ReplicaID >= 0 {
+				// a follower fetches from its log end offset, which acks=all produces wait on.
+				tp := topicPartition{Topic: topic.Topic, Partition: p.Partition}
+				b.replicaOffsets.set(tp, r.ReplicaID, p.FetchOffset)
+				b.replicaLag.fetched(tp, r.ReplicaID, p.FetchOffset, partition.CommitLog.NewestOffset(), time.Now())
+				b.maybeExpandISR(partition, r.ReplicaID, p.FetchOffset)
+				b.maybeIncrementHighWatermark(partition)
+				b.completeDelayedProduces(tp)
+			}
+			logStartOffset := partition.LowWatermark()
+			leo := partition.CommitLog.NewestOffset()
+			if p.FetchOffset < logStartOffset || p.FetchOffset > leo {
+				// the data was truncated or deleted, or was never appended, tell the fetcher
+				// where the log starts now.
+				fr.PartitionResponses[j] = &protocol.FetchPartitionResponse{
+					Partition:        p.Partition,
+					ErrorCode:        protocol.ErrOffsetOutOfRange.Code(),
+					HighWatermark:    partition.HighWatermark(),
+					LastStableOffset: partition.HighWatermark(),
+					LogStartOffset:   logStartOffset,
+				}
+				continue
+			}
+			pr := &protocol.FetchPartitionResponse{
+				Partition:        p.Partition,
+				ErrorCode:        protocol.ErrNone.Code(),
+				HighWatermark:    partition.HighWatermark(),
+				LastStableOffset: partition.HighWatermark(),
+				LogStartOffset:   logStartOffset,
 			}
+			read := &fetchRead{
+				partition: partition,
+				fetch:     p,
+				resp:      pr,
+				responses: fr.PartitionResponses,
+				index:     j,
+			}
+			if r.ReplicaID >= 0 && b.leaderThrottle != nil && b.replicationThrottled("leader.replication.throttled.replicas", topic.Topic, p.Partition, r.ReplicaID) {
+				read.throttle = b.leaderThrottle
+			}
+			reads = append(reads, read)
 		}
 
 		fresp.Responses[i] = fr
 	}
-	return fresp
+	// partitions' logs are in dirs under the log dir named for their topics and IDs. they're read
+	// in that order, rather than the order they were requested in, so reads of nearby dirs are
+	// together. streamed record sets are read when the response is written.
+	sort.SliceStable(reads, func(i, j int) bool {
+		pi, pj := reads[i].partition, reads[j].partition
+		if pi.Topic != pj.Topic {
+			return pi.Topic < pj.Topic
+		}
+		return pi.ID < pj.ID
+	})
+	for {
+		var n int32
+		for _, read := range reads {
+			n += b.readPartition(read)
+		}
+		// with no max wait time whatever's available is returned right away, even nothing.
+		// otherwise the fetch waits until there's min bytes across its partitions, rather than
+		// have the fetcher poll.
+		if n >= r.MinBytes || r.MaxWaitTime <= 0 || !b.awaitAppend(ctx, reads, deadline) {
+			for _, read := range reads {
+				read.throttle.record(int(read.resp.RecordSetSize) + len(read.resp.RecordSet))
+			}
+			return fresp
+		}
+	}
+}
+
+// awaitAppend is used to wait until records are appended to any of the fetched partitions' logs
+// after they were read. It returns false if none are by the deadline, or if the context's done or
+// the broker shuts down first.
+func (b *Broker) awaitAppend(ctx context.Context, reads []*fetchRead, deadline time.Time) bool {
+	// the fetch is notified before the logs are checked, so appends in between aren't missed.
+	appended := make(chan struct{}, 1)
+	for _, read := range reads {
+		read.partition.NotifyAppend(appended)
+		defer read.partition.StopNotifyAppend(appended)
+	}
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	for {
+		for _, read := range reads {
+			if read.partition.CommitLog.NewestOffset() > read.leo {
+				return true
+			}
+		}
+		select {
+		case <-appended:
+		case <-timer.C:
+			return false
+		case <-ctx.Done():
+			return false
+		case <-b.shutdownCh:
+			return false
+		}
+	}
+}
+
+// fetchRead is a read of a fetched partition's log, deferred until the fetch's partitions have
+// all been checked, and where its response goes.
+type fetchRead struct {
+	partition *jocko.Partition
+	fetch     *protocol.FetchPartition
+	resp      *protocol.FetchPartitionResponse
+	responses []*protocol.FetchPartitionResponse
+	index     int
+	// leo is the log end offset when the partition was last read.
+	leo int64
+	// throttle limits the rate the partition's served to the follower fetching it, if the
+	// follower's replica is configured as throttled.
+	throttle *replicationThrottle
+}
+
+// readPartition is used to read what's in the partition's log from the fetch offset into the
+// partition's response. It returns how many bytes were read.
+func (b *Broker) readPartition(read *fetchRead) int32 {
+	p, pr, partition := read.fetch, read.resp, read.partition
+	start := time.Now()
+	defer b.metrics.observeFetch(partition.Topic, p.Partition, start)
+	read.responses[read.index] = pr
+	read.leo = partition.CommitLog.NewestOffset()
+	// the high watermark may have moved while the fetch waited.
+	pr.HighWatermark = partition.HighWatermark()
+	pr.LastStableOffset = pr.HighWatermark
+	if p.FetchOffset == read.leo {
+		// the fetcher's caught up, there's nothing to read until records are appended.
+		return 0
+	}
+	if read.throttle.exceeded() {
+		// the follower's throttled, it's sent nothing until the throttle's refilled.
+		return 0
+	}
+	rdr, rdrErr := partition.NewReader(p.FetchOffset, p.MaxBytes)
+	if rdrErr != nil {
+		read.responses[read.index] = &protocol.FetchPartitionResponse{
+			Partition: p.Partition,
+			ErrorCode: protocol.ErrUnknown.Code(),
+		}
+		return 0
+	}
+	if lr, ok := rdr.(lenReader); ok {
+		// the record set's copied from the log to the conn when the response is written,
+		// rather than buffered, so only how much of it there is matters now.
+		n := int32(lr.Len())
+		pr.RecordSetReader = io.LimitReader(rdr, int64(n))
+		pr.RecordSetSize = n
+		return n
+	}
+	buf := new(bytes.Buffer)
+	if _, err := io.Copy(buf, rdr); err != nil {
+		read.responses[read.index] = &protocol.FetchPartitionResponse{
+			Partition: p.Partition,
+			ErrorCode: protocol.ErrUnknown.Code(),
+		}
+		return 0
+	}
+	pr.RecordSet = buf.Bytes()
+	return int32(buf.Len())
+}
+
+// checkLeaderEpoch is used to fence fetchers whose metadata doesn't have the partition's current
+// leader epoch. It returns ErrFencedLeaderEpoch if the fetcher's epoch is older, its metadata's
+// stale, and ErrUnknownLeaderEpoch if it's newer, this broker hasn't learned of the new leader
+// yet. Fetchers that don't know the epoch send -1 and aren't fenced.
+func (b *Broker) checkLeaderEpoch(partition *jocko.Partition, epoch int32) protocol.Error {
+	if epoch < 0 {
+		return protocol.ErrNone
+	}
+	b.RLock()
+	defer b.RUnlock()
+	switch {
+	case epoch < partition.LeaderEpoch:
+		return protocol.ErrFencedLeaderEpoch
+	case epoch > partition.LeaderEpoch:
+		return protocol.ErrUnknownLeaderEpoch
+	}
+	return protocol.ErrNone
+}
+
+// offline returns whether the partition's offline, without a leader because the controller couldn't
+// elect one. Requests for it fail with ErrLeaderNotAvailable until a leader's elected.
+func (b *Broker) offline(partition *jocko.Partition) bool {
+	b.RLock()
+	defer b.RUnlock()
+	return partition.Offline
+}
+
+// lenReader is implemented by partitions' log readers that know how many bytes they have left to
+// read, so fetched record sets can be streamed.
+type lenReader interface {
+	io.Reader
+	Len() int
 }
 
 // clusterMembers is used to get a list of members in the cluster.
@@ -454,6 +1465,43 @@ func (b *Broker) isController() bool {
 	return b.raft.IsLeader()
 }
 
+// authorize returns whether the principal is allowed to do the operation on the
+// resource. Everything is allowed if the broker doesn't have an authorizer.
+func (b *Broker) authorize(principal string, operation jocko.Operation, resource jocko.Resource) bool {
+	if b.authorizer == nil {
+		return true
+	}
+	return b.authorizer.Authorize(principal, operation, resource)
+}
+
+// controllerOnly is used to guard requests only the controller can handle. If
+// this broker isn't the controller it returns ErrNotController, with the ID of
+// the controller if it's known, so the client retries against the controller.
+func (b *Broker) controllerOnly() protocol.Error {
+	if b.isController() {
+		return protocol.ErrNone
+	}
+	if id := b.controllerID(); id != -1 {
+		return protocol.ErrNotController.WithErr(fmt.Errorf("controller is broker %d", id))
+	}
+	return protocol.ErrNotController
+}
+
+// controllerID returns the ID of the cluster controller, the raft leader, or -1
+// if there isn't a leader or the leader isn't a known member of the cluster.
+func (b *Broker) controllerID() int32 {
+	leader := b.raft.LeaderID()
+	if leader == "" {
+		return -1
+	}
+	for _, m := range b.clusterMembers() {
+		if m.RaftAddr() == leader {
+			return m.ID
+		}
+	}
+	return -1
+}
+
 // topicPartitions is used to get the partitions for the given topic.
 func (b *Broker) topicPartitions(topic string) (found []*jocko.Partition, err protocol.Error) {
 	b.RLock()
@@ -471,6 +1519,37 @@ func (b *Broker) topics() map[string][]*jocko.Partition {
 	return b.topicMap
 }
 
+// ledPartitions returns the partitions this broker leads.
+func (b *Broker) ledPartitions() []*jocko.Partition {
+	b.RLock()
+	defer b.RUnlock()
+	var led []*jocko.Partition
+	for _, partitions := range b.topicMap {
+		for _, p := range partitions {
+			if p.IsLeader(b.id) {
+				led = append(led, p)
+			}
+		}
+	}
+	return led
+}
+
+// replicatedPartitions returns the partitions this broker follows, replicating them from their
+// leaders. They don't include the partitions it leads.
+func (b *Broker) replicatedPartitions() []*jocko.Partition {
+	b.RLock()
+	defer b.RUnlock()
+	var followed []*jocko.Partition
+	for _, partitions := range b.topicMap {
+		for _, p := range partitions {
+			if !p.IsLeader(b.id) && p.IsFollowing(b.id) {
+				followed = append(followed, p)
+			}
+		}
+	}
+	return followed
+}
+
 func (b *Broker) partition(topic string, partition int32) (*jocko.Partition, protocol.Error) {
 	found, err := b.topicPartitions(topic)
 	if err != protocol.ErrNone {
@@ -498,11 +1577,37 @@ func (b *Broker) clusterMember(id int32) *jocko.ClusterMember {
 func (b *Broker) startReplica(partition *jocko.Partition) protocol.Error {
 	b.Lock()
 	defer b.Unlock()
-	if v, ok := b.topicMap[partition.Topic]; ok {
-		b.topicMap[partition.Topic] = append(v, partition)
-	} else {
-		b.topicMap[partition.Topic] = []*jocko.Partition{partition}
+	return b.startReplicaLocked(partition)
+}
+
+// restartReplica is used to start again the replica of a partition that failed to start, unless the
+// partition's been deleted or replaced since, in which case ErrUnknownTopicOrPartition's returned.
+func (b *Broker) restartReplica(partition *jocko.Partition) protocol.Error {
+	b.Lock()
+	defer b.Unlock()
+	for _, p := range b.topicMap[partition.Topic] {
+		if p == partition {
+			return b.startReplicaLocked(partition)
+		}
 	}
+	return protocol.ErrUnknownTopicOrPartition
+}
+
+// startReplicaLocked is used to start the replica. The caller must hold the lock.
+func (b *Broker) startReplicaLocked(partition *jocko.Partition) protocol.Error {
+	// replace the partition if it's being started again after failing to start.
+	partitions := b.topicMap[partition.Topic]
+	replaced := false
+	for i, p := range partitions {
+		if p.ID == partition.ID {
+			partitions[i] = partition
+			replaced = true
+		}
+	}
+	if !replaced {
+		partitions = append(partitions, partition)
+	}
+	b.topicMap[partition.Topic] = partitions
 	isLeader := partition.Leader == b.id
 	isFollower := false
 	for _, r := range partition.Replicas {
@@ -511,47 +1616,276 @@ func (b *Broker) startReplica(partition *jocko.Partition) protocol.Error {
 		}
 	}
 	if isLeader || isFollower {
-		commitLog, err := commitlog.New(commitlog.Options{
-			Path:            path.Join(b.logDir, partition.String()),
-			MaxSegmentBytes: 1024,
-			MaxLogBytes:     -1,
-		})
+		if b.maxPartitionsPerBroker > 0 && b.replicaCounts()[b.id] > b.maxPartitionsPerBroker {
+			// the controller doesn't assign brokers more replicas than its limit, so this broker's
+			// limit must be lower. refuse to host the replica rather than exhaust its resources.
+			return protocol.ErrPolicyViolation
+		}
+		p := path.Join(b.logDir, partition.String())
+		if err, ok := b.recoveryFailures[p]; ok {
+			// the log failed to recover when the broker started, the partition's offline.
+			return protocol.ErrKafkaStorageError.WithErr(err)
+		}
+		hw, recoveryPoint, logStartOffset, err := b.checkpointedOffsets(partition)
+		if err != nil {
+			return protocol.ErrUnknown.WithErr(err)
+		}
+		commitLog, err := b.createCommitLog(p, recoveryPoint, logStartOffset)
 		if err != nil {
 			return protocol.ErrUnknown.WithErr(err)
 		}
 		partition.CommitLog = commitLog
 		partition.Conn = b.serf.Member(partition.LeaderID())
+		if hw >= 0 {
+			partition.SetHighWatermark(hw)
+		}
 	}
 	return protocol.ErrNone
 }
 
-// createTopic is used to create the topic across the cluster.
-func (b *Broker) createTopic(topic string, partitions int32, replicationFactor int16) protocol.Error {
+// checkpointedOffsets is used to get the partition's checkpointed high watermark, recovery point,
+// and log start offset. If they weren't checkpointed, the high watermark is -1 and the others 0.
+func (b *Broker) checkpointedOffsets(partition *jocko.Partition) (hw, recoveryPoint, logStartOffset int64, err error) {
+	hw = -1
+	if b.checkpointInterval <= 0 {
+		return hw, recoveryPoint, logStartOffset, nil
+	}
+	tp := topicPartition{Topic: partition.Topic, Partition: partition.ID}
+	hws, err := readCheckpoint(b.checkpointPath(hwCheckpointFile))
+	if err != nil {
+		return hw, recoveryPoint, logStartOffset, err
+	}
+	if offset, ok := hws[tp]; ok {
+		hw = offset
+	}
+	recoveryPoints, err := readCheckpoint(b.checkpointPath(recoveryPointCheckpointFile))
+	if err != nil {
+		return hw, recoveryPoint, logStartOffset, err
+	}
+	logStartOffsets, err := readCheckpoint(b.checkpointPath(logStartOffsetCheckpointFile))
+	if err != nil {
+		return hw, recoveryPoint, logStartOffset, err
+	}
+	return hw, recoveryPoints[tp], logStartOffsets[tp], nil
+}
+
+// checkpointOffsets is used to periodically checkpoint the high watermarks, recovery points, and
+// log start offsets of the partitions on this broker until it shuts down.
+func (b *Broker) checkpointOffsets() {
+	ticker := time.NewTicker(b.checkpointInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := b.writeCheckpoints(); err != nil {
+				b.logger.Info("failed to checkpoint offsets: %v", err)
+			}
+		case <-b.shutdownCh:
+			return
+		}
+	}
+}
+
+// writeCheckpoints is used to checkpoint the high watermarks, recovery points, and log start
+// offsets of the partitions on this broker.
+func (b *Broker) writeCheckpoints() error {
+	hws := make(map[topicPartition]int64)
+	recoveryPoints := make(map[topicPartition]int64)
+	logStartOffsets := make(map[topicPartition]int64)
+	b.RLock()
+	for _, partitions := range b.topicMap {
+		for _, p := range partitions {
+			if p.IsOpen() {
+				tp := topicPartition{Topic: p.Topic, Partition: p.ID}
+				hws[tp] = p.HighWatermark()
+				recoveryPoints[tp] = p.CommitLog.RecoveryPoint()
+				logStartOffsets[tp] = p.LowWatermark()
+			}
+		}
+	}
+	b.RUnlock()
+	if err := writeCheckpoint(b.checkpointPath(hwCheckpointFile), hws); err != nil {
+		return err
+	}
+	if err := writeCheckpoint(b.checkpointPath(recoveryPointCheckpointFile), recoveryPoints); err != nil {
+		return err
+	}
+	return writeCheckpoint(b.checkpointPath(logStartOffsetCheckpointFile), logStartOffsets)
+}
+
+// flushPartitions is used to periodically flush the commit logs of the partitions on this broker
+// to stable storage until it shuts down.
+func (b *Broker) flushPartitions() {
+	ticker := time.NewTicker(b.flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := b.syncPartitions(); err != nil {
+				b.logger.Info("failed to flush partitions: %v", err)
+			}
+		case <-b.shutdownCh:
+			return
+		}
+	}
+}
+
+// syncPartitions is used to sync the commit logs of the partitions on this broker.
+func (b *Broker) syncPartitions() error {
+	b.RLock()
+	defer b.RUnlock()
+	for _, partitions := range b.topicMap {
+		for _, p := range partitions {
+			if p.IsOpen() {
+				if err := p.CommitLog.Sync(); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// drainReplicators is used to stop the broker's replicators, waiting for them to append what
+// they've fetched.
+func (b *Broker) drainReplicators() {
+	b.Lock()
+	replicators := make([]*Replicator, 0, len(b.replicators))
+	for p, r := range b.replicators {
+		replicators = append(replicators, r)
+		delete(b.replicators, p)
+	}
+	b.Unlock()
+	// the replicators check whether they're throttled under the read lock, so they're drained
+	// outside the lock.
+	for _, r := range replicators {
+		if err := r.Drain(); err != nil {
+			b.logger.Info("failed to drain replicator: %v", err)
+		}
+	}
+}
+
+// closePartitions is used to close the open partitions' commit logs.
+func (b *Broker) closePartitions() error {
+	b.RLock()
+	defer b.RUnlock()
+	for _, partitions := range b.topicMap {
+		for _, p := range partitions {
+			if p.IsOpen() {
+				if err := p.CommitLog.Close(); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (b *Broker) checkpointPath(name string) string {
+	return filepath.Join(b.logDir, name)
+}
+
+// checkLogDir is used to check the log dir is a directory the broker can write to, creating it
+// if it doesn't exist, so the broker fails when it starts rather than when it creates partitions.
+func checkLogDir(logDir string) error {
+	if logDir == "" {
+		return errors.New("log dir is empty")
+	}
+	if err := os.MkdirAll(logDir, 0755); err != nil {
+		return errors.Wrapf(err, "log dir %s can't be created", logDir)
+	}
+	fi, err := os.Stat(logDir)
+	if err != nil {
+		return errors.Wrapf(err, "log dir %s can't be read", logDir)
+	}
+	if !fi.IsDir() {
+		return errors.Errorf("log dir %s isn't a directory", logDir)
+	}
+	f, err := ioutil.TempFile(logDir, ".jocko-write-check")
+	if err != nil {
+		return errors.Wrapf(err, "log dir %s isn't writable", logDir)
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// createCommitLog is used to create the commit log for a partition at the given path, recovering
+// the log's data after the recovery point and starting the log at the log start offset. The log's
+// reused if it was recovered when the broker started.
+func (b *Broker) createCommitLog(p string, recoveryPoint, logStartOffset int64) (jocko.CommitLog, error) {
+	if log, ok := b.recoveredLogs[p]; ok {
+		// the log was recovered when the broker started.
+		delete(b.recoveredLogs, p)
+		return log, nil
+	}
+	return b.openCommitLog(p, recoveryPoint, logStartOffset)
+}
+
+// openCommitLog is used to open the commit log at the given path, recovering it from the recovery
+// point if it wasn't flushed.
+func (b *Broker) openCommitLog(p string, recoveryPoint, logStartOffset int64) (jocko.CommitLog, error) {
+	if b.newCommitLog != nil {
+		return b.newCommitLog(p)
+	}
+	return commitlog.New(commitlog.Options{
+		Path:                p,
+		MaxSegmentBytes:     1024,
+		MaxLogBytes:         -1,
+		RecoveryPoint:       recoveryPoint,
+		LogStartOffset:      logStartOffset,
+		SingleWriter:        b.singleWriterLogs,
+		PreallocateSegments: b.preallocateSegments,
+	})
+}
+
+// validateTopic is used to check the topic can be created and returns the brokers its partitions'
+// replicas would be assigned to, without creating it.
+func (b *Broker) validateTopic(topic string, partitions int32, replicationFactor int16) ([][]int32, protocol.Error) {
 	for t, _ := range b.topics() {
 		if t == topic {
-			return protocol.ErrTopicAlreadyExists
+			return nil, protocol.ErrTopicAlreadyExists
 		}
 	}
 
-	c := b.clusterMembers()
-	clen := int32(len(c))
+	var brokers []int32
+	for _, m := range b.clusterMembers() {
+		brokers = append(brokers, m.ID)
+	}
+	if len(brokers) == 0 || int(replicationFactor) > len(brokers) {
+		return nil, protocol.ErrInvalidReplicationFactor
+	}
+	if b.maxPartitionsPerTopic > 0 && partitions > b.maxPartitionsPerTopic {
+		return nil, protocol.ErrInvalidPartitions
+	}
 
-	for i := int32(0); i < partitions; i++ {
-		leader := c[i%clen].ID
-		replicas := []int32{leader}
-		for replica := rand.Int31n(clen); len(replicas) < int(replicationFactor); replica++ {
-			if replica != leader {
-				replicas = append(replicas, replica)
-			}
-			if replica+1 == clen {
-				replica = -1
+	assignment := topicAssignment(topic, brokers, partitions, replicationFactor)
+	if b.maxPartitionsPerBroker > 0 {
+		b.RLock()
+		counts := b.replicaCounts()
+		b.RUnlock()
+		for _, replicas := range assignment {
+			for _, id := range replicas {
+				if counts[id]++; counts[id] > b.maxPartitionsPerBroker {
+					return nil, protocol.ErrPolicyViolation
+				}
 			}
 		}
+	}
+	return assignment, protocol.ErrNone
+}
+
+// createTopic is used to create the topic across the cluster.
+func (b *Broker) createTopic(topic string, partitions int32, replicationFactor int16) protocol.Error {
+	assignment, err := b.validateTopic(topic, partitions, replicationFactor)
+	if err != protocol.ErrNone {
+		return err
+	}
+	for i, replicas := range assignment {
 		partition := &jocko.Partition{
 			Topic:           topic,
-			ID:              i,
-			Leader:          leader,
-			PreferredLeader: leader,
+			ID:              int32(i),
+			Leader:          replicas[0],
+			PreferredLeader: replicas[0],
 			Replicas:        replicas,
 			ISR:             replicas,
 		}
@@ -562,6 +1896,59 @@ func (b *Broker) createTopic(topic string, partitions int32, replicationFactor i
 	return protocol.ErrNone
 }
 
+// replicaCounts returns the number of partition replicas each broker hosts. The broker must be
+// locked.
+func (b *Broker) replicaCounts() map[int32]int {
+	counts := make(map[int32]int)
+	for _, partitions := range b.topicMap {
+		for _, p := range partitions {
+			for _, id := range p.Replicas {
+				counts[id]++
+			}
+		}
+	}
+	return counts
+}
+
+// autoCreateTopic is used to create the topic, which doesn't exist, with the default number of
+// partitions and replication factor, asking the controller to create it if this broker isn't the
+// controller. It returns ErrLeaderNotAvailable if the topic's created, since its partitions don't
+// have leaders until the controller's applied it, so clients retry.
+func (b *Broker) autoCreateTopic(topic string) protocol.Error {
+	var err protocol.Error
+	if b.isController() {
+		err = b.createTopic(topic, autoCreateTopicPartitions, autoCreateTopicReplicationFactor)
+	} else {
+		err = b.sendCreateTopic(topic)
+	}
+	if err != protocol.ErrNone && err != protocol.ErrTopicAlreadyExists {
+		return err
+	}
+	return protocol.ErrLeaderNotAvailable
+}
+
+// sendCreateTopic is used to ask the controller to create the topic with the default number of
+// partitions and replication factor.
+func (b *Broker) sendCreateTopic(topic string) protocol.Error {
+	conn, err := b.dialController()
+	if err != nil {
+		return protocol.ErrUnknown.WithErr(err)
+	}
+	defer conn.Close()
+	resp, err := server.NewClient(conn).CreateTopic(fmt.Sprintf("Broker-%d", b.id), &protocol.CreateTopicRequest{
+		Topic:             topic,
+		NumPartitions:     autoCreateTopicPartitions,
+		ReplicationFactor: autoCreateTopicReplicationFactor,
+	})
+	if err != nil {
+		return protocol.ErrUnknown.WithErr(err)
+	}
+	if len(resp.TopicErrorCodes) != 1 {
+		return protocol.ErrUnknown
+	}
+	return protocol.Errs[resp.TopicErrorCodes[0].ErrorCode]
+}
+
 // deleteTopic is used to delete the topic across the cluster.
 func (b *Broker) deleteTopic(topic string) protocol.Error {
 	if err := b.raftApply(deleteTopic, &jocko.Partition{Topic: topic}); err != nil {
@@ -577,13 +1964,29 @@ func (b *Broker) deletePartitions(tp *jocko.Partition) error {
 		return err
 	}
 	for _, p := range partitions {
+		b.Lock()
+		r, ok := b.replicators[p]
+		delete(b.replicators, p)
+		b.Unlock()
+		if ok {
+			if err := r.Drain(); err != nil {
+				return err
+			}
+		}
 		if err := p.Delete(); err != nil {
 			return err
 		}
 	}
 	b.Lock()
 	delete(b.topicMap, tp.Topic)
+	delete(b.configs, configResource{Type: protocol.ConfigResourceTopic, Name: tp.Topic})
 	b.Unlock()
+	b.replicaOffsets.remove(tp.Topic)
+	b.replicaLag.remove(tp.Topic)
+	b.producerStates.remove(tp.Topic)
+	for _, p := range partitions {
+		b.completeDelayedProduces(topicPartition{Topic: p.Topic, Partition: p.ID})
+	}
 	return nil
 }
 
@@ -599,6 +2002,13 @@ func (b *Broker) Shutdown() error {
 	b.shutdown = true
 	defer close(b.shutdownCh)
 
+	if b.controlledShutdownMaxRetries > 0 {
+		if err := b.controlledShutdown(); err != nil {
+			// shut down anyway, the partitions are unavailable until the controller notices.
+			b.logger.Info("failed to shut down in a controlled way: %v", err)
+		}
+	}
+
 	if b.serf != nil {
 		if err := b.serf.Shutdown(); err != nil {
 			b.logger.Info("failed to shut down serf: %v", err)
@@ -613,9 +2023,88 @@ func (b *Broker) Shutdown() error {
 		}
 	}
 
+	// stop replicating so nothing's appended to the logs once they're closed.
+	b.drainReplicators()
+
+	// sync the logs so their recovery points are current and they aren't recovered on restart.
+	if err := b.syncPartitions(); err != nil {
+		b.logger.Info("failed to sync partitions: %v", err)
+	}
+	if b.checkpointInterval > 0 {
+		if err := b.writeCheckpoints(); err != nil {
+			b.logger.Info("failed to checkpoint offsets: %v", err)
+		}
+	}
+	// close the logs so their preallocated segments are truncated to what was written.
+	if err := b.closePartitions(); err != nil {
+		b.logger.Info("failed to close partitions: %v", err)
+	}
+
 	return nil
 }
 
+// controlledShutdown is used to have the controller move the leadership of the partitions this
+// broker leads to other brokers before it shuts down, so they stay available. It asks again, up to
+// the max retries, while partitions remain that couldn't be moved.
+func (b *Broker) controlledShutdown() error {
+	req := &protocol.ControlledShutdownRequest{
+		APIVersion:  2,
+		BrokerID:    b.id,
+		BrokerEpoch: b.brokerEpoch(b.id),
+	}
+	for i := 0; i < b.controlledShutdownMaxRetries; i++ {
+		if i > 0 {
+			time.Sleep(controlledShutdownRetryBackoff)
+		}
+		resp, err := b.sendControlledShutdown(req)
+		if err != nil {
+			b.logger.Info("failed to send controlled shutdown request: %v", err)
+			continue
+		}
+		if resp.ErrorCode != protocol.ErrNone.Code() {
+			b.logger.Info("controlled shutdown request failed: %v", protocol.Errs[resp.ErrorCode])
+			continue
+		}
+		if len(resp.RemainingPartitions) == 0 {
+			return nil
+		}
+		b.logger.Info("controlled shutdown couldn't move leadership of %d partitions", len(resp.RemainingPartitions))
+	}
+	return fmt.Errorf("partitions remain after %d attempts", b.controlledShutdownMaxRetries)
+}
+
+// sendControlledShutdown is used to send the controlled shutdown request to the controller, which
+// may be this broker.
+func (b *Broker) sendControlledShutdown(req *protocol.ControlledShutdownRequest) (*protocol.ControlledShutdownResponse, error) {
+	if b.isController() {
+		header := &protocol.RequestHeader{APIKey: protocol.ControlledShutdownKey, APIVersion: req.APIVersion}
+		return b.handleControlledShutdown(header, req), nil
+	}
+	conn, err := b.dialController()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return server.NewClient(conn).ControlledShutdown(fmt.Sprintf("Broker-%d", b.id), req)
+}
+
+// dialController is used to connect to the controller, with the replica socket timeout as the
+// connection's deadline.
+func (b *Broker) dialController() (net.Conn, error) {
+	controller := b.clusterMember(b.controllerID())
+	if controller == nil {
+		return nil, errors.New("controller isn't known")
+	}
+	conn, err := net.DialTimeout("tcp", controller.Addr().String(), b.replicaSocketTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if b.replicaSocketTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(b.replicaSocketTimeout))
+	}
+	return conn, nil
+}
+
 // Replication.
 
 func (b *Broker) becomeFollower(topic string, partitionID int32, partitionState *protocol.PartitionState) protocol.Error {
@@ -637,9 +2126,22 @@ func (b *Broker) becomeFollower(topic string, partitionID int32, partitionState
 		return protocol.ErrUnknown.WithErr(err)
 	}
 	p.Leader = partitionState.Leader
+	if partitionState.LeaderEpoch > p.LeaderEpoch {
+		p.LeaderEpoch = partitionState.LeaderEpoch
+	}
 	p.Conn = b.clusterMember(p.LeaderID())
-	r := NewReplicator(p, b.id,
-		ReplicatorLeader(server.NewClient(p.Conn)))
+	opts := []ReplicatorFn{
+		ReplicatorDial(b.dialLeader(p)),
+		ReplicatorTimeout(b.replicaSocketTimeout),
+	}
+	if b.followerThrottle != nil {
+		// the replica's throttled while it's configured as throttled, e.g. while a reassignment
+		// catches it up, so it doesn't starve other replicas.
+		opts = append(opts, replicatorThrottle(b.followerThrottle, func() bool {
+			return b.replicationThrottled("follower.replication.throttled.replicas", p.Topic, p.ID, b.id)
+		}))
+	}
+	r := NewReplicator(p, b.id, opts...)
 	b.replicators[p] = r
 	return protocol.ErrNone
 }
@@ -658,11 +2160,55 @@ func (b *Broker) becomeLeader(topic string, partitionID int32, partitionState *p
 	}
 	p.Leader = b.id
 	p.Conn = b.clusterMember(p.LeaderID())
-	p.ISR = partitionState.ISR
+	p.SetISR(partitionState.ISR)
 	p.LeaderAndISRVersionInZK = partitionState.ZKVersion
+	// the controller bumps the epoch when it elects a leader, so followers and clients can tell
+	// this broker's appends apart from a previous leader's.
+	if partitionState.LeaderEpoch > p.LeaderEpoch {
+		p.LeaderEpoch = partitionState.LeaderEpoch
+	}
+	if p.IsOpen() {
+		p.AssignLeaderEpoch(p.LeaderEpoch, p.CommitLog.NewestOffset())
+	}
+	// the producers' sequences aren't replicated, so this broker doesn't know what they appended.
+	b.producerStates.reset(topicPartition{Topic: topic, Partition: partitionID})
+	b.replicaLag.reset(topicPartition{Topic: topic, Partition: partitionID})
 	return protocol.ErrNone
 }
 
+// dialLeader returns a func used to connect to the partition's current leader.
+func (b *Broker) dialLeader(p *jocko.Partition) func() (net.Conn, error) {
+	return func() (net.Conn, error) {
+		leader := b.clusterMember(p.LeaderID())
+		if leader == nil {
+			return nil, fmt.Errorf("leader %d of partition %s isn't a cluster member", p.LeaderID(), p)
+		}
+		conn, err := net.DialTimeout("tcp", leader.Addr().String(), b.replicaSocketTimeout)
+		if err != nil {
+			return nil, err
+		}
+		if err := setSocketBuffers(conn, b.replicaSocketReceiveBufferBytes, b.replicaSocketSendBufferBytes); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if err := setKeepAlive(conn, b.replicaSocketKeepAlivePeriod); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+}
+
+// subset returns whether every replica in rs is in of.
+func subset(rs, of []int32) bool {
+	for _, r := range rs {
+		if !contains(of, r) {
+			return false
+		}
+	}
+	return true
+}
+
 func contains(rs []int32, r int32) bool {
 	for _, ri := range rs {
 		if ri == r {
@@ -1,15 +1,31 @@
 package broker
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
 	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 
 	"github.com/travisjeffery/jocko"
+	"github.com/travisjeffery/jocko/commitlog"
 	"github.com/travisjeffery/jocko/protocol"
+	"github.com/travisjeffery/jocko/testutil"
 	"github.com/travisjeffery/jocko/testutil/mock"
 	"github.com/travisjeffery/simplelog"
 )
@@ -77,16 +93,27 @@ func TestNew(t *testing.T) {
 				tt.alterFields(&tt.fields)
 			}
 			tt.want = &Broker{
-				logger:      tt.fields.logger,
-				id:          tt.fields.id,
-				topicMap:    tt.fields.topicMap,
-				replicators: tt.fields.replicators,
-				brokerAddr:  tt.fields.brokerAddr,
-				logDir:      tt.fields.logDir,
-				raft:        tt.fields.raft,
-				serf:        tt.fields.serf,
-				shutdownCh:  tt.fields.shutdownCh,
-				shutdown:    tt.fields.shutdown,
+				logger:                    tt.fields.logger,
+				id:                        tt.fields.id,
+				topicMap:                  tt.fields.topicMap,
+				replicators:               tt.fields.replicators,
+				brokerAddr:                tt.fields.brokerAddr,
+				logDir:                    tt.fields.logDir,
+				mutationQuota:             newMutationQuota(),
+				replicaSocketTimeout:      defaultReplicaSocketTimeout,
+				checkpointInterval:        defaultCheckpointInterval,
+				leaderImbalancePercentage: defaultLeaderImbalancePercentage,
+				requestHandlerThreads:     defaultRequestHandlerThreads,
+				numRecoveryThreads:        defaultNumRecoveryThreads,
+				seedsJoinTimeout:          defaultSeedsJoinTimeout,
+				raftApplyRetries:          defaultRaftApplyRetries,
+				raftApplyRetryBackoff:     defaultRaftApplyRetryBackoff,
+				replicaLagTimeMax:         defaultReplicaLagTimeMax,
+				producerIDExpiration:      defaultProducerIDExpiration,
+				raft:                      tt.fields.raft,
+				serf:                      tt.fields.serf,
+				shutdownCh:                tt.fields.shutdownCh,
+				shutdown:                  tt.fields.shutdown,
 			}
 
 			got, err := New(tt.fields.id, Addr(tt.fields.brokerAddr), Serf(tt.fields.serf), Raft(tt.fields.raft), Logger(tt.fields.logger), LogDir(tt.fields.logDir))
@@ -107,6 +134,8 @@ func TestNew(t *testing.T) {
 				t.Errorf("got.shutdownCh is nil")
 			} else if got != nil {
 				tt.want.shutdownCh = got.shutdownCh
+				// the logs recovered depend on what other tests left in the log dir.
+				tt.want.recoveredLogs, tt.want.recoveryFailures = got.recoveredLogs, got.recoveryFailures
 			}
 			if !reflect.DeepEqual(got, tt.want) {
 				t.Errorf("New() = %v, want %v", got, tt.want)
@@ -115,6 +144,104 @@ func TestNew(t *testing.T) {
 	}
 }
 
+func TestNew_startFailures(t *testing.T) {
+	t.Run("seeds unreachable", func(t *testing.T) {
+		f := newFields()
+		f.serf.JoinFn = func(addrs ...string) (int, error) {
+			return 0, errors.New("connection refused")
+		}
+		_, err := New(f.id, Addr(f.brokerAddr), Serf(f.serf), Raft(f.raft), Logger(f.logger), LogDir(f.logDir),
+			Seeds("10.0.0.1:9094"), SeedsJoinTimeout(50*time.Millisecond))
+		if err == nil {
+			t.Fatal("New() error = nil, want the join's error")
+		}
+		if !f.serf.ShutdownInvoked {
+			t.Error("serf wasn't shut down, want it shut down")
+		}
+		if f.raft.BootstrapInvoked {
+			t.Error("raft bootstrapped, want it not started")
+		}
+	})
+
+	t.Run("raft bootstrap failed", func(t *testing.T) {
+		f := newFields()
+		var commandCh chan<- jocko.RaftCommand
+		f.raft.BootstrapFn = func(s jocko.Serf, sCh <-chan *jocko.ClusterMember, cCh chan<- jocko.RaftCommand) error {
+			commandCh = cCh
+			return errors.New("tcp transport failed")
+		}
+		if _, err := New(f.id, Addr(f.brokerAddr), Serf(f.serf), Raft(f.raft), Logger(f.logger), LogDir(f.logDir)); err == nil {
+			t.Fatal("New() error = nil, want the bootstrap's error")
+		}
+		if !f.serf.ShutdownInvoked {
+			t.Error("serf wasn't shut down, want it shut down")
+		}
+		// once the handler's stopped, nothing takes raft's commands, so sends block when the
+		// channel's buffer is full.
+		for i := 0; i < 1000; i++ {
+			select {
+			case commandCh <- jocko.RaftCommand{Cmd: -1}:
+			case <-time.After(100 * time.Millisecond):
+				return
+			}
+		}
+		t.Error("raft's commands are still handled, want the handler stopped")
+	})
+}
+
+func TestNew_logDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jocko-log-dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	readOnly := filepath.Join(dir, "read-only")
+	if err := os.Mkdir(readOnly, 0500); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		logDir  string
+		wantErr string
+	}{
+		{name: "created", logDir: filepath.Join(dir, "logs")},
+		{name: "empty", logDir: "", wantErr: "log dir is empty"},
+		{name: "file", logDir: file, wantErr: "log dir " + file + " can't be created"},
+		{name: "under file", logDir: filepath.Join(file, "logs"), wantErr: "log dir " + filepath.Join(file, "logs") + " can't be created"},
+		{name: "read-only", logDir: readOnly, wantErr: "log dir " + readOnly + " isn't writable"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.logDir == readOnly && os.Geteuid() == 0 {
+				t.Skip("root can write to read-only dirs")
+			}
+			f := newFields()
+			b, err := New(f.id, Addr(f.brokerAddr), Serf(f.serf), Raft(f.raft), Logger(f.logger), LogDir(tt.logDir))
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("New() error = %v", err)
+				}
+				if fi, err := os.Stat(tt.logDir); err != nil || !fi.IsDir() {
+					t.Errorf("log dir wasn't created: %v", err)
+				}
+				close(b.shutdownCh)
+				return
+			}
+			if err == nil || !strings.HasPrefix(err.Error(), tt.wantErr) {
+				t.Fatalf("New() error = %v, want %q", err, tt.wantErr)
+			}
+			if f.serf.BootstrapInvoked {
+				t.Error("expected serf bootstrap not invoked; was")
+			}
+		})
+	}
+}
+
 func TestBroker_Run(t *testing.T) {
 	type args struct {
 		ctx       context.Context
@@ -171,6 +298,499 @@ func TestBroker_Run(t *testing.T) {
 	}
 }
 
+func TestBroker_handleCreateTopic(t *testing.T) {
+	f := newFields()
+	f.raft.IsLeaderFn = func() bool {
+		return true
+	}
+	f.raft.ApplyFn = func(c jocko.RaftCommand) error {
+		return nil
+	}
+	f.serf.ClusterFn = func() []*jocko.ClusterMember {
+		return []*jocko.ClusterMember{{ID: 1}}
+	}
+	b := &Broker{
+		logger:      f.logger,
+		id:          f.id,
+		topicMap:    f.topicMap,
+		replicators: f.replicators,
+		brokerAddr:  f.brokerAddr,
+		logDir:      f.logDir,
+		raft:        f.raft,
+		serf:        f.serf,
+		shutdownCh:  f.shutdownCh,
+		shutdown:    f.shutdown,
+	}
+	reqs := &protocol.CreateTopicRequests{Requests: []*protocol.CreateTopicRequest{
+		{Topic: "dup", NumPartitions: 1, ReplicationFactor: 1},
+		{Topic: "unique", NumPartitions: 1, ReplicationFactor: 1},
+		{Topic: "dup", NumPartitions: 1, ReplicationFactor: 1},
+	}}
+	want := &protocol.CreateTopicsResponse{TopicErrorCodes: []*protocol.TopicErrorCode{
+		{Topic: "dup", ErrorCode: protocol.ErrInvalidRequest.Code()},
+		{Topic: "unique", ErrorCode: protocol.ErrNone.Code(), NumPartitions: 1, ReplicationFactor: 1},
+		{Topic: "dup", ErrorCode: protocol.ErrInvalidRequest.Code()},
+	}}
+	if got := b.handleCreateTopic(nil, jocko.AnonymousPrincipal, reqs); !reflect.DeepEqual(got, want) {
+		t.Errorf("Broker.handleCreateTopic() = %v, want %v", got, want)
+	}
+	for _, c := range f.raft.ApplyCommands {
+		p := new(jocko.Partition)
+		if err := json.Unmarshal(*c.Data, p); err != nil {
+			t.Fatalf("json.Unmarshal() error = %v", err)
+		}
+		if p.Topic != "unique" {
+			t.Errorf("Broker.handleCreateTopic() created partition for topic %v, want %v", p.Topic, "unique")
+		}
+	}
+	if len(f.raft.ApplyCommands) != 1 {
+		t.Errorf("len(raft.ApplyCommands) = %v, want %v", len(f.raft.ApplyCommands), 1)
+	}
+}
+
+func TestBroker_handleCreateTopic_throttled(t *testing.T) {
+	f := newFields()
+	f.raft.IsLeaderFn = func() bool {
+		return true
+	}
+	f.raft.ApplyFn = func(c jocko.RaftCommand) error {
+		return nil
+	}
+	f.serf.ClusterFn = func() []*jocko.ClusterMember {
+		return []*jocko.ClusterMember{{ID: 1}}
+	}
+	b := &Broker{
+		logger:        f.logger,
+		id:            f.id,
+		topicMap:      f.topicMap,
+		replicators:   f.replicators,
+		brokerAddr:    f.brokerAddr,
+		logDir:        f.logDir,
+		mutationQuota: newMutationQuota(),
+		raft:          f.raft,
+		serf:          f.serf,
+		shutdownCh:    f.shutdownCh,
+		shutdown:      f.shutdown,
+	}
+	ControllerMutationRate(2)(b)
+	principal := "User:test"
+	createTopic := func(topic string, version int16) *protocol.CreateTopicsResponse {
+		return b.handleCreateTopic(nil, principal, &protocol.CreateTopicRequests{
+			APIVersion: version,
+			Requests: []*protocol.CreateTopicRequest{
+				{Topic: topic + "-small", NumPartitions: 1, ReplicationFactor: 1},
+				{Topic: topic, NumPartitions: 4, ReplicationFactor: 1},
+			},
+		})
+	}
+
+	// the first request's within the burst, so it's accepted but throttled until the
+	// debt its topics run up is paid off.
+	resp := createTopic("first", minStrictCreateTopicsVersion)
+	for _, tec := range resp.TopicErrorCodes {
+		if tec.ErrorCode != protocol.ErrNone.Code() {
+			t.Errorf("first create %v error code = %v, want %v", tec.Topic, tec.ErrorCode, protocol.ErrNone.Code())
+		}
+	}
+	// 5 partitions at 2/s less the 2 burst is 1.5s of debt, less what's refilled meanwhile.
+	if resp.ThrottleTimeMs <= 1000 || resp.ThrottleTimeMs > 1500 {
+		t.Errorf("first create throttle time = %v, want in (1000, 1500]", resp.ThrottleTimeMs)
+	}
+
+	resp = createTopic("second", minStrictCreateTopicsVersion)
+	if code := resp.TopicErrorCodes[0].ErrorCode; code != protocol.ErrThrottlingQuotaExceeded.Code() {
+		t.Errorf("second create error code = %v, want %v", code, protocol.ErrThrottlingQuotaExceeded.Code())
+	}
+	if resp.ThrottleTimeMs <= 0 {
+		t.Errorf("second create throttle time = %v, want > 0", resp.ThrottleTimeMs)
+	}
+
+	// older clients don't know the quota error, so they're only throttled.
+	resp = createTopic("third", 2)
+	if code := resp.TopicErrorCodes[0].ErrorCode; code != protocol.ErrNone.Code() {
+		t.Errorf("v2 create error code = %v, want %v", code, protocol.ErrNone.Code())
+	}
+	if resp.ThrottleTimeMs <= 0 {
+		t.Errorf("v2 create throttle time = %v, want > 0", resp.ThrottleTimeMs)
+	}
+
+	// other principals have their own quota.
+	principal = "User:other"
+	resp = createTopic("fourth", minStrictCreateTopicsVersion)
+	if code := resp.TopicErrorCodes[0].ErrorCode; code != protocol.ErrNone.Code() {
+		t.Errorf("other principal create error code = %v, want %v", code, protocol.ErrNone.Code())
+	}
+}
+
+func TestBroker_handleCreateTopic_throttleCreated(t *testing.T) {
+	f := newFields()
+	f.raft.IsLeaderFn = func() bool {
+		return true
+	}
+	f.raft.ApplyFn = func(c jocko.RaftCommand) error {
+		return nil
+	}
+	f.serf.ClusterFn = func() []*jocko.ClusterMember {
+		return []*jocko.ClusterMember{{ID: 1}}
+	}
+	f.topicMap["existing"] = []*jocko.Partition{{Topic: "existing", ID: 0}}
+	b := &Broker{
+		logger:        f.logger,
+		id:            f.id,
+		topicMap:      f.topicMap,
+		replicators:   f.replicators,
+		brokerAddr:    f.brokerAddr,
+		logDir:        f.logDir,
+		mutationQuota: newMutationQuota(),
+		raft:          f.raft,
+		serf:          f.serf,
+		shutdownCh:    f.shutdownCh,
+		shutdown:      f.shutdown,
+	}
+	ControllerMutationRate(2)(b)
+	// the topic isn't created, so its partitions don't count against the quota.
+	resp := b.handleCreateTopic(nil, "User:test", &protocol.CreateTopicRequests{
+		APIVersion: minStrictCreateTopicsVersion,
+		Requests:   []*protocol.CreateTopicRequest{{Topic: "existing", NumPartitions: 100, ReplicationFactor: 1}},
+	})
+	if code := resp.TopicErrorCodes[0].ErrorCode; code != protocol.ErrTopicAlreadyExists.Code() {
+		t.Fatalf("existing create error code = %v, want %v", code, protocol.ErrTopicAlreadyExists.Code())
+	}
+	if resp.ThrottleTimeMs != 0 {
+		t.Errorf("existing create throttle time = %v, want 0", resp.ThrottleTimeMs)
+	}
+	resp = b.handleCreateTopic(nil, "User:test", &protocol.CreateTopicRequests{
+		APIVersion: minStrictCreateTopicsVersion,
+		Requests:   []*protocol.CreateTopicRequest{{Topic: "new", NumPartitions: 1, ReplicationFactor: 1}},
+	})
+	want := []*protocol.TopicErrorCode{{Topic: "new", ErrorCode: protocol.ErrNone.Code(), NumPartitions: 1, ReplicationFactor: 1}}
+	if !reflect.DeepEqual(resp.TopicErrorCodes, want) {
+		t.Errorf("new create = %v, want %v", resp.TopicErrorCodes, want)
+	}
+	if resp.ThrottleTimeMs != 0 {
+		t.Errorf("new create throttle time = %v, want 0", resp.ThrottleTimeMs)
+	}
+}
+
+func TestBroker_handleDeleteTopics_throttled(t *testing.T) {
+	f := newFields()
+	f.raft.IsLeaderFn = func() bool {
+		return true
+	}
+	failApply := true
+	f.raft.ApplyFn = func(c jocko.RaftCommand) error {
+		if failApply {
+			return errors.New("apply failed")
+		}
+		return nil
+	}
+	for _, topic := range []string{"first", "second", "third"} {
+		for i := int32(0); i < 4; i++ {
+			f.topicMap[topic] = append(f.topicMap[topic], &jocko.Partition{Topic: topic, ID: i})
+		}
+	}
+	b := &Broker{
+		logger:        f.logger,
+		id:            f.id,
+		topicMap:      f.topicMap,
+		replicators:   f.replicators,
+		mutationQuota: newMutationQuota(),
+		raft:          f.raft,
+		serf:          f.serf,
+		shutdownCh:    f.shutdownCh,
+		shutdown:      f.shutdown,
+	}
+	ControllerMutationRate(2)(b)
+	deleteTopic := func(topic string) *protocol.DeleteTopicsResponse {
+		return b.handleDeleteTopics(nil, "User:test", &protocol.DeleteTopicsRequest{
+			APIVersion: minStrictDeleteTopicsVersion,
+			Topics:     []string{topic},
+		})
+	}
+
+	// the topic isn't deleted, so its partitions don't count against the quota.
+	resp := deleteTopic("first")
+	if code := resp.TopicErrorCodes[0].ErrorCode; code != protocol.ErrUnknown.Code() {
+		t.Fatalf("failed delete error code = %v, want %v", code, protocol.ErrUnknown.Code())
+	}
+	if resp.ThrottleTimeMs != 0 {
+		t.Errorf("failed delete throttle time = %v, want 0", resp.ThrottleTimeMs)
+	}
+
+	failApply = false
+	resp = deleteTopic("second")
+	if code := resp.TopicErrorCodes[0].ErrorCode; code != protocol.ErrNone.Code() {
+		t.Fatalf("second delete error code = %v, want %v", code, protocol.ErrNone.Code())
+	}
+	if resp.ThrottleTimeMs <= 0 {
+		t.Errorf("second delete throttle time = %v, want > 0", resp.ThrottleTimeMs)
+	}
+
+	resp = deleteTopic("third")
+	if code := resp.TopicErrorCodes[0].ErrorCode; code != protocol.ErrThrottlingQuotaExceeded.Code() {
+		t.Errorf("third delete error code = %v, want %v", code, protocol.ErrThrottlingQuotaExceeded.Code())
+	}
+	if resp.ThrottleTimeMs <= 0 {
+		t.Errorf("third delete throttle time = %v, want > 0", resp.ThrottleTimeMs)
+	}
+}
+
+func TestBroker_handleCreateTopic_validateOnly(t *testing.T) {
+	f := newFields()
+	f.raft.IsLeaderFn = func() bool {
+		return true
+	}
+	f.raft.ApplyFn = func(c jocko.RaftCommand) error {
+		return nil
+	}
+	f.serf.ClusterFn = func() []*jocko.ClusterMember {
+		return []*jocko.ClusterMember{{ID: 1}}
+	}
+	b := &Broker{
+		logger:        f.logger,
+		id:            f.id,
+		topicMap:      f.topicMap,
+		replicators:   f.replicators,
+		brokerAddr:    f.brokerAddr,
+		logDir:        f.logDir,
+		mutationQuota: newMutationQuota(),
+		raft:          f.raft,
+		serf:          f.serf,
+		shutdownCh:    f.shutdownCh,
+		shutdown:      f.shutdown,
+	}
+	ControllerMutationRate(1)(b)
+	resp := b.handleCreateTopic(nil, "User:test", &protocol.CreateTopicRequests{
+		APIVersion:   minStrictCreateTopicsVersion,
+		ValidateOnly: true,
+		Requests: []*protocol.CreateTopicRequest{
+			{Topic: "valid", NumPartitions: 4, ReplicationFactor: 1},
+			{Topic: "invalid", NumPartitions: 1, ReplicationFactor: 3},
+		},
+	})
+	want := []*protocol.TopicErrorCode{
+		{Topic: "valid", ErrorCode: protocol.ErrNone.Code()},
+		{Topic: "invalid", ErrorCode: protocol.ErrInvalidReplicationFactor.Code()},
+	}
+	if !reflect.DeepEqual(resp.TopicErrorCodes, want) {
+		t.Errorf("Broker.handleCreateTopic() = %v, want %v", resp.TopicErrorCodes, want)
+	}
+	if resp.ThrottleTimeMs != 0 {
+		t.Errorf("Broker.handleCreateTopic() throttle time = %v, want 0", resp.ThrottleTimeMs)
+	}
+	if f.raft.ApplyInvoked {
+		t.Errorf("raft.ApplyInvoked = %v, want false", f.raft.ApplyInvoked)
+	}
+}
+
+func TestBroker_handleMetadata(t *testing.T) {
+	members := []*jocko.ClusterMember{
+		{ID: 1, IP: "127.0.0.1", Port: 9092, RaftPort: 9093},
+		{ID: 2, IP: "127.0.0.1", Port: 9192, RaftPort: 9193},
+	}
+	tests := []struct {
+		name             string
+		leaderID         string
+		wantControllerID int32
+	}{
+		{
+			name:             "known leader",
+			leaderID:         "127.0.0.1:9193",
+			wantControllerID: 2,
+		},
+		{
+			name:             "no leader",
+			leaderID:         "",
+			wantControllerID: -1,
+		},
+		{
+			name:             "unknown leader",
+			leaderID:         "127.0.0.1:9293",
+			wantControllerID: -1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFields()
+			f.raft.LeaderIDFn = func() string {
+				return tt.leaderID
+			}
+			f.serf.ClusterFn = func() []*jocko.ClusterMember {
+				return members
+			}
+			b := &Broker{
+				logger:      f.logger,
+				id:          f.id,
+				topicMap:    f.topicMap,
+				replicators: f.replicators,
+				brokerAddr:  f.brokerAddr,
+				logDir:      f.logDir,
+				raft:        f.raft,
+				serf:        f.serf,
+				shutdownCh:  f.shutdownCh,
+				shutdown:    f.shutdown,
+			}
+			resp := b.handleMetadata(nil, "", &protocol.MetadataRequest{APIVersion: 1})
+			if resp.ControllerID != tt.wantControllerID {
+				t.Errorf("Broker.handleMetadata() ControllerID = %v, want %v", resp.ControllerID, tt.wantControllerID)
+			}
+			if len(resp.Brokers) != len(members) {
+				t.Errorf("len(Broker.handleMetadata() Brokers) = %v, want %v", len(resp.Brokers), len(members))
+			}
+		})
+	}
+}
+
+func TestBroker_advertisedAddr(t *testing.T) {
+	f := newFields()
+	var bootstrapped *jocko.ClusterMember
+	f.serf.BootstrapFn = func(n *jocko.ClusterMember, rCh chan<- *jocko.ClusterMember) error {
+		bootstrapped = n
+		return nil
+	}
+	b, err := New(f.id, Addr("0.0.0.0:9092"), AdvertisedAddr("broker-1.example.com:19092"), Serf(f.serf), Raft(f.raft), Logger(f.logger), LogDir(f.logDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the broker listens on its addr, clients are told to connect to the advertised addr.
+	if bootstrapped.Port != 9092 {
+		t.Errorf("Port = %v, want 9092", bootstrapped.Port)
+	}
+	if bootstrapped.AdvertisedHost != "broker-1.example.com" || bootstrapped.AdvertisedPort != 19092 {
+		t.Errorf("advertised addr = %v:%v, want broker-1.example.com:19092", bootstrapped.AdvertisedHost, bootstrapped.AdvertisedPort)
+	}
+	member := *bootstrapped
+	member.IP = "10.0.0.1"
+	f.serf.ClusterFn = func() []*jocko.ClusterMember {
+		return []*jocko.ClusterMember{&member, {ID: 2, IP: "10.0.0.2", Port: 9092}}
+	}
+	f.raft.LeaderIDFn = func() string {
+		return ""
+	}
+	resp := b.handleMetadata(nil, "", &protocol.MetadataRequest{APIVersion: 1})
+	want := []*protocol.Broker{
+		{NodeID: 1, Host: "broker-1.example.com", Port: 19092},
+		// brokers without an advertised addr are reported at the addr they listen at.
+		{NodeID: 2, Host: "10.0.0.2", Port: 9092},
+	}
+	if !reflect.DeepEqual(resp.Brokers, want) {
+		t.Errorf("Brokers = %v, want %v", resp.Brokers, want)
+	}
+}
+
+func TestBroker_advertisedListener(t *testing.T) {
+	f := newFields()
+	var bootstrapped *jocko.ClusterMember
+	f.serf.BootstrapFn = func(n *jocko.ClusterMember, rCh chan<- *jocko.ClusterMember) error {
+		bootstrapped = n
+		return nil
+	}
+	b, err := New(f.id, Addr("0.0.0.0:9092"), AdvertisedAddr("broker-1.example.com:19092"), AdvertisedListener("SSL", "broker-1.example.com:19093"), Serf(f.serf), Raft(f.raft), Logger(f.logger), LogDir(f.logDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	member := *bootstrapped
+	member.IP = "10.0.0.1"
+	f.serf.ClusterFn = func() []*jocko.ClusterMember {
+		return []*jocko.ClusterMember{&member, {ID: 2, IP: "10.0.0.2", Port: 9092}}
+	}
+	f.raft.LeaderIDFn = func() string {
+		return ""
+	}
+	tests := []struct {
+		name     string
+		listener string
+		want     []*protocol.Broker
+	}{
+		{
+			name: "default listener",
+			want: []*protocol.Broker{
+				{NodeID: 1, Host: "broker-1.example.com", Port: 19092},
+				{NodeID: 2, Host: "10.0.0.2", Port: 9092},
+			},
+		},
+		{
+			name:     "ssl listener",
+			listener: "SSL",
+			want: []*protocol.Broker{
+				{NodeID: 1, Host: "broker-1.example.com", Port: 19093},
+				// brokers without an endpoint for the listener are reported at their advertised addr.
+				{NodeID: 2, Host: "10.0.0.2", Port: 9092},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := &protocol.RequestHeader{APIKey: protocol.MetadataKey, APIVersion: 1}
+			resp := b.handle(context.Background(), header, jocko.AnonymousPrincipal, tt.listener, &protocol.MetadataRequest{APIVersion: 1}, nil)
+			if got := resp.(*protocol.MetadataResponse).Brokers; !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Brokers = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBroker_controllerOnly(t *testing.T) {
+	tests := []struct {
+		name     string
+		isLeader bool
+		wantCode int16
+	}{
+		{
+			name:     "follower rejects",
+			isLeader: false,
+			wantCode: protocol.ErrNotController.Code(),
+		},
+		{
+			name:     "leader proceeds",
+			isLeader: true,
+			wantCode: protocol.ErrNone.Code(),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFields()
+			f.raft.IsLeaderFn = func() bool {
+				return tt.isLeader
+			}
+			f.raft.LeaderIDFn = func() string {
+				return ""
+			}
+			f.raft.ApplyFn = func(c jocko.RaftCommand) error {
+				return nil
+			}
+			f.serf.ClusterFn = func() []*jocko.ClusterMember {
+				return []*jocko.ClusterMember{{ID: 1}}
+			}
+			b := &Broker{
+				logger:      f.logger,
+				id:          f.id,
+				topicMap:    f.topicMap,
+				replicators: f.replicators,
+				brokerAddr:  f.brokerAddr,
+				logDir:      f.logDir,
+				raft:        f.raft,
+				serf:        f.serf,
+				shutdownCh:  f.shutdownCh,
+				shutdown:    f.shutdown,
+			}
+			createResp := b.handleCreateTopic(nil, jocko.AnonymousPrincipal, &protocol.CreateTopicRequests{Requests: []*protocol.CreateTopicRequest{
+				{Topic: "the-topic", NumPartitions: 1, ReplicationFactor: 1},
+			}})
+			if code := createResp.TopicErrorCodes[0].ErrorCode; code != tt.wantCode {
+				t.Errorf("Broker.handleCreateTopic() error code = %v, want %v", code, tt.wantCode)
+			}
+			deleteResp := b.handleDeleteTopics(nil, jocko.AnonymousPrincipal, &protocol.DeleteTopicsRequest{Topics: []string{"the-topic"}})
+			if code := deleteResp.TopicErrorCodes[0].ErrorCode; code != tt.wantCode {
+				t.Errorf("Broker.handleDeleteTopics() error code = %v, want %v", code, tt.wantCode)
+			}
+			if f.raft.ApplyInvoked != tt.isLeader {
+				t.Errorf("raft.ApplyInvoked = %v, want %v", f.raft.ApplyInvoked, tt.isLeader)
+			}
+		})
+	}
+}
+
 func TestBroker_Join(t *testing.T) {
 	type args struct {
 		addrs []string
@@ -552,6 +1172,20 @@ func TestBroker_createPartition(t *testing.T) {
 			if !raft.ApplyInvoked {
 				t.Errorf("Broker.createPartition() raft.ApplyInvoked = %v, want %v", raft.ApplyInvoked, true)
 			}
+			if len(raft.ApplyCommands) != 1 {
+				t.Fatalf("Broker.createPartition() len(raft.ApplyCommands) = %v, want %v", len(raft.ApplyCommands), 1)
+			}
+			c := raft.ApplyCommands[0]
+			if c.Cmd != createPartition {
+				t.Errorf("Broker.createPartition() c.Cmd = %v, want %v", c.Cmd, createPartition)
+			}
+			p := new(jocko.Partition)
+			if err := json.Unmarshal(*c.Data, p); err != nil {
+				t.Fatalf("json.Unmarshal() error = %v", err)
+			}
+			if !reflect.DeepEqual(p, tt.args.partition) {
+				t.Errorf("Broker.createPartition() c.Data = %v, want %v", p, tt.args.partition)
+			}
 		})
 	}
 }
@@ -622,6 +1256,9 @@ func TestBroker_clusterMember(t *testing.T) {
 
 func TestBroker_startReplica(t *testing.T) {
 	f := newFields()
+	f.serf.MemberFn = func(id int32) *jocko.ClusterMember {
+		return &jocko.ClusterMember{ID: id}
+	}
 	type args struct {
 		partition *jocko.Partition
 	}
@@ -630,10 +1267,13 @@ func TestBroker_startReplica(t *testing.T) {
 		ID:    1,
 	}
 	tests := []struct {
-		name   string
-		fields fields
-		args   args
-		want   protocol.Error
+		name          string
+		fields        fields
+		args          args
+		commitLog     *mock.CommitLog
+		wantPath      string
+		wantCommitLog bool
+		want          protocol.Error
 	}{
 		{
 			name:   "started replica",
@@ -643,6 +1283,22 @@ func TestBroker_startReplica(t *testing.T) {
 			},
 			want: protocol.ErrNone,
 		},
+		{
+			name:   "started replica with commit log",
+			fields: f,
+			args: args{
+				partition: &jocko.Partition{
+					Topic:    "the-topic",
+					ID:       2,
+					Leader:   f.id,
+					Replicas: []int32{f.id},
+				},
+			},
+			commitLog:     &mock.CommitLog{},
+			wantPath:      "/tmp/jocko/the-topic/2",
+			wantCommitLog: true,
+			want:          protocol.ErrNone,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -658,16 +1314,29 @@ func TestBroker_startReplica(t *testing.T) {
 				shutdownCh:  tt.fields.shutdownCh,
 				shutdown:    tt.fields.shutdown,
 			}
+			var gotPath string
+			if tt.commitLog != nil {
+				b.newCommitLog = func(path string) (jocko.CommitLog, error) {
+					gotPath = path
+					return tt.commitLog, nil
+				}
+			}
 			if got := b.startReplica(tt.args.partition); !reflect.DeepEqual(got, tt.want) {
 				t.Errorf("Broker.startReplica() = %v, want %v", got, tt.want)
 			}
-			got, err := b.partition(partition.Topic, partition.ID)
-			if !reflect.DeepEqual(got, partition) {
-				t.Errorf("Broker.partition() = %v, want %v", got, partition)
+			got, err := b.partition(tt.args.partition.Topic, tt.args.partition.ID)
+			if !reflect.DeepEqual(got, tt.args.partition) {
+				t.Errorf("Broker.partition() = %v, want %v", got, tt.args.partition)
 			}
 			if err != protocol.ErrNone {
 				t.Errorf("Broker.partition() err = %v, want %v", err, protocol.ErrNone)
 			}
+			if gotPath != tt.wantPath {
+				t.Errorf("commit log path = %v, want %v", gotPath, tt.wantPath)
+			}
+			if tt.wantCommitLog && got.CommitLog != tt.commitLog {
+				t.Errorf("Partition.CommitLog = %v, want %v", got.CommitLog, tt.commitLog)
+			}
 		})
 	}
 }
@@ -719,62 +1388,292 @@ func TestBroker_createTopic(t *testing.T) {
 	}
 }
 
-func TestBroker_deleteTopic(t *testing.T) {
-	type fields struct {
-		logger      *simplelog.Logger
-		id          int32
-		topicMap    map[string][]*jocko.Partition
-		replicators map[*jocko.Partition]*Replicator
-		brokerAddr  string
-		logDir      string
-		raft        jocko.Raft
-		serf        jocko.Serf
-		shutdownCh  chan struct{}
-		shutdown    bool
-	}
-	type args struct {
-		topic string
-	}
+func TestBroker_createTopic_partitionLimits(t *testing.T) {
 	tests := []struct {
-		name   string
-		fields fields
-		args   args
-		want   protocol.Error
+		name              string
+		partitions        int32
+		replicationFactor int16
+		want              protocol.Error
 	}{
-	// TODO: Add test cases.
+		{name: "over topic limit", partitions: 5, replicationFactor: 1, want: protocol.ErrInvalidPartitions},
+		{name: "over broker limit", partitions: 4, replicationFactor: 2, want: protocol.ErrPolicyViolation},
+		{name: "within limits", partitions: 2, replicationFactor: 2, want: protocol.ErrNone},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
+			f := newFields()
+			f.raft.ApplyFn = func(c jocko.RaftCommand) error {
+				return nil
+			}
+			f.serf.ClusterFn = func() []*jocko.ClusterMember {
+				return []*jocko.ClusterMember{{ID: 1}, {ID: 2}}
+			}
+			f.topicMap["existing"] = []*jocko.Partition{
+				{Topic: "existing", ID: 0, Leader: 1, Replicas: []int32{1, 2}, ISR: []int32{1, 2}},
+			}
 			b := &Broker{
-				logger:      tt.fields.logger,
-				id:          tt.fields.id,
-				topicMap:    tt.fields.topicMap,
-				replicators: tt.fields.replicators,
-				brokerAddr:  tt.fields.brokerAddr,
-				logDir:      tt.fields.logDir,
-				raft:        tt.fields.raft,
-				serf:        tt.fields.serf,
-				shutdownCh:  tt.fields.shutdownCh,
-				shutdown:    tt.fields.shutdown,
+				logger:                 f.logger,
+				id:                     f.id,
+				topicMap:               f.topicMap,
+				replicators:            f.replicators,
+				raft:                   f.raft,
+				serf:                   f.serf,
+				maxPartitionsPerTopic:  4,
+				maxPartitionsPerBroker: 3,
 			}
-			if got := b.deleteTopic(tt.args.topic); !reflect.DeepEqual(got, tt.want) {
-				t.Errorf("Broker.deleteTopic() = %v, want %v", got, tt.want)
+			if got := b.createTopic("the-topic", tt.partitions, tt.replicationFactor); got != tt.want {
+				t.Fatalf("createTopic() = %v, want %v", got, tt.want)
+			}
+			want := 0
+			if tt.want == protocol.ErrNone {
+				want = int(tt.partitions)
+			}
+			if got := len(f.raft.ApplyCommands); got != want {
+				t.Errorf("len(raft.ApplyCommands) = %v, want %v", got, want)
 			}
 		})
 	}
 }
 
-func TestBroker_deletePartitions(t *testing.T) {
-	type fields struct {
-		logger      *simplelog.Logger
-		id          int32
-		topicMap    map[string][]*jocko.Partition
-		replicators map[*jocko.Partition]*Replicator
-		brokerAddr  string
-		logDir      string
-		raft        jocko.Raft
-		serf        jocko.Serf
-		shutdownCh  chan struct{}
+func TestBroker_startReplica_maxPartitionsPerBroker(t *testing.T) {
+	dir, err := ioutil.TempDir("", "start-replica-limit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	f := newFields()
+	f.serf.MemberFn = func(id int32) *jocko.ClusterMember {
+		return &jocko.ClusterMember{ID: id}
+	}
+	b := &Broker{
+		logger:                 f.logger,
+		id:                     f.id,
+		topicMap:               make(map[string][]*jocko.Partition),
+		replicators:            f.replicators,
+		logDir:                 dir,
+		raft:                   f.raft,
+		serf:                   f.serf,
+		maxPartitionsPerBroker: 2,
+	}
+	for i := int32(0); i < 3; i++ {
+		p := &jocko.Partition{Topic: "the-topic", ID: i, Leader: 2, Replicas: []int32{2, 1}}
+		want := protocol.ErrNone
+		if i == 2 {
+			want = protocol.ErrPolicyViolation
+		}
+		if got := b.startReplica(p); got != want {
+			t.Fatalf("startReplica(%d) = %v, want %v", i, got, want)
+		}
+		if p.IsOpen() != (want == protocol.ErrNone) {
+			t.Errorf("startReplica(%d) opened the log = %v, want %v", i, p.IsOpen(), want == protocol.ErrNone)
+		}
+	}
+	// partitions this broker doesn't replicate don't count toward its limit.
+	if got := b.startReplica(&jocko.Partition{Topic: "other-topic", ID: 0, Leader: 2, Replicas: []int32{2}}); got != protocol.ErrNone {
+		t.Errorf("startReplica() = %v, want %v", got, protocol.ErrNone)
+	}
+}
+
+func TestBroker_apply_createPartitionRetries(t *testing.T) {
+	f := newFields()
+	f.serf.MemberFn = func(id int32) *jocko.ClusterMember {
+		return &jocko.ClusterMember{ID: id}
+	}
+	b := &Broker{
+		logger:      f.logger,
+		id:          f.id,
+		topicMap:    make(map[string][]*jocko.Partition),
+		replicators: f.replicators,
+		logDir:      f.logDir,
+		raft:        f.raft,
+		serf:        f.serf,
+		shutdownCh:  make(chan struct{}),
+	}
+	// the log fails to open twice, e.g. the disk's full, then opens.
+	var opens int
+	b.newCommitLog = func(path string) (jocko.CommitLog, error) {
+		if opens++; opens <= 2 {
+			return nil, errors.New("no space left on device")
+		}
+		return &mock.CommitLog{}, nil
+	}
+	// apply the command as raft would.
+	f.raft.ApplyFn = func(c jocko.RaftCommand) error {
+		b.apply(c)
+		return nil
+	}
+	p := &jocko.Partition{Topic: "the-topic", ID: 0, Leader: f.id, Replicas: []int32{f.id}}
+	if err := b.raftApply(createPartition, p); err != nil {
+		t.Fatal(err)
+	}
+	if opens != 3 {
+		t.Errorf("opened the log %d times, want 3", opens)
+	}
+	partitions := b.topicMap["the-topic"]
+	if len(partitions) != 1 {
+		t.Fatalf("got %d partitions, want the partition once", len(partitions))
+	}
+	if !partitions[0].IsOpen() {
+		t.Errorf("partition isn't running, want its replica started")
+	}
+	if b.shutdown {
+		t.Errorf("broker shut down, want it to retry")
+	}
+
+	// the log keeps failing to open, the partition's offline and its replica's retried in the
+	// background rather than holding up later commands, until it starts.
+	var failing, failures int32 = 1, 0
+	b.newCommitLog = func(path string) (jocko.CommitLog, error) {
+		if atomic.LoadInt32(&failing) == 1 {
+			atomic.AddInt32(&failures, 1)
+			return nil, errors.New("no space left on device")
+		}
+		return &mock.CommitLog{}, nil
+	}
+	if err := b.raftApply(createPartition, &jocko.Partition{Topic: "the-topic", ID: 1, Leader: f.id, Replicas: []int32{f.id}}); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&failures); n != maxStartReplicaAttempts {
+		t.Errorf("opened the log %d times, want %d", n, maxStartReplicaAttempts)
+	}
+	offline, perr := b.partition("the-topic", 1)
+	if perr != protocol.ErrNone {
+		t.Fatalf("partition() error = %v, want the partition", perr)
+	}
+	b.RLock()
+	open := offline.IsOpen()
+	b.RUnlock()
+	if open {
+		t.Errorf("partition is running, want it offline")
+	}
+	if b.shutdown {
+		t.Errorf("broker shut down, want the partition offline")
+	}
+	atomic.StoreInt32(&failing, 0)
+	testutil.WaitForResult(func() (bool, error) {
+		b.RLock()
+		defer b.RUnlock()
+		return offline.IsOpen(), nil
+	}, func(err error) {
+		t.Fatal("partition is offline, want its replica started once the log opens")
+	})
+
+	// the broker stops retrying when it shuts down.
+	b.newCommitLog = func(path string) (jocko.CommitLog, error) {
+		return nil, errors.New("no space left on device")
+	}
+	close(b.shutdownCh)
+	done := make(chan struct{})
+	go func() {
+		b.raftApply(createPartition, &jocko.Partition{Topic: "the-topic", ID: 2, Leader: f.id, Replicas: []int32{f.id}})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("apply didn't return after the broker shut down")
+	}
+}
+
+func TestBroker_ledAndReplicatedPartitions(t *testing.T) {
+	f := newFields()
+	// this broker, 1, leads the-topic/0 and other-topic/0, follows the-topic/1 and other-topic/1,
+	// and doesn't host the-topic/2.
+	f.topicMap["the-topic"] = []*jocko.Partition{
+		{Topic: "the-topic", ID: 0, Leader: f.id, Replicas: []int32{f.id, 2}},
+		{Topic: "the-topic", ID: 1, Leader: 2, Replicas: []int32{2, f.id}},
+		{Topic: "the-topic", ID: 2, Leader: 2, Replicas: []int32{2, 3}},
+	}
+	f.topicMap["other-topic"] = []*jocko.Partition{
+		{Topic: "other-topic", ID: 0, Leader: f.id, Replicas: []int32{f.id}},
+		{Topic: "other-topic", ID: 1, Leader: 3, Replicas: []int32{3, f.id}},
+	}
+	b := &Broker{
+		logger:   f.logger,
+		id:       f.id,
+		topicMap: f.topicMap,
+	}
+	names := func(partitions []*jocko.Partition) []string {
+		var s []string
+		for _, p := range partitions {
+			s = append(s, p.String())
+		}
+		sort.Strings(s)
+		return s
+	}
+	if got, want := names(b.ledPartitions()), []string{"other-topic/0", "the-topic/0"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ledPartitions() = %v, want %v", got, want)
+	}
+	if got, want := names(b.replicatedPartitions()), []string{"other-topic/1", "the-topic/1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("replicatedPartitions() = %v, want %v", got, want)
+	}
+
+	// the sets follow leadership changes.
+	f.topicMap["the-topic"][1].Leader = f.id
+	if got, want := names(b.ledPartitions()), []string{"other-topic/0", "the-topic/0", "the-topic/1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ledPartitions() = %v, want %v", got, want)
+	}
+	if got, want := names(b.replicatedPartitions()), []string{"other-topic/1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("replicatedPartitions() = %v, want %v", got, want)
+	}
+}
+
+func TestBroker_deleteTopic(t *testing.T) {
+	type fields struct {
+		logger      *simplelog.Logger
+		id          int32
+		topicMap    map[string][]*jocko.Partition
+		replicators map[*jocko.Partition]*Replicator
+		brokerAddr  string
+		logDir      string
+		raft        jocko.Raft
+		serf        jocko.Serf
+		shutdownCh  chan struct{}
+		shutdown    bool
+	}
+	type args struct {
+		topic string
+	}
+	tests := []struct {
+		name   string
+		fields fields
+		args   args
+		want   protocol.Error
+	}{
+	// TODO: Add test cases.
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &Broker{
+				logger:      tt.fields.logger,
+				id:          tt.fields.id,
+				topicMap:    tt.fields.topicMap,
+				replicators: tt.fields.replicators,
+				brokerAddr:  tt.fields.brokerAddr,
+				logDir:      tt.fields.logDir,
+				raft:        tt.fields.raft,
+				serf:        tt.fields.serf,
+				shutdownCh:  tt.fields.shutdownCh,
+				shutdown:    tt.fields.shutdown,
+			}
+			if got := b.deleteTopic(tt.args.topic); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Broker.deleteTopic() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBroker_deletePartitions(t *testing.T) {
+	type fields struct {
+		logger      *simplelog.Logger
+		id          int32
+		topicMap    map[string][]*jocko.Partition
+		replicators map[*jocko.Partition]*Replicator
+		brokerAddr  string
+		logDir      string
+		raft        jocko.Raft
+		serf        jocko.Serf
+		shutdownCh  chan struct{}
 		shutdown    bool
 	}
 	type args struct {
@@ -850,6 +1749,51 @@ func TestBroker_Shutdown(t *testing.T) {
 	}
 }
 
+func TestBroker_Shutdown_closesLogs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jocko-shutdown")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	f := newFields()
+	f.raft.ShutdownFn = func() error { return nil }
+	b := &Broker{
+		logger:              f.logger,
+		id:                  f.id,
+		topicMap:            f.topicMap,
+		replicators:         f.replicators,
+		logDir:              dir,
+		raft:                f.raft,
+		serf:                f.serf,
+		shutdownCh:          make(chan struct{}),
+		preallocateSegments: true,
+	}
+	clog, err := b.openCommitLog(filepath.Join(dir, "the-topic-0"), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.topicMap["the-topic"] = []*jocko.Partition{{Topic: "the-topic", ID: 0, Leader: b.id, CommitLog: clog}}
+	var appended int64
+	for i := 0; i < 2; i++ {
+		ms := commitlog.NewMessageSet(0, commitlog.NewMessage([]byte("hello")))
+		if _, err := clog.Append(ms); err != nil {
+			t.Fatal(err)
+		}
+		appended += int64(len(ms))
+	}
+	if err := b.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	// the preallocated segment's truncated to what was appended once the log's closed.
+	fi, err := os.Stat(filepath.Join(dir, "the-topic-0", fmt.Sprintf("%020d.log", 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != appended {
+		t.Fatalf("segment size = %d, want %d", fi.Size(), appended)
+	}
+}
+
 func TestBroker_becomeFollower(t *testing.T) {
 	type fields struct {
 		logger      *simplelog.Logger
@@ -992,11 +1936,17 @@ func newFields() fields {
 		JoinFn: func(addrs ...string) (int, error) {
 			return 1, nil
 		},
+		ShutdownFn: func() error {
+			return nil
+		},
 	}
 	raft := &mock.Raft{
 		AddrFn: func() string {
 			return "localhost:9093"
 		},
+		IsLeaderFn: func() bool {
+			return false
+		},
 		BootstrapFn: func(s jocko.Serf, sCh <-chan *jocko.ClusterMember, cCh chan<- jocko.RaftCommand) error {
 			if s == nil {
 				return errors.New("jocko.Serf is nil")
@@ -1027,3 +1977,3325 @@ type nopReaderWriter struct{}
 func (nopReaderWriter) Read(b []byte) (int, error)  { return 0, nil }
 func (nopReaderWriter) Write(b []byte) (int, error) { return 0, nil }
 func newNopReaderWriter() io.ReadWriter             { return nopReaderWriter{} }
+
+func TestBroker_WaitForLeader(t *testing.T) {
+	tests := []struct {
+		name       string
+		leaderID   func(calls int) string
+		timeout    time.Duration
+		want       string
+		wantErr    error
+		wantCalls int
+	}{
+		{
+			name: "leader appears",
+			leaderID: func(calls int) string {
+				if calls < 3 {
+					return ""
+				}
+				return "localhost:9093"
+			},
+			timeout:    5 * time.Second,
+			want:       "localhost:9093",
+			wantCalls: 3,
+		},
+		{
+			name: "timed out",
+			leaderID: func(calls int) string {
+				return ""
+			},
+			timeout: 250 * time.Millisecond,
+			wantErr: ErrLeaderTimeout,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			b := &Broker{
+				raft: &mock.Raft{
+					LeaderIDFn: func() string {
+						calls++
+						return tt.leaderID(calls)
+					},
+				},
+			}
+			got, err := b.WaitForLeader(tt.timeout)
+			if err != tt.wantErr {
+				t.Fatalf("Broker.WaitForLeader() error = %v, want %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("Broker.WaitForLeader() = %v, want %v", got, tt.want)
+			}
+			if calls < tt.wantCalls {
+				t.Errorf("raft.LeaderID() calls = %v, want >= %v", calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestBroker_handleProduce_authorizer(t *testing.T) {
+	tests := []struct {
+		name       string
+		authorizer *mock.Authorizer
+		wantCode   int16
+		wantAppend bool
+	}{
+		{
+			name:       "no authorizer allows",
+			wantCode:   protocol.ErrNone.Code(),
+			wantAppend: true,
+		},
+		{
+			name: "authorizer allows",
+			authorizer: &mock.Authorizer{
+				AuthorizeFn: func(principal string, operation jocko.Operation, resource jocko.Resource) bool {
+					return true
+				},
+			},
+			wantCode:   protocol.ErrNone.Code(),
+			wantAppend: true,
+		},
+		{
+			name: "authorizer denies anonymous",
+			authorizer: &mock.Authorizer{
+				AuthorizeFn: func(principal string, operation jocko.Operation, resource jocko.Resource) bool {
+					return principal != jocko.AnonymousPrincipal
+				},
+			},
+			wantCode: protocol.ErrTopicAuthorizationFailed.Code(),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFields()
+			clog := &mock.CommitLog{
+				AppendFn: func(b []byte) (int64, error) {
+					return 0, nil
+				},
+			}
+			f.topicMap["the-topic"] = []*jocko.Partition{{
+				Topic:     "the-topic",
+				ID:        0,
+				Leader:    f.id,
+				Replicas:  []int32{f.id},
+				CommitLog: clog,
+			}}
+			b := &Broker{
+				logger:      f.logger,
+				id:          f.id,
+				topicMap:    f.topicMap,
+				replicators: f.replicators,
+				brokerAddr:  f.brokerAddr,
+				logDir:      f.logDir,
+				raft:        f.raft,
+				serf:        f.serf,
+				shutdownCh:  f.shutdownCh,
+				shutdown:    f.shutdown,
+			}
+			if tt.authorizer != nil {
+				b.authorizer = tt.authorizer
+			}
+			resp := b.handleProduce(nil, jocko.AnonymousPrincipal, &protocol.ProduceRequest{
+				TopicData: []*protocol.TopicData{{
+					Topic: "the-topic",
+					Data:  []*protocol.Data{{Partition: 0, RecordSet: []byte("hello")}},
+				}},
+			}, nil)
+			if code := resp.Responses[0].PartitionResponses[0].ErrorCode; code != tt.wantCode {
+				t.Errorf("Broker.handleProduce(, nil) error code = %v, want %v", code, tt.wantCode)
+			}
+			if clog.AppendInvoked != tt.wantAppend {
+				t.Errorf("CommitLog.AppendInvoked = %v, want %v", clog.AppendInvoked, tt.wantAppend)
+			}
+			if tt.authorizer != nil && !tt.authorizer.AuthorizeInvoked {
+				t.Errorf("Authorizer.AuthorizeInvoked = %v, want %v", tt.authorizer.AuthorizeInvoked, true)
+			}
+		})
+	}
+}
+
+func TestBroker_partitionMetrics(t *testing.T) {
+	f := newFields()
+	clog := &mock.CommitLog{
+		AppendFn: func(b []byte) (int64, error) {
+			return 0, nil
+		},
+		NewReaderFn: func(offset int64, maxBytes int32) (io.Reader, error) {
+			return bytes.NewReader([]byte("hello")), nil
+		},
+		NewestOffsetFn: func() int64 {
+			return 1
+		},
+		OldestOffsetFn: func() int64 {
+			return 0
+		},
+	}
+	f.topicMap["the-topic"] = []*jocko.Partition{{
+		Topic:     "the-topic",
+		ID:        0,
+		Leader:    f.id,
+		Replicas:  []int32{f.id},
+		CommitLog: clog,
+	}}
+	b := &Broker{
+		logger:      f.logger,
+		id:          f.id,
+		topicMap:    f.topicMap,
+		replicators: f.replicators,
+		brokerAddr:  f.brokerAddr,
+		logDir:      f.logDir,
+		raft:        f.raft,
+		serf:        f.serf,
+		shutdownCh:  f.shutdownCh,
+		shutdown:    f.shutdown,
+	}
+	PartitionMetrics(prometheus.NewRegistry())(b)
+
+	for i := 0; i < 3; i++ {
+		b.handleProduce(nil, jocko.AnonymousPrincipal, &protocol.ProduceRequest{
+			TopicData: []*protocol.TopicData{{
+				Topic: "the-topic",
+				Data:  []*protocol.Data{{Partition: 0, RecordSet: []byte("hello")}},
+			}},
+		}, nil)
+	}
+	b.handleFetch(context.Background(), nil, &protocol.FetchRequest{
+		MinBytes: 1,
+		Topics: []*protocol.FetchTopic{{
+			Topic:      "the-topic",
+			Partitions: []*protocol.FetchPartition{{Partition: 0, MaxBytes: 5}},
+		}},
+	})
+
+	tests := []struct {
+		name string
+		vec  *prometheus.HistogramVec
+		want uint64
+	}{
+		{name: "produce", vec: b.metrics.produceLatency, want: 3},
+		{name: "fetch", vec: b.metrics.fetchLatency, want: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &dto.Metric{}
+			if err := tt.vec.WithLabelValues("the-topic", "0").Write(m); err != nil {
+				t.Fatalf("Histogram.Write() error = %v", err)
+			}
+			if got := m.GetHistogram().GetSampleCount(); got != tt.want {
+				t.Errorf("sample count = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBroker_Run_slowRequestLog(t *testing.T) {
+	tests := []struct {
+		name      string
+		threshold time.Duration
+		wantLog   bool
+	}{
+		{name: "disabled", wantLog: false},
+		{name: "below threshold", threshold: time.Hour, wantLog: false},
+		{name: "above threshold", threshold: time.Millisecond, wantLog: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFields()
+			f.topicMap["the-topic"] = []*jocko.Partition{{
+				Topic:    "the-topic",
+				ID:       0,
+				Leader:   f.id,
+				Replicas: []int32{f.id},
+				CommitLog: &mock.CommitLog{
+					AppendFn: func(b []byte) (int64, error) {
+						time.Sleep(10 * time.Millisecond)
+						return 0, nil
+					},
+				},
+			}}
+			buf := new(bytes.Buffer)
+			b := &Broker{
+				logger:               simplelog.New(buf, simplelog.DEBUG, "jocko/brokertest"),
+				id:                   f.id,
+				topicMap:             f.topicMap,
+				replicators:          f.replicators,
+				brokerAddr:           f.brokerAddr,
+				logDir:               f.logDir,
+				raft:                 f.raft,
+				serf:                 f.serf,
+				shutdownCh:           f.shutdownCh,
+				shutdown:             f.shutdown,
+				slowRequestThreshold: tt.threshold,
+			}
+			requestc := make(chan jocko.Request, 1)
+			responsec := make(chan jocko.Response, 1)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go b.Run(ctx, requestc, responsec)
+			requestc <- jocko.Request{
+				Header: &protocol.RequestHeader{APIKey: protocol.ProduceKey, CorrelationID: 7, ClientID: "slow-client"},
+				Request: &protocol.ProduceRequest{
+					Acks: 1,
+					TopicData: []*protocol.TopicData{{
+						Topic: "the-topic",
+						Data:  []*protocol.Data{{Partition: 0, RecordSet: []byte("hello")}},
+					}},
+				},
+			}
+			<-responsec
+			log := buf.String()
+			gotLog := strings.Contains(log, "slow request")
+			if gotLog != tt.wantLog {
+				t.Fatalf("slow request logged = %v, want %v: %q", gotLog, tt.wantLog, log)
+			}
+			if !tt.wantLog {
+				return
+			}
+			for _, want := range []string{"api key: 0", "correlation id: 7", "client id: slow-client", "duration: "} {
+				if !strings.Contains(log, want) {
+					t.Errorf("slow request log = %q, want it to contain %q", log, want)
+				}
+			}
+		})
+	}
+}
+
+func TestBroker_Run_sampledRequestLog(t *testing.T) {
+	tests := []struct {
+		name    string
+		rate    string
+		wantLog int
+	}{
+		{name: "disabled", wantLog: 0},
+		{name: "every request", rate: "1", wantLog: 4},
+		{name: "one in two", rate: "2", wantLog: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFields()
+			f.topicMap["the-topic"] = []*jocko.Partition{{
+				Topic:     "the-topic",
+				ID:        0,
+				Leader:    f.id,
+				Replicas:  []int32{f.id},
+				CommitLog: &mock.CommitLog{AppendFn: func(b []byte) (int64, error) { return 0, nil }},
+			}}
+			buf := new(bytes.Buffer)
+			b := &Broker{
+				logger:      simplelog.New(buf, simplelog.DEBUG, "jocko/brokertest"),
+				id:          f.id,
+				topicMap:    f.topicMap,
+				replicators: f.replicators,
+				brokerAddr:  f.brokerAddr,
+				logDir:      f.logDir,
+				raft:        f.raft,
+				serf:        f.serf,
+				shutdownCh:  f.shutdownCh,
+				shutdown:    f.shutdown,
+			}
+			if tt.rate != "" {
+				b.setConfigs(&resourceConfigs{Type: protocol.ConfigResourceBroker, Name: "1", Configs: map[string]string{requestLogSampleRateConfig: tt.rate}})
+			}
+			requestc := make(chan jocko.Request, 1)
+			responsec := make(chan jocko.Response, 1)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go b.Run(ctx, requestc, responsec)
+			for i := 0; i < 4; i++ {
+				requestc <- jocko.Request{
+					Header: &protocol.RequestHeader{APIKey: protocol.ProduceKey, CorrelationID: int32(i), ClientID: "sampled-client"},
+					Request: &protocol.ProduceRequest{
+						Acks: 1,
+						TopicData: []*protocol.TopicData{{
+							Topic: "the-topic",
+							Data:  []*protocol.Data{{Partition: 0, RecordSet: newMessageSet(t, "hello")}},
+						}},
+					},
+				}
+				<-responsec
+			}
+			log := buf.String()
+			if got := strings.Count(log, "request: api key: 0"); got != tt.wantLog {
+				t.Fatalf("logged %d requests, want %d: %q", got, tt.wantLog, log)
+			}
+			if tt.wantLog == 0 {
+				return
+			}
+			for _, want := range []string{"client id: sampled-client", "error codes: [the-topic/0: 0]"} {
+				if !strings.Contains(log, want) {
+					t.Errorf("request log = %q, want it to contain %q", log, want)
+				}
+			}
+		})
+	}
+}
+
+func TestBroker_handleFetch_zeroMaxWaitTime(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jocko-fetch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	clog, err := commitlog.New(commitlog.Options{Path: dir, MaxSegmentBytes: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := newFields()
+	f.topicMap["the-topic"] = []*jocko.Partition{{
+		Topic:     "the-topic",
+		ID:        0,
+		Leader:    f.id,
+		Replicas:  []int32{f.id},
+		CommitLog: clog,
+	}}
+	b := &Broker{
+		logger:      f.logger,
+		id:          f.id,
+		topicMap:    f.topicMap,
+		replicators: f.replicators,
+		brokerAddr:  f.brokerAddr,
+		logDir:      f.logDir,
+		raft:        f.raft,
+		serf:        f.serf,
+		shutdownCh:  f.shutdownCh,
+		shutdown:    f.shutdown,
+	}
+	respc := make(chan *protocol.FetchResponses)
+	go func() {
+		respc <- b.handleFetch(context.Background(), nil, &protocol.FetchRequest{
+			APIVersion:  5,
+			MaxWaitTime: 0,
+			MinBytes:    1,
+			Topics: []*protocol.FetchTopic{{
+				Topic:      "the-topic",
+				Partitions: []*protocol.FetchPartition{{Partition: 0, FetchOffset: 0, MaxBytes: 1024}},
+			}},
+		})
+	}()
+	select {
+	case resp := <-respc:
+		p := resp.Responses[0].PartitionResponses[0]
+		if p.ErrorCode != protocol.ErrNone.Code() {
+			t.Errorf("ErrorCode = %v, want %v", p.ErrorCode, protocol.ErrNone.Code())
+		}
+		if len(p.RecordSet) != 0 || p.RecordSetSize != 0 {
+			t.Errorf("RecordSet = %v, RecordSetSize = %v, want empty", p.RecordSet, p.RecordSetSize)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("fetch with zero max wait time didn't return")
+	}
+}
+
+func TestBroker_handleFetch_notLeader(t *testing.T) {
+	f := newFields()
+	clog := &mock.CommitLog{
+		NewReaderFn: func(offset int64, maxBytes int32) (io.Reader, error) {
+			return bytes.NewReader([]byte("stale")), nil
+		},
+	}
+	// this broker, 1, follows the partition's leader, 2.
+	f.topicMap["the-topic"] = []*jocko.Partition{{
+		Topic:     "the-topic",
+		ID:        0,
+		Leader:    2,
+		Replicas:  []int32{2, f.id},
+		ISR:       []int32{2, f.id},
+		CommitLog: clog,
+	}}
+	b := &Broker{
+		logger:      f.logger,
+		id:          f.id,
+		topicMap:    f.topicMap,
+		replicators: f.replicators,
+		raft:        f.raft,
+		serf:        f.serf,
+	}
+	resp := b.handleFetch(context.Background(), nil, &protocol.FetchRequest{
+		APIVersion: 5,
+		ReplicaID:  -1,
+		MinBytes:   1,
+		Topics: []*protocol.FetchTopic{{
+			Topic:      "the-topic",
+			Partitions: []*protocol.FetchPartition{{Partition: 0, FetchOffset: 0, MaxBytes: 1024}},
+		}},
+	})
+	p := resp.Responses[0].PartitionResponses[0]
+	if p.ErrorCode != protocol.ErrNotLeaderForPartition.Code() {
+		t.Errorf("ErrorCode = %v, want %v", p.ErrorCode, protocol.ErrNotLeaderForPartition.Code())
+	}
+	if p.RecordSet != nil || p.RecordSetReader != nil {
+		t.Errorf("RecordSet = %v, RecordSetReader = %v, want the follower's data not served", p.RecordSet, p.RecordSetReader)
+	}
+	if clog.NewReaderInvoked {
+		t.Error("NewReader() invoked, want the follower's log not read")
+	}
+}
+
+func TestBroker_maybeIncrementHighWatermark(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jocko-hw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	clog, err := commitlog.New(commitlog.Options{Path: dir, MaxSegmentBytes: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := newFields()
+	f.topicMap["the-topic"] = []*jocko.Partition{{
+		Topic:     "the-topic",
+		ID:        0,
+		Leader:    f.id,
+		Replicas:  []int32{f.id, 2, 3},
+		ISR:       []int32{f.id, 2, 3},
+		CommitLog: clog,
+	}}
+	partition := f.topicMap["the-topic"][0]
+	b := &Broker{
+		logger:      f.logger,
+		id:          f.id,
+		topicMap:    f.topicMap,
+		replicators: f.replicators,
+		raft:        f.raft,
+		serf:        f.serf,
+	}
+	for i := 0; i < 3; i++ {
+		resp := b.handleProduce(nil, "", &protocol.ProduceRequest{
+			Acks: 1,
+			TopicData: []*protocol.TopicData{{
+				Topic: "the-topic",
+				Data:  []*protocol.Data{{Partition: 0, RecordSet: newMessageSet(t, "hello")}},
+			}},
+		}, nil)
+		if code := resp.Responses[0].PartitionResponses[0].ErrorCode; code != protocol.ErrNone.Code() {
+			t.Fatalf("produce ErrorCode = %v, want %v", code, protocol.ErrNone.Code())
+		}
+	}
+	if got := partition.HighWatermark(); got != 0 {
+		t.Fatalf("HighWatermark() = %v before the followers fetched, want 0", got)
+	}
+	fetch := func(replica int32, offset int64) {
+		b.handleFetch(context.Background(), nil, &protocol.FetchRequest{
+			APIVersion: 5,
+			ReplicaID:  replica,
+			Topics: []*protocol.FetchTopic{{
+				Topic:      "the-topic",
+				Partitions: []*protocol.FetchPartition{{Partition: 0, FetchOffset: offset, MaxBytes: 1024}},
+			}},
+		})
+	}
+	tests := []struct {
+		name    string
+		replica int32
+		offset  int64
+		wantHW  int64
+	}{
+		{name: "fast follower caught up", replica: 2, offset: 3, wantHW: 0},
+		{name: "slow follower behind", replica: 3, offset: 1, wantHW: 1},
+		{name: "slow follower further", replica: 3, offset: 2, wantHW: 2},
+		{name: "slow follower caught up", replica: 3, offset: 3, wantHW: 3},
+		// a follower refetching doesn't move the high watermark back.
+		{name: "follower refetching", replica: 2, offset: 1, wantHW: 3},
+	}
+	for _, tt := range tests {
+		fetch(tt.replica, tt.offset)
+		if got := partition.HighWatermark(); got != tt.wantHW {
+			t.Fatalf("%s: HighWatermark() = %v, want %v", tt.name, got, tt.wantHW)
+		}
+	}
+}
+
+func TestBroker_maybeIncrementHighWatermark_isrChanging(t *testing.T) {
+	f := newFields()
+	partition := &jocko.Partition{
+		Topic:     "the-topic",
+		ID:        0,
+		Leader:    f.id,
+		Replicas:  []int32{f.id, 2},
+		ISR:       []int32{f.id, 2},
+		CommitLog: &mock.CommitLog{NewestOffsetFn: func() int64 { return 3 }},
+	}
+	b := &Broker{id: f.id}
+	b.replicaOffsets.set(topicPartition{Topic: "the-topic", Partition: 0}, 2, 3)
+	// the ISR's read from a snapshot while the controller changes it, run with -race.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			partition.SetISR([]int32{f.id})
+			partition.SetISR([]int32{f.id, 2})
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		b.maybeIncrementHighWatermark(partition)
+	}
+	<-done
+	if got := partition.HighWatermark(); got != 3 {
+		t.Fatalf("HighWatermark() = %v, want 3", got)
+	}
+}
+
+func TestBroker_handleFetch_logEndOffset(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jocko-fetch-leo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	clog, err := commitlog.New(commitlog.Options{Path: dir, MaxSegmentBytes: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := clog.Append(commitlog.NewMessageSet(0, commitlog.NewMessage([]byte("hello")))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f := newFields()
+	f.topicMap["the-topic"] = []*jocko.Partition{{
+		Topic:     "the-topic",
+		ID:        0,
+		Leader:    f.id,
+		Replicas:  []int32{f.id},
+		ISR:       []int32{f.id},
+		CommitLog: clog,
+	}}
+	b := &Broker{
+		logger:      f.logger,
+		id:          f.id,
+		topicMap:    f.topicMap,
+		replicators: f.replicators,
+		raft:        f.raft,
+		serf:        f.serf,
+	}
+	fetch := func(offset int64, maxWaitTime int32) *protocol.FetchPartitionResponse {
+		resp := b.handleFetch(context.Background(), nil, &protocol.FetchRequest{
+			APIVersion:  5,
+			ReplicaID:   -1,
+			MinBytes:    1,
+			MaxWaitTime: maxWaitTime,
+			Topics: []*protocol.FetchTopic{{
+				Topic:      "the-topic",
+				Partitions: []*protocol.FetchPartition{{Partition: 0, FetchOffset: offset, MaxBytes: 1024}},
+			}},
+		})
+		return resp.Responses[0].PartitionResponses[0]
+	}
+
+	t.Run("at log end offset", func(t *testing.T) {
+		p := fetch(3, 0)
+		if p.ErrorCode != protocol.ErrNone.Code() {
+			t.Fatalf("ErrorCode = %v, want %v", p.ErrorCode, protocol.ErrNone.Code())
+		}
+		if len(p.RecordSet) != 0 || p.RecordSetReader != nil {
+			t.Errorf("RecordSet = %v, RecordSetReader = %v, want an empty record set", p.RecordSet, p.RecordSetReader)
+		}
+		if p.HighWatermark != 3 {
+			t.Errorf("HighWatermark = %v, want 3", p.HighWatermark)
+		}
+	})
+
+	t.Run("at log end offset waits", func(t *testing.T) {
+		start := time.Now()
+		p := fetch(3, 50)
+		if p.ErrorCode != protocol.ErrNone.Code() {
+			t.Fatalf("ErrorCode = %v, want %v", p.ErrorCode, protocol.ErrNone.Code())
+		}
+		if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+			t.Errorf("fetch returned after %v, want it to wait for records for the max wait time", elapsed)
+		}
+	})
+
+	t.Run("beyond log end offset", func(t *testing.T) {
+		p := fetch(4, 0)
+		if p.ErrorCode != protocol.ErrOffsetOutOfRange.Code() {
+			t.Fatalf("ErrorCode = %v, want %v", p.ErrorCode, protocol.ErrOffsetOutOfRange.Code())
+		}
+		if len(p.RecordSet) != 0 || p.RecordSetReader != nil {
+			t.Errorf("RecordSet = %v, RecordSetReader = %v, want no records", p.RecordSet, p.RecordSetReader)
+		}
+		if p.HighWatermark != 3 || p.LogStartOffset != 0 {
+			t.Errorf("HighWatermark = %v, LogStartOffset = %v, want 3, 0", p.HighWatermark, p.LogStartOffset)
+		}
+	})
+}
+
+func TestBroker_handleFetch_currentLeaderEpoch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jocko-fetch-epoch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	clog, err := commitlog.New(commitlog.Options{Path: dir, MaxSegmentBytes: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := clog.Append(commitlog.NewMessageSet(0, commitlog.NewMessage([]byte("hello")))); err != nil {
+		t.Fatal(err)
+	}
+	f := newFields()
+	f.topicMap["the-topic"] = []*jocko.Partition{{
+		Topic:       "the-topic",
+		ID:          0,
+		Leader:      f.id,
+		LeaderEpoch: 5,
+		Replicas:    []int32{f.id},
+		ISR:         []int32{f.id},
+		CommitLog:   clog,
+	}}
+	b := &Broker{
+		logger:      f.logger,
+		id:          f.id,
+		topicMap:    f.topicMap,
+		replicators: f.replicators,
+		raft:        f.raft,
+		serf:        f.serf,
+	}
+	tests := []struct {
+		name       string
+		apiVersion int16
+		epoch      int32
+		want       protocol.Error
+	}{
+		{name: "older epoch", apiVersion: 9, epoch: 4, want: protocol.ErrFencedLeaderEpoch},
+		{name: "newer epoch", apiVersion: 9, epoch: 6, want: protocol.ErrUnknownLeaderEpoch},
+		{name: "matching epoch", apiVersion: 9, epoch: 5, want: protocol.ErrNone},
+		{name: "unknown to fetcher", apiVersion: 9, epoch: -1, want: protocol.ErrNone},
+		{name: "before v9", apiVersion: 5, epoch: 4, want: protocol.ErrNone},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := b.handleFetch(context.Background(), nil, &protocol.FetchRequest{
+				APIVersion:   tt.apiVersion,
+				ReplicaID:    -1,
+				MinBytes:     1,
+				SessionEpoch: -1,
+				Topics: []*protocol.FetchTopic{{
+					Topic: "the-topic",
+					Partitions: []*protocol.FetchPartition{{
+						Partition:          0,
+						CurrentLeaderEpoch: tt.epoch,
+						FetchOffset:        0,
+						MaxBytes:           1024,
+					}},
+				}},
+			})
+			p := resp.Responses[0].PartitionResponses[0]
+			if p.ErrorCode != tt.want.Code() {
+				t.Fatalf("ErrorCode = %v, want %v", p.ErrorCode, tt.want.Code())
+			}
+			served := p.RecordSet != nil || p.RecordSetReader != nil
+			if served != (tt.want == protocol.ErrNone) {
+				t.Errorf("served records = %v, want %v", served, tt.want == protocol.ErrNone)
+			}
+		})
+	}
+
+	t.Run("incremental fetch session", func(t *testing.T) {
+		resp := b.handleFetch(context.Background(), nil, &protocol.FetchRequest{
+			APIVersion:   9,
+			ReplicaID:    -1,
+			SessionID:    7,
+			SessionEpoch: 1,
+		})
+		if resp.ErrorCode != protocol.ErrFetchSessionIDNotFound.Code() {
+			t.Errorf("ErrorCode = %v, want %v", resp.ErrorCode, protocol.ErrFetchSessionIDNotFound.Code())
+		}
+		if resp.SessionID != 0 {
+			t.Errorf("SessionID = %v, want 0, no session", resp.SessionID)
+		}
+	})
+}
+
+func TestBroker_handleFetch_streamsRecordSet(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jocko-fetch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	clog, err := commitlog.New(commitlog.Options{Path: dir, MaxSegmentBytes: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var appended []byte
+	for i := 0; i < 3; i++ {
+		ms := commitlog.NewMessageSet(0, commitlog.NewMessage([]byte("hello")))
+		if _, err := clog.Append(ms); err != nil {
+			t.Fatal(err)
+		}
+		appended = append(appended, ms...)
+	}
+	f := newFields()
+	f.topicMap["the-topic"] = []*jocko.Partition{{
+		Topic:     "the-topic",
+		ID:        0,
+		Leader:    f.id,
+		Replicas:  []int32{f.id},
+		CommitLog: clog,
+	}}
+	b := &Broker{
+		logger:      f.logger,
+		id:          f.id,
+		topicMap:    f.topicMap,
+		replicators: f.replicators,
+		raft:        f.raft,
+		serf:        f.serf,
+	}
+	resp := b.handleFetch(context.Background(), nil, &protocol.FetchRequest{
+		APIVersion: 5,
+		MinBytes:   1,
+		Topics: []*protocol.FetchTopic{{
+			Topic:      "the-topic",
+			Partitions: []*protocol.FetchPartition{{Partition: 0, FetchOffset: 0, MaxBytes: 1024}},
+		}},
+	})
+	p := resp.Responses[0].PartitionResponses[0]
+	if p.RecordSet != nil || p.RecordSetReader == nil {
+		t.Fatalf("RecordSet = %v, RecordSetReader = %v, want the record set streamed", p.RecordSet, p.RecordSetReader)
+	}
+	if p.RecordSetSize != int32(len(appended)) {
+		t.Fatalf("RecordSetSize = %v, want %v", p.RecordSetSize, len(appended))
+	}
+	// appends after the fetch's handled aren't written, the response's size is already set.
+	if _, err := clog.Append(commitlog.NewMessageSet(0, commitlog.NewMessage([]byte("hello")))); err != nil {
+		t.Fatal(err)
+	}
+	buf := new(bytes.Buffer)
+	if _, err := protocol.EncodeTo(buf, resp); err != nil {
+		t.Fatalf("EncodeTo() error = %v", err)
+	}
+	got := &protocol.FetchResponses{APIVersion: 5}
+	if err := protocol.Decode(buf.Bytes(), got); err != nil {
+		t.Fatalf("Decode() error = %v", err)
+	}
+	if rs := got.Responses[0].PartitionResponses[0].RecordSet; !bytes.Equal(rs, appended) {
+		t.Errorf("RecordSet = %v, want %v", rs, []byte(appended))
+	}
+}
+
+func TestBroker_handleFetch_partitions(t *testing.T) {
+	b, appended, req := newMultiPartitionFetch(t, 4)
+	defer os.RemoveAll(b.logDir)
+	// the partitions are requested out of the order they're read in.
+	for _, topic := range req.Topics {
+		for i, j := 0, len(topic.Partitions)-1; i < j; i, j = i+1, j-1 {
+			topic.Partitions[i], topic.Partitions[j] = topic.Partitions[j], topic.Partitions[i]
+		}
+	}
+	req.Topics[0], req.Topics[1] = req.Topics[1], req.Topics[0]
+
+	resp := b.handleFetch(context.Background(), nil, req)
+	buf := new(bytes.Buffer)
+	if _, err := protocol.EncodeTo(buf, resp); err != nil {
+		t.Fatalf("EncodeTo() error = %v", err)
+	}
+	got := &protocol.FetchResponses{APIVersion: req.APIVersion}
+	if err := protocol.Decode(buf.Bytes(), got); err != nil {
+		t.Fatalf("Decode() error = %v", err)
+	}
+	for i, topic := range req.Topics {
+		if got.Responses[i].Topic != topic.Topic {
+			t.Fatalf("topic = %v, want %v", got.Responses[i].Topic, topic.Topic)
+		}
+		for j, p := range topic.Partitions {
+			pr := got.Responses[i].PartitionResponses[j]
+			if pr.Partition != p.Partition || pr.ErrorCode != protocol.ErrNone.Code() {
+				t.Fatalf("partition = %v, error code = %v, want %v, %v", pr.Partition, pr.ErrorCode, p.Partition, protocol.ErrNone.Code())
+			}
+			want := appended[fmt.Sprintf("%s/%d", topic.Topic, p.Partition)]
+			if !bytes.Equal(pr.RecordSet, want) {
+				t.Errorf("%s/%d record set = %v, want %v", topic.Topic, p.Partition, pr.RecordSet, want)
+			}
+		}
+	}
+}
+
+func BenchmarkBroker_handleFetch_partitions(b *testing.B) {
+	broker, _, req := newMultiPartitionFetch(b, 16)
+	defer os.RemoveAll(broker.logDir)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		resp := broker.handleFetch(context.Background(), nil, req)
+		if _, err := protocol.EncodeTo(ioutil.Discard, resp); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// newMultiPartitionFetch returns a broker leading two topics with the given number of partitions
+// each, the record sets appended to each partition by its name, and a fetch of all of them.
+func newMultiPartitionFetch(t testing.TB, partitions int32) (*Broker, map[string][]byte, *protocol.FetchRequest) {
+	dir, err := ioutil.TempDir("", "jocko-fetch-partitions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := newFields()
+	appended := make(map[string][]byte)
+	req := &protocol.FetchRequest{APIVersion: 5, MinBytes: 1}
+	for _, topic := range []string{"topic-a", "topic-b"} {
+		ft := &protocol.FetchTopic{Topic: topic}
+		for id := int32(0); id < partitions; id++ {
+			p := &jocko.Partition{Topic: topic, ID: id, Leader: f.id, Replicas: []int32{f.id}}
+			p.CommitLog, err = commitlog.New(commitlog.Options{Path: filepath.Join(dir, p.String()), MaxSegmentBytes: 1 << 20, MaxLogBytes: -1})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 10; i++ {
+				ms := commitlog.NewMessageSet(0, commitlog.NewMessage([]byte(fmt.Sprintf("%s-%d", p, i))))
+				if _, err := p.CommitLog.Append(ms); err != nil {
+					t.Fatal(err)
+				}
+				appended[p.String()] = append(appended[p.String()], ms...)
+			}
+			f.topicMap[topic] = append(f.topicMap[topic], p)
+			ft.Partitions = append(ft.Partitions, &protocol.FetchPartition{Partition: id, MaxBytes: 1 << 20})
+		}
+		req.Topics = append(req.Topics, ft)
+	}
+	b := &Broker{
+		logger:      f.logger,
+		id:          f.id,
+		logDir:      dir,
+		topicMap:    f.topicMap,
+		replicators: f.replicators,
+		raft:        f.raft,
+		serf:        f.serf,
+	}
+	return b, appended, req
+}
+
+func TestBroker_handleFetch_logStartOffset(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jocko-fetch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// each message set fills a segment, so truncating deletes whole message sets.
+	clog, err := commitlog.New(commitlog.Options{Path: dir, MaxSegmentBytes: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		ms, err := protocol.Encode(&protocol.MessageSet{
+			Messages: []*protocol.Message{{Value: []byte("hello")}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := clog.Append(ms); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := clog.Truncate(2); err != nil {
+		t.Fatal(err)
+	}
+
+	f := newFields()
+	f.topicMap["the-topic"] = []*jocko.Partition{{
+		Topic:     "the-topic",
+		ID:        0,
+		Leader:    f.id,
+		Replicas:  []int32{f.id},
+		CommitLog: clog,
+	}}
+	b := &Broker{
+		logger:      f.logger,
+		id:          f.id,
+		topicMap:    f.topicMap,
+		replicators: f.replicators,
+		brokerAddr:  f.brokerAddr,
+		logDir:      f.logDir,
+		raft:        f.raft,
+		serf:        f.serf,
+		shutdownCh:  f.shutdownCh,
+		shutdown:    f.shutdown,
+	}
+	tests := []struct {
+		name        string
+		fetchOffset int64
+		wantCode    int16
+	}{
+		{name: "truncated offset", fetchOffset: 0, wantCode: protocol.ErrOffsetOutOfRange.Code()},
+		{name: "log start offset", fetchOffset: 2, wantCode: protocol.ErrNone.Code()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := b.handleFetch(context.Background(), nil, &protocol.FetchRequest{
+				APIVersion: 5,
+				MinBytes:   1,
+				Topics: []*protocol.FetchTopic{{
+					Topic:      "the-topic",
+					Partitions: []*protocol.FetchPartition{{Partition: 0, FetchOffset: tt.fetchOffset, MaxBytes: 1024}},
+				}},
+			})
+			if resp.APIVersion != 5 {
+				t.Errorf("FetchResponses.APIVersion = %v, want %v", resp.APIVersion, 5)
+			}
+			p := resp.Responses[0].PartitionResponses[0]
+			if p.ErrorCode != tt.wantCode {
+				t.Errorf("error code = %v, want %v", p.ErrorCode, tt.wantCode)
+			}
+			if p.LogStartOffset != 2 {
+				t.Errorf("log start offset = %v, want %v", p.LogStartOffset, 2)
+			}
+		})
+	}
+}
+
+func TestBroker_highWatermarkCheckpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jocko-hw-checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	newBroker := func() *Broker {
+		f := newFields()
+		f.serf.MemberFn = func(id int32) *jocko.ClusterMember {
+			return &jocko.ClusterMember{ID: id}
+		}
+		return &Broker{
+			logger:               f.logger,
+			id:                   f.id,
+			topicMap:             make(map[string][]*jocko.Partition),
+			replicators:          f.replicators,
+			brokerAddr:           f.brokerAddr,
+			logDir:               dir,
+			raft:                 f.raft,
+			serf:                 f.serf,
+			shutdownCh:           f.shutdownCh,
+			checkpointInterval:   time.Hour,
+		}
+	}
+	newPartition := func() *jocko.Partition {
+		return &jocko.Partition{Topic: "the-topic", ID: 0, Leader: 1, Replicas: []int32{1}}
+	}
+
+	b := newBroker()
+	p := newPartition()
+	if err := b.startReplica(p); err != protocol.ErrNone {
+		t.Fatalf("startReplica() error = %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		ms, err := protocol.Encode(&protocol.MessageSet{
+			Messages: []*protocol.Message{{Value: []byte("hello")}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := p.Append(ms); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p.SetHighWatermark(2)
+	if err := p.DeleteRecords(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.CommitLog.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.writeCheckpoints(); err != nil {
+		t.Fatalf("writeCheckpoints() error = %v", err)
+	}
+	_, recoveryPoint, logStartOffset, err := newBroker().checkpointedOffsets(p)
+	if err != nil || recoveryPoint != 3 {
+		t.Errorf("checkpointedOffsets() recovery point = %v, %v, want %v", recoveryPoint, err, 3)
+	}
+	if logStartOffset != 1 {
+		t.Errorf("checkpointedOffsets() log start offset = %v, want %v", logStartOffset, 1)
+	}
+
+	tests := []struct {
+		name       string
+		checkpoint int64
+		want       int64
+	}{
+		{name: "restored", checkpoint: 2, want: 2},
+		{name: "clamped to log end offset", checkpoint: 10, want: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tp := topicPartition{Topic: "the-topic", Partition: 0}
+			if tt.checkpoint != 2 {
+				if err := writeCheckpoint(b.checkpointPath(hwCheckpointFile), map[topicPartition]int64{tp: tt.checkpoint}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// restart the partition on a new broker using the same log dir.
+			p := newPartition()
+			if err := newBroker().startReplica(p); err != protocol.ErrNone {
+				t.Fatalf("startReplica() error = %v", err)
+			}
+			if got := p.HighWatermark(); got != tt.want {
+				t.Errorf("HighWatermark() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBroker_Run_produceAcksZero(t *testing.T) {
+	f := newFields()
+	var appended []byte
+	f.topicMap["the-topic"] = []*jocko.Partition{{
+		Topic:    "the-topic",
+		ID:       0,
+		Leader:   f.id,
+		Replicas: []int32{f.id},
+		CommitLog: &mock.CommitLog{
+			AppendFn: func(b []byte) (int64, error) {
+				appended = b
+				return 0, nil
+			},
+		},
+	}}
+	b := &Broker{
+		logger:      f.logger,
+		id:          f.id,
+		topicMap:    f.topicMap,
+		replicators: f.replicators,
+		brokerAddr:  f.brokerAddr,
+		logDir:      f.logDir,
+		raft:        f.raft,
+		serf:        f.serf,
+		shutdownCh:  f.shutdownCh,
+		shutdown:    f.shutdown,
+	}
+	requestc := make(chan jocko.Request, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go b.Run(ctx, requestc, nil)
+
+	responsec := make(chan jocko.Response, 1)
+	requestc <- jocko.Request{
+		Header: &protocol.RequestHeader{APIKey: protocol.ProduceKey, CorrelationID: 1},
+		Request: &protocol.ProduceRequest{
+			Acks: 0,
+			TopicData: []*protocol.TopicData{{
+				Topic: "the-topic",
+				Data:  []*protocol.Data{{Partition: 0, RecordSet: []byte("hello")}},
+			}},
+		},
+		Response: responsec,
+	}
+	// the connection's told the request's handled, but has nothing to write.
+	if resp := <-responsec; resp.Response != nil {
+		t.Errorf("Response = %v, want nil", resp.Response)
+	}
+	if string(appended) != "hello" {
+		t.Errorf("appended %q, want %q", appended, "hello")
+	}
+
+	// the next request on the connection is responded to as usual.
+	requestc <- jocko.Request{
+		Header:   &protocol.RequestHeader{APIKey: protocol.APIVersionsKey, CorrelationID: 2},
+		Request:  &protocol.APIVersionsRequest{},
+		Response: responsec,
+	}
+	resp, ok := (<-responsec).Response.(*protocol.Response)
+	if !ok || resp.CorrelationID != 2 {
+		t.Errorf("Response = %v, want correlation id 2", resp)
+	}
+}
+
+func TestBroker_Run_recoversPanics(t *testing.T) {
+	f := newFields()
+	f.topicMap["the-topic"] = []*jocko.Partition{{
+		Topic:    "the-topic",
+		ID:       0,
+		Leader:   f.id,
+		Replicas: []int32{f.id},
+		CommitLog: &mock.CommitLog{
+			AppendFn: func(b []byte) (int64, error) {
+				panic("append blew up")
+			},
+		},
+	}}
+	b := &Broker{
+		logger:      simplelog.New(ioutil.Discard, simplelog.DEBUG, "jocko/brokertest"),
+		id:          f.id,
+		topicMap:    f.topicMap,
+		replicators: f.replicators,
+		brokerAddr:  f.brokerAddr,
+		logDir:      f.logDir,
+		raft:        f.raft,
+		serf:        f.serf,
+		shutdownCh:  f.shutdownCh,
+		shutdown:    f.shutdown,
+	}
+	requestc := make(chan jocko.Request, 1)
+	responsec := make(chan jocko.Response, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go b.Run(ctx, requestc, responsec)
+
+	requestc <- jocko.Request{
+		Header: &protocol.RequestHeader{APIKey: protocol.ProduceKey, CorrelationID: 1},
+		Request: &protocol.ProduceRequest{
+			Acks: 1,
+			TopicData: []*protocol.TopicData{{
+				Topic: "the-topic",
+				Data:  []*protocol.Data{{Partition: 0, RecordSet: []byte("hello")}},
+			}},
+		},
+	}
+	resp := (<-responsec).Response.(*protocol.Response)
+	if resp.CorrelationID != 1 {
+		t.Errorf("CorrelationID = %v, want %v", resp.CorrelationID, 1)
+	}
+	produceResp := resp.Body.(*protocol.ProduceResponses)
+	if code := produceResp.Responses[0].PartitionResponses[0].ErrorCode; code != protocol.ErrUnknown.Code() {
+		t.Errorf("error code = %v, want %v", code, protocol.ErrUnknown.Code())
+	}
+
+	// the broker should keep handling requests.
+	requestc <- jocko.Request{
+		Header:  &protocol.RequestHeader{APIKey: protocol.APIVersionsKey, CorrelationID: 2},
+		Request: &protocol.APIVersionsRequest{},
+	}
+	resp = (<-responsec).Response.(*protocol.Response)
+	if resp.CorrelationID != 2 {
+		t.Errorf("CorrelationID = %v, want %v", resp.CorrelationID, 2)
+	}
+	if _, ok := resp.Body.(*protocol.APIVersionsResponse); !ok {
+		t.Errorf("Body = %T, want %T", resp.Body, &protocol.APIVersionsResponse{})
+	}
+}
+
+func TestBroker_Run_requestHandlerPool(t *testing.T) {
+	const (
+		threads  = 3
+		requests = 30
+	)
+	var inFlight, maxInFlight int32
+	f := newFields()
+	var partitions []*jocko.Partition
+	for i := int32(0); i < requests; i++ {
+		offset := int64(i)
+		partitions = append(partitions, &jocko.Partition{
+			Topic:  "the-topic",
+			ID:     i,
+			Leader: f.id,
+			CommitLog: &mock.CommitLog{
+				AppendFn: func(b []byte) (int64, error) {
+					n := atomic.AddInt32(&inFlight, 1)
+					defer atomic.AddInt32(&inFlight, -1)
+					for {
+						max := atomic.LoadInt32(&maxInFlight)
+						if n <= max || atomic.CompareAndSwapInt32(&maxInFlight, max, n) {
+							break
+						}
+					}
+					time.Sleep(10 * time.Millisecond)
+					return offset, nil
+				},
+			},
+		})
+	}
+	f.topicMap["the-topic"] = partitions
+	b := &Broker{
+		logger:                f.logger,
+		id:                    f.id,
+		topicMap:              f.topicMap,
+		replicators:           f.replicators,
+		brokerAddr:            f.brokerAddr,
+		logDir:                f.logDir,
+		raft:                  f.raft,
+		serf:                  f.serf,
+		shutdownCh:            f.shutdownCh,
+		requestHandlerThreads: threads,
+	}
+	requestc := make(chan jocko.Request)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go b.Run(ctx, requestc, nil)
+
+	var wg sync.WaitGroup
+	for i := int32(0); i < requests; i++ {
+		wg.Add(1)
+		go func(i int32) {
+			defer wg.Done()
+			responsec := make(chan jocko.Response, 1)
+			requestc <- jocko.Request{
+				Header: &protocol.RequestHeader{APIKey: protocol.ProduceKey, CorrelationID: i},
+				Request: &protocol.ProduceRequest{
+					Acks: 1,
+					TopicData: []*protocol.TopicData{{
+						Topic: "the-topic",
+						Data:  []*protocol.Data{{Partition: i, RecordSet: []byte("hello")}},
+					}},
+				},
+				Response: responsec,
+			}
+			resp := (<-responsec).Response.(*protocol.Response)
+			if resp.CorrelationID != i {
+				t.Errorf("CorrelationID = %v, want %v", resp.CorrelationID, i)
+			}
+			pr := resp.Body.(*protocol.ProduceResponses).Responses[0].PartitionResponses[0]
+			if pr.Partition != i || pr.BaseOffset != int64(i) {
+				t.Errorf("response for partition %d, offset %d, want partition %d, offset %d", pr.Partition, pr.BaseOffset, i, i)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if max := atomic.LoadInt32(&maxInFlight); max > threads {
+		t.Errorf("handled %d requests at once, want at most %d", max, threads)
+	}
+}
+
+func TestBroker_rebalanceLeaders(t *testing.T) {
+	tests := []struct {
+		name     string
+		leader   int32
+		wantElec bool
+	}{
+		{name: "imbalanced", leader: 2, wantElec: true},
+		{name: "balanced", leader: 1, wantElec: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			elected := make(chan *jocko.Partition, 1)
+			f := newFields()
+			f.raft.IsLeaderFn = func() bool {
+				return true
+			}
+			f.raft.ApplyFn = func(c jocko.RaftCommand) error {
+				if c.Cmd != electLeader {
+					t.Errorf("Apply() cmd = %v, want %v", c.Cmd, electLeader)
+				}
+				p := new(jocko.Partition)
+				if err := unmarshalData(c.Data, p); err != nil {
+					t.Error(err)
+				}
+				select {
+				case elected <- p:
+				default:
+				}
+				return nil
+			}
+			f.serf.MemberFn = func(id int32) *jocko.ClusterMember {
+				return &jocko.ClusterMember{ID: id}
+			}
+			f.topicMap["the-topic"] = []*jocko.Partition{
+				{Topic: "the-topic", ID: 0, PreferredLeader: 1, Leader: tt.leader, Replicas: []int32{1, 2}, ISR: []int32{1, 2}},
+				{Topic: "the-topic", ID: 1, PreferredLeader: 2, Leader: 2, Replicas: []int32{2, 1}, ISR: []int32{2, 1}},
+			}
+			b := &Broker{
+				logger:                       f.logger,
+				id:                           f.id,
+				topicMap:                     f.topicMap,
+				replicators:                  f.replicators,
+				brokerAddr:                   f.brokerAddr,
+				logDir:                       f.logDir,
+				raft:                         f.raft,
+				serf:                         f.serf,
+				shutdownCh:                   make(chan struct{}),
+				leaderImbalanceCheckInterval: 10 * time.Millisecond,
+				leaderImbalancePercentage:    defaultLeaderImbalancePercentage,
+			}
+			go b.rebalanceLeaders()
+			defer close(b.shutdownCh)
+
+			select {
+			case p := <-elected:
+				if !tt.wantElec {
+					t.Fatalf("elected leader %d of partition %s, want no election", p.Leader, p)
+				}
+				if p.Topic != "the-topic" || p.ID != 0 || p.Leader != 1 {
+					t.Errorf("elected leader %d of partition %s, want leader 1 of the-topic/0", p.Leader, p)
+				}
+			case <-time.After(100 * time.Millisecond):
+				if tt.wantElec {
+					t.Fatal("no leader elected, want an election")
+				}
+			}
+		})
+	}
+}
+
+func TestBroker_electLeader(t *testing.T) {
+	f := newFields()
+	f.serf.MemberFn = func(id int32) *jocko.ClusterMember {
+		return &jocko.ClusterMember{ID: id}
+	}
+	// this broker, 1, isn't a replica of the partition so it only updates its leader.
+	f.topicMap["the-topic"] = []*jocko.Partition{
+		{Topic: "the-topic", ID: 0, PreferredLeader: 2, Leader: 3, Replicas: []int32{2, 3}, ISR: []int32{2, 3}},
+	}
+	b := &Broker{
+		logger:      f.logger,
+		id:          f.id,
+		topicMap:    f.topicMap,
+		replicators: f.replicators,
+		raft:        f.raft,
+		serf:        f.serf,
+	}
+	if err := b.electLeader(&jocko.Partition{Topic: "the-topic", ID: 0, Leader: 2}); err != protocol.ErrNone {
+		t.Fatalf("electLeader() error = %v", err)
+	}
+	if got := f.topicMap["the-topic"][0].Leader; got != 2 {
+		t.Errorf("Leader = %v, want %v", got, 2)
+	}
+	if got := f.topicMap["the-topic"][0].LeaderEpoch; got != 1 {
+		t.Errorf("LeaderEpoch = %v, want %v", got, 1)
+	}
+	if err := b.electLeader(&jocko.Partition{Topic: "unknown-topic", ID: 0, Leader: 2}); err != protocol.ErrUnknownTopicOrPartition {
+		t.Errorf("electLeader() error = %v, want %v", err, protocol.ErrUnknownTopicOrPartition)
+	}
+}
+
+func TestBroker_electLeader_leaderEpochCache(t *testing.T) {
+	f := newFields()
+	f.serf.MemberFn = func(id int32) *jocko.ClusterMember {
+		return nil
+	}
+	var leo int64 = 5
+	clog := &mock.CommitLog{
+		NewestOffsetFn: func() int64 {
+			return leo
+		},
+		TruncateFn: func(int64) error {
+			return nil
+		},
+	}
+	p := &jocko.Partition{Topic: "the-topic", ID: 0, PreferredLeader: 1, Leader: 2, Replicas: []int32{1, 2}, ISR: []int32{1, 2}, CommitLog: clog}
+	f.topicMap["the-topic"] = []*jocko.Partition{p}
+	b := &Broker{
+		logger:      f.logger,
+		id:          f.id,
+		topicMap:    f.topicMap,
+		replicators: f.replicators,
+		raft:        f.raft,
+		serf:        f.serf,
+	}
+	// lead, follow 2 and lead again, after the log's grown.
+	for _, leader := range []int32{1, 2, 1} {
+		if err := b.electLeader(&jocko.Partition{Topic: "the-topic", ID: 0, Leader: leader}); err != protocol.ErrNone {
+			t.Fatalf("electLeader(%d) error = %v", leader, err)
+		}
+		leo += 3
+	}
+	want := []jocko.EpochEntry{{Epoch: 1, StartOffset: 5}, {Epoch: 3, StartOffset: 11}}
+	if !reflect.DeepEqual(p.LeaderEpochs, want) {
+		t.Fatalf("LeaderEpochs = %v, want %v", p.LeaderEpochs, want)
+	}
+	for i := 1; i < len(p.LeaderEpochs); i++ {
+		if p.LeaderEpochs[i].Epoch <= p.LeaderEpochs[i-1].Epoch {
+			t.Errorf("LeaderEpochs = %v, want strictly increasing epochs", p.LeaderEpochs)
+		}
+	}
+	if p.LeaderEpoch != 3 {
+		t.Errorf("LeaderEpoch = %v, want %v", p.LeaderEpoch, 3)
+	}
+}
+
+func TestBroker_internalTopics(t *testing.T) {
+	var controller int32
+	created := make(chan *jocko.Partition, 8)
+	f := newFields()
+	f.raft.IsLeaderFn = func() bool {
+		return atomic.LoadInt32(&controller) == 1
+	}
+	f.serf.ClusterFn = func() []*jocko.ClusterMember {
+		return []*jocko.ClusterMember{{ID: 1}, {ID: 2}, {ID: 3}}
+	}
+	b := &Broker{
+		logger:      f.logger,
+		id:          f.id,
+		topicMap:    f.topicMap,
+		replicators: f.replicators,
+		brokerAddr:  f.brokerAddr,
+		logDir:      f.logDir,
+		raft:        f.raft,
+		serf:        f.serf,
+		shutdownCh:  make(chan struct{}),
+		internalTopics: []InternalTopic{
+			{Name: "__consumer_offsets", Partitions: 3, ReplicationFactor: 3},
+			{Name: "__transaction_state", Partitions: 2, ReplicationFactor: 1},
+		},
+	}
+	// apply the commands as the fsm would, without starting replicas.
+	f.raft.ApplyFn = func(c jocko.RaftCommand) error {
+		if c.Cmd != createPartition {
+			t.Errorf("Apply() cmd = %v, want %v", c.Cmd, createPartition)
+		}
+		p := new(jocko.Partition)
+		if err := unmarshalData(c.Data, p); err != nil {
+			t.Error(err)
+		}
+		b.Lock()
+		b.topicMap[p.Topic] = append(b.topicMap[p.Topic], p)
+		b.Unlock()
+		created <- p
+		return nil
+	}
+	go b.monitorInternalTopics()
+	defer close(b.shutdownCh)
+
+	select {
+	case p := <-created:
+		t.Fatalf("created partition %s before becoming controller", p)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	atomic.StoreInt32(&controller, 1)
+	partitions := make(map[string]int32)
+	for i := 0; i < 5; i++ {
+		select {
+		case p := <-created:
+			partitions[p.Topic]++
+		case <-time.After(5 * time.Second):
+			t.Fatalf("created partitions %v, want all internal topics' partitions", partitions)
+		}
+	}
+	want := map[string]int32{"__consumer_offsets": 3, "__transaction_state": 2}
+	if !reflect.DeepEqual(partitions, want) {
+		t.Errorf("created partitions = %v, want %v", partitions, want)
+	}
+
+	if err := b.ensureInternalTopics(); err != protocol.ErrNone {
+		t.Fatalf("ensureInternalTopics() error = %v", err)
+	}
+	select {
+	case p := <-created:
+		t.Errorf("created partition %s again, want existing topics left alone", p)
+	default:
+	}
+}
+
+// endlessLeader is a leader that always has another batchSize bytes to fetch.
+type endlessLeader struct {
+	batchSize int
+}
+
+func (l *endlessLeader) FetchMessages(clientID string, req *protocol.FetchRequest) (*protocol.FetchResponses, error) {
+	recordSet := make([]byte, l.batchSize)
+	protocol.Encoding.PutUint64(recordSet, uint64(req.Topics[0].Partitions[0].FetchOffset))
+	return &protocol.FetchResponses{
+		Responses: []*protocol.FetchResponse{{
+			Topic: req.Topics[0].Topic,
+			PartitionResponses: []*protocol.FetchPartitionResponse{{
+				Partition: req.Topics[0].Partitions[0].Partition,
+				RecordSet: recordSet,
+			}},
+		}},
+	}, nil
+}
+
+func (l *endlessLeader) CreateTopic(clientID string, req *protocol.CreateTopicRequest) (*protocol.CreateTopicsResponse, error) {
+	return nil, nil
+}
+
+func TestReplicator_throttle(t *testing.T) {
+	const rate = 10000
+	var appended int64
+	p := &jocko.Partition{
+		Topic:    "the-topic",
+		ID:       0,
+		Leader:   2,
+		Replicas: []int32{2, 1},
+		ISR:      []int32{2},
+		CommitLog: &mock.CommitLog{
+			AppendFn: func(b []byte) (int64, error) {
+				return atomic.AddInt64(&appended, int64(len(b))), nil
+			},
+			SyncFn: func() error {
+				return nil
+			},
+		},
+	}
+	start := time.Now()
+	r := NewReplicator(p, 1,
+		ReplicatorLeader(&endlessLeader{batchSize: 1000}),
+		replicatorThrottle(newReplicationThrottle(rate), nil))
+	time.Sleep(500 * time.Millisecond)
+	if err := r.Drain(); err != nil {
+		t.Fatalf("Drain() error = %v", err)
+	}
+	elapsed := time.Since(start)
+
+	got := atomic.LoadInt64(&appended)
+	if got == 0 {
+		t.Fatal("replicated no bytes, want some")
+	}
+	// the throttle allows a second's worth of bytes as a burst, plus a batch
+	// fetched before the throttle kicks in.
+	if max := int64(rate*elapsed.Seconds()) + rate + 1000; got > max {
+		t.Errorf("replicated %d bytes in %v, want at most %d", got, elapsed, max)
+	}
+}
+
+func TestReplicator_throttleOnlyThrottled(t *testing.T) {
+	const rate = 1000
+	var appended int64
+	p := &jocko.Partition{
+		Topic:    "the-topic",
+		ID:       0,
+		Leader:   2,
+		Replicas: []int32{2, 1},
+		ISR:      []int32{2},
+		CommitLog: &mock.CommitLog{
+			AppendFn: func(b []byte) (int64, error) {
+				return atomic.AddInt64(&appended, int64(len(b))), nil
+			},
+			SyncFn: func() error {
+				return nil
+			},
+		},
+	}
+	// the replica isn't configured as throttled, so the throttle doesn't limit it.
+	r := NewReplicator(p, 1,
+		ReplicatorLeader(&endlessLeader{batchSize: 1000}),
+		replicatorThrottle(newReplicationThrottle(rate), func() bool { return false }))
+	time.Sleep(500 * time.Millisecond)
+	if err := r.Drain(); err != nil {
+		t.Fatalf("Drain() error = %v", err)
+	}
+	if got, max := atomic.LoadInt64(&appended), int64(rate*2+1000); got <= max {
+		t.Errorf("replicated %d bytes, want more than the throttle's %d", got, max)
+	}
+}
+
+func TestBroker_handleFetch_leaderThrottle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jocko-fetch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	clog, err := commitlog.New(commitlog.Options{Path: dir, MaxSegmentBytes: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := clog.Append(commitlog.NewMessageSet(0, commitlog.NewMessage([]byte("hello")))); err != nil {
+		t.Fatal(err)
+	}
+	f := newFields()
+	f.topicMap["the-topic"] = []*jocko.Partition{{
+		Topic:     "the-topic",
+		ID:        0,
+		Leader:    f.id,
+		Replicas:  []int32{f.id, 2, 3},
+		ISR:       []int32{f.id, 2, 3},
+		CommitLog: clog,
+	}}
+	throttle := newReplicationThrottle(1)
+	throttle.record(10)
+	b := &Broker{
+		logger:         f.logger,
+		id:             f.id,
+		topicMap:       f.topicMap,
+		replicators:    f.replicators,
+		raft:           f.raft,
+		serf:           f.serf,
+		leaderThrottle: throttle,
+	}
+	b.setConfigs(&resourceConfigs{Type: protocol.ConfigResourceTopic, Name: "the-topic", Configs: map[string]string{
+		"leader.replication.throttled.replicas": "0:2",
+	}})
+	fetch := func(replica int32) *protocol.FetchPartitionResponse {
+		resp := b.handleFetch(context.Background(), nil, &protocol.FetchRequest{
+			APIVersion: 5,
+			ReplicaID:  replica,
+			Topics: []*protocol.FetchTopic{{
+				Topic:      "the-topic",
+				Partitions: []*protocol.FetchPartition{{Partition: 0, FetchOffset: 0, MaxBytes: 1024}},
+			}},
+		})
+		return resp.Responses[0].PartitionResponses[0]
+	}
+	// replica 2's listed and the throttle's exceeded, so it's sent nothing.
+	if p := fetch(2); p.RecordSetSize != 0 || len(p.RecordSet) != 0 {
+		t.Errorf("throttled replica's RecordSetSize = %v, RecordSet = %v, want empty", p.RecordSetSize, p.RecordSet)
+	}
+	// replica 3 isn't listed, so it isn't throttled.
+	if p := fetch(3); p.RecordSetSize == 0 && len(p.RecordSet) == 0 {
+		t.Error("unthrottled replica's record set is empty, want the appended records")
+	}
+}
+
+func TestBroker_handleFindCoordinator(t *testing.T) {
+	f := newFields()
+	f.serf.MemberFn = func(id int32) *jocko.ClusterMember {
+		return &jocko.ClusterMember{ID: id, IP: "localhost", Port: 9090 + int(id)}
+	}
+	var partitions []*jocko.Partition
+	for i := int32(0); i < 50; i++ {
+		partitions = append(partitions, &jocko.Partition{Topic: transactionStateTopic, ID: i, Leader: i%3 + 1})
+	}
+	f.topicMap[transactionStateTopic] = partitions
+	b := &Broker{
+		logger:                           f.logger,
+		id:                               f.id,
+		topicMap:                         f.topicMap,
+		replicators:                      f.replicators,
+		brokerAddr:                       f.brokerAddr,
+		logDir:                           f.logDir,
+		raft:                             f.raft,
+		serf:                             f.serf,
+		shutdownCh:                       f.shutdownCh,
+		transactionStateLogNumPartitions: 50,
+	}
+	tests := []struct {
+		name     string
+		req      *protocol.GroupCoordinatorRequest
+		wantErr  protocol.Error
+		wantNode int32
+	}{
+		{
+			// the ID's Java hash code is positive, it hashes to partition 45, led by 1.
+			name:     "transaction",
+			req:      &protocol.GroupCoordinatorRequest{APIVersion: 1, GroupID: "the-transactional-id", CoordinatorType: protocol.CoordinatorTransaction},
+			wantNode: 1,
+		},
+		{
+			// the ID's Java hash code is negative, it hashes to partition 5, led by 3.
+			name:     "transaction negative hash",
+			req:      &protocol.GroupCoordinatorRequest{APIVersion: 1, GroupID: "txn-42", CoordinatorType: protocol.CoordinatorTransaction},
+			wantNode: 3,
+		},
+		{
+			name:     "group",
+			req:      &protocol.GroupCoordinatorRequest{GroupID: "the-group"},
+			wantErr:  protocol.ErrCoordinatorNotAvailable,
+			wantNode: -1,
+		},
+		{
+			name:     "unknown type",
+			req:      &protocol.GroupCoordinatorRequest{APIVersion: 1, GroupID: "the-group", CoordinatorType: 2},
+			wantErr:  protocol.ErrInvalidRequest,
+			wantNode: -1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := b.handleFindCoordinator(&protocol.RequestHeader{APIKey: protocol.GroupCoordinatorKey, APIVersion: tt.req.APIVersion}, "", tt.req)
+			if resp.ErrorCode != tt.wantErr.Code() {
+				t.Fatalf("ErrorCode = %v, want %v", resp.ErrorCode, tt.wantErr.Code())
+			}
+			if resp.Coordinator.NodeID != tt.wantNode {
+				t.Errorf("NodeID = %v, want %v", resp.Coordinator.NodeID, tt.wantNode)
+			}
+			if tt.wantNode != -1 && resp.Coordinator.Port != int32(9090+tt.wantNode) {
+				t.Errorf("Port = %v, want %v", resp.Coordinator.Port, 9090+tt.wantNode)
+			}
+		})
+	}
+}
+
+func TestBroker_handleAlterPartition(t *testing.T) {
+	tests := []struct {
+		name      string
+		partition *protocol.AlterPartitionPartition
+		wantErr   protocol.Error
+		wantISR   []int32
+		wantEpoch int32
+	}{
+		{
+			name:      "expand isr",
+			partition: &protocol.AlterPartitionPartition{Partition: 0, LeaderEpoch: 2, NewISR: []int32{1, 2}, PartitionEpoch: 3},
+			wantErr:   protocol.ErrNone,
+			wantISR:   []int32{1, 2},
+			wantEpoch: 4,
+		},
+		{
+			name:      "fenced leader epoch",
+			partition: &protocol.AlterPartitionPartition{Partition: 0, LeaderEpoch: 1, NewISR: []int32{1, 2}, PartitionEpoch: 3},
+			wantErr:   protocol.ErrFencedLeaderEpoch,
+			wantISR:   []int32{1},
+			wantEpoch: 3,
+		},
+		{
+			name:      "stale partition epoch",
+			partition: &protocol.AlterPartitionPartition{Partition: 0, LeaderEpoch: 2, NewISR: []int32{1, 2}, PartitionEpoch: 2},
+			wantErr:   protocol.ErrInvalidUpdateVersion,
+			wantISR:   []int32{1},
+			wantEpoch: 3,
+		},
+		{
+			name:      "replica not assigned",
+			partition: &protocol.AlterPartitionPartition{Partition: 0, LeaderEpoch: 2, NewISR: []int32{1, 4}, PartitionEpoch: 3},
+			wantErr:   protocol.ErrInvalidRequest,
+			wantISR:   []int32{1},
+			wantEpoch: 3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFields()
+			f.raft.IsLeaderFn = func() bool {
+				return true
+			}
+			f.topicMap["the-topic"] = []*jocko.Partition{
+				{Topic: "the-topic", ID: 0, Leader: 1, LeaderEpoch: 2, PartitionEpoch: 3, Replicas: []int32{1, 2, 3}, ISR: []int32{1}},
+			}
+			b := &Broker{
+				logger:      f.logger,
+				id:          f.id,
+				topicMap:    f.topicMap,
+				replicators: f.replicators,
+				brokerAddr:  f.brokerAddr,
+				logDir:      f.logDir,
+				raft:        f.raft,
+				serf:        f.serf,
+				shutdownCh:  f.shutdownCh,
+			}
+			// apply the command as raft would.
+			f.raft.ApplyFn = func(c jocko.RaftCommand) error {
+				b.apply(c)
+				return nil
+			}
+			resp := b.handleAlterPartition(&protocol.RequestHeader{APIKey: protocol.AlterPartitionKey}, &protocol.AlterPartitionRequest{
+				BrokerID: 1,
+				Topics: []*protocol.AlterPartitionTopic{{
+					Topic:      "the-topic",
+					Partitions: []*protocol.AlterPartitionPartition{tt.partition},
+				}},
+			})
+			if resp.ErrorCode != protocol.ErrNone.Code() {
+				t.Fatalf("ErrorCode = %v, want %v", resp.ErrorCode, protocol.ErrNone.Code())
+			}
+			presp := resp.Topics[0].Partitions[0]
+			if presp.ErrorCode != tt.wantErr.Code() {
+				t.Errorf("partition ErrorCode = %v, want %v", presp.ErrorCode, tt.wantErr.Code())
+			}
+			if tt.wantErr == protocol.ErrNone {
+				if !reflect.DeepEqual(presp.ISR, tt.wantISR) || presp.PartitionEpoch != tt.wantEpoch || presp.LeaderEpoch != 2 || presp.LeaderID != 1 {
+					t.Errorf("partition response = %+v, want isr %v, partition epoch %v", presp, tt.wantISR, tt.wantEpoch)
+				}
+			}
+			p := f.topicMap["the-topic"][0]
+			if !reflect.DeepEqual(p.ISR, tt.wantISR) {
+				t.Errorf("ISR = %v, want %v", p.ISR, tt.wantISR)
+			}
+			if p.PartitionEpoch != tt.wantEpoch {
+				t.Errorf("PartitionEpoch = %v, want %v", p.PartitionEpoch, tt.wantEpoch)
+			}
+		})
+	}
+}
+
+func TestBroker_handleControlledShutdown(t *testing.T) {
+	f := newFields()
+	f.raft.IsLeaderFn = func() bool {
+		return true
+	}
+	f.serf.MemberFn = func(id int32) *jocko.ClusterMember {
+		return &jocko.ClusterMember{ID: id}
+	}
+	f.topicMap["the-topic"] = []*jocko.Partition{
+		{Topic: "the-topic", ID: 0, Leader: 2, Replicas: []int32{2, 3}, ISR: []int32{2, 3}},
+		{Topic: "the-topic", ID: 1, Leader: 2, Replicas: []int32{2, 3}, ISR: []int32{2}},
+		{Topic: "the-topic", ID: 2, Leader: 3, Replicas: []int32{2, 3}, ISR: []int32{2, 3}},
+	}
+	b := &Broker{
+		logger:      f.logger,
+		id:          f.id,
+		topicMap:    f.topicMap,
+		replicators: f.replicators,
+		brokerAddr:  f.brokerAddr,
+		logDir:      f.logDir,
+		raft:        f.raft,
+		serf:        f.serf,
+		shutdownCh:  f.shutdownCh,
+	}
+	// apply the command as raft would.
+	f.raft.ApplyFn = func(c jocko.RaftCommand) error {
+		b.apply(c)
+		return nil
+	}
+	resp := b.handleControlledShutdown(&protocol.RequestHeader{APIKey: protocol.ControlledShutdownKey, APIVersion: 2}, &protocol.ControlledShutdownRequest{
+		APIVersion:  2,
+		BrokerID:    2,
+		BrokerEpoch: -1,
+	})
+	if resp.ErrorCode != protocol.ErrNone.Code() {
+		t.Fatalf("ErrorCode = %v, want %v", resp.ErrorCode, protocol.ErrNone.Code())
+	}
+	// partition 1 has no other replica in its ISR to lead it.
+	want := []*protocol.ControlledShutdownPartition{{Topic: "the-topic", Partition: 1}}
+	if !reflect.DeepEqual(resp.RemainingPartitions, want) {
+		t.Errorf("RemainingPartitions = %v, want %v", resp.RemainingPartitions, want)
+	}
+	for i, want := range []int32{3, 2, 3} {
+		if leader := f.topicMap["the-topic"][i].Leader; leader != want {
+			t.Errorf("partition %d Leader = %v, want %v", i, leader, want)
+		}
+	}
+}
+
+func TestBroker_laggingFollowerISR(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jocko-isr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	clog, err := commitlog.New(commitlog.Options{Path: dir, MaxSegmentBytes: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := newFields()
+	// this broker's the controller and the partition's leader.
+	f.raft.IsLeaderFn = func() bool {
+		return true
+	}
+	f.topicMap["the-topic"] = []*jocko.Partition{{
+		Topic:          "the-topic",
+		ID:             0,
+		Leader:         f.id,
+		LeaderEpoch:    1,
+		PartitionEpoch: 1,
+		Replicas:       []int32{f.id, 2},
+		ISR:            []int32{f.id, 2},
+		CommitLog:      clog,
+	}}
+	partition := f.topicMap["the-topic"][0]
+	b := &Broker{
+		logger:            f.logger,
+		id:                f.id,
+		topicMap:          f.topicMap,
+		replicators:       f.replicators,
+		raft:              f.raft,
+		serf:              f.serf,
+		shutdownCh:        f.shutdownCh,
+		replicaLagTimeMax: 50 * time.Millisecond,
+	}
+	// apply the command as raft would.
+	f.raft.ApplyFn = func(c jocko.RaftCommand) error {
+		b.apply(c)
+		return nil
+	}
+	fetch := func(offset int64) {
+		b.handleFetch(context.Background(), nil, &protocol.FetchRequest{
+			APIVersion: 5,
+			ReplicaID:  2,
+			Topics: []*protocol.FetchTopic{{
+				Topic:      "the-topic",
+				Partitions: []*protocol.FetchPartition{{Partition: 0, FetchOffset: offset, MaxBytes: 1024}},
+			}},
+		})
+	}
+	waitForISR := func(want []int32, wantEpoch int32) {
+		testutil.WaitForResult(func() (bool, error) {
+			isr := partition.ISRSnapshot()
+			b.RLock()
+			epoch := partition.PartitionEpoch
+			b.RUnlock()
+			// the change's applied once it's done being sent.
+			b.replicaLag.mu.Lock()
+			altering := len(b.replicaLag.altering) > 0
+			b.replicaLag.mu.Unlock()
+			return !altering && reflect.DeepEqual(isr, want) && epoch == wantEpoch, fmt.Errorf("ISR = %v, PartitionEpoch = %v, want %v, %v", isr, epoch, want, wantEpoch)
+		}, func(err error) {
+			t.Fatal(err)
+		})
+	}
+
+	resp := b.handleProduce(nil, "", &protocol.ProduceRequest{
+		Acks: 1,
+		TopicData: []*protocol.TopicData{{
+			Topic: "the-topic",
+			Data:  []*protocol.Data{{Partition: 0, RecordSet: newMessageSet(t, "hello")}},
+		}},
+	}, nil)
+	if code := resp.Responses[0].PartitionResponses[0].ErrorCode; code != protocol.ErrNone.Code() {
+		t.Fatalf("produce ErrorCode = %v, want %v", code, protocol.ErrNone.Code())
+	}
+	// the follower fetches without catching up, and isn't removed before the lag time max.
+	fetch(0)
+	b.maybeShrinkISRs()
+	waitForISR([]int32{f.id, 2}, 1)
+	if got := partition.HighWatermark(); got != 0 {
+		t.Fatalf("HighWatermark() = %v while the follower's in the ISR, want 0", got)
+	}
+
+	// the follower's removed once it's lagged for longer, and the high watermark stops waiting on it.
+	time.Sleep(2 * b.replicaLagTimeMax)
+	fetch(0)
+	b.maybeShrinkISRs()
+	waitForISR([]int32{f.id}, 2)
+	if got := partition.HighWatermark(); got != 1 {
+		t.Fatalf("HighWatermark() = %v after the follower left the ISR, want 1", got)
+	}
+
+	// the follower's added back once it's fetched up to the high watermark.
+	fetch(1)
+	waitForISR([]int32{f.id, 2}, 3)
+	b.maybeShrinkISRs()
+	waitForISR([]int32{f.id, 2}, 3)
+}
+
+func TestBroker_handleAlterPartition_staleBrokerEpoch(t *testing.T) {
+	f := newFields()
+	f.raft.IsLeaderFn = func() bool {
+		return true
+	}
+	member := &jocko.ClusterMember{ID: 2, Incarnation: 1}
+	f.serf.ClusterFn = func() []*jocko.ClusterMember {
+		return []*jocko.ClusterMember{member}
+	}
+	f.topicMap["the-topic"] = []*jocko.Partition{
+		{Topic: "the-topic", ID: 0, Leader: 2, LeaderEpoch: 1, PartitionEpoch: 1, Replicas: []int32{1, 2}, ISR: []int32{2}},
+	}
+	b := &Broker{
+		logger:      f.logger,
+		id:          f.id,
+		topicMap:    f.topicMap,
+		replicators: f.replicators,
+		brokerAddr:  f.brokerAddr,
+		logDir:      f.logDir,
+		raft:        f.raft,
+		serf:        f.serf,
+		shutdownCh:  f.shutdownCh,
+	}
+	// apply the command as raft would.
+	f.raft.ApplyFn = func(c jocko.RaftCommand) error {
+		b.apply(c)
+		return nil
+	}
+	if err := b.checkRegistrations(); err != nil {
+		t.Fatal(err)
+	}
+	if epoch := b.brokerEpoch(2); epoch != 1 {
+		t.Fatalf("brokerEpoch = %v, want 1", epoch)
+	}
+	// the broker restarts and re-registers.
+	member.Incarnation = 2
+	for i := 0; i < 2; i++ {
+		if err := b.checkRegistrations(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if epoch := b.brokerEpoch(2); epoch != 2 {
+		t.Fatalf("brokerEpoch = %v, want 2", epoch)
+	}
+	alterISR := func(brokerEpoch int64) *protocol.AlterPartitionResponse {
+		return b.handleAlterPartition(&protocol.RequestHeader{APIKey: protocol.AlterPartitionKey}, &protocol.AlterPartitionRequest{
+			BrokerID:    2,
+			BrokerEpoch: brokerEpoch,
+			Topics: []*protocol.AlterPartitionTopic{{
+				Topic:      "the-topic",
+				Partitions: []*protocol.AlterPartitionPartition{{Partition: 0, LeaderEpoch: 1, NewISR: []int32{1, 2}, PartitionEpoch: 1}},
+			}},
+		})
+	}
+	if resp := alterISR(1); resp.ErrorCode != protocol.ErrStaleBrokerEpoch.Code() {
+		t.Fatalf("ErrorCode = %v, want %v", resp.ErrorCode, protocol.ErrStaleBrokerEpoch.Code())
+	}
+	if isr := f.topicMap["the-topic"][0].ISR; !reflect.DeepEqual(isr, []int32{2}) {
+		t.Fatalf("ISR = %v, want [2]", isr)
+	}
+	resp := alterISR(2)
+	if resp.ErrorCode != protocol.ErrNone.Code() || resp.Topics[0].Partitions[0].ErrorCode != protocol.ErrNone.Code() {
+		t.Fatalf("response = %+v, want no errors", resp.Topics[0].Partitions[0])
+	}
+	if isr := f.topicMap["the-topic"][0].ISR; !reflect.DeepEqual(isr, []int32{1, 2}) {
+		t.Fatalf("ISR = %v, want [1 2]", isr)
+	}
+}
+
+func TestBroker_LogOffsets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jocko-log-offsets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	f := newFields()
+	var partitions []*jocko.Partition
+	for i := int32(0); i < 2; i++ {
+		clog, err := commitlog.New(commitlog.Options{Path: filepath.Join(dir, fmt.Sprintf("the-topic-%d", i)), MaxSegmentBytes: 1024})
+		if err != nil {
+			t.Fatal(err)
+		}
+		partitions = append(partitions, &jocko.Partition{
+			Topic:     "the-topic",
+			ID:        i,
+			Leader:    f.id,
+			Replicas:  []int32{f.id},
+			CommitLog: clog,
+		})
+	}
+	// reversed to check the offsets are sorted by partition.
+	f.topicMap["the-topic"] = []*jocko.Partition{partitions[1], partitions[0]}
+	b := &Broker{
+		logger:      f.logger,
+		id:          f.id,
+		topicMap:    f.topicMap,
+		replicators: f.replicators,
+		brokerAddr:  f.brokerAddr,
+		logDir:      f.logDir,
+		raft:        f.raft,
+		serf:        f.serf,
+		shutdownCh:  f.shutdownCh,
+		shutdown:    f.shutdown,
+	}
+
+	appended := []int64{3, 5}
+	for partition, n := range appended {
+		for i := int64(0); i < n; i++ {
+			resp := b.handleProduce(nil, jocko.AnonymousPrincipal, &protocol.ProduceRequest{
+				Acks: 1,
+				TopicData: []*protocol.TopicData{{
+					Topic: "the-topic",
+					Data: []*protocol.Data{{
+						Partition: int32(partition),
+						RecordSet: newMessageSet(t, "hello"),
+					}},
+				}},
+			}, nil)
+			if code := resp.Responses[0].PartitionResponses[0].ErrorCode; code != protocol.ErrNone.Code() {
+				t.Fatalf("Broker.handleProduce(, nil) error code = %v, want %v", code, protocol.ErrNone.Code())
+			}
+		}
+	}
+
+	want := []PartitionLogOffsets{
+		{Topic: "the-topic", Partition: 0, LogStartOffset: 0, LogEndOffset: 3, HighWatermark: 3},
+		{Topic: "the-topic", Partition: 1, LogStartOffset: 0, LogEndOffset: 5, HighWatermark: 5},
+	}
+	if got := b.LogOffsets(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Broker.LogOffsets() = %v, want %v", got, want)
+	}
+}
+
+func TestBroker_handleDeleteRecords(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jocko-delete-records")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	clog, err := commitlog.New(commitlog.Options{Path: dir, MaxSegmentBytes: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := newFields()
+	f.topicMap["the-topic"] = []*jocko.Partition{{
+		Topic:     "the-topic",
+		ID:        0,
+		Leader:    f.id,
+		Replicas:  []int32{f.id},
+		CommitLog: clog,
+	}}
+	b := &Broker{
+		logger:      f.logger,
+		id:          f.id,
+		topicMap:    f.topicMap,
+		replicators: f.replicators,
+		brokerAddr:  f.brokerAddr,
+		logDir:      f.logDir,
+		raft:        f.raft,
+		serf:        f.serf,
+		shutdownCh:  f.shutdownCh,
+		shutdown:    f.shutdown,
+	}
+	for i := 0; i < 5; i++ {
+		if _, err := f.topicMap["the-topic"][0].Append(commitlog.NewMessageSet(0, commitlog.NewMessage([]byte("hello")))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deleteRecords := func(offset int64) *protocol.DeleteRecordsPartitionResponse {
+		resp := b.handleDeleteRecords(nil, jocko.AnonymousPrincipal, &protocol.DeleteRecordsRequest{
+			Topics: []*protocol.DeleteRecordsTopic{{
+				Topic:      "the-topic",
+				Partitions: []*protocol.DeleteRecordsPartition{{Partition: 0, Offset: offset}},
+			}},
+		})
+		return resp.Topics[0].Partitions[0]
+	}
+
+	if p := deleteRecords(6); p.ErrorCode != protocol.ErrOffsetOutOfRange.Code() {
+		t.Errorf("delete records past the high watermark error code = %v, want %v", p.ErrorCode, protocol.ErrOffsetOutOfRange.Code())
+	}
+	p := deleteRecords(3)
+	if p.ErrorCode != protocol.ErrNone.Code() || p.LowWatermark != 3 {
+		t.Fatalf("delete records = %v, %v, want %v, %v", p.ErrorCode, p.LowWatermark, protocol.ErrNone.Code(), 3)
+	}
+
+	fetch := b.handleFetch(context.Background(), nil, &protocol.FetchRequest{
+		APIVersion: 5,
+		Topics: []*protocol.FetchTopic{{
+			Topic:      "the-topic",
+			Partitions: []*protocol.FetchPartition{{Partition: 0, FetchOffset: 1, MaxBytes: 1024}},
+		}},
+	}).Responses[0].PartitionResponses[0]
+	if fetch.ErrorCode != protocol.ErrOffsetOutOfRange.Code() {
+		t.Errorf("fetch error code = %v, want %v", fetch.ErrorCode, protocol.ErrOffsetOutOfRange.Code())
+	}
+	if fetch.LogStartOffset != 3 {
+		t.Errorf("fetch log start offset = %v, want %v", fetch.LogStartOffset, 3)
+	}
+
+	offsets := b.handleOffsets(nil, &protocol.OffsetsRequest{
+		ReplicaID: -1,
+		Topics: []*protocol.OffsetsTopic{{
+			Topic:      "the-topic",
+			Partitions: []*protocol.OffsetsPartition{{Partition: 0, Timestamp: -2}},
+		}},
+	}).Responses[0].PartitionResponses[0]
+	if !reflect.DeepEqual(offsets.Offsets, []int64{3}) {
+		t.Errorf("earliest offsets = %v, want %v", offsets.Offsets, []int64{3})
+	}
+}
+
+func TestBroker_unopenedPartition(t *testing.T) {
+	f := newFields()
+	// the partition's log hasn't been opened, e.g. it's still being recovered.
+	f.topicMap["the-topic"] = []*jocko.Partition{{
+		Topic:    "the-topic",
+		ID:       0,
+		Leader:   f.id,
+		Replicas: []int32{f.id},
+	}}
+	b := &Broker{
+		logger:      f.logger,
+		id:          f.id,
+		topicMap:    f.topicMap,
+		replicators: f.replicators,
+		raft:        f.raft,
+		serf:        f.serf,
+	}
+	for _, timestamp := range []int64{-2, -1, 1000} {
+		offsets := b.handleOffsets(nil, &protocol.OffsetsRequest{
+			ReplicaID: -1,
+			Topics: []*protocol.OffsetsTopic{{
+				Topic:      "the-topic",
+				Partitions: []*protocol.OffsetsPartition{{Partition: 0, Timestamp: timestamp}},
+			}},
+		}).Responses[0].PartitionResponses[0]
+		if offsets.ErrorCode != protocol.ErrKafkaStorageError.Code() {
+			t.Errorf("offsets for timestamp %v error code = %v, want %v", timestamp, offsets.ErrorCode, protocol.ErrKafkaStorageError.Code())
+		}
+	}
+	deleted := b.handleDeleteRecords(nil, jocko.AnonymousPrincipal, &protocol.DeleteRecordsRequest{
+		Topics: []*protocol.DeleteRecordsTopic{{
+			Topic:      "the-topic",
+			Partitions: []*protocol.DeleteRecordsPartition{{Partition: 0, Offset: -1}},
+		}},
+	}).Topics[0].Partitions[0]
+	if deleted.ErrorCode != protocol.ErrKafkaStorageError.Code() {
+		t.Errorf("delete records error code = %v, want %v", deleted.ErrorCode, protocol.ErrKafkaStorageError.Code())
+	}
+}
+
+func TestBroker_handleOffsets_leaderEpoch(t *testing.T) {
+	f := newFields()
+	f.topicMap["the-topic"] = []*jocko.Partition{{
+		Topic:       "the-topic",
+		ID:          0,
+		Leader:      f.id,
+		Replicas:    []int32{f.id},
+		LeaderEpoch: 3,
+		LeaderEpochs: []jocko.EpochEntry{
+			{Epoch: 1, StartOffset: 0},
+			{Epoch: 3, StartOffset: 10},
+		},
+		CommitLog: &mock.CommitLog{
+			OldestOffsetFn: func() int64 { return 2 },
+			NewestOffsetFn: func() int64 { return 15 },
+			OffsetForTimestampFn: func(ts int64) (int64, int64, error) {
+				switch ts {
+				case 100:
+					return 5, 150, nil
+				case 200:
+					return 12, 200, nil
+				}
+				return -1, -1, nil
+			},
+		},
+	}}
+	b := &Broker{
+		logger:   f.logger,
+		id:       f.id,
+		topicMap: f.topicMap,
+	}
+	tests := []struct {
+		name               string
+		timestamp          int64
+		currentLeaderEpoch int32
+		want               *protocol.PartitionResponse
+	}{
+		{
+			name:               "earliest",
+			timestamp:          -2,
+			currentLeaderEpoch: -1,
+			want:               &protocol.PartitionResponse{Timestamp: -1, Offset: 2, LeaderEpoch: 3},
+		},
+		{
+			name:               "latest",
+			timestamp:          -1,
+			currentLeaderEpoch: 3,
+			want:               &protocol.PartitionResponse{Timestamp: -1, Offset: 15, LeaderEpoch: 3},
+		},
+		{
+			name:               "timestamp in an older epoch",
+			timestamp:          100,
+			currentLeaderEpoch: -1,
+			want:               &protocol.PartitionResponse{Timestamp: 150, Offset: 5, LeaderEpoch: 1},
+		},
+		{
+			name:               "timestamp in the current epoch",
+			timestamp:          200,
+			currentLeaderEpoch: -1,
+			want:               &protocol.PartitionResponse{Timestamp: 200, Offset: 12, LeaderEpoch: 3},
+		},
+		{
+			name:               "timestamp after the last message",
+			timestamp:          300,
+			currentLeaderEpoch: -1,
+			want:               &protocol.PartitionResponse{Timestamp: -1, Offset: -1, LeaderEpoch: -1},
+		},
+		{
+			name:               "fenced leader epoch",
+			timestamp:          -1,
+			currentLeaderEpoch: 2,
+			want:               &protocol.PartitionResponse{ErrorCode: protocol.ErrFencedLeaderEpoch.Code(), Timestamp: -1, Offset: -1, LeaderEpoch: -1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := b.handleOffsets(nil, &protocol.OffsetsRequest{
+				APIVersion: 4,
+				ReplicaID:  -1,
+				Topics: []*protocol.OffsetsTopic{{
+					Topic: "the-topic",
+					Partitions: []*protocol.OffsetsPartition{
+						{Partition: 0, CurrentLeaderEpoch: tt.currentLeaderEpoch, Timestamp: tt.timestamp},
+					},
+				}},
+			})
+			if resp.APIVersion != 4 {
+				t.Errorf("api version = %v, want %v", resp.APIVersion, 4)
+			}
+			got := resp.Responses[0].PartitionResponses[0]
+			got.Offsets = nil
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("partition response = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBroker_handleOffsets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jocko-offsets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	clog, err := commitlog.New(commitlog.Options{Path: dir, MaxSegmentBytes: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// messages produced at 100ms, 200ms, and 300ms.
+	for i := int64(1); i <= 3; i++ {
+		m, err := protocol.Encode(&protocol.Message{MagicByte: 1, Timestamp: time.Unix(0, i*100*int64(time.Millisecond)), Value: []byte("hello")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := clog.Append(commitlog.NewMessageSet(0, commitlog.NewMessage(m))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f := newFields()
+	f.topicMap["the-topic"] = []*jocko.Partition{{
+		Topic:     "the-topic",
+		ID:        0,
+		Leader:    f.id,
+		Replicas:  []int32{f.id},
+		CommitLog: clog,
+	}}
+	b := &Broker{
+		logger:   f.logger,
+		id:       f.id,
+		topicMap: f.topicMap,
+	}
+	tests := []struct {
+		name          string
+		topic         string
+		partition     int32
+		timestamp     int64
+		wantErr       protocol.Error
+		wantOffset    int64
+		wantTimestamp int64
+	}{
+		{name: "earliest", topic: "the-topic", timestamp: -2, wantOffset: 0, wantTimestamp: -1},
+		{name: "latest", topic: "the-topic", timestamp: -1, wantOffset: 3, wantTimestamp: -1},
+		// the found message's timestamp is returned, not the requested one.
+		{name: "timestamp", topic: "the-topic", timestamp: 150, wantOffset: 1, wantTimestamp: 200},
+		{name: "message's timestamp", topic: "the-topic", timestamp: 300, wantOffset: 2, wantTimestamp: 300},
+		{name: "timestamp after the last message", topic: "the-topic", timestamp: 400, wantOffset: -1, wantTimestamp: -1},
+		{name: "unknown partition", topic: "the-topic", partition: 1, timestamp: -1, wantErr: protocol.ErrUnknownTopicOrPartition, wantOffset: -1, wantTimestamp: -1},
+		{name: "unknown topic", topic: "another-topic", timestamp: -1, wantErr: protocol.ErrUnknownTopicOrPartition, wantOffset: -1, wantTimestamp: -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := b.handleOffsets(nil, &protocol.OffsetsRequest{
+				APIVersion: 1,
+				ReplicaID:  -1,
+				Topics: []*protocol.OffsetsTopic{{
+					Topic:      tt.topic,
+					Partitions: []*protocol.OffsetsPartition{{Partition: tt.partition, Timestamp: tt.timestamp}},
+				}},
+			})
+			p := resp.Responses[0].PartitionResponses[0]
+			if p.ErrorCode != tt.wantErr.Code() {
+				t.Errorf("ErrorCode = %v, want %v", p.ErrorCode, tt.wantErr.Code())
+			}
+			if p.Offset != tt.wantOffset {
+				t.Errorf("Offset = %v, want %v", p.Offset, tt.wantOffset)
+			}
+			if p.Timestamp != tt.wantTimestamp {
+				t.Errorf("Timestamp = %v, want %v", p.Timestamp, tt.wantTimestamp)
+			}
+		})
+	}
+}
+
+func TestBroker_handleProduce_acksAllTimeout(t *testing.T) {
+	tests := []struct {
+		name string
+		// during is done while the produce waits.
+		during   func(b *Broker)
+		wantCode int16
+	}{
+		{name: "follower never catches up", wantCode: protocol.ErrRequestTimedOut.Code()},
+		{
+			name: "follower catches up",
+			during: func(b *Broker) {
+				// the follower fetches from after the produced record once it's replicated it.
+				b.handleFetch(context.Background(), nil, &protocol.FetchRequest{
+					ReplicaID: 2,
+					Topics: []*protocol.FetchTopic{{
+						Topic:      "the-topic",
+						Partitions: []*protocol.FetchPartition{{Partition: 0, FetchOffset: 1, MaxBytes: 1024}},
+					}},
+				})
+			},
+			wantCode: protocol.ErrNone.Code(),
+		},
+		{
+			name: "follower leaves the isr",
+			during: func(b *Broker) {
+				if err := b.raftApply(alterISR, &jocko.Partition{Topic: "the-topic", ID: 0, ISR: []int32{b.id}}); err != nil {
+					t.Error(err)
+				}
+			},
+			wantCode: protocol.ErrNone.Code(),
+		},
+		{
+			name: "partition goes offline",
+			during: func(b *Broker) {
+				if err := b.raftApply(electLeader, &jocko.Partition{Topic: "the-topic", ID: 0, Leader: -1}); err != nil {
+					t.Error(err)
+				}
+			},
+			wantCode: protocol.ErrNotLeaderForPartition.Code(),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "jocko-produce-timeout")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			clog, err := commitlog.New(commitlog.Options{Path: dir, MaxSegmentBytes: 1024})
+			if err != nil {
+				t.Fatal(err)
+			}
+			f := newFields()
+			f.topicMap["the-topic"] = []*jocko.Partition{{
+				Topic:     "the-topic",
+				ID:        0,
+				Leader:    f.id,
+				Replicas:  []int32{f.id, 2},
+				ISR:       []int32{f.id, 2},
+				CommitLog: clog,
+			}}
+			b := &Broker{
+				logger:      f.logger,
+				id:          f.id,
+				topicMap:    f.topicMap,
+				replicators: f.replicators,
+				brokerAddr:  f.brokerAddr,
+				logDir:      f.logDir,
+				raft:        f.raft,
+				serf:        f.serf,
+				shutdownCh:  f.shutdownCh,
+				shutdown:    f.shutdown,
+			}
+			// apply the command as raft would.
+			f.raft.ApplyFn = func(c jocko.RaftCommand) error {
+				b.apply(c)
+				return nil
+			}
+			// the follower fetches from the start of the log, before the produce.
+			b.handleFetch(context.Background(), nil, &protocol.FetchRequest{
+				ReplicaID: 2,
+				Topics: []*protocol.FetchTopic{{
+					Topic:      "the-topic",
+					Partitions: []*protocol.FetchPartition{{Partition: 0, FetchOffset: 0, MaxBytes: 1024}},
+				}},
+			})
+			tp := topicPartition{Topic: "the-topic", Partition: 0}
+			if _, ok := b.replicaOffsets.offsets[tp][2]; !ok {
+				t.Fatalf("follower's fetch offset wasn't recorded")
+			}
+			timeout := 100 * time.Millisecond
+			start := time.Now()
+			respc := make(chan protocol.ResponseBody, 1)
+			resp := b.handleProduce(nil, jocko.AnonymousPrincipal, &protocol.ProduceRequest{
+				Acks:    -1,
+				Timeout: int32(timeout / time.Millisecond),
+				TopicData: []*protocol.TopicData{{
+					Topic: "the-topic",
+					Data: []*protocol.Data{{
+						Partition: 0,
+						RecordSet: newMessageSet(t, "hello"),
+					}},
+				}},
+			}, func(resp protocol.ResponseBody) { respc <- resp })
+			// the produce's delayed rather than holding up the handler.
+			if resp != nil {
+				t.Fatalf("Broker.handleProduce() = %v, want nil", resp)
+			}
+			if tt.during != nil {
+				tt.during(b)
+			}
+			var got *protocol.ProduceResponses
+			select {
+			case r := <-respc:
+				got = r.(*protocol.ProduceResponses)
+			case <-time.After(10 * timeout):
+				t.Fatal("produce wasn't responded to")
+			}
+			elapsed := time.Since(start)
+			if code := got.Responses[0].PartitionResponses[0].ErrorCode; code != tt.wantCode {
+				t.Errorf("Broker.handleProduce() error code = %v, want %v", code, tt.wantCode)
+			}
+			if tt.during != nil && elapsed >= timeout {
+				t.Errorf("Broker.handleProduce() took %v, want less than the timeout %v", elapsed, timeout)
+			}
+			if tt.during == nil && elapsed < timeout {
+				t.Errorf("Broker.handleProduce() took %v, want at least the timeout %v", elapsed, timeout)
+			}
+			if len(b.delayedProduces.produces) != 0 {
+				t.Errorf("delayed produces = %v, want none", b.delayedProduces.produces)
+			}
+		})
+	}
+}
+
+func TestBroker_handleProduce_notLeader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jocko-produce-not-leader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	led, err := commitlog.New(commitlog.Options{Path: dir, MaxSegmentBytes: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	followed := &mock.CommitLog{
+		AppendFn: func(b []byte) (int64, error) {
+			return 0, nil
+		},
+	}
+	f := newFields()
+	// this broker, 1, leads partition 0 and follows broker 2's partition 1.
+	f.topicMap["the-topic"] = []*jocko.Partition{
+		{Topic: "the-topic", ID: 0, Leader: f.id, Replicas: []int32{f.id, 2}, CommitLog: led},
+		{Topic: "the-topic", ID: 1, Leader: 2, Replicas: []int32{2, f.id}, CommitLog: followed},
+	}
+	b := &Broker{
+		logger:      f.logger,
+		id:          f.id,
+		topicMap:    f.topicMap,
+		replicators: f.replicators,
+		raft:        f.raft,
+		serf:        f.serf,
+	}
+	resp := b.handleProduce(nil, jocko.AnonymousPrincipal, &protocol.ProduceRequest{
+		Acks: 1,
+		TopicData: []*protocol.TopicData{{
+			Topic: "the-topic",
+			Data: []*protocol.Data{
+				{Partition: 0, RecordSet: newMessageSet(t, "hello")},
+				{Partition: 1, RecordSet: newMessageSet(t, "hello")},
+			},
+		}},
+	}, nil)
+	ps := resp.Responses[0].PartitionResponses
+	if ps[0].ErrorCode != protocol.ErrNone.Code() || ps[0].BaseOffset != 0 {
+		t.Errorf("partition 0: ErrorCode = %v, BaseOffset = %v, want %v, 0", ps[0].ErrorCode, ps[0].BaseOffset, protocol.ErrNone.Code())
+	}
+	if ps[1].ErrorCode != protocol.ErrNotLeaderForPartition.Code() || ps[1].BaseOffset != -1 {
+		t.Errorf("partition 1: ErrorCode = %v, BaseOffset = %v, want %v, -1", ps[1].ErrorCode, ps[1].BaseOffset, protocol.ErrNotLeaderForPartition.Code())
+	}
+	if followed.AppendInvoked {
+		t.Error("Append() invoked on the followed partition, want its log not to diverge")
+	}
+	if got := led.NewestOffset(); got != 1 {
+		t.Errorf("led partition's NewestOffset() = %v, want 1", got)
+	}
+}
+
+func TestBroker_handleProduce_logAppendTime(t *testing.T) {
+	// a v2 record batch, with the producer's create times, in a message set.
+	newRecordSet := func() []byte {
+		batch := make([]byte, 61+len("records"))
+		batch[4] = 2
+		commitlog.Encoding.PutUint64(batch[15:23], 100)
+		commitlog.Encoding.PutUint64(batch[23:31], 200)
+		copy(batch[61:], "records")
+		return commitlog.NewMessageSet(0, batch)
+	}
+	tests := []struct {
+		name          string
+		configs       map[string]string
+		wantTimestamp bool
+	}{
+		{name: "create time"},
+		{name: "log append time", configs: map[string]string{"message.timestamp.type": "LogAppendTime"}, wantTimestamp: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var appended []byte
+			f := newFields()
+			f.topicMap["the-topic"] = []*jocko.Partition{{
+				Topic:    "the-topic",
+				ID:       0,
+				Leader:   f.id,
+				Replicas: []int32{f.id},
+				CommitLog: &mock.CommitLog{
+					AppendFn: func(b []byte) (int64, error) {
+						appended = append([]byte(nil), b...)
+						return 0, nil
+					},
+				},
+			}}
+			b := &Broker{
+				logger:      f.logger,
+				id:          f.id,
+				topicMap:    f.topicMap,
+				replicators: f.replicators,
+				raft:        f.raft,
+				serf:        f.serf,
+			}
+			if tt.configs != nil {
+				b.setConfigs(&resourceConfigs{Type: protocol.ConfigResourceTopic, Name: "the-topic", Configs: tt.configs})
+			}
+			before := time.Now().UnixNano() / int64(time.Millisecond)
+			resp := b.handleProduce(nil, jocko.AnonymousPrincipal, &protocol.ProduceRequest{
+				Acks: 1,
+				TopicData: []*protocol.TopicData{{
+					Topic: "the-topic",
+					Data:  []*protocol.Data{{Partition: 0, RecordSet: newRecordSet()}},
+				}},
+			}, nil)
+			after := time.Now().UnixNano() / int64(time.Millisecond)
+			presp := resp.Responses[0].PartitionResponses[0]
+			if presp.ErrorCode != protocol.ErrNone.Code() {
+				t.Fatalf("ErrorCode = %v, want %v", presp.ErrorCode, protocol.ErrNone.Code())
+			}
+			if !tt.wantTimestamp {
+				if presp.Timestamp != -1 {
+					t.Errorf("Timestamp = %v, want -1", presp.Timestamp)
+				}
+				if !bytes.Equal(appended, newRecordSet()) {
+					t.Errorf("appended record set was rewritten, want it as produced")
+				}
+				return
+			}
+			if presp.Timestamp < before || presp.Timestamp > after {
+				t.Errorf("Timestamp = %v, want the append time, between %v and %v", presp.Timestamp, before, after)
+			}
+			batch := appended[12:]
+			if got := commitlog.Encoding.Uint16(batch[9:11]) & (1 << 3); got == 0 {
+				t.Errorf("batch isn't marked as using log append time")
+			}
+			for name, pos := range map[string]int{"first": 15, "max": 23} {
+				if got := int64(commitlog.Encoding.Uint64(batch[pos:])); got != presp.Timestamp {
+					t.Errorf("batch %s timestamp = %v, want %v", name, got, presp.Timestamp)
+				}
+			}
+			if got := commitlog.MessageSet(appended).MaxTimestamp(); got != presp.Timestamp {
+				t.Errorf("MaxTimestamp() = %v, want %v", got, presp.Timestamp)
+			}
+		})
+	}
+}
+
+func TestBroker_handleProduce_unsupportedFormat(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jocko-produce-format")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	f := newFields()
+	var logs []*commitlog.CommitLog
+	for i := int32(0); i < 2; i++ {
+		clog, err := commitlog.New(commitlog.Options{Path: filepath.Join(dir, fmt.Sprint(i)), MaxSegmentBytes: 1024})
+		if err != nil {
+			t.Fatal(err)
+		}
+		logs = append(logs, clog)
+		f.topicMap["the-topic"] = append(f.topicMap["the-topic"], &jocko.Partition{
+			Topic:     "the-topic",
+			ID:        i,
+			Leader:    f.id,
+			Replicas:  []int32{f.id},
+			CommitLog: clog,
+		})
+	}
+	b := &Broker{
+		logger:      f.logger,
+		id:          f.id,
+		topicMap:    f.topicMap,
+		replicators: f.replicators,
+		raft:        f.raft,
+		serf:        f.serf,
+	}
+	// a record batch with a magic byte that isn't a message format.
+	bogus := newMessageSet(t, "hello")
+	bogus[12+4] = 9
+	resp := b.handleProduce(nil, jocko.AnonymousPrincipal, &protocol.ProduceRequest{
+		Acks: 1,
+		TopicData: []*protocol.TopicData{{
+			Topic: "the-topic",
+			Data: []*protocol.Data{
+				{Partition: 0, RecordSet: bogus},
+				{Partition: 1, RecordSet: newMessageSet(t, "hello")},
+			},
+		}},
+	}, nil)
+	ps := resp.Responses[0].PartitionResponses
+	if ps[0].ErrorCode != protocol.ErrUnsupportedForMessageFormat.Code() || ps[0].BaseOffset != -1 {
+		t.Errorf("partition 0: ErrorCode = %v, BaseOffset = %v, want %v, -1", ps[0].ErrorCode, ps[0].BaseOffset, protocol.ErrUnsupportedForMessageFormat.Code())
+	}
+	if got := logs[0].NewestOffset(); got != 0 {
+		t.Errorf("partition 0's NewestOffset() = %v, want 0, the log unchanged", got)
+	}
+	// the other partitions in the request are appended to.
+	if ps[1].ErrorCode != protocol.ErrNone.Code() {
+		t.Errorf("partition 1: ErrorCode = %v, want %v", ps[1].ErrorCode, protocol.ErrNone.Code())
+	}
+	if got := logs[1].NewestOffset(); got != 1 {
+		t.Errorf("partition 1's NewestOffset() = %v, want 1", got)
+	}
+}
+
+func TestBroker_handleProduce_multiplePartitions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jocko-produce-partitions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	f := newFields()
+	for _, topic := range []string{"topic-a", "topic-b"} {
+		clog, err := commitlog.New(commitlog.Options{Path: filepath.Join(dir, topic), MaxSegmentBytes: 1024})
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.topicMap[topic] = []*jocko.Partition{{
+			Topic:     topic,
+			ID:        0,
+			Leader:    f.id,
+			Replicas:  []int32{f.id},
+			CommitLog: clog,
+		}}
+	}
+	b := &Broker{
+		logger:      f.logger,
+		id:          f.id,
+		topicMap:    f.topicMap,
+		replicators: f.replicators,
+		brokerAddr:  f.brokerAddr,
+		logDir:      f.logDir,
+		raft:        f.raft,
+		serf:        f.serf,
+		shutdownCh:  f.shutdownCh,
+		shutdown:    f.shutdown,
+	}
+	ms := func() []byte {
+		return newMessageSet(t, "hello")
+	}
+	// topic-a already has a record, to check offsets are assigned per partition.
+	if _, err := f.topicMap["topic-a"][0].Append(ms()); err != nil {
+		t.Fatal(err)
+	}
+
+	resp := b.handleProduce(nil, jocko.AnonymousPrincipal, &protocol.ProduceRequest{
+		Acks: 1,
+		TopicData: []*protocol.TopicData{{
+			Topic: "topic-a",
+			Data:  []*protocol.Data{{Partition: 0, RecordSet: ms()}},
+		}, {
+			Topic: "topic-b",
+			Data: []*protocol.Data{
+				{Partition: 1, RecordSet: ms()},
+				{Partition: 0, RecordSet: ms()},
+			},
+		}},
+	}, nil)
+
+	type result struct {
+		Topic      string
+		Partition  int32
+		ErrorCode  int16
+		BaseOffset int64
+	}
+	var got []result
+	for _, r := range resp.Responses {
+		for _, p := range r.PartitionResponses {
+			got = append(got, result{Topic: r.Topic, Partition: p.Partition, ErrorCode: p.ErrorCode, BaseOffset: p.BaseOffset})
+		}
+	}
+	want := []result{
+		{Topic: "topic-a", Partition: 0, ErrorCode: protocol.ErrNone.Code(), BaseOffset: 1},
+		{Topic: "topic-b", Partition: 1, ErrorCode: protocol.ErrUnknownTopicOrPartition.Code(), BaseOffset: -1},
+		{Topic: "topic-b", Partition: 0, ErrorCode: protocol.ErrNone.Code(), BaseOffset: 0},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Broker.handleProduce(, nil) = %+v, want %+v", got, want)
+	}
+}
+
+func TestBroker_autoTopicCreation(t *testing.T) {
+	tests := []struct {
+		name        string
+		allow       bool
+		request     func(b *Broker) int16
+		wantCode    int16
+		wantCreated bool
+	}{
+		{
+			name:     "produce disabled",
+			request:  produceNewTopic,
+			wantCode: protocol.ErrUnknownTopicOrPartition.Code(),
+		},
+		{
+			name:        "produce enabled",
+			allow:       true,
+			request:     produceNewTopic,
+			wantCode:    protocol.ErrLeaderNotAvailable.Code(),
+			wantCreated: true,
+		},
+		{
+			name: "metadata disabled",
+			request: func(b *Broker) int16 {
+				return b.handleMetadata(nil, "", &protocol.MetadataRequest{Topics: []string{"new-topic"}}).TopicMetadata[0].TopicErrorCode
+			},
+			wantCode: protocol.ErrUnknownTopicOrPartition.Code(),
+		},
+		{
+			name:  "metadata enabled",
+			allow: true,
+			request: func(b *Broker) int16 {
+				return b.handleMetadata(nil, "", &protocol.MetadataRequest{Topics: []string{"new-topic"}}).TopicMetadata[0].TopicErrorCode
+			},
+			wantCode:    protocol.ErrLeaderNotAvailable.Code(),
+			wantCreated: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFields()
+			f.raft.IsLeaderFn = func() bool {
+				return true
+			}
+			f.raft.ApplyFn = func(c jocko.RaftCommand) error {
+				return nil
+			}
+			f.raft.LeaderIDFn = func() string {
+				return ""
+			}
+			f.serf.ClusterFn = func() []*jocko.ClusterMember {
+				return []*jocko.ClusterMember{{ID: 1}}
+			}
+			b := &Broker{
+				logger:                 f.logger,
+				id:                     f.id,
+				topicMap:               f.topicMap,
+				replicators:            f.replicators,
+				brokerAddr:             f.brokerAddr,
+				logDir:                 f.logDir,
+				raft:                   f.raft,
+				serf:                   f.serf,
+				shutdownCh:             f.shutdownCh,
+				shutdown:               f.shutdown,
+				allowAutoTopicCreation: tt.allow,
+			}
+			if code := tt.request(b); code != tt.wantCode {
+				t.Errorf("error code = %v, want %v", code, tt.wantCode)
+			}
+			var created []string
+			for _, c := range f.raft.ApplyCommands {
+				p := new(jocko.Partition)
+				if err := json.Unmarshal(*c.Data, p); err != nil {
+					t.Fatalf("json.Unmarshal() error = %v", err)
+				}
+				created = append(created, p.Topic)
+			}
+			if tt.wantCreated && !reflect.DeepEqual(created, []string{"new-topic"}) {
+				t.Errorf("created partitions of topics %v, want %v", created, []string{"new-topic"})
+			}
+			if !tt.wantCreated && len(created) != 0 {
+				t.Errorf("created partitions of topics %v, want none", created)
+			}
+		})
+	}
+}
+
+func produceNewTopic(b *Broker) int16 {
+	resp := b.handleProduce(nil, jocko.AnonymousPrincipal, &protocol.ProduceRequest{
+		Acks: 1,
+		TopicData: []*protocol.TopicData{{
+			Topic: "new-topic",
+			Data:  []*protocol.Data{{Partition: 0, RecordSet: []byte("hello")}},
+		}},
+	}, nil)
+	return resp.Responses[0].PartitionResponses[0].ErrorCode
+}
+
+func TestBroker_flushPartitions(t *testing.T) {
+	synced := make(chan struct{}, 1)
+	f := newFields()
+	f.topicMap["the-topic"] = []*jocko.Partition{{
+		Topic:  "the-topic",
+		ID:     0,
+		Leader: f.id,
+		CommitLog: &mock.CommitLog{
+			SyncFn: func() error {
+				select {
+				case synced <- struct{}{}:
+				default:
+				}
+				return nil
+			},
+		},
+	}}
+	b := &Broker{
+		logger:        f.logger,
+		id:            f.id,
+		topicMap:      f.topicMap,
+		replicators:   f.replicators,
+		raft:          f.raft,
+		serf:          f.serf,
+		shutdownCh:    make(chan struct{}),
+		flushInterval: 10 * time.Millisecond,
+	}
+	go b.flushPartitions()
+	defer close(b.shutdownCh)
+	select {
+	case <-synced:
+	case <-time.After(time.Second):
+		t.Fatal("partition's log wasn't flushed")
+	}
+}
+
+func TestBroker_openCommitLog_options(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jocko-open-log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	b := &Broker{singleWriterLogs: true, preallocateSegments: true}
+	log, err := b.openCommitLog(filepath.Join(dir, "the-topic-0"), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := log.(*commitlog.CommitLog)
+	defer l.Close()
+	if !l.SingleWriter() || !l.PreallocateSegments {
+		t.Fatalf("log single writer = %v, preallocate segments = %v, want both true", l.SingleWriter(), l.PreallocateSegments)
+	}
+	// the active segment's reserved up to the max segment bytes.
+	fi, err := os.Stat(filepath.Join(dir, "the-topic-0", fmt.Sprintf("%020d.log", 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != 1024 {
+		t.Fatalf("active segment size = %d, want 1024", fi.Size())
+	}
+}
+
+// bufferConn is a conn recording the socket buffer sizes set on it.
+type bufferConn struct {
+	net.Conn
+	readBuffer, writeBuffer int
+}
+
+func (c *bufferConn) SetReadBuffer(bytes int) error {
+	c.readBuffer = bytes
+	return nil
+}
+
+func (c *bufferConn) SetWriteBuffer(bytes int) error {
+	c.writeBuffer = bytes
+	return nil
+}
+
+func TestSetSocketBuffers(t *testing.T) {
+	tests := []struct {
+		name          string
+		receive, send int
+	}{
+		{name: "sized", receive: 1 << 20, send: 2 << 20},
+		{name: "os defaults", receive: -1, send: -1},
+		{name: "receive only", receive: 1 << 20},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := &bufferConn{}
+			if err := setSocketBuffers(conn, tt.receive, tt.send); err != nil {
+				t.Fatal(err)
+			}
+			want := func(size int) int {
+				if size > 0 {
+					return size
+				}
+				return 0
+			}
+			if conn.readBuffer != want(tt.receive) || conn.writeBuffer != want(tt.send) {
+				t.Errorf("buffers = %d, %d, want %d, %d", conn.readBuffer, conn.writeBuffer, want(tt.receive), want(tt.send))
+			}
+		})
+	}
+}
+
+// keepAliveConn is a conn recording the TCP keepalive set on it.
+type keepAliveConn struct {
+	net.Conn
+	keepAlive       *bool
+	keepAlivePeriod time.Duration
+}
+
+func (c *keepAliveConn) SetKeepAlive(keepalive bool) error {
+	c.keepAlive = &keepalive
+	return nil
+}
+
+func (c *keepAliveConn) SetKeepAlivePeriod(d time.Duration) error {
+	c.keepAlivePeriod = d
+	return nil
+}
+
+func TestSetKeepAlive(t *testing.T) {
+	enabled, disabled := true, false
+	tests := []struct {
+		name       string
+		period     time.Duration
+		wantEnable *bool
+		wantPeriod time.Duration
+	}{
+		{name: "enabled", period: 30 * time.Second, wantEnable: &enabled, wantPeriod: 30 * time.Second},
+		{name: "disabled", period: -1, wantEnable: &disabled},
+		{name: "go default", period: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := &keepAliveConn{}
+			if err := setKeepAlive(conn, tt.period); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(conn.keepAlive, tt.wantEnable) || conn.keepAlivePeriod != tt.wantPeriod {
+				t.Errorf("keepalive = %v, %v, want %v, %v", conn.keepAlive, conn.keepAlivePeriod, tt.wantEnable, tt.wantPeriod)
+			}
+		})
+	}
+}
+
+// newMessageSet returns a message set of a v1 message with the value, as clients produce them.
+func newMessageSet(t *testing.T, value string) []byte {
+	m, err := protocol.Encode(&protocol.Message{MagicByte: 1, Timestamp: time.Unix(1, 0), Value: []byte(value)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return commitlog.NewMessageSet(0, commitlog.NewMessage(m))
+}
+
+func TestBroker_handleProduce_currentLeaderEpoch(t *testing.T) {
+	// a v2 record batch whose partition leader epoch is the producer's current leader epoch.
+	newRecordSet := func(epoch int32) []byte {
+		batch := make([]byte, 61+len("records"))
+		commitlog.Encoding.PutUint32(batch[0:4], uint32(epoch))
+		batch[4] = 2
+		commitlog.Encoding.PutUint64(batch[31:39], ^uint64(0))
+		copy(batch[61:], "records")
+		return commitlog.NewMessageSet(0, batch)
+	}
+	var appends int
+	f := newFields()
+	f.topicMap["the-topic"] = []*jocko.Partition{{
+		Topic:       "the-topic",
+		ID:          0,
+		Leader:      f.id,
+		LeaderEpoch: 5,
+		Replicas:    []int32{f.id},
+		CommitLog: &mock.CommitLog{
+			AppendFn: func(b []byte) (int64, error) {
+				appends++
+				return 0, nil
+			},
+		},
+	}}
+	b := &Broker{
+		logger:      f.logger,
+		id:          f.id,
+		topicMap:    f.topicMap,
+		replicators: f.replicators,
+		raft:        f.raft,
+		serf:        f.serf,
+	}
+	tests := []struct {
+		name  string
+		epoch int32
+		want  protocol.Error
+	}{
+		{name: "older epoch", epoch: 4, want: protocol.ErrFencedLeaderEpoch},
+		{name: "newer epoch", epoch: 6, want: protocol.ErrUnknownLeaderEpoch},
+		{name: "matching epoch", epoch: 5, want: protocol.ErrNone},
+		{name: "unknown to producer", epoch: -1, want: protocol.ErrNone},
+		{name: "unset by producer", epoch: 0, want: protocol.ErrNone},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			appends = 0
+			resp := b.handleProduce(nil, jocko.AnonymousPrincipal, &protocol.ProduceRequest{
+				Acks: 1,
+				TopicData: []*protocol.TopicData{{
+					Topic: "the-topic",
+					Data:  []*protocol.Data{{Partition: 0, RecordSet: newRecordSet(tt.epoch)}},
+				}},
+			}, nil)
+			if code := resp.Responses[0].PartitionResponses[0].ErrorCode; code != tt.want.Code() {
+				t.Fatalf("ErrorCode = %v, want %v", code, tt.want.Code())
+			}
+			if appended := appends == 1; appended != (tt.want == protocol.ErrNone) {
+				t.Errorf("appended = %v, want %v", appended, tt.want == protocol.ErrNone)
+			}
+		})
+	}
+}
+
+func TestBroker_handleProduce_idempotent(t *testing.T) {
+	// a v2 record batch of three records from an idempotent producer.
+	newRecordSet := func(epoch int16, baseSequence int32) []byte {
+		batch := make([]byte, 61+len("records"))
+		batch[4] = 2
+		commitlog.Encoding.PutUint32(batch[11:15], 2)
+		commitlog.Encoding.PutUint64(batch[31:39], 1)
+		commitlog.Encoding.PutUint16(batch[39:41], uint16(epoch))
+		commitlog.Encoding.PutUint32(batch[41:45], uint32(baseSequence))
+		copy(batch[61:], "records")
+		return commitlog.NewMessageSet(0, batch)
+	}
+	var appends int64
+	f := newFields()
+	f.topicMap["the-topic"] = []*jocko.Partition{{
+		Topic:    "the-topic",
+		ID:       0,
+		Leader:   f.id,
+		Replicas: []int32{f.id},
+		CommitLog: &mock.CommitLog{
+			AppendFn: func(b []byte) (int64, error) {
+				appends++
+				return (appends - 1) * 3, nil
+			},
+		},
+	}}
+	b := &Broker{
+		logger:      f.logger,
+		id:          f.id,
+		topicMap:    f.topicMap,
+		replicators: f.replicators,
+		raft:        f.raft,
+		serf:        f.serf,
+	}
+	produce := func(recordSet []byte) *protocol.ProducePartitionResponse {
+		resp := b.handleProduce(nil, jocko.AnonymousPrincipal, &protocol.ProduceRequest{
+			Acks: 1,
+			TopicData: []*protocol.TopicData{{
+				Topic: "the-topic",
+				Data:  []*protocol.Data{{Partition: 0, RecordSet: recordSet}},
+			}},
+		}, nil)
+		return resp.Responses[0].PartitionResponses[0]
+	}
+	tests := []struct {
+		name           string
+		recordSet      []byte
+		wantErr        protocol.Error
+		wantBaseOffset int64
+		wantAppends    int64
+	}{
+		{name: "first batch", recordSet: newRecordSet(0, 0), wantBaseOffset: 0, wantAppends: 1},
+		{name: "retried batch", recordSet: newRecordSet(0, 0), wantBaseOffset: 0, wantAppends: 1},
+		{name: "out of order batch", recordSet: newRecordSet(0, 4), wantErr: protocol.ErrOutOfOrderSequenceNumber, wantBaseOffset: -1, wantAppends: 1},
+		{name: "next batch", recordSet: newRecordSet(0, 3), wantBaseOffset: 3, wantAppends: 2},
+		{name: "retried next batch", recordSet: newRecordSet(0, 3), wantBaseOffset: 3, wantAppends: 2},
+		{name: "retried earlier batch", recordSet: newRecordSet(0, 0), wantBaseOffset: 0, wantAppends: 2},
+		{name: "third batch", recordSet: newRecordSet(0, 6), wantBaseOffset: 6, wantAppends: 3},
+		{name: "fourth batch", recordSet: newRecordSet(0, 9), wantBaseOffset: 9, wantAppends: 4},
+		{name: "fifth batch", recordSet: newRecordSet(0, 12), wantBaseOffset: 12, wantAppends: 5},
+		{name: "sixth batch", recordSet: newRecordSet(0, 15), wantBaseOffset: 15, wantAppends: 6},
+		{name: "retried oldest kept batch", recordSet: newRecordSet(0, 3), wantBaseOffset: 3, wantAppends: 6},
+		{name: "retried forgotten batch", recordSet: newRecordSet(0, 0), wantErr: protocol.ErrOutOfOrderSequenceNumber, wantBaseOffset: -1, wantAppends: 6},
+		{name: "new epoch", recordSet: newRecordSet(1, 0), wantBaseOffset: 18, wantAppends: 7},
+		{name: "fenced epoch", recordSet: newRecordSet(0, 18), wantErr: protocol.ErrInvalidProducerEpoch, wantBaseOffset: -1, wantAppends: 7},
+	}
+	for _, tt := range tests {
+		presp := produce(tt.recordSet)
+		if presp.ErrorCode != tt.wantErr.Code() {
+			t.Errorf("%s: ErrorCode = %v, want %v", tt.name, presp.ErrorCode, tt.wantErr.Code())
+		}
+		if presp.BaseOffset != tt.wantBaseOffset {
+			t.Errorf("%s: BaseOffset = %v, want %v", tt.name, presp.BaseOffset, tt.wantBaseOffset)
+		}
+		if appends != tt.wantAppends {
+			t.Errorf("%s: appends = %v, want %v", tt.name, appends, tt.wantAppends)
+		}
+	}
+}
+
+func TestProducerStates_expire(t *testing.T) {
+	const expiration = time.Minute
+	var states producerStates
+	tp := topicPartition{Topic: "the-topic", Partition: 0}
+	batch := func(producerID int64, baseSequence int32) commitlog.ProducerBatch {
+		return commitlog.ProducerBatch{ProducerID: producerID, BaseSequence: baseSequence, LastSequence: baseSequence + 2}
+	}
+	start := time.Now()
+	producers := states.partition(tp)
+	producers.update(batch(1, 0), 0, start)
+	producers.update(batch(2, 0), 3, start.Add(expiration/2))
+
+	// neither's been idle past the expiration, their state's kept.
+	states.expire(expiration, start.Add(expiration))
+	if _, _, err := producers.check(batch(1, 6)); err != protocol.ErrOutOfOrderSequenceNumber {
+		t.Errorf("check() of producer 1's out of order batch = %v, want %v", err, protocol.ErrOutOfOrderSequenceNumber)
+	}
+
+	// producer 1's idle past the expiration, its state's evicted and its next batch is accepted
+	// like a new producer's.
+	states.expire(expiration, start.Add(expiration+time.Second))
+	if _, duplicate, err := producers.check(batch(1, 6)); err != protocol.ErrNone || duplicate {
+		t.Errorf("check() of evicted producer's batch = %v, %v, want %v, false", duplicate, err, protocol.ErrNone)
+	}
+	if _, duplicate, err := producers.check(batch(2, 0)); err != protocol.ErrNone || !duplicate {
+		t.Errorf("check() of producer 2's retried batch = %v, %v, want %v, true", duplicate, err, protocol.ErrNone)
+	}
+}
+
+func TestBroker_handleFetch_minBytes(t *testing.T) {
+	ms := commitlog.NewMessageSet(0, commitlog.NewMessage([]byte("hello")))
+	tests := []struct {
+		name string
+		// appended is how many message sets each partition has when the fetch starts.
+		appended    []int
+		maxWaitTime int32
+		// during is done while the fetch waits.
+		during      func(b *Broker, cancel context.CancelFunc)
+		wantMinWait time.Duration
+		wantBytes   int32
+	}{
+		{name: "enough bytes across partitions", appended: []int{1, 1}, maxWaitTime: 10000, wantBytes: 2 * int32(len(ms))},
+		{name: "not enough bytes waits max wait time", appended: []int{1, 0}, maxWaitTime: 50, wantMinWait: 50 * time.Millisecond, wantBytes: int32(len(ms))},
+		{
+			name:        "append while waiting",
+			appended:    []int{1, 0},
+			maxWaitTime: 10000,
+			during: func(b *Broker, cancel context.CancelFunc) {
+				if _, err := b.topicMap["the-topic"][1].Append(ms); err != nil {
+					t.Error(err)
+				}
+			},
+			wantBytes: 2 * int32(len(ms)),
+		},
+		{
+			name:        "context done",
+			appended:    []int{0, 0},
+			maxWaitTime: 10000,
+			during:      func(b *Broker, cancel context.CancelFunc) { cancel() },
+		},
+		{
+			name:        "broker shut down",
+			appended:    []int{0, 0},
+			maxWaitTime: 10000,
+			during:      func(b *Broker, cancel context.CancelFunc) { close(b.shutdownCh) },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFields()
+			var partitions []*protocol.FetchPartition
+			for i, n := range tt.appended {
+				dir, err := ioutil.TempDir("", "jocko-fetch-min-bytes")
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer os.RemoveAll(dir)
+				clog, err := commitlog.New(commitlog.Options{Path: dir, MaxSegmentBytes: 1024})
+				if err != nil {
+					t.Fatal(err)
+				}
+				for j := 0; j < n; j++ {
+					if _, err := clog.Append(ms); err != nil {
+						t.Fatal(err)
+					}
+				}
+				f.topicMap["the-topic"] = append(f.topicMap["the-topic"], &jocko.Partition{
+					Topic:     "the-topic",
+					ID:        int32(i),
+					Leader:    f.id,
+					Replicas:  []int32{f.id},
+					ISR:       []int32{f.id},
+					CommitLog: clog,
+				})
+				partitions = append(partitions, &protocol.FetchPartition{Partition: int32(i), FetchOffset: 0, MaxBytes: 1024})
+			}
+			b := &Broker{
+				logger:      f.logger,
+				id:          f.id,
+				topicMap:    f.topicMap,
+				replicators: f.replicators,
+				raft:        f.raft,
+				serf:        f.serf,
+				shutdownCh:  make(chan struct{}),
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			respc := make(chan *protocol.FetchResponses)
+			start := time.Now()
+			go func() {
+				respc <- b.handleFetch(ctx, nil, &protocol.FetchRequest{
+					APIVersion:  5,
+					ReplicaID:   -1,
+					MinBytes:    int32(len(ms)) + 1,
+					MaxWaitTime: tt.maxWaitTime,
+					Topics:      []*protocol.FetchTopic{{Topic: "the-topic", Partitions: partitions}},
+				})
+			}()
+			if tt.during != nil {
+				time.Sleep(20 * time.Millisecond)
+				tt.during(b, cancel)
+			}
+			var resp *protocol.FetchResponses
+			select {
+			case resp = <-respc:
+			case <-time.After(5 * time.Second):
+				t.Fatal("fetch didn't return")
+			}
+			if elapsed := time.Since(start); elapsed < tt.wantMinWait {
+				t.Errorf("fetch returned after %v, want it to wait at least %v", elapsed, tt.wantMinWait)
+			}
+			var n int32
+			for _, p := range resp.Responses[0].PartitionResponses {
+				if p.ErrorCode != protocol.ErrNone.Code() {
+					t.Errorf("ErrorCode = %v, want %v", p.ErrorCode, protocol.ErrNone.Code())
+				}
+				n += p.RecordSetSize + int32(len(p.RecordSet))
+			}
+			if n != tt.wantBytes {
+				t.Errorf("fetched %d bytes, want %d", n, tt.wantBytes)
+			}
+		})
+	}
+}
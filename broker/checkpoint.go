@@ -0,0 +1,104 @@
+package broker
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// hwCheckpointFile is the name of the file in the log dir that checkpoints partitions'
+	// high watermarks, same as Kafka's.
+	hwCheckpointFile = "replication-offset-checkpoint"
+	// recoveryPointCheckpointFile is the name of the file in the log dir that checkpoints
+	// partitions' recovery points, same as Kafka's.
+	recoveryPointCheckpointFile = "recovery-point-offset-checkpoint"
+	// logStartOffsetCheckpointFile is the name of the file in the log dir that checkpoints
+	// partitions' log start offsets, same as Kafka's.
+	logStartOffsetCheckpointFile = "log-start-offset-checkpoint"
+	// checkpointVersion is the version of the checkpoint file format.
+	checkpointVersion = 0
+)
+
+// topicPartition identifies a partition in a checkpoint.
+type topicPartition struct {
+	Topic     string
+	Partition int32
+}
+
+// writeCheckpoint is used to write the offsets to the checkpoint file at path,
+// in Kafka's checkpoint file format: the version, the number of offsets, then
+// a "topic partition offset" line per offset. The file's replaced atomically.
+func writeCheckpoint(path string, offsets map[topicPartition]int64) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return errors.Wrap(err, "create checkpoint dir failed")
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return errors.Wrap(err, "create checkpoint failed")
+	}
+	defer os.Remove(f.Name())
+	w := bufio.NewWriter(f)
+	fmt.Fprintf(w, "%d\n%d\n", checkpointVersion, len(offsets))
+	for tp, offset := range offsets {
+		fmt.Fprintf(w, "%s %d %d\n", tp.Topic, tp.Partition, offset)
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return errors.Wrap(err, "write checkpoint failed")
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return errors.Wrap(err, "sync checkpoint failed")
+	}
+	if err := f.Close(); err != nil {
+		return errors.Wrap(err, "close checkpoint failed")
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// readCheckpoint is used to read the offsets in the checkpoint file at path. A
+// missing file has no offsets.
+func readCheckpoint(path string) (map[topicPartition]int64, error) {
+	offsets := make(map[topicPartition]int64)
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return offsets, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "read checkpoint failed")
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(lines) < 2 {
+		return nil, errors.Errorf("malformed checkpoint %s", path)
+	}
+	if v, err := strconv.Atoi(lines[0]); err != nil || v != checkpointVersion {
+		return nil, errors.Errorf("unknown checkpoint version %q in %s", lines[0], path)
+	}
+	n, err := strconv.Atoi(lines[1])
+	if err != nil || n != len(lines)-2 {
+		return nil, errors.Errorf("malformed checkpoint %s", path)
+	}
+	for _, line := range lines[2:] {
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, errors.Errorf("malformed checkpoint line %q in %s", line, path)
+		}
+		partition, err := strconv.ParseInt(fields[1], 10, 32)
+		if err != nil {
+			return nil, errors.Errorf("malformed checkpoint line %q in %s", line, path)
+		}
+		offset, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return nil, errors.Errorf("malformed checkpoint line %q in %s", line, path)
+		}
+		offsets[topicPartition{Topic: fields[0], Partition: int32(partition)}] = offset
+	}
+	return offsets, nil
+}
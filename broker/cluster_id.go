@@ -0,0 +1,55 @@
+package broker
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+)
+
+// clusterID is the cluster's ID, generated by the controller when the cluster's first bootstrapped.
+type clusterID struct {
+	ID string `json:"id"`
+}
+
+// checkClusterID is used by the controller to give the cluster an ID if it hasn't got one.
+func (b *Broker) checkClusterID() error {
+	if b.ClusterID() != "" {
+		return nil
+	}
+	id, err := newClusterID()
+	if err != nil {
+		return err
+	}
+	return b.raftApply(setClusterID, &clusterID{ID: id})
+}
+
+// newClusterID returns a random cluster ID, a base64 encoded UUID like Kafka's.
+func newClusterID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	// version 4, variant 1.
+	id[6] = id[6]&0x0f | 0x40
+	id[8] = id[8]&0x3f | 0x80
+	return base64.RawURLEncoding.EncodeToString(id), nil
+}
+
+// setClusterID is used to apply the cluster's ID. The first ID applied is the cluster's, IDs
+// applied after it, e.g. generated by a controller that hadn't seen it yet, are ignored, so every
+// broker agrees on it.
+func (b *Broker) setClusterID(c *clusterID) {
+	b.Lock()
+	defer b.Unlock()
+	if b.clusterID != "" || c.ID == "" {
+		return
+	}
+	b.clusterID = c.ID
+	b.logger.Info("cluster id is %s", c.ID)
+}
+
+// ClusterID returns the cluster's ID, empty if it hasn't been generated yet.
+func (b *Broker) ClusterID() string {
+	b.RLock()
+	defer b.RUnlock()
+	return b.clusterID
+}
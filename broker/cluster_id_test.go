@@ -0,0 +1,60 @@
+package broker
+
+import (
+	"testing"
+
+	"github.com/travisjeffery/jocko"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+func TestBroker_checkClusterID(t *testing.T) {
+	newBroker := func(id int32) (*Broker, fields) {
+		f := newFields()
+		f.id = id
+		f.raft.LeaderIDFn = func() string {
+			return ""
+		}
+		f.serf.ClusterFn = func() []*jocko.ClusterMember {
+			return nil
+		}
+		return &Broker{
+			logger:      f.logger,
+			id:          f.id,
+			topicMap:    f.topicMap,
+			replicators: f.replicators,
+			brokerAddr:  f.brokerAddr,
+			logDir:      f.logDir,
+			raft:        f.raft,
+			serf:        f.serf,
+		}, f
+	}
+	controller, f := newBroker(1)
+	other, _ := newBroker(2)
+	// raft applies the controller's commands on every broker.
+	f.raft.ApplyFn = func(c jocko.RaftCommand) error {
+		controller.apply(c)
+		other.apply(c)
+		return nil
+	}
+	if err := controller.checkClusterID(); err != nil {
+		t.Fatal(err)
+	}
+	id := controller.ClusterID()
+	if id == "" {
+		t.Fatal("the controller didn't generate a cluster id")
+	}
+	// checking again keeps the cluster's id, and an id proposed after the cluster has one, e.g.
+	// by a controller that hadn't seen it yet, is ignored.
+	if err := controller.checkClusterID(); err != nil {
+		t.Fatal(err)
+	}
+	if err := controller.raftApply(setClusterID, &clusterID{ID: "another-id"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range []*Broker{controller, other} {
+		resp := b.handleMetadata(nil, "", &protocol.MetadataRequest{APIVersion: 2})
+		if resp.ClusterID != id {
+			t.Errorf("broker %d ClusterID = %q, want %q", b.id, resp.ClusterID, id)
+		}
+	}
+}
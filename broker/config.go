@@ -0,0 +1,392 @@
+package broker
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/travisjeffery/jocko"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+// configType is the type of a config's values.
+type configType int
+
+const (
+	configString configType = iota
+	configInt
+	configLong
+	// configList values are comma-separated lists, which can be appended to and subtracted from.
+	configList
+	// configPassword values are sensitive, they're never described.
+	configPassword
+)
+
+// configDef is the definition of a config that can be set on a resource.
+type configDef struct {
+	Type configType
+	// Default is the config's value when it isn't set, the broker-level default.
+	Default string
+	// Synonym is the broker config a topic config inherits its value from when it isn't set on
+	// the topic, empty if it doesn't inherit one.
+	Synonym string
+	// Valid are the config's valid values, any value of its type is valid if it's empty.
+	Valid []string
+}
+
+// sensitive returns whether the config's values are sensitive, e.g. passwords.
+func (d configDef) sensitive() bool {
+	return d.Type == configPassword
+}
+
+// timestampTypes are the valid values of the message timestamp type configs.
+var timestampTypes = []string{"CreateTime", "LogAppendTime"}
+
+// topicConfigDefs are the configs that can be set on topics, with the same defaults and broker
+// synonyms as Kafka's.
+var topicConfigDefs = map[string]configDef{
+	"cleanup.policy":                          {Type: configList, Default: "delete", Synonym: "log.cleanup.policy"},
+	"retention.ms":                            {Type: configLong, Default: "604800000", Synonym: "log.retention.ms"},
+	"retention.bytes":                         {Type: configLong, Default: "-1", Synonym: "log.retention.bytes"},
+	"segment.bytes":                           {Type: configInt, Default: "1073741824", Synonym: "log.segment.bytes"},
+	"max.message.bytes":                       {Type: configInt, Default: "1048588", Synonym: "message.max.bytes"},
+	"min.insync.replicas":                     {Type: configInt, Default: "1", Synonym: "min.insync.replicas"},
+	"message.timestamp.type":                  {Type: configString, Default: "CreateTime", Synonym: "log.message.timestamp.type", Valid: timestampTypes},
+	"leader.replication.throttled.replicas":   {Type: configList},
+	"follower.replication.throttled.replicas": {Type: configList},
+}
+
+// brokerConfigDefs are the configs that can be set on brokers, with the same defaults as Kafka's.
+var brokerConfigDefs = map[string]configDef{
+	"leader.replication.throttled.rate":   {Type: configLong, Default: "9223372036854775807"},
+	"follower.replication.throttled.rate": {Type: configLong, Default: "9223372036854775807"},
+	// the defaults of the topic configs that inherit them.
+	"log.cleanup.policy":         {Type: configList, Default: "delete"},
+	"log.retention.ms":           {Type: configLong, Default: "604800000"},
+	"log.retention.bytes":        {Type: configLong, Default: "-1"},
+	"log.segment.bytes":          {Type: configInt, Default: "1073741824"},
+	"message.max.bytes":          {Type: configInt, Default: "1048588"},
+	"min.insync.replicas":        {Type: configInt, Default: "1"},
+	"log.message.timestamp.type": {Type: configString, Default: "CreateTime", Valid: timestampTypes},
+	// the SASL and SSL secrets, which are never described.
+	"sasl.jaas.config":        {Type: configPassword},
+	"ssl.key.password":        {Type: configPassword},
+	"ssl.keystore.password":   {Type: configPassword},
+	"ssl.truststore.password": {Type: configPassword},
+	// request.log.sample.rate isn't Kafka's: one in this many requests is logged at debug, 0 logs none.
+	requestLogSampleRateConfig: {Type: configInt, Default: "0"},
+}
+
+// configResource is a resource configs are set on, a topic or a broker.
+type configResource struct {
+	Type int8
+	Name string
+}
+
+// resourceConfigs is a resource's configs, used to apply the changes made by the controller.
+type resourceConfigs struct {
+	Type    int8              `json:"type"`
+	Name    string            `json:"name"`
+	Configs map[string]string `json:"configs"`
+}
+
+// handleIncrementalAlterConfigs is used by the controller to set, delete, append to or subtract
+// from resources' config entries. A resource's operations are validated together and applied
+// together, or not at all if any is invalid.
+func (b *Broker) handleIncrementalAlterConfigs(header *protocol.RequestHeader, principal string, req *protocol.IncrementalAlterConfigsRequest) *protocol.IncrementalAlterConfigsResponse {
+	resp := &protocol.IncrementalAlterConfigsResponse{APIVersion: req.APIVersion}
+	resp.Resources = make([]*protocol.AlterConfigsResourceResponse, len(req.Resources))
+	controllerErr := b.controllerOnly()
+	for i, res := range req.Resources {
+		err := controllerErr
+		if err == protocol.ErrNone {
+			err = b.alterResourceConfigs(principal, res, req.ValidateOnly)
+		}
+		rresp := &protocol.AlterConfigsResourceResponse{
+			ErrorCode: err.Code(),
+			Type:      res.Type,
+			Name:      res.Name,
+		}
+		if err != protocol.ErrNone {
+			rresp.ErrorMessage = err.Error()
+		}
+		resp.Resources[i] = rresp
+	}
+	return resp
+}
+
+// alterResourceConfigs is used to validate and apply the operations on the resource's configs.
+func (b *Broker) alterResourceConfigs(principal string, res *protocol.AlterConfigsResource, validateOnly bool) protocol.Error {
+	var defs map[string]configDef
+	switch res.Type {
+	case protocol.ConfigResourceTopic:
+		if !b.authorize(principal, jocko.OpAlterConfigs, jocko.Resource{Type: jocko.ResourceTopic, Name: res.Name}) {
+			return protocol.ErrTopicAuthorizationFailed
+		}
+		if _, err := b.topicPartitions(res.Name); err != protocol.ErrNone {
+			return err
+		}
+		defs = topicConfigDefs
+	case protocol.ConfigResourceBroker:
+		if !b.authorize(principal, jocko.OpAlterConfigs, jocko.Resource{Type: jocko.ResourceCluster, Name: jocko.ClusterResourceName}) {
+			return protocol.ErrClusterAuthorizationFailed
+		}
+		// the empty name is the cluster-wide default for every broker.
+		if _, err := strconv.Atoi(res.Name); res.Name != "" && err != nil {
+			return protocol.ErrInvalidRequest.WithErr(fmt.Errorf("invalid broker id %q", res.Name))
+		}
+		defs = brokerConfigDefs
+	default:
+		return protocol.ErrInvalidRequest.WithErr(fmt.Errorf("unsupported resource type %d", res.Type))
+	}
+	configs, err := applyConfigOps(b.configsFor(res.Type, res.Name), defs, res.Configs)
+	if err != protocol.ErrNone || validateOnly {
+		return err
+	}
+	if err := b.raftApply(alterConfigs, &resourceConfigs{Type: res.Type, Name: res.Name, Configs: configs}); err != nil {
+		return protocol.ErrUnknown.WithErr(err)
+	}
+	return protocol.ErrNone
+}
+
+// applyConfigOps returns the configs after the operations, or an error if any operation is invalid.
+// The given configs aren't changed.
+func applyConfigOps(configs map[string]string, defs map[string]configDef, ops []*protocol.AlterableConfig) (map[string]string, protocol.Error) {
+	altered := make(map[string]string, len(configs))
+	for k, v := range configs {
+		altered[k] = v
+	}
+	seen := make(map[string]bool, len(ops))
+	for _, op := range ops {
+		if seen[op.Name] {
+			return nil, protocol.ErrInvalidRequest.WithErr(fmt.Errorf("config %s is altered more than once", op.Name))
+		}
+		seen[op.Name] = true
+		def, ok := defs[op.Name]
+		if !ok {
+			return nil, protocol.ErrInvalidConfig.WithErr(fmt.Errorf("unknown config %s", op.Name))
+		}
+		switch op.Operation {
+		case protocol.ConfigOperationSet:
+			if err := def.validate(op.Value); err != nil {
+				return nil, protocol.ErrInvalidConfig.WithErr(fmt.Errorf("invalid value %q for config %s: %v", op.Value, op.Name, err))
+			}
+			altered[op.Name] = op.Value
+		case protocol.ConfigOperationDelete:
+			delete(altered, op.Name)
+		case protocol.ConfigOperationAppend, protocol.ConfigOperationSubtract:
+			if def.Type != configList {
+				return nil, protocol.ErrInvalidConfig.WithErr(fmt.Errorf("config %s isn't a list", op.Name))
+			}
+			value, ok := altered[op.Name]
+			if !ok {
+				value = def.Default
+			}
+			values := splitList(value)
+			for _, v := range splitList(op.Value) {
+				i := indexOf(values, v)
+				switch {
+				case op.Operation == protocol.ConfigOperationAppend && i == -1:
+					values = append(values, v)
+				case op.Operation == protocol.ConfigOperationSubtract && i != -1:
+					values = append(values[:i], values[i+1:]...)
+				}
+			}
+			altered[op.Name] = strings.Join(values, ",")
+		default:
+			return nil, protocol.ErrInvalidRequest.WithErr(fmt.Errorf("unknown config operation %d", op.Operation))
+		}
+	}
+	return altered, protocol.ErrNone
+}
+
+// handleDescribeConfigs is used to describe resources' configs. Configs that aren't set on the
+// resource report the value they inherit, with its source, e.g. topic configs that aren't set
+// report the broker-level default.
+func (b *Broker) handleDescribeConfigs(header *protocol.RequestHeader, principal string, req *protocol.DescribeConfigsRequest) *protocol.DescribeConfigsResponse {
+	resp := &protocol.DescribeConfigsResponse{APIVersion: req.APIVersion}
+	resp.Results = make([]*protocol.DescribeConfigsResult, len(req.Resources))
+	for i, res := range req.Resources {
+		result := &protocol.DescribeConfigsResult{Type: res.Type, Name: res.Name}
+		resp.Results[i] = result
+		defs, err := b.describableConfigs(principal, res)
+		if err != protocol.ErrNone {
+			result.ErrorCode = err.Code()
+			result.ErrorMessage = err.Error()
+			continue
+		}
+		names := res.ConfigNames
+		if names == nil {
+			for name := range defs {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+		}
+		for _, name := range names {
+			if _, ok := defs[name]; !ok {
+				continue
+			}
+			entry := b.describeConfig(res.Type, res.Name, name, defs)
+			if !req.IncludeSynonyms {
+				entry.Synonyms = nil
+			}
+			result.Configs = append(result.Configs, entry)
+		}
+	}
+	return resp
+}
+
+// describeConfig is used to describe the resource's config, defined in defs, with its synonyms.
+func (b *Broker) describeConfig(resourceType int8, resourceName, config string, defs map[string]configDef) *protocol.DescribeConfigsEntry {
+	synonyms := b.resolveConfig(resourceType, resourceName, config, defs)
+	sensitive := defs[config].sensitive()
+	if sensitive {
+		// sensitive values are redacted to null, as Kafka does, empty values are encoded as null.
+		// only where they come from is described.
+		for _, s := range synonyms {
+			s.Value = ""
+		}
+	}
+	return &protocol.DescribeConfigsEntry{
+		Name:        config,
+		Value:       synonyms[0].Value,
+		Source:      synonyms[0].Source,
+		IsDefault:   synonyms[0].Source == protocol.ConfigSourceDefaultConfig,
+		IsSensitive: sensitive,
+		Synonyms:    synonyms,
+	}
+}
+
+// describableConfigs is used to check the resource's configs can be described, returning the
+// definitions of its configs.
+func (b *Broker) describableConfigs(principal string, res *protocol.DescribeConfigsResource) (map[string]configDef, protocol.Error) {
+	switch res.Type {
+	case protocol.ConfigResourceTopic:
+		if !b.authorize(principal, jocko.OpDescribeConfigs, jocko.Resource{Type: jocko.ResourceTopic, Name: res.Name}) {
+			return nil, protocol.ErrTopicAuthorizationFailed
+		}
+		if _, err := b.topicPartitions(res.Name); err != protocol.ErrNone {
+			return nil, err
+		}
+		return topicConfigDefs, protocol.ErrNone
+	case protocol.ConfigResourceBroker:
+		if !b.authorize(principal, jocko.OpDescribeConfigs, jocko.Resource{Type: jocko.ResourceCluster, Name: jocko.ClusterResourceName}) {
+			return nil, protocol.ErrClusterAuthorizationFailed
+		}
+		if _, err := strconv.Atoi(res.Name); res.Name != "" && err != nil {
+			return nil, protocol.ErrInvalidRequest.WithErr(fmt.Errorf("invalid broker id %q", res.Name))
+		}
+		return brokerConfigDefs, protocol.ErrNone
+	}
+	return nil, protocol.ErrInvalidRequest.WithErr(fmt.Errorf("unsupported resource type %d", res.Type))
+}
+
+// resolveConfig returns the values the resource's config has, in order of precedence, so the
+// first is its value: the value set on the resource, then the value set on this broker and the
+// value set as the default for every broker, for brokers' configs and the broker configs topic
+// configs inherit, then the config's default.
+func (b *Broker) resolveConfig(resourceType int8, name, config string, defs map[string]configDef) []*protocol.DescribeConfigsSynonym {
+	var synonyms []*protocol.DescribeConfigsSynonym
+	add := func(resourceType int8, resourceName, config string, source int8) {
+		if v, ok := b.configsFor(resourceType, resourceName)[config]; ok {
+			synonyms = append(synonyms, &protocol.DescribeConfigsSynonym{Name: config, Value: v, Source: source})
+		}
+	}
+	if resourceType == protocol.ConfigResourceTopic {
+		add(protocol.ConfigResourceTopic, name, config, protocol.ConfigSourceDynamicTopicConfig)
+		synonym := defs[config].Synonym
+		if synonym == "" {
+			return append(synonyms, &protocol.DescribeConfigsSynonym{
+				Name:   config,
+				Value:  defs[config].Default,
+				Source: protocol.ConfigSourceDefaultConfig,
+			})
+		}
+		// the rest of the chain is the broker config the topic config inherits.
+		name, config, defs = strconv.Itoa(int(b.id)), synonym, brokerConfigDefs
+	}
+	if name != "" {
+		add(protocol.ConfigResourceBroker, name, config, protocol.ConfigSourceDynamicBrokerConfig)
+	}
+	add(protocol.ConfigResourceBroker, "", config, protocol.ConfigSourceDynamicDefaultBrokerConfig)
+	return append(synonyms, &protocol.DescribeConfigsSynonym{
+		Name:   config,
+		Value:  defs[config].Default,
+		Source: protocol.ConfigSourceDefaultConfig,
+	})
+}
+
+// validate returns an error if the value isn't valid for the config.
+func (d configDef) validate(value string) error {
+	var err error
+	switch d.Type {
+	case configInt:
+		_, err = strconv.ParseInt(value, 10, 32)
+	case configLong:
+		_, err = strconv.ParseInt(value, 10, 64)
+	}
+	if err == nil && len(d.Valid) > 0 && indexOf(d.Valid, value) == -1 {
+		err = fmt.Errorf("must be one of %s", strings.Join(d.Valid, ", "))
+	}
+	return err
+}
+
+// setConfigs is used to apply the resource's configs, made by the controller, on this broker.
+func (b *Broker) setConfigs(rc *resourceConfigs) {
+	b.Lock()
+	defer b.Unlock()
+	if b.configs == nil {
+		b.configs = make(map[configResource]map[string]string)
+	}
+	res := configResource{Type: rc.Type, Name: rc.Name}
+	if len(rc.Configs) == 0 {
+		delete(b.configs, res)
+		return
+	}
+	b.configs[res] = rc.Configs
+}
+
+// configsFor returns the configs explicitly set on the resource.
+func (b *Broker) configsFor(resourceType int8, name string) map[string]string {
+	b.RLock()
+	defer b.RUnlock()
+	return b.configs[configResource{Type: resourceType, Name: name}]
+}
+
+// topicConfig returns the value of the topic's config: the value set on it, or else the value of
+// the broker config it inherits, or else the config's default.
+func (b *Broker) topicConfig(topic, config string) string {
+	return b.resolveConfig(protocol.ConfigResourceTopic, topic, config, topicConfigDefs)[0].Value
+}
+
+// brokerConfig returns the value of this broker's config: the value set on it, or else the value
+// set for every broker, or else the config's default.
+func (b *Broker) brokerConfig(config string) string {
+	return b.resolveConfig(protocol.ConfigResourceBroker, strconv.Itoa(int(b.id)), config, brokerConfigDefs)[0].Value
+}
+
+// splitList returns the values of the list config's value.
+func splitList(value string) []string {
+	if value == "" {
+		return nil
+	}
+	return strings.Split(value, ",")
+}
+
+// replicationThrottled returns whether the topic's config, leader or
+// follower.replication.throttled.replicas, lists the partition's replica on the broker, as
+// partition:broker or as * for every replica.
+func (b *Broker) replicationThrottled(config, topic string, partition, broker int32) bool {
+	replicas := splitList(b.topicConfig(topic, config))
+	return indexOf(replicas, "*") != -1 || indexOf(replicas, fmt.Sprintf("%d:%d", partition, broker)) != -1
+}
+
+func indexOf(values []string, v string) int {
+	for i, vi := range values {
+		if vi == v {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,327 @@
+package broker
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/travisjeffery/jocko"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+func TestBroker_handleIncrementalAlterConfigs(t *testing.T) {
+	tests := []struct {
+		name        string
+		configs     map[string]string
+		ops         []*protocol.AlterableConfig
+		wantErr     protocol.Error
+		wantConfigs map[string]string
+	}{
+		{
+			name:        "set",
+			configs:     map[string]string{"retention.ms": "1000"},
+			ops:         []*protocol.AlterableConfig{{Name: "retention.ms", Operation: protocol.ConfigOperationSet, Value: "2000"}},
+			wantConfigs: map[string]string{"retention.ms": "2000"},
+		},
+		{
+			name:        "delete",
+			configs:     map[string]string{"retention.ms": "1000", "retention.bytes": "1024"},
+			ops:         []*protocol.AlterableConfig{{Name: "retention.ms", Operation: protocol.ConfigOperationDelete}},
+			wantConfigs: map[string]string{"retention.bytes": "1024"},
+		},
+		{
+			name:    "append to list",
+			configs: map[string]string{"follower.replication.throttled.replicas": "0:1"},
+			ops: []*protocol.AlterableConfig{
+				{Name: "follower.replication.throttled.replicas", Operation: protocol.ConfigOperationAppend, Value: "0:1,1:2"},
+			},
+			wantConfigs: map[string]string{"follower.replication.throttled.replicas": "0:1,1:2"},
+		},
+		{
+			name: "append to unset list",
+			ops: []*protocol.AlterableConfig{
+				{Name: "cleanup.policy", Operation: protocol.ConfigOperationAppend, Value: "compact"},
+			},
+			wantConfigs: map[string]string{"cleanup.policy": "delete,compact"},
+		},
+		{
+			name:    "subtract from list",
+			configs: map[string]string{"cleanup.policy": "compact,delete"},
+			ops: []*protocol.AlterableConfig{
+				{Name: "cleanup.policy", Operation: protocol.ConfigOperationSubtract, Value: "compact"},
+			},
+			wantConfigs: map[string]string{"cleanup.policy": "delete"},
+		},
+		{
+			name:        "append to non-list",
+			configs:     map[string]string{"retention.ms": "1000"},
+			ops:         []*protocol.AlterableConfig{{Name: "retention.ms", Operation: protocol.ConfigOperationAppend, Value: "2000"}},
+			wantErr:     protocol.ErrInvalidConfig,
+			wantConfigs: map[string]string{"retention.ms": "1000"},
+		},
+		{
+			name:    "invalid value",
+			configs: map[string]string{"retention.ms": "1000"},
+			ops: []*protocol.AlterableConfig{
+				{Name: "retention.bytes", Operation: protocol.ConfigOperationSet, Value: "1024"},
+				{Name: "retention.ms", Operation: protocol.ConfigOperationSet, Value: "forever"},
+			},
+			wantErr:     protocol.ErrInvalidConfig,
+			wantConfigs: map[string]string{"retention.ms": "1000"},
+		},
+		{
+			name:        "set timestamp type",
+			ops:         []*protocol.AlterableConfig{{Name: "message.timestamp.type", Operation: protocol.ConfigOperationSet, Value: "LogAppendTime"}},
+			wantConfigs: map[string]string{"message.timestamp.type": "LogAppendTime"},
+		},
+		{
+			name:        "invalid timestamp type",
+			configs:     map[string]string{"message.timestamp.type": "LogAppendTime"},
+			ops:         []*protocol.AlterableConfig{{Name: "message.timestamp.type", Operation: protocol.ConfigOperationSet, Value: "AppendTime"}},
+			wantErr:     protocol.ErrInvalidConfig,
+			wantConfigs: map[string]string{"message.timestamp.type": "LogAppendTime"},
+		},
+		{
+			name:        "unknown config",
+			ops:         []*protocol.AlterableConfig{{Name: "not.a.config", Operation: protocol.ConfigOperationSet, Value: "1"}},
+			wantErr:     protocol.ErrInvalidConfig,
+			wantConfigs: nil,
+		},
+		{
+			name:        "unknown operation",
+			ops:         []*protocol.AlterableConfig{{Name: "retention.ms", Operation: 4, Value: "1"}},
+			wantErr:     protocol.ErrInvalidRequest,
+			wantConfigs: nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFields()
+			f.raft.IsLeaderFn = func() bool {
+				return true
+			}
+			f.topicMap["the-topic"] = []*jocko.Partition{{Topic: "the-topic", ID: 0}}
+			b := &Broker{
+				logger:      f.logger,
+				id:          f.id,
+				topicMap:    f.topicMap,
+				replicators: f.replicators,
+				brokerAddr:  f.brokerAddr,
+				logDir:      f.logDir,
+				raft:        f.raft,
+				serf:        f.serf,
+				shutdownCh:  f.shutdownCh,
+			}
+			// apply the command as raft would.
+			f.raft.ApplyFn = func(c jocko.RaftCommand) error {
+				b.apply(c)
+				return nil
+			}
+			b.setConfigs(&resourceConfigs{Type: protocol.ConfigResourceTopic, Name: "the-topic", Configs: tt.configs})
+			resp := b.handleIncrementalAlterConfigs(nil, jocko.AnonymousPrincipal, &protocol.IncrementalAlterConfigsRequest{
+				Resources: []*protocol.AlterConfigsResource{{
+					Type:    protocol.ConfigResourceTopic,
+					Name:    "the-topic",
+					Configs: tt.ops,
+				}},
+			})
+			if code := resp.Resources[0].ErrorCode; code != tt.wantErr.Code() {
+				t.Errorf("ErrorCode = %v, want %v", code, tt.wantErr.Code())
+			}
+			if got := b.configsFor(protocol.ConfigResourceTopic, "the-topic"); !reflect.DeepEqual(got, tt.wantConfigs) {
+				t.Errorf("configs = %v, want %v", got, tt.wantConfigs)
+			}
+		})
+	}
+}
+
+func TestBroker_handleIncrementalAlterConfigs_unknownTopic(t *testing.T) {
+	f := newFields()
+	f.raft.IsLeaderFn = func() bool {
+		return true
+	}
+	b := &Broker{
+		logger:   f.logger,
+		id:       f.id,
+		topicMap: f.topicMap,
+		raft:     f.raft,
+		serf:     f.serf,
+	}
+	resp := b.handleIncrementalAlterConfigs(nil, jocko.AnonymousPrincipal, &protocol.IncrementalAlterConfigsRequest{
+		Resources: []*protocol.AlterConfigsResource{{
+			Type:    protocol.ConfigResourceTopic,
+			Name:    "the-topic",
+			Configs: []*protocol.AlterableConfig{{Name: "retention.ms", Operation: protocol.ConfigOperationSet, Value: "1000"}},
+		}},
+	})
+	if code := resp.Resources[0].ErrorCode; code != protocol.ErrUnknownTopicOrPartition.Code() {
+		t.Errorf("ErrorCode = %v, want %v", code, protocol.ErrUnknownTopicOrPartition.Code())
+	}
+}
+
+func TestBroker_handleDescribeConfigs(t *testing.T) {
+	f := newFields()
+	f.topicMap["the-topic"] = []*jocko.Partition{{Topic: "the-topic", ID: 0}}
+	b := &Broker{
+		logger:   f.logger,
+		id:       f.id,
+		topicMap: f.topicMap,
+		raft:     f.raft,
+		serf:     f.serf,
+	}
+	b.setConfigs(&resourceConfigs{Type: protocol.ConfigResourceTopic, Name: "the-topic", Configs: map[string]string{"retention.ms": "1000"}})
+	resp := b.handleDescribeConfigs(nil, jocko.AnonymousPrincipal, &protocol.DescribeConfigsRequest{
+		APIVersion: 1,
+		Resources: []*protocol.DescribeConfigsResource{{
+			Type:        protocol.ConfigResourceTopic,
+			Name:        "the-topic",
+			ConfigNames: []string{"retention.ms", "retention.bytes"},
+		}},
+		IncludeSynonyms: true,
+	})
+	result := resp.Results[0]
+	if result.ErrorCode != protocol.ErrNone.Code() {
+		t.Fatalf("ErrorCode = %v, want %v", result.ErrorCode, protocol.ErrNone.Code())
+	}
+	want := []*protocol.DescribeConfigsEntry{
+		{
+			Name:   "retention.ms",
+			Value:  "1000",
+			Source: protocol.ConfigSourceDynamicTopicConfig,
+			Synonyms: []*protocol.DescribeConfigsSynonym{
+				{Name: "retention.ms", Value: "1000", Source: protocol.ConfigSourceDynamicTopicConfig},
+				{Name: "log.retention.ms", Value: "604800000", Source: protocol.ConfigSourceDefaultConfig},
+			},
+		},
+		{
+			// unset, so it's inherited from the broker default.
+			Name:      "retention.bytes",
+			Value:     "-1",
+			Source:    protocol.ConfigSourceDefaultConfig,
+			IsDefault: true,
+			Synonyms: []*protocol.DescribeConfigsSynonym{
+				{Name: "log.retention.bytes", Value: "-1", Source: protocol.ConfigSourceDefaultConfig},
+			},
+		},
+	}
+	if !reflect.DeepEqual(result.Configs, want) {
+		t.Errorf("Configs = %v, want %v", result.Configs, want)
+	}
+
+	// all the configs are described when none are named.
+	resp = b.handleDescribeConfigs(nil, jocko.AnonymousPrincipal, &protocol.DescribeConfigsRequest{
+		Resources: []*protocol.DescribeConfigsResource{{Type: protocol.ConfigResourceTopic, Name: "the-topic"}},
+	})
+	if got := len(resp.Results[0].Configs); got != len(topicConfigDefs) {
+		t.Errorf("len(Configs) = %v, want %v", got, len(topicConfigDefs))
+	}
+}
+
+func TestBroker_handleDescribeConfigs_synonyms(t *testing.T) {
+	f := newFields()
+	f.topicMap["the-topic"] = []*jocko.Partition{{Topic: "the-topic", ID: 0}}
+	b := &Broker{
+		logger:   f.logger,
+		id:       f.id,
+		topicMap: f.topicMap,
+		raft:     f.raft,
+		serf:     f.serf,
+	}
+	describe := func(res *protocol.DescribeConfigsResource) *protocol.DescribeConfigsEntry {
+		resp := b.handleDescribeConfigs(nil, jocko.AnonymousPrincipal, &protocol.DescribeConfigsRequest{
+			APIVersion:      1,
+			Resources:       []*protocol.DescribeConfigsResource{res},
+			IncludeSynonyms: true,
+		})
+		if code := resp.Results[0].ErrorCode; code != protocol.ErrNone.Code() {
+			t.Fatalf("ErrorCode = %v, want %v", code, protocol.ErrNone.Code())
+		}
+		return resp.Results[0].Configs[0]
+	}
+
+	t.Run("topic config", func(t *testing.T) {
+		b.setConfigs(&resourceConfigs{Type: protocol.ConfigResourceTopic, Name: "the-topic", Configs: map[string]string{"retention.ms": "1000"}})
+		b.setConfigs(&resourceConfigs{Type: protocol.ConfigResourceBroker, Name: "1", Configs: map[string]string{"log.retention.ms": "2000"}})
+		b.setConfigs(&resourceConfigs{Type: protocol.ConfigResourceBroker, Name: "", Configs: map[string]string{"log.retention.ms": "3000"}})
+		got := describe(&protocol.DescribeConfigsResource{Type: protocol.ConfigResourceTopic, Name: "the-topic", ConfigNames: []string{"retention.ms"}})
+		want := &protocol.DescribeConfigsEntry{
+			Name:   "retention.ms",
+			Value:  "1000",
+			Source: protocol.ConfigSourceDynamicTopicConfig,
+			Synonyms: []*protocol.DescribeConfigsSynonym{
+				{Name: "retention.ms", Value: "1000", Source: protocol.ConfigSourceDynamicTopicConfig},
+				{Name: "log.retention.ms", Value: "2000", Source: protocol.ConfigSourceDynamicBrokerConfig},
+				{Name: "log.retention.ms", Value: "3000", Source: protocol.ConfigSourceDynamicDefaultBrokerConfig},
+				{Name: "log.retention.ms", Value: "604800000", Source: protocol.ConfigSourceDefaultConfig},
+			},
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("retention.ms = %+v, want %+v", got, want)
+		}
+
+		// without the topic override the topic inherits this broker's value.
+		b.setConfigs(&resourceConfigs{Type: protocol.ConfigResourceTopic, Name: "the-topic"})
+		if got := b.topicConfig("the-topic", "retention.ms"); got != "2000" {
+			t.Errorf("topicConfig() = %v, want 2000", got)
+		}
+		got = describe(&protocol.DescribeConfigsResource{Type: protocol.ConfigResourceTopic, Name: "the-topic", ConfigNames: []string{"retention.ms"}})
+		if got.Value != "2000" || got.Source != protocol.ConfigSourceDynamicBrokerConfig || len(got.Synonyms) != 3 {
+			t.Errorf("retention.ms = %+v, want the broker's value", got)
+		}
+	})
+
+	t.Run("sensitive config", func(t *testing.T) {
+		b.setConfigs(&resourceConfigs{Type: protocol.ConfigResourceBroker, Name: "1", Configs: map[string]string{"ssl.keystore.password": "hunter2"}})
+		got := describe(&protocol.DescribeConfigsResource{Type: protocol.ConfigResourceBroker, Name: "1", ConfigNames: []string{"ssl.keystore.password"}})
+		want := &protocol.DescribeConfigsEntry{
+			Name:        "ssl.keystore.password",
+			Source:      protocol.ConfigSourceDynamicBrokerConfig,
+			IsSensitive: true,
+			Synonyms: []*protocol.DescribeConfigsSynonym{
+				{Name: "ssl.keystore.password", Source: protocol.ConfigSourceDynamicBrokerConfig},
+				{Name: "ssl.keystore.password", Source: protocol.ConfigSourceDefaultConfig},
+			},
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("ssl.keystore.password = %+v, want %+v", got, want)
+		}
+		// it's only redacted in the response.
+		if got := b.configsFor(protocol.ConfigResourceBroker, "1")["ssl.keystore.password"]; got != "hunter2" {
+			t.Errorf("config = %v, want hunter2", got)
+		}
+	})
+}
+
+func TestBroker_replicationThrottled(t *testing.T) {
+	f := newFields()
+	b := &Broker{
+		logger: f.logger,
+		id:     f.id,
+		raft:   f.raft,
+		serf:   f.serf,
+	}
+	b.setConfigs(&resourceConfigs{Type: protocol.ConfigResourceTopic, Name: "the-topic", Configs: map[string]string{
+		"follower.replication.throttled.replicas": "0:1,1:2",
+	}})
+	b.setConfigs(&resourceConfigs{Type: protocol.ConfigResourceTopic, Name: "every-replica", Configs: map[string]string{
+		"leader.replication.throttled.replicas": "*",
+	}})
+	tests := []struct {
+		config    string
+		topic     string
+		partition int32
+		broker    int32
+		want      bool
+	}{
+		{"follower.replication.throttled.replicas", "the-topic", 0, 1, true},
+		{"follower.replication.throttled.replicas", "the-topic", 1, 2, true},
+		{"follower.replication.throttled.replicas", "the-topic", 0, 2, false},
+		{"leader.replication.throttled.replicas", "the-topic", 0, 1, false},
+		{"leader.replication.throttled.replicas", "every-replica", 3, 2, true},
+		{"follower.replication.throttled.replicas", "other-topic", 0, 1, false},
+	}
+	for _, tt := range tests {
+		if got := b.replicationThrottled(tt.config, tt.topic, tt.partition, tt.broker); got != tt.want {
+			t.Errorf("replicationThrottled(%q, %q, %d, %d) = %v, want %v", tt.config, tt.topic, tt.partition, tt.broker, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package broker
+
+import (
+	"unicode/utf16"
+
+	"github.com/travisjeffery/jocko"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+// transactionStateTopic is the internal topic transactions' state is stored in.
+const transactionStateTopic = "__transaction_state"
+
+// transactionCoordinator is used to find the broker coordinating the transactional ID: the leader
+// of the transaction state log partition the ID hashes to.
+func (b *Broker) transactionCoordinator(transactionalID string) (*jocko.ClusterMember, protocol.Error) {
+	if b.transactionStateLogNumPartitions <= 0 {
+		return nil, protocol.ErrCoordinatorNotAvailable
+	}
+	id := partitionFor(transactionalID, b.transactionStateLogNumPartitions)
+	p, err := b.partition(transactionStateTopic, id)
+	if err != protocol.ErrNone {
+		// the controller hasn't created the log yet.
+		return nil, protocol.ErrCoordinatorNotAvailable
+	}
+	leader := b.clusterMember(p.LeaderID())
+	if leader == nil {
+		return nil, protocol.ErrCoordinatorNotAvailable
+	}
+	return leader, protocol.ErrNone
+}
+
+// partitionFor returns the partition of an internal topic with the given number of partitions the
+// key hashes to. Like Kafka, it's the absolute value of the key's Java string hash code modulo the
+// number of partitions, so the partition's the same as Kafka's for the same key.
+func partitionFor(key string, numPartitions int32) int32 {
+	var h int32
+	for _, c := range utf16.Encode([]rune(key)) {
+		h = 31*h + int32(c)
+	}
+	// Kafka's Utils.abs maps MinInt32 to 0 rather than overflowing.
+	return (h & 0x7fffffff) % numPartitions
+}
@@ -0,0 +1,169 @@
+package broker
+
+import (
+	"sync"
+	"time"
+
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+// replicaOffsets tracks the offsets followers fetch the partitions this broker leads from, i.e.
+// their log end offsets, so acks=all produces can wait for the ISR to replicate their records.
+type replicaOffsets struct {
+	mu      sync.Mutex
+	offsets map[topicPartition]map[int32]int64
+}
+
+// set is used to record the offset the replica fetched the partition from.
+func (o *replicaOffsets) set(tp topicPartition, replica int32, offset int64) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.offsets == nil {
+		o.offsets = make(map[topicPartition]map[int32]int64)
+	}
+	if o.offsets[tp] == nil {
+		o.offsets[tp] = make(map[int32]int64)
+	}
+	o.offsets[tp][replica] = offset
+}
+
+// offset is used to get the offset the replica last fetched the partition from, and false if it
+// hasn't fetched it.
+func (o *replicaOffsets) offset(tp topicPartition, replica int32) (int64, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	offset, ok := o.offsets[tp][replica]
+	return offset, ok
+}
+
+// remove is used to forget the followers' offsets of the topic's partitions, e.g. when it's deleted.
+func (o *replicaOffsets) remove(topic string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for tp := range o.offsets {
+		if tp.Topic == topic {
+			delete(o.offsets, tp)
+		}
+	}
+}
+
+// delayedProduce is an acks=all produce waiting for the ISRs of the partitions it appended to to
+// replicate its records. Rather than holding up a request handler, which the followers need to
+// fetch the records, it's responded to by whoever completes it: a follower's fetch, a change to a
+// partition's ISR or leader, or its timeout.
+type delayedProduce struct {
+	resp *protocol.ProduceResponses
+	// pending are the responses of the partitions whose ISR hasn't replicated the records yet.
+	pending []pendingProduce
+	// partitions are the partitions the produce was waiting on when it was delayed.
+	partitions []topicPartition
+	respond    func(protocol.ResponseBody)
+	timer      *time.Timer
+	done       bool
+}
+
+// pendingProduce is the response of a partition whose ISR an acks=all produce is waiting on.
+type pendingProduce struct {
+	tp    topicPartition
+	presp *protocol.ProducePartitionResponse
+}
+
+// delayedProduces are the acks=all produces waiting on the partitions this broker leads.
+type delayedProduces struct {
+	mu       sync.Mutex
+	produces map[topicPartition][]*delayedProduce
+}
+
+// add is used to wait on the produce's pending partitions, calling expire if they're still pending
+// after the timeout.
+func (p *delayedProduces) add(d *delayedProduce, timeout time.Duration, expire func()) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	d.timer = time.AfterFunc(timeout, expire)
+	if p.produces == nil {
+		p.produces = make(map[topicPartition][]*delayedProduce)
+	}
+	for _, pp := range d.pending {
+		if containsPartition(d.partitions, pp.tp) {
+			// the request appended to the partition more than once.
+			continue
+		}
+		d.partitions = append(d.partitions, pp.tp)
+		p.produces[pp.tp] = append(p.produces[pp.tp], d)
+	}
+}
+
+// complete is used to check the partition's responses of the produces waiting on it. check returns
+// the response's error and true once the partition's done with, or false if it's still pending.
+// The produces that have no partitions left pending are forgotten and returned to be responded to.
+func (p *delayedProduces) complete(tp topicPartition, check func(presp *protocol.ProducePartitionResponse) (protocol.Error, bool)) []*delayedProduce {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var completed []*delayedProduce
+	for _, d := range p.produces[tp] {
+		pending := d.pending[:0]
+		for _, pp := range d.pending {
+			if pp.tp == tp {
+				if err, ok := check(pp.presp); ok {
+					pp.presp.ErrorCode = err.Code()
+					continue
+				}
+			}
+			pending = append(pending, pp)
+		}
+		d.pending = pending
+		if len(d.pending) == 0 {
+			completed = append(completed, d)
+		}
+	}
+	for _, d := range completed {
+		p.forget(d)
+	}
+	return completed
+}
+
+// expire is used to time out the produce's pending partitions. It returns false if the produce
+// already completed.
+func (p *delayedProduces) expire(d *delayedProduce) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if d.done {
+		return false
+	}
+	for _, pp := range d.pending {
+		pp.presp.ErrorCode = protocol.ErrRequestTimedOut.Code()
+	}
+	d.pending = nil
+	p.forget(d)
+	return true
+}
+
+// containsPartition returns whether the partitions contain tp.
+func containsPartition(partitions []topicPartition, tp topicPartition) bool {
+	for _, p := range partitions {
+		if p == tp {
+			return true
+		}
+	}
+	return false
+}
+
+// forget is used to stop waiting on the produce, its lock must be held.
+func (p *delayedProduces) forget(d *delayedProduce) {
+	d.done = true
+	d.timer.Stop()
+	for _, tp := range d.partitions {
+		produces := p.produces[tp]
+		for i, w := range produces {
+			if w == d {
+				produces = append(produces[:i], produces[i+1:]...)
+				break
+			}
+		}
+		if len(produces) == 0 {
+			delete(p.produces, tp)
+		} else {
+			p.produces[tp] = produces
+		}
+	}
+}
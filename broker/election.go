@@ -0,0 +1,46 @@
+package broker
+
+import (
+	"github.com/travisjeffery/jocko"
+)
+
+// checkPartitionLeaders is used by the controller to elect new leaders for the partitions whose
+// leaders have left the cluster, from the members of their ISRs. Partitions without an ISR member
+// in the cluster are marked offline, with no leader, until one rejoins and is elected.
+func (b *Broker) checkPartitionLeaders() error {
+	members := make(map[int32]bool)
+	for _, m := range b.clusterMembers() {
+		members[m.ID] = true
+	}
+	var elections []*jocko.Partition
+	b.RLock()
+	for _, partitions := range b.topicMap {
+		for _, p := range partitions {
+			if !p.Offline && members[p.Leader] {
+				continue
+			}
+			leader := int32(-1)
+			for _, id := range p.ISRSnapshot() {
+				if members[id] {
+					leader = id
+					break
+				}
+			}
+			if leader == -1 && p.Offline {
+				// it's already offline.
+				continue
+			}
+			elections = append(elections, &jocko.Partition{Topic: p.Topic, ID: p.ID, Leader: leader})
+		}
+	}
+	b.RUnlock()
+	for _, p := range elections {
+		if p.Leader == -1 {
+			b.logger.Info("partition %s is offline, none of its ISR is in the cluster", p)
+		}
+		if err := b.raftApply(electLeader, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package broker
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/travisjeffery/jocko"
+	"github.com/travisjeffery/jocko/commitlog"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+func TestBroker_checkPartitionLeaders_offline(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jocko-offline")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	clog, err := commitlog.New(commitlog.Options{Path: dir, MaxSegmentBytes: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := newFields()
+	// broker 2 led the partition and was the only broker in its ISR.
+	f.topicMap["the-topic"] = []*jocko.Partition{{
+		Topic:     "the-topic",
+		ID:        0,
+		Leader:    2,
+		Replicas:  []int32{f.id, 2},
+		ISR:       []int32{2},
+		CommitLog: clog,
+	}}
+	members := []*jocko.ClusterMember{{ID: f.id}}
+	f.serf.ClusterFn = func() []*jocko.ClusterMember {
+		return members
+	}
+	f.serf.MemberFn = func(id int32) *jocko.ClusterMember {
+		return nil
+	}
+	f.raft.LeaderIDFn = func() string {
+		return ""
+	}
+	b := &Broker{
+		logger:      f.logger,
+		id:          f.id,
+		topicMap:    f.topicMap,
+		replicators: f.replicators,
+		brokerAddr:  f.brokerAddr,
+		logDir:      f.logDir,
+		raft:        f.raft,
+		serf:        f.serf,
+		shutdownCh:  f.shutdownCh,
+	}
+	f.raft.ApplyFn = func(c jocko.RaftCommand) error {
+		b.apply(c)
+		return nil
+	}
+	partition := f.topicMap["the-topic"][0]
+
+	check := func(t *testing.T, want protocol.Error) {
+		metadata := b.handleMetadata(nil, "", &protocol.MetadataRequest{Topics: []string{"the-topic"}})
+		pm := metadata.TopicMetadata[0].PartitionMetadata[0]
+		if pm.PartitionErrorCode != want.Code() {
+			t.Errorf("metadata error code = %v, want %v", pm.PartitionErrorCode, want.Code())
+		}
+		produce := b.handleProduce(nil, jocko.AnonymousPrincipal, &protocol.ProduceRequest{
+			Acks:    1,
+			Timeout: 100,
+			TopicData: []*protocol.TopicData{{
+				Topic: "the-topic",
+				Data:  []*protocol.Data{{Partition: 0, RecordSet: newMessageSet(t, "hello")}},
+			}},
+		}, nil)
+		if code := produce.Responses[0].PartitionResponses[0].ErrorCode; code != want.Code() {
+			t.Errorf("produce error code = %v, want %v", code, want.Code())
+		}
+		fetch := b.handleFetch(context.Background(), nil, &protocol.FetchRequest{
+			Topics: []*protocol.FetchTopic{{
+				Topic:      "the-topic",
+				Partitions: []*protocol.FetchPartition{{Partition: 0, FetchOffset: 0, MaxBytes: 1024}},
+			}},
+		})
+		if code := fetch.Responses[0].PartitionResponses[0].ErrorCode; code != want.Code() {
+			t.Errorf("fetch error code = %v, want %v", code, want.Code())
+		}
+	}
+
+	t.Run("no isr member to elect", func(t *testing.T) {
+		if err := b.checkPartitionLeaders(); err != nil {
+			t.Fatal(err)
+		}
+		if !partition.Offline || partition.Leader != -1 {
+			t.Fatalf("offline = %v, leader = %v, want %v, %v", partition.Offline, partition.Leader, true, -1)
+		}
+		check(t, protocol.ErrLeaderNotAvailable)
+		// it stays offline, without another election, until an isr member can be elected.
+		epoch := partition.LeaderEpoch
+		if err := b.checkPartitionLeaders(); err != nil {
+			t.Fatal(err)
+		}
+		if partition.LeaderEpoch != epoch {
+			t.Errorf("leader epoch = %v, want %v", partition.LeaderEpoch, epoch)
+		}
+	})
+
+	t.Run("leader elected", func(t *testing.T) {
+		if err := b.alterISR(&jocko.Partition{Topic: "the-topic", ID: 0, ISR: []int32{f.id}}); err != protocol.ErrNone {
+			t.Fatal(err)
+		}
+		if err := b.checkPartitionLeaders(); err != nil {
+			t.Fatal(err)
+		}
+		if partition.Offline || partition.Leader != f.id {
+			t.Fatalf("offline = %v, leader = %v, want %v, %v", partition.Offline, partition.Leader, false, f.id)
+		}
+		check(t, protocol.ErrNone)
+	})
+}
@@ -0,0 +1,120 @@
+package broker
+
+import "github.com/travisjeffery/jocko/protocol"
+
+// errorResponse is used to get the response to the request with every error code set to err, e.g.
+// when handling the request failed unexpectedly.
+func errorResponse(request interface{}, err protocol.Error) protocol.ResponseBody {
+	switch req := request.(type) {
+	case *protocol.APIVersionsRequest:
+		return &protocol.APIVersionsResponse{ErrorCode: err.Code()}
+	case *protocol.ProduceRequest:
+		resp := &protocol.ProduceResponses{Responses: make([]*protocol.ProduceResponse, len(req.TopicData))}
+		for i, td := range req.TopicData {
+			pr := &protocol.ProduceResponse{
+				Topic:              td.Topic,
+				PartitionResponses: make([]*protocol.ProducePartitionResponse, len(td.Data)),
+			}
+			for j, d := range td.Data {
+				pr.PartitionResponses[j] = &protocol.ProducePartitionResponse{Partition: d.Partition, ErrorCode: err.Code()}
+			}
+			resp.Responses[i] = pr
+		}
+		return resp
+	case *protocol.FetchRequest:
+		resp := &protocol.FetchResponses{APIVersion: req.APIVersion, Responses: make([]*protocol.FetchResponse, len(req.Topics))}
+		for i, t := range req.Topics {
+			fr := &protocol.FetchResponse{
+				Topic:              t.Topic,
+				PartitionResponses: make([]*protocol.FetchPartitionResponse, len(t.Partitions)),
+			}
+			for j, p := range t.Partitions {
+				fr.PartitionResponses[j] = &protocol.FetchPartitionResponse{Partition: p.Partition, ErrorCode: err.Code()}
+			}
+			resp.Responses[i] = fr
+		}
+		return resp
+	case *protocol.OffsetsRequest:
+		resp := &protocol.OffsetsResponse{APIVersion: req.APIVersion, Responses: make([]*protocol.OffsetResponse, len(req.Topics))}
+		for i, t := range req.Topics {
+			or := &protocol.OffsetResponse{
+				Topic:              t.Topic,
+				PartitionResponses: make([]*protocol.PartitionResponse, len(t.Partitions)),
+			}
+			for j, p := range t.Partitions {
+				or.PartitionResponses[j] = &protocol.PartitionResponse{Partition: p.Partition, ErrorCode: err.Code(), Timestamp: -1, Offset: -1, LeaderEpoch: -1}
+			}
+			resp.Responses[i] = or
+		}
+		return resp
+	case *protocol.DeleteRecordsRequest:
+		resp := &protocol.DeleteRecordsResponse{APIVersion: req.APIVersion, Topics: make([]*protocol.DeleteRecordsTopicResponse, len(req.Topics))}
+		for i, t := range req.Topics {
+			tr := &protocol.DeleteRecordsTopicResponse{
+				Topic:      t.Topic,
+				Partitions: make([]*protocol.DeleteRecordsPartitionResponse, len(t.Partitions)),
+			}
+			for j, p := range t.Partitions {
+				tr.Partitions[j] = &protocol.DeleteRecordsPartitionResponse{Partition: p.Partition, LowWatermark: -1, ErrorCode: err.Code()}
+			}
+			resp.Topics[i] = tr
+		}
+		return resp
+	case *protocol.MetadataRequest:
+		resp := &protocol.MetadataResponse{APIVersion: req.APIVersion, ControllerID: -1}
+		for _, t := range req.Topics {
+			resp.TopicMetadata = append(resp.TopicMetadata, &protocol.TopicMetadata{Topic: t, TopicErrorCode: err.Code()})
+		}
+		return resp
+	case *protocol.CreateTopicRequests:
+		resp := &protocol.CreateTopicsResponse{APIVersion: req.APIVersion, TopicErrorCodes: make([]*protocol.TopicErrorCode, len(req.Requests))}
+		for i, r := range req.Requests {
+			resp.TopicErrorCodes[i] = &protocol.TopicErrorCode{Topic: r.Topic, ErrorCode: err.Code(), ErrorMessage: err.Error()}
+		}
+		return resp
+	case *protocol.DeleteTopicsRequest:
+		resp := &protocol.DeleteTopicsResponse{APIVersion: req.APIVersion, TopicErrorCodes: make([]*protocol.TopicErrorCode, len(req.Topics))}
+		for i, t := range req.Topics {
+			resp.TopicErrorCodes[i] = &protocol.TopicErrorCode{Topic: t, ErrorCode: err.Code()}
+		}
+		return resp
+	case *protocol.LeaderAndISRRequest:
+		return &protocol.LeaderAndISRResponse{ErrorCode: err.Code()}
+	case *protocol.AlterPartitionRequest:
+		return &protocol.AlterPartitionResponse{APIVersion: req.APIVersion, ErrorCode: err.Code()}
+	case *protocol.DescribeConfigsRequest:
+		resp := &protocol.DescribeConfigsResponse{APIVersion: req.APIVersion}
+		resp.Results = make([]*protocol.DescribeConfigsResult, len(req.Resources))
+		for i, res := range req.Resources {
+			resp.Results[i] = &protocol.DescribeConfigsResult{
+				ErrorCode:    err.Code(),
+				ErrorMessage: err.Error(),
+				Type:         res.Type,
+				Name:         res.Name,
+			}
+		}
+		return resp
+	case *protocol.IncrementalAlterConfigsRequest:
+		resp := &protocol.IncrementalAlterConfigsResponse{APIVersion: req.APIVersion}
+		resp.Resources = make([]*protocol.AlterConfigsResourceResponse, len(req.Resources))
+		for i, res := range req.Resources {
+			resp.Resources[i] = &protocol.AlterConfigsResourceResponse{
+				ErrorCode:    err.Code(),
+				ErrorMessage: err.Error(),
+				Type:         res.Type,
+				Name:         res.Name,
+			}
+		}
+		return resp
+	case *protocol.ControlledShutdownRequest:
+		return &protocol.ControlledShutdownResponse{APIVersion: req.APIVersion, ErrorCode: err.Code()}
+	case *protocol.GroupCoordinatorRequest:
+		return &protocol.GroupCoordinatorResponse{
+			APIVersion:   req.APIVersion,
+			ErrorCode:    err.Code(),
+			ErrorMessage: err.Error(),
+			Coordinator:  &protocol.Coordinator{NodeID: -1, Port: -1},
+		}
+	}
+	return nil
+}
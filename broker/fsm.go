@@ -2,18 +2,46 @@ package broker
 
 import (
 	"encoding/json"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/travisjeffery/jocko"
 	"github.com/travisjeffery/jocko/protocol"
 )
 
+const (
+	// startReplicaRetryBackoff is how long the broker first waits before retrying to start a
+	// replica whose creation raft committed, doubling after each failure up to
+	// maxStartReplicaRetryBackoff, and maxStartReplicaAttempts how many times it tries before
+	// retrying in the background. Later commands wait on those tries, so they're kept short.
+	startReplicaRetryBackoff    = 100 * time.Millisecond
+	maxStartReplicaRetryBackoff = 10 * time.Second
+	maxStartReplicaAttempts     = 5
+	// defaultRaftApplyRetries is how many times the controller retries applying a raft command
+	// that wasn't committed, and defaultRaftApplyRetryBackoff how long it first waits before
+	// checking whether a leader's been elected, doubling after each check up to
+	// maxRaftApplyRetryBackoff. It waits up to maxRaftApplyLeaderWait for a leader.
+	defaultRaftApplyRetries      = 3
+	defaultRaftApplyRetryBackoff = 100 * time.Millisecond
+	maxRaftApplyRetryBackoff     = 2 * time.Second
+	maxRaftApplyLeaderWait       = 30 * time.Second
+)
+
 const (
 	createPartition jocko.RaftCmdType = iota
 	deleteTopic
+	electLeader
+	alterISR
+	registerBroker
+	alterConfigs
+	setClusterID
 	// others
 )
 
+// raftApply is used to apply the command through raft. Commands raft rejected without adding them
+// to its log, e.g. during an election, are retried up to the broker's raft apply retries once this
+// broker's been elected the leader again. Commands that may still commit, e.g. because leadership
+// was lost after they were added, aren't retried since applying them again could apply them twice.
 func (b *Broker) raftApply(cmd jocko.RaftCmdType, data interface{}) error {
 	var bb []byte
 	bb, err := json.Marshal(data)
@@ -25,7 +53,44 @@ func (b *Broker) raftApply(cmd jocko.RaftCmdType, data interface{}) error {
 		Cmd:  cmd,
 		Data: &r,
 	}
-	return b.raft.Apply(c)
+	for attempt := 1; ; attempt++ {
+		err := b.raft.Apply(c)
+		if err != jocko.ErrNotCommitted {
+			return err
+		}
+		if attempt > b.raftApplyRetries {
+			return errors.Wrapf(err, "raft apply failed after %d attempts", attempt)
+		}
+		if err := b.waitForRaftLeader(); err != nil {
+			return err
+		}
+		if !b.raft.IsLeader() {
+			// another broker's the controller now, it's the one to apply commands.
+			return errors.Wrap(err, "not the raft leader")
+		}
+		b.logger.Info("failed to apply raft command %d, attempt %d, retrying: %v", cmd, attempt, err)
+	}
+}
+
+// waitForRaftLeader is used to wait until a raft leader's been elected, checking with backoff up to
+// maxRaftApplyLeaderWait.
+func (b *Broker) waitForRaftLeader() error {
+	backoff := b.raftApplyRetryBackoff
+	deadline := time.Now().Add(maxRaftApplyLeaderWait)
+	for b.raft.LeaderID() == "" {
+		if time.Now().After(deadline) {
+			return errors.Errorf("no raft leader elected after %s", maxRaftApplyLeaderWait)
+		}
+		select {
+		case <-time.After(backoff):
+		case <-b.shutdownCh:
+			return errors.New("broker shut down")
+		}
+		if backoff *= 2; backoff > maxRaftApplyRetryBackoff {
+			backoff = maxRaftApplyRetryBackoff
+		}
+	}
+	return nil
 }
 
 // handleRaftCommands reads commands sent into the given channel to apply them.
@@ -58,9 +123,7 @@ func (b *Broker) apply(c jocko.RaftCommand) {
 			// TODO: should panic?
 			return
 		}
-		if err := b.startReplica(p); err != protocol.ErrNone {
-			panic(err)
-		}
+		b.startCommittedReplica(p)
 	case deleteTopic:
 		p := new(jocko.Partition)
 		if err := unmarshalData(c.Data, p); err != nil {
@@ -71,5 +134,108 @@ func (b *Broker) apply(c jocko.RaftCommand) {
 		if err := b.deletePartitions(p); err != nil {
 			panic(errors.Wrap(err, "topic delete failed"))
 		}
+	case electLeader:
+		p := new(jocko.Partition)
+		if err := unmarshalData(c.Data, p); err != nil {
+			b.logger.Info("received malformed raft command: %v", err)
+			return
+		}
+		if err := b.electLeader(p); err != protocol.ErrNone {
+			b.logger.Info("failed to elect leader %d for partition %s: %v", p.Leader, p, err)
+		}
+		// produces waiting on the partition fail if this broker's no longer its leader.
+		b.completeDelayedProduces(topicPartition{Topic: p.Topic, Partition: p.ID})
+	case alterISR:
+		p := new(jocko.Partition)
+		if err := unmarshalData(c.Data, p); err != nil {
+			b.logger.Info("received malformed raft command: %v", err)
+			return
+		}
+		if err := b.alterISR(p); err != protocol.ErrNone {
+			b.logger.Info("failed to alter isr of partition %s: %v", p, err)
+		}
+		// the high watermark doesn't wait on followers that left the ISR anymore.
+		if partition, err := b.partition(p.Topic, p.ID); err == protocol.ErrNone && partition.IsLeader(b.id) && partition.IsOpen() {
+			b.maybeIncrementHighWatermark(partition)
+		}
+		// produces waiting on followers that left the ISR don't wait on them anymore.
+		b.completeDelayedProduces(topicPartition{Topic: p.Topic, Partition: p.ID})
+	case registerBroker:
+		r := new(brokerRegistration)
+		if err := unmarshalData(c.Data, r); err != nil {
+			b.logger.Info("received malformed raft command: %v", err)
+			return
+		}
+		b.registerBroker(r)
+	case alterConfigs:
+		rc := new(resourceConfigs)
+		if err := unmarshalData(c.Data, rc); err != nil {
+			b.logger.Info("received malformed raft command: %v", err)
+			return
+		}
+		b.setConfigs(rc)
+	case setClusterID:
+		id := new(clusterID)
+		if err := unmarshalData(c.Data, id); err != nil {
+			b.logger.Info("received malformed raft command: %v", err)
+			return
+		}
+		b.setClusterID(id)
+	}
+}
+
+// startCommittedReplica is used to start the replica of a partition whose creation raft
+// committed. Failures, like the disk being full, are retried with backoff a few times. Commands are
+// applied in order and later ones wait on the retries, so if the replica still hasn't started it's
+// retried in the background and the partition's offline, requests for it failing with
+// ErrKafkaStorageError, until it starts.
+func (b *Broker) startCommittedReplica(p *jocko.Partition) {
+	b.retryStartReplica(p, 1, startReplicaRetryBackoff)
+}
+
+// retryStartReplica is used to try starting the partition's replica from the given attempt, waiting
+// backoff before each retry. After maxStartReplicaAttempts it hands the retries off to a goroutine,
+// which keeps retrying until the replica starts, the partition's deleted or replaced by a later
+// command, or the broker shuts down.
+func (b *Broker) retryStartReplica(p *jocko.Partition, attempt int, backoff time.Duration) {
+	for ; ; attempt++ {
+		if attempt > 1 {
+			select {
+			case <-time.After(backoff):
+			case <-b.shutdownCh:
+				return
+			}
+			if backoff *= 2; backoff > maxStartReplicaRetryBackoff {
+				backoff = maxStartReplicaRetryBackoff
+			}
+		}
+		var err protocol.Error
+		if attempt > maxStartReplicaAttempts {
+			err = b.restartReplica(p)
+		} else {
+			err = b.startReplica(p)
+		}
+		switch err.Code() {
+		case protocol.ErrNone.Code():
+			if attempt > maxStartReplicaAttempts {
+				b.logger.Info("started replica of partition %s after %d attempts", p, attempt)
+			}
+			return
+		case protocol.ErrPolicyViolation.Code():
+			b.logger.Info("refused to host replica of partition %s, the broker's at its partition limit", p)
+			return
+		case protocol.ErrKafkaStorageError.Code():
+			b.logger.Info("partition %s is offline: %v", p, err)
+			return
+		case protocol.ErrUnknownTopicOrPartition.Code():
+			// the partition was deleted or replaced while its replica was offline.
+			return
+		}
+		if attempt == maxStartReplicaAttempts {
+			b.logger.Info("partition %s is offline, failed to start its replica after %d attempts, retrying in the background: %v", p, attempt, err)
+			go b.retryStartReplica(p, attempt+1, backoff)
+			return
+		}
+		b.logger.Info("failed to start replica of partition %s, attempt %d, retrying in %s: %v", p, attempt, backoff, err)
 	}
 }
@@ -0,0 +1,68 @@
+package broker
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/travisjeffery/jocko"
+)
+
+func TestBroker_raftApply_retry(t *testing.T) {
+	tests := []struct {
+		name string
+		// fails is how many applies fail before one succeeds, and err the error they fail with.
+		fails int
+		err   error
+		// leaderID is the raft leader once the election's over, and leader whether it's this
+		// broker.
+		leaderID    string
+		leader      bool
+		wantApplies int
+		wantErr     bool
+	}{
+		{name: "applied", wantApplies: 1},
+		{name: "applied after re-elected", fails: 1, err: jocko.ErrNotCommitted, leaderID: "1", leader: true, wantApplies: 2},
+		{name: "not committed after retries", fails: -1, err: jocko.ErrNotCommitted, leaderID: "1", leader: true, wantApplies: 3, wantErr: true},
+		{name: "other broker elected", fails: 1, err: jocko.ErrNotCommitted, leaderID: "2", wantApplies: 1, wantErr: true},
+		{name: "may have committed", fails: 1, err: errors.New("leadership lost while committing log"), leaderID: "1", leader: true, wantApplies: 1, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFields()
+			var applies, leaderChecks int
+			f.raft.ApplyFn = func(jocko.RaftCommand) error {
+				applies++
+				if tt.fails < 0 || applies <= tt.fails {
+					return tt.err
+				}
+				return nil
+			}
+			f.raft.LeaderIDFn = func() string {
+				// the election's in progress for the first check.
+				if leaderChecks++; leaderChecks == 1 {
+					return ""
+				}
+				return tt.leaderID
+			}
+			f.raft.IsLeaderFn = func() bool {
+				return tt.leader
+			}
+			b := &Broker{
+				logger:                f.logger,
+				id:                    f.id,
+				raft:                  f.raft,
+				raftApplyRetries:      2,
+				raftApplyRetryBackoff: time.Millisecond,
+				shutdownCh:            make(chan struct{}),
+			}
+			err := b.raftApply(createPartition, &jocko.Partition{Topic: "the-topic", ID: 0})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("raftApply() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if applies != tt.wantApplies {
+				t.Errorf("applies = %d, want %d", applies, tt.wantApplies)
+			}
+		})
+	}
+}
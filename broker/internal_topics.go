@@ -0,0 +1,69 @@
+package broker
+
+import (
+	"time"
+
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+// internalTopicsCheckInterval is how often the broker checks whether it's become the
+// controller, and so needs to ensure the internal topics exist.
+const internalTopicsCheckInterval = time.Second
+
+// InternalTopic is a topic the controller creates when it starts, if it doesn't exist,
+// e.g. __consumer_offsets or __transaction_state.
+type InternalTopic struct {
+	Name              string
+	Partitions        int32
+	ReplicationFactor int16
+}
+
+// monitorInternalTopics is used to ensure the internal topics exist each time this broker
+// becomes the controller, until it shuts down. If they couldn't be created, e.g. because
+// there aren't enough brokers for their replication factor yet, it tries again.
+func (b *Broker) monitorInternalTopics() {
+	ticker := time.NewTicker(internalTopicsCheckInterval)
+	defer ticker.Stop()
+	ensured := false
+	for {
+		if !b.isController() {
+			ensured = false
+		} else if !ensured {
+			if err := b.ensureInternalTopics(); err != protocol.ErrNone {
+				b.logger.Info("failed to create internal topics: %v", err)
+			} else {
+				ensured = true
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-b.shutdownCh:
+			return
+		}
+	}
+}
+
+// ensureInternalTopics is used to create the internal topics that don't exist yet. Topics
+// that already exist are left alone, so it's safe to call more than once.
+func (b *Broker) ensureInternalTopics() protocol.Error {
+	for _, t := range b.internalTopics {
+		if int(t.ReplicationFactor) > len(b.clusterMembers()) {
+			return protocol.ErrInvalidReplicationFactor
+		}
+		err := b.createTopic(t.Name, t.Partitions, t.ReplicationFactor)
+		if err != protocol.ErrNone && err != protocol.ErrTopicAlreadyExists {
+			return err
+		}
+	}
+	return protocol.ErrNone
+}
+
+// isInternalTopic returns whether the topic is one of the broker's internal topics.
+func (b *Broker) isInternalTopic(topic string) bool {
+	for _, t := range b.internalTopics {
+		if t.Name == topic {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,236 @@
+package broker
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/travisjeffery/jocko"
+	"github.com/travisjeffery/jocko/protocol"
+	"github.com/travisjeffery/jocko/server"
+)
+
+// defaultReplicaLagTimeMax is the default time a follower in a partition's ISR can go without
+// catching up to the leader before the leader removes it from the ISR, same as Kafka's
+// replica.lag.time.max.ms.
+const defaultReplicaLagTimeMax = 30 * time.Second
+
+// replicaFetch is a follower's fetch progress of a partition this broker leads.
+type replicaFetch struct {
+	// lastFetch is when the follower last fetched, and lastFetchLEO the leader's log end offset
+	// then.
+	lastFetch    time.Time
+	lastFetchLEO int64
+	// caughtUp is the last time the follower had every record the leader had.
+	caughtUp time.Time
+}
+
+// replicaLag tracks when the followers of the partitions this broker leads last caught up, to
+// shrink the partitions' ISRs when followers fall behind, like Kafka's lastCaughtUpTimeMs.
+type replicaLag struct {
+	mu       sync.Mutex
+	replicas map[topicPartition]map[int32]*replicaFetch
+	// altering are the partitions whose ISR changes are being sent to the controller.
+	altering map[topicPartition]bool
+}
+
+// fetched is used to record the follower fetching the partition from offset when the leader's log
+// end offset was leo. The follower's caught up if it fetched from the log end offset, or from the
+// log end offset of its previous fetch, since it had everything then.
+func (l *replicaLag) fetched(tp topicPartition, replica int32, offset, leo int64, now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	f := l.replica(tp, replica, now)
+	if offset >= leo {
+		f.caughtUp = now
+	} else if !f.lastFetch.IsZero() && offset >= f.lastFetchLEO && f.lastFetch.After(f.caughtUp) {
+		f.caughtUp = f.lastFetch
+	}
+	f.lastFetch = now
+	f.lastFetchLEO = leo
+}
+
+// lastCaughtUp is used to get when the follower last caught up. A follower that hasn't fetched
+// since this broker became the partition's leader is given until the lag time max from now.
+func (l *replicaLag) lastCaughtUp(tp topicPartition, replica int32, now time.Time) time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.replica(tp, replica, now).caughtUp
+}
+
+// replica returns the follower's fetch progress, starting it at now. The caller must hold the lock.
+func (l *replicaLag) replica(tp topicPartition, replica int32, now time.Time) *replicaFetch {
+	if l.replicas == nil {
+		l.replicas = make(map[topicPartition]map[int32]*replicaFetch)
+	}
+	if l.replicas[tp] == nil {
+		l.replicas[tp] = make(map[int32]*replicaFetch)
+	}
+	f, ok := l.replicas[tp][replica]
+	if !ok {
+		f = &replicaFetch{caughtUp: now}
+		l.replicas[tp][replica] = f
+	}
+	return f
+}
+
+// reset is used to forget the followers' progress of the partition, e.g. when this broker becomes
+// its leader, so followers aren't judged by how they did under an earlier leadership.
+func (l *replicaLag) reset(tp topicPartition) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.replicas, tp)
+}
+
+// remove is used to forget the followers' progress of the topic's partitions, e.g. when it's deleted.
+func (l *replicaLag) remove(topic string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for tp := range l.replicas {
+		if tp.Topic == topic {
+			delete(l.replicas, tp)
+		}
+	}
+}
+
+// startAltering is used to mark the partition's ISR as being altered, returning false if it already
+// is, so the leader doesn't send a change while another's in flight.
+func (l *replicaLag) startAltering(tp topicPartition) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.altering[tp] {
+		return false
+	}
+	if l.altering == nil {
+		l.altering = make(map[topicPartition]bool)
+	}
+	l.altering[tp] = true
+	return true
+}
+
+// doneAltering is used once the partition's ISR change has been sent.
+func (l *replicaLag) doneAltering(tp topicPartition) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.altering, tp)
+}
+
+// maybeExpandISR is used to add the follower to the ISR of the partition this broker leads once it's
+// fetched up to the high watermark, like Kafka's maybeExpandIsr, so it counts toward the high
+// watermark and acks=all produces again.
+func (b *Broker) maybeExpandISR(partition *jocko.Partition, replica int32, fetchOffset int64) {
+	b.RLock()
+	assigned := contains(partition.Replicas, replica)
+	b.RUnlock()
+	if !assigned || partition.InISR(replica) {
+		return
+	}
+	if fetchOffset < partition.HighWatermark() {
+		return
+	}
+	isr := append(partition.ISRSnapshot(), replica)
+	b.logger.Info("expanding isr of partition %s to %v", partition, isr)
+	b.alterPartitionISR(partition, isr)
+}
+
+// maybeShrinkISRs is used to remove the followers that haven't caught up within the replica lag
+// time max from the ISRs of the partitions this broker leads, like Kafka's maybeShrinkIsr, so they
+// don't hold up the high watermark and acks=all produces.
+func (b *Broker) maybeShrinkISRs() {
+	var led []*jocko.Partition
+	b.RLock()
+	for _, partitions := range b.topicMap {
+		for _, p := range partitions {
+			if p.IsLeader(b.id) && p.IsOpen() {
+				led = append(led, p)
+			}
+		}
+	}
+	b.RUnlock()
+	now := time.Now()
+	for _, p := range led {
+		tp := topicPartition{Topic: p.Topic, Partition: p.ID}
+		isr := p.ISRSnapshot()
+		inSync := make([]int32, 0, len(isr))
+		for _, id := range isr {
+			if id == b.id || now.Sub(b.replicaLag.lastCaughtUp(tp, id, now)) <= b.replicaLagTimeMax {
+				inSync = append(inSync, id)
+			}
+		}
+		if len(inSync) < len(isr) {
+			b.logger.Info("shrinking isr of partition %s from %v to %v", p, isr, inSync)
+			b.alterPartitionISR(p, inSync)
+		}
+	}
+}
+
+// shrinkISRs is used to periodically shrink the ISRs of the partitions this broker leads, at half
+// the replica lag time max like Kafka, until it shuts down.
+func (b *Broker) shrinkISRs() {
+	ticker := time.NewTicker(b.replicaLagTimeMax / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			b.maybeShrinkISRs()
+		case <-b.shutdownCh:
+			return
+		}
+	}
+}
+
+// alterPartitionISR is used to propose changing the ISR of the partition this broker leads to the
+// controller. The change is sent in the background, unless one's already in flight, and is applied
+// when the controller commits it through raft.
+func (b *Broker) alterPartitionISR(partition *jocko.Partition, isr []int32) {
+	tp := topicPartition{Topic: partition.Topic, Partition: partition.ID}
+	if !b.replicaLag.startAltering(tp) {
+		return
+	}
+	epoch := b.brokerEpoch(b.id)
+	b.RLock()
+	req := &protocol.AlterPartitionRequest{
+		BrokerID:    b.id,
+		BrokerEpoch: epoch,
+		Topics: []*protocol.AlterPartitionTopic{{
+			Topic: partition.Topic,
+			Partitions: []*protocol.AlterPartitionPartition{{
+				Partition:      partition.ID,
+				LeaderEpoch:    partition.LeaderEpoch,
+				NewISR:         isr,
+				PartitionEpoch: partition.PartitionEpoch,
+			}},
+		}},
+	}
+	b.RUnlock()
+	go func() {
+		defer b.replicaLag.doneAltering(tp)
+		resp, err := b.sendAlterPartition(req)
+		if err != nil {
+			b.logger.Info("failed to send alter partition request of partition %s: %v", partition, err)
+			return
+		}
+		code := resp.ErrorCode
+		if code == protocol.ErrNone.Code() && len(resp.Topics) == 1 && len(resp.Topics[0].Partitions) == 1 {
+			code = resp.Topics[0].Partitions[0].ErrorCode
+		}
+		if code != protocol.ErrNone.Code() {
+			b.logger.Info("failed to alter isr of partition %s: %v", partition, protocol.Errs[code])
+		}
+	}()
+}
+
+// sendAlterPartition is used to send the alter partition request to the controller, which may be
+// this broker.
+func (b *Broker) sendAlterPartition(req *protocol.AlterPartitionRequest) (*protocol.AlterPartitionResponse, error) {
+	if b.isController() {
+		header := &protocol.RequestHeader{APIKey: protocol.AlterPartitionKey, APIVersion: req.APIVersion}
+		return b.handleAlterPartition(header, req), nil
+	}
+	conn, err := b.dialController()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return server.NewClient(conn).AlterPartition(fmt.Sprintf("Broker-%d", b.id), req)
+}
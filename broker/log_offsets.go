@@ -0,0 +1,41 @@
+package broker
+
+import "sort"
+
+// PartitionLogOffsets is the state of a partition's log on a broker.
+type PartitionLogOffsets struct {
+	Topic          string
+	Partition      int32
+	LogStartOffset int64
+	LogEndOffset   int64
+	HighWatermark  int64
+}
+
+// LogOffsets is used to get the log start and end offsets, and the high watermarks, of the
+// partitions this broker hosts, sorted by topic and partition. It's meant for monitoring and
+// health checks.
+func (b *Broker) LogOffsets() []PartitionLogOffsets {
+	var offsets []PartitionLogOffsets
+	b.RLock()
+	for _, partitions := range b.topicMap {
+		for _, p := range partitions {
+			if p.IsOpen() {
+				offsets = append(offsets, PartitionLogOffsets{
+					Topic:          p.Topic,
+					Partition:      p.ID,
+					LogStartOffset: p.LowWatermark(),
+					LogEndOffset:   p.CommitLog.NewestOffset(),
+					HighWatermark:  p.HighWatermark(),
+				})
+			}
+		}
+	}
+	b.RUnlock()
+	sort.Slice(offsets, func(i, j int) bool {
+		if offsets[i].Topic != offsets[j].Topic {
+			return offsets[i].Topic < offsets[j].Topic
+		}
+		return offsets[i].Partition < offsets[j].Partition
+	})
+	return offsets
+}
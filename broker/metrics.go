@@ -0,0 +1,51 @@
+package broker
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/travisjeffery/jocko"
+)
+
+// metrics are the broker's per-partition metrics. They're labeled by topic
+// and partition, so they're only collected when enabled with the
+// PartitionMetrics option.
+type metrics struct {
+	produceLatency *prometheus.HistogramVec
+	fetchLatency   *prometheus.HistogramVec
+}
+
+func newMetrics(r prometheus.Registerer) *metrics {
+	m := &metrics{
+		produceLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "partition_produce_latency_seconds",
+			Help: "Time taken to append produced messages to the partition's log.",
+		}, []string{"topic", "partition"}),
+		fetchLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "partition_fetch_latency_seconds",
+			Help: "Time taken to read fetched messages from the partition's log.",
+		}, []string{"topic", "partition"}),
+	}
+	if r != nil {
+		m.produceLatency = jocko.RegisterCollector(r, m.produceLatency).(*prometheus.HistogramVec)
+		m.fetchLatency = jocko.RegisterCollector(r, m.fetchLatency).(*prometheus.HistogramVec)
+	}
+	return m
+}
+
+// observeProduce is used to record the time taken to append to the partition.
+func (m *metrics) observeProduce(topic string, partition int32, start time.Time) {
+	if m == nil {
+		return
+	}
+	m.produceLatency.WithLabelValues(topic, strconv.Itoa(int(partition))).Observe(time.Since(start).Seconds())
+}
+
+// observeFetch is used to record the time taken to read from the partition.
+func (m *metrics) observeFetch(topic string, partition int32, start time.Time) {
+	if m == nil {
+		return
+	}
+	m.fetchLatency.WithLabelValues(topic, strconv.Itoa(int(partition))).Observe(time.Since(start).Seconds())
+}
@@ -1,6 +1,10 @@
 package broker
 
 import (
+	"net"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/travisjeffery/jocko"
 	"github.com/travisjeffery/simplelog"
 )
@@ -22,6 +26,28 @@ func Addr(brokerAddr string) BrokerFn {
 	}
 }
 
+// AdvertisedAddr is used to set the address, host:port, clients should connect to the broker at
+// if it differs from the address it binds on, e.g. when it's behind NAT. It's what's reported in
+// metadata, while the broker's addr is only used for listening. Defaults to the broker's addr.
+func AdvertisedAddr(advertisedAddr string) BrokerFn {
+	return func(b *Broker) {
+		b.advertisedAddr = advertisedAddr
+	}
+}
+
+// AdvertisedListener is used to set the address, host:port, clients connecting on the server's
+// listener with the given name, e.g. "SSL", should connect to the broker at. It's what's reported
+// in metadata to requests that arrive on the listener. Listeners without an advertised address
+// report the broker's advertised addr.
+func AdvertisedListener(name, addr string) BrokerFn {
+	return func(b *Broker) {
+		if b.advertisedListeners == nil {
+			b.advertisedListeners = make(map[string]string)
+		}
+		b.advertisedListeners[name] = addr
+	}
+}
+
 // Logger is used to set the broker's logger.
 func Logger(logger *simplelog.Logger) BrokerFn {
 	return func(b *Broker) {
@@ -43,6 +69,284 @@ func Raft(raft jocko.Raft) BrokerFn {
 	}
 }
 
+// Authorizer is used to set the authorizer the broker uses to authorize requests.
+// If not set, every request is allowed.
+func Authorizer(authorizer jocko.Authorizer) BrokerFn {
+	return func(b *Broker) {
+		b.authorizer = authorizer
+	}
+}
+
+// PartitionMetrics is used to enable the broker's per-partition produce and fetch
+// latency metrics, registered with r. They're disabled by default because
+// they're labeled by topic and partition, which can mean many series.
+func PartitionMetrics(r prometheus.Registerer) BrokerFn {
+	return func(b *Broker) {
+		b.metrics = newMetrics(r)
+	}
+}
+
+// ReplicaSocketTimeout is used to set the read/write timeout of followers' connections to
+// partition leaders. Followers reconnect when it's exceeded.
+func ReplicaSocketTimeout(timeout time.Duration) BrokerFn {
+	return func(b *Broker) {
+		b.replicaSocketTimeout = timeout
+	}
+}
+
+// ReplicaSocketBufferSizes is used to set the sizes, in bytes, of the receive and send buffers
+// of followers' connections to partition leaders, SO_RCVBUF and SO_SNDBUF. Sizes that aren't
+// positive leave the OS's.
+func ReplicaSocketBufferSizes(receive, send int) BrokerFn {
+	return func(b *Broker) {
+		b.replicaSocketReceiveBufferBytes = receive
+		b.replicaSocketSendBufferBytes = send
+	}
+}
+
+// ReplicaSocketKeepAlivePeriod is used to enable TCP keepalive on followers' connections to
+// partition leaders, sending keepalives every period, so half-open connections are detected and
+// closed. Negative periods disable keepalive, zero leaves Go's default.
+func ReplicaSocketKeepAlivePeriod(period time.Duration) BrokerFn {
+	return func(b *Broker) {
+		b.replicaSocketKeepAlivePeriod = period
+	}
+}
+
+// CheckpointInterval is used to set how often the partitions' high watermarks, recovery points,
+// and log start offsets are checkpointed, to restore them on restart. Zero disables checkpointing them.
+func CheckpointInterval(interval time.Duration) BrokerFn {
+	return func(b *Broker) {
+		b.checkpointInterval = interval
+	}
+}
+
+// FlushInterval is used to set how often the partitions' logs are flushed to stable storage, like
+// Kafka's log.flush.interval.ms. Zero, the default, leaves flushing them to the OS, relying on
+// replication for durability. The logs are flushed when the broker shuts down either way.
+func FlushInterval(interval time.Duration) BrokerFn {
+	return func(b *Broker) {
+		b.flushInterval = interval
+	}
+}
+
+// ReplicaLagTimeMax is used to set how long a follower in a partition's ISR can go without catching
+// up to the leader before the leader removes it from the ISR, like Kafka's replica.lag.time.max.ms.
+// Defaults to 30s, zero disables removing lagging followers.
+func ReplicaLagTimeMax(lagTimeMax time.Duration) BrokerFn {
+	return func(b *Broker) {
+		b.replicaLagTimeMax = lagTimeMax
+	}
+}
+
+// ProducerIDExpiration is used to set how long an idempotent producer's sequences are kept after
+// it last appended to a partition, like Kafka's producer.id.expiration.ms. Defaults to 24h, zero
+// keeps them until the partition's leadership changes.
+func ProducerIDExpiration(expiration time.Duration) BrokerFn {
+	return func(b *Broker) {
+		b.producerIDExpiration = expiration
+	}
+}
+
+// SingleWriterLogs is used to have partitions' logs skip the append lock, for when each partition's
+// produced to by one producer at a time. A log whose appends do overlap falls back to locked
+// appends. Defaults to false.
+func SingleWriterLogs(singleWriter bool) BrokerFn {
+	return func(b *Broker) {
+		b.singleWriterLogs = singleWriter
+	}
+}
+
+// PreallocateSegments is used to have partitions' log segments reserved up to their max bytes when
+// they're created, so they aren't fragmented as they're appended to. Defaults to false.
+func PreallocateSegments(preallocate bool) BrokerFn {
+	return func(b *Broker) {
+		b.preallocateSegments = preallocate
+	}
+}
+
+// AutoLeaderRebalance is used to have the controller check for leadership imbalance at the given
+// interval, moving partitions' leadership back to their preferred leaders when a broker's
+// imbalanced. Zero, the default, disables automatic leader rebalancing.
+func AutoLeaderRebalance(checkInterval time.Duration) BrokerFn {
+	return func(b *Broker) {
+		b.leaderImbalanceCheckInterval = checkInterval
+	}
+}
+
+// LeaderImbalancePerBrokerPercentage is used to set the percentage of a broker's partitions that
+// can be led by other brokers before the controller rebalances them. Defaults to 10.
+func LeaderImbalancePerBrokerPercentage(percentage float64) BrokerFn {
+	return func(b *Broker) {
+		b.leaderImbalancePercentage = percentage
+	}
+}
+
+// InternalTopics is used to set the internal topics, e.g. __transaction_state, the controller
+// creates when it starts if they don't exist.
+func InternalTopics(topics ...InternalTopic) BrokerFn {
+	return func(b *Broker) {
+		b.internalTopics = append(b.internalTopics, topics...)
+	}
+}
+
+// FollowerReplicationThrottledRate is used to limit the rate, in bytes per second, this broker
+// replicates the replicas its topics' follower.replication.throttled.replicas configs list, e.g.
+// replicas added by a reassignment that are catching up, so they don't saturate the network.
+// Replicating other replicas isn't throttled. Zero, the default, means unlimited.
+func FollowerReplicationThrottledRate(bytesPerSecond float64) BrokerFn {
+	return func(b *Broker) {
+		if bytesPerSecond > 0 {
+			b.followerThrottle = newReplicationThrottle(bytesPerSecond)
+		}
+	}
+}
+
+// LeaderReplicationThrottledRate is used to limit the rate, in bytes per second, this broker
+// serves follower fetches of the replicas its topics' leader.replication.throttled.replicas
+// configs list. Serving other replicas isn't throttled. Zero, the default, means unlimited.
+func LeaderReplicationThrottledRate(bytesPerSecond float64) BrokerFn {
+	return func(b *Broker) {
+		if bytesPerSecond > 0 {
+			b.leaderThrottle = newReplicationThrottle(bytesPerSecond)
+		}
+	}
+}
+
+// TransactionStateLog is used to enable the transaction state log, __transaction_state, with the
+// given number of partitions and replication factor. The controller creates the topic, and
+// transactional IDs are hashed into its partitions to find their coordinators.
+func TransactionStateLog(numPartitions int32, replicationFactor int16) BrokerFn {
+	return func(b *Broker) {
+		b.transactionStateLogNumPartitions = numPartitions
+		b.internalTopics = append(b.internalTopics, InternalTopic{
+			Name:              transactionStateTopic,
+			Partitions:        numPartitions,
+			ReplicationFactor: replicationFactor,
+		})
+	}
+}
+
+// RequestHandlerThreads is used to set the number of goroutines handling requests, bounding how
+// many requests the broker handles at once however many connections it has. Defaults to 8.
+func RequestHandlerThreads(n int) BrokerFn {
+	return func(b *Broker) {
+		b.requestHandlerThreads = n
+	}
+}
+
+// NumRecoveryThreads is used to set the number of goroutines recovering partitions' logs in
+// parallel when the broker starts, bounded so they don't thrash the disk. Defaults to 1.
+func NumRecoveryThreads(n int) BrokerFn {
+	return func(b *Broker) {
+		b.numRecoveryThreads = n
+	}
+}
+
+// RecoveryFailureThreshold is used to have the broker fail to start if n or more partitions' logs
+// fail to recover. Zero, the default, means the broker starts however many fail, leaving their
+// partitions offline.
+func RecoveryFailureThreshold(n int) BrokerFn {
+	return func(b *Broker) {
+		b.recoveryFailureThreshold = n
+	}
+}
+
+// AllowAutoTopicCreation is used to have topics that don't exist created, with one partition and a
+// replication factor of one, when they're requested in metadata or produced to. Disabled by default,
+// so topics have to be created explicitly.
+func AllowAutoTopicCreation(allow bool) BrokerFn {
+	return func(b *Broker) {
+		b.allowAutoTopicCreation = allow
+	}
+}
+
+// MaxPartitionsPerTopic is used to set the most partitions a topic can be created with, like
+// Kafka's max.partitions.per.topic, so a typo can't exhaust the cluster's resources. Zero, the
+// default, means unlimited.
+func MaxPartitionsPerTopic(n int32) BrokerFn {
+	return func(b *Broker) {
+		b.maxPartitionsPerTopic = n
+	}
+}
+
+// MaxPartitionsPerBroker is used to set the most partition replicas a broker can host. The
+// controller refuses to create topics whose replicas it would have to assign to brokers over the
+// limit, and brokers refuse to host replicas over it. Zero, the default, means unlimited.
+func MaxPartitionsPerBroker(n int) BrokerFn {
+	return func(b *Broker) {
+		b.maxPartitionsPerBroker = n
+	}
+}
+
+// ControlledShutdownMaxRetries is used to have the broker ask the controller to move the leadership
+// of the partitions it leads to other brokers when it shuts down, retrying up to the given number
+// of times while partitions remain. Zero, the default, disables controlled shutdown.
+func ControlledShutdownMaxRetries(n int) BrokerFn {
+	return func(b *Broker) {
+		b.controlledShutdownMaxRetries = n
+	}
+}
+
+// SlowRequestThreshold is used to set how long a request can take to handle before it's
+// logged as slow. Zero, the default, disables the slow request log.
+func SlowRequestThreshold(d time.Duration) BrokerFn {
+	return func(b *Broker) {
+		b.slowRequestThreshold = d
+	}
+}
+
+// ControllerMutationRate is used to set the default number of partitions per second a
+// principal can create or delete. Zero, the default, means unlimited.
+func ControllerMutationRate(rate float64) BrokerFn {
+	return func(b *Broker) {
+		b.mutationQuota.rate = rate
+	}
+}
+
+// PrincipalControllerMutationRate is used to set the number of partitions per second the
+// principal, e.g. "User:alice", can create or delete, overriding the default rate.
+func PrincipalControllerMutationRate(principal string, rate float64) BrokerFn {
+	return func(b *Broker) {
+		b.mutationQuota.rates[principal] = rate
+	}
+}
+
+// Seeds is used to set the serf addresses of brokers to join the cluster through when the broker
+// starts. The broker retries with backoff until it's joined through one of them, failing to start
+// if it can't within the join timeout. Without seeds the broker starts a new cluster.
+func Seeds(addrs ...string) BrokerFn {
+	return func(b *Broker) {
+		b.seeds = addrs
+	}
+}
+
+// SeedsJoinTimeout is used to set how long the broker tries to join the cluster through its seeds
+// when it starts. Defaults to a minute.
+func SeedsJoinTimeout(timeout time.Duration) BrokerFn {
+	return func(b *Broker) {
+		b.seedsJoinTimeout = timeout
+	}
+}
+
+// RaftApplyRetries is used to set how many times the broker retries applying a raft command, e.g.
+// creating a topic or electing a leader, that raft rejected without committing, e.g. during an
+// election. Zero disables retrying. Defaults to 3.
+func RaftApplyRetries(retries int) BrokerFn {
+	return func(b *Broker) {
+		b.raftApplyRetries = retries
+	}
+}
+
+// RaftApplyRetryBackoff is used to set how long the broker first waits before checking whether a
+// raft leader's been elected to retry a command, doubling after each check up to 2s. Defaults to
+// 100ms.
+func RaftApplyRetryBackoff(backoff time.Duration) BrokerFn {
+	return func(b *Broker) {
+		b.raftApplyRetryBackoff = backoff
+	}
+}
+
 // ReplicatorFn is used to configure replicators.
 type ReplicatorFn func(r *Replicator)
 
@@ -74,6 +378,32 @@ func ReplicatorMaxWaitTime(time int32) ReplicatorFn {
 	}
 }
 
+// ReplicatorDial is used to set how the replicator connects to the partition's leader. The
+// replicator calls dial again to reconnect when a fetch fails, so it should connect to the
+// current leader. Overrides ReplicatorLeader.
+func ReplicatorDial(dial func() (net.Conn, error)) ReplicatorFn {
+	return func(r *Replicator) {
+		r.dial = dial
+	}
+}
+
+// ReplicatorTimeout is used to set the read/write timeout of the replicator's connection to
+// the leader, used when the replicator dials the leader. Zero, the default, means no timeout.
+func ReplicatorTimeout(timeout time.Duration) ReplicatorFn {
+	return func(r *Replicator) {
+		r.timeout = timeout
+	}
+}
+
+// replicatorThrottle is used to limit the rate the replicator fetches from the leader at while
+// throttled returns true. If throttled is nil, the replicator's always throttled.
+func replicatorThrottle(throttle *replicationThrottle, throttled func() bool) ReplicatorFn {
+	return func(r *Replicator) {
+		r.throttle = throttle
+		r.throttled = throttled
+	}
+}
+
 // ReplicatorLeader is used to set the replicator's leader to consume from.
 func ReplicatorLeader(leader jocko.Client) ReplicatorFn {
 	return func(r *Replicator) {
@@ -0,0 +1,182 @@
+package broker
+
+import (
+	"sync"
+	"time"
+
+	"github.com/travisjeffery/jocko/commitlog"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+// producerStates tracks the sequences idempotent producers last appended to the partitions this
+// broker leads, so a batch a producer retries, e.g. because its response was lost, is appended
+// once. Like Kafka, the last maxProducerBatches batches of each producer are kept, since that's how
+// many a producer can have in flight. The state isn't persisted, after a restart or a leader change
+// the producers' next batches are accepted as they come. Producers that haven't appended within the
+// producer ID expiration are forgotten the same way, so the state doesn't grow with every producer
+// that's ever appended.
+type producerStates struct {
+	mu         sync.Mutex
+	partitions map[topicPartition]*partitionProducers
+}
+
+// partitionProducers are the states of the producers appending to a partition. Its lock is held
+// from checking a batch until it's appended, so the producer's retries can't race it.
+type partitionProducers struct {
+	sync.Mutex
+	producers map[int64]*producerState
+}
+
+const (
+	// maxProducerBatches is the number of batches kept for each producer.
+	maxProducerBatches = 5
+	// defaultProducerIDExpiration is the default time a producer's state is kept after it last
+	// appended, same as Kafka's producer.id.expiration.ms, and producerIDExpirationCheckInterval
+	// how often expired states are looked for, same as producer.id.expiration.check.interval.ms.
+	defaultProducerIDExpiration       = 24 * time.Hour
+	producerIDExpirationCheckInterval = 10 * time.Minute
+)
+
+// producerState is the epoch of a producer, the batches it last appended, oldest first, and when
+// it last appended.
+type producerState struct {
+	epoch    int16
+	batches  []producerBatch
+	lastUsed time.Time
+}
+
+// producerBatch is the sequences of a batch a producer appended and the offset it was appended at.
+type producerBatch struct {
+	baseSequence int32
+	lastSequence int32
+	offset       int64
+}
+
+// partition returns the states of the producers appending to the partition.
+func (s *producerStates) partition(tp topicPartition) *partitionProducers {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.partitions == nil {
+		s.partitions = make(map[topicPartition]*partitionProducers)
+	}
+	p, ok := s.partitions[tp]
+	if !ok {
+		p = &partitionProducers{producers: make(map[int64]*producerState)}
+		s.partitions[tp] = p
+	}
+	return p
+}
+
+// reset is used to forget the producers of the partition, e.g. when this broker becomes its leader.
+func (s *producerStates) reset(tp topicPartition) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.partitions, tp)
+}
+
+// remove is used to forget the producers of the topic's partitions, e.g. when it's deleted.
+func (s *producerStates) remove(topic string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for tp := range s.partitions {
+		if tp.Topic == topic {
+			delete(s.partitions, tp)
+		}
+	}
+}
+
+// expire is used to forget the producers that haven't appended to any partition within expiration
+// of now. Their next batches are accepted as they come, like a new producer's.
+func (s *producerStates) expire(expiration time.Duration, now time.Time) {
+	s.mu.Lock()
+	partitions := make([]*partitionProducers, 0, len(s.partitions))
+	for _, p := range s.partitions {
+		partitions = append(partitions, p)
+	}
+	s.mu.Unlock()
+	for _, p := range partitions {
+		p.Lock()
+		for id, state := range p.producers {
+			if now.Sub(state.lastUsed) > expiration {
+				delete(p.producers, id)
+			}
+		}
+		p.Unlock()
+	}
+}
+
+// check is used to validate the batch against its producer's state. It returns true and the
+// offset the batch was appended at if the batch is a retry of one of the batches the producer last
+// appended, or an error if the producer's been fenced by a newer epoch or the batch's out of
+// sequence.
+func (p *partitionProducers) check(batch commitlog.ProducerBatch) (int64, bool, protocol.Error) {
+	state, ok := p.producers[batch.ProducerID]
+	switch {
+	case !ok:
+		// we don't know what the producer appended before, e.g. we just became the leader.
+		return 0, false, protocol.ErrNone
+	case batch.ProducerEpoch < state.epoch:
+		return 0, false, protocol.ErrInvalidProducerEpoch
+	case batch.ProducerEpoch > state.epoch:
+		// a new epoch starts its sequences over.
+		if batch.BaseSequence != 0 {
+			return 0, false, protocol.ErrOutOfOrderSequenceNumber
+		}
+		return 0, false, protocol.ErrNone
+	}
+	for _, b := range state.batches {
+		if b.baseSequence == batch.BaseSequence && b.lastSequence == batch.LastSequence {
+			return b.offset, true, protocol.ErrNone
+		}
+	}
+	last := state.batches[len(state.batches)-1]
+	if batch.BaseSequence != nextSequence(last.lastSequence) {
+		return 0, false, protocol.ErrOutOfOrderSequenceNumber
+	}
+	return 0, false, protocol.ErrNone
+}
+
+// update is used to record the batch the producer appended at offset at now.
+func (p *partitionProducers) update(batch commitlog.ProducerBatch, offset int64, now time.Time) {
+	state, ok := p.producers[batch.ProducerID]
+	if !ok || state.epoch != batch.ProducerEpoch {
+		state = &producerState{epoch: batch.ProducerEpoch}
+		p.producers[batch.ProducerID] = state
+	}
+	state.lastUsed = now
+	state.batches = append(state.batches, producerBatch{
+		baseSequence: batch.BaseSequence,
+		lastSequence: batch.LastSequence,
+		offset:       offset,
+	})
+	if n := len(state.batches); n > maxProducerBatches {
+		state.batches = append(state.batches[:0], state.batches[n-maxProducerBatches:]...)
+	}
+}
+
+// expireProducerIDs is used to periodically forget the producers that haven't appended within the
+// producer ID expiration, until the broker shuts down.
+func (b *Broker) expireProducerIDs() {
+	interval := producerIDExpirationCheckInterval
+	if b.producerIDExpiration < interval {
+		interval = b.producerIDExpiration
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			b.producerStates.expire(b.producerIDExpiration, time.Now())
+		case <-b.shutdownCh:
+			return
+		}
+	}
+}
+
+// nextSequence returns the sequence after seq, sequences wrap around after the max int32.
+func nextSequence(seq int32) int32 {
+	if seq == 1<<31-1 {
+		return 0
+	}
+	return seq + 1
+}
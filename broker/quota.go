@@ -0,0 +1,166 @@
+package broker
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// minStrictCreateTopicsVersion and minStrictDeleteTopicsVersion are the first versions of
+	// the requests whose clients know ErrThrottlingQuotaExceeded. Like Kafka, older clients'
+	// mutations are accepted when they exceed the quota, and the clients are only throttled.
+	minStrictCreateTopicsVersion = 6
+	minStrictDeleteTopicsVersion = 5
+)
+
+// mutationQuota is used to limit the rate of the controller mutations, i.e.
+// partitions created or deleted, each principal can make. Like Kafka's
+// controller mutation quota (KIP-599), it's a token bucket per principal:
+// mutations are accepted while the principal's bucket has tokens left, even if
+// that takes it into debt, and the principal's throttled until the debt's
+// paid off.
+type mutationQuota struct {
+	sync.Mutex
+	// rate is the default number of mutations per second a principal can
+	// make, zero means unlimited.
+	rate    float64
+	rates   map[string]float64
+	buckets map[string]*mutationBucket
+}
+
+type mutationBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newMutationQuota() *mutationQuota {
+	return &mutationQuota{
+		rates:   make(map[string]float64),
+		buckets: make(map[string]*mutationBucket),
+	}
+}
+
+// exceeded returns whether the principal's bucket is in debt, so strict
+// clients' mutations should be rejected, and how long the principal should be
+// throttled for.
+func (q *mutationQuota) exceeded(principal string) (bool, time.Duration) {
+	if q == nil {
+		return false, 0
+	}
+	q.Lock()
+	defer q.Unlock()
+	bucket, rate := q.bucket(principal)
+	if bucket == nil {
+		return false, 0
+	}
+	return bucket.tokens <= 0, throttleTime(bucket.tokens, rate)
+}
+
+// record is used to record the given number of mutations made by the
+// principal, once they've been applied. It returns how long the principal
+// should be throttled for. The mutations are recorded even if they take the
+// principal's bucket into debt.
+func (q *mutationQuota) record(principal string, mutations int) time.Duration {
+	if q == nil {
+		return 0
+	}
+	q.Lock()
+	defer q.Unlock()
+	bucket, rate := q.bucket(principal)
+	if bucket == nil {
+		return 0
+	}
+	bucket.tokens -= float64(mutations)
+	return throttleTime(bucket.tokens, rate)
+}
+
+// bucket returns the principal's bucket, refilled with the tokens accrued
+// since it was last used, and its rate. It returns nil if the principal's
+// mutations are unlimited. The caller must hold the lock.
+func (q *mutationQuota) bucket(principal string) (*mutationBucket, float64) {
+	rate, ok := q.rates[principal]
+	if !ok {
+		rate = q.rate
+	}
+	if rate <= 0 {
+		return nil, 0
+	}
+	now := time.Now()
+	bucket, ok := q.buckets[principal]
+	if !ok {
+		// the burst is a second's worth of mutations.
+		bucket = &mutationBucket{tokens: rate, last: now}
+		q.buckets[principal] = bucket
+	}
+	bucket.tokens += now.Sub(bucket.last).Seconds() * rate
+	if bucket.tokens > rate {
+		bucket.tokens = rate
+	}
+	bucket.last = now
+	return bucket, rate
+}
+
+// throttleTime returns how long it'll take a bucket to pay off its debt.
+func throttleTime(tokens, rate float64) time.Duration {
+	if tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-tokens / rate * float64(time.Second))
+}
+
+// throttleTimeMs returns the throttle time as the milliseconds used by responses.
+func throttleTimeMs(d time.Duration) int32 {
+	return int32(d / time.Millisecond)
+}
+
+// replicationThrottle is used to limit the rate, in bytes per second, at which
+// throttled replicas are replicated, so replicas catching up, e.g. after being
+// reassigned, don't saturate the network. It's a token bucket shared by every
+// throttled replica on the broker, like Kafka's leader and
+// follower.replication.throttled.rate.
+type replicationThrottle struct {
+	sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newReplicationThrottle(rate float64) *replicationThrottle {
+	return &replicationThrottle{rate: rate, tokens: rate, last: time.Now()}
+}
+
+// record is used to record the given number of bytes fetched. It returns how
+// long the replicator should wait before fetching again.
+func (t *replicationThrottle) record(bytes int) time.Duration {
+	if t == nil || t.rate <= 0 {
+		return 0
+	}
+	t.Lock()
+	defer t.Unlock()
+	t.refill()
+	t.tokens -= float64(bytes)
+	return throttleTime(t.tokens, t.rate)
+}
+
+// exceeded returns whether more bytes have been recorded than the rate allows, so throttled
+// replicas shouldn't be replicated until the throttle's refilled.
+func (t *replicationThrottle) exceeded() bool {
+	if t == nil || t.rate <= 0 {
+		return false
+	}
+	t.Lock()
+	defer t.Unlock()
+	t.refill()
+	return t.tokens < 0
+}
+
+// refill is used to add the tokens accrued since the throttle was last used. The caller must hold
+// the lock.
+func (t *replicationThrottle) refill() {
+	now := time.Now()
+	t.tokens += now.Sub(t.last).Seconds() * t.rate
+	if t.tokens > t.rate {
+		t.tokens = t.rate
+	}
+	t.last = now
+}
@@ -0,0 +1,114 @@
+package broker
+
+import (
+	"time"
+
+	"github.com/travisjeffery/jocko"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+// rebalanceLeaders is used to periodically check for leadership imbalance, while this broker's
+// the controller, until it shuts down.
+func (b *Broker) rebalanceLeaders() {
+	ticker := time.NewTicker(b.leaderImbalanceCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if !b.isController() {
+				continue
+			}
+			if err := b.checkLeaderImbalance(); err != nil {
+				b.logger.Info("failed to rebalance leaders: %v", err)
+			}
+		case <-b.shutdownCh:
+			return
+		}
+	}
+}
+
+// checkLeaderImbalance is used to find the brokers whose percentage of partitions led by other
+// brokers exceeds the imbalance percentage, and elect them leader of those partitions again.
+// Partitions are only moved back to preferred leaders that are cluster members and in the ISR.
+func (b *Broker) checkLeaderImbalance() error {
+	preferred := make(map[int32]int)
+	imbalanced := make(map[int32][]*jocko.Partition)
+	b.RLock()
+	for _, partitions := range b.topicMap {
+		for _, p := range partitions {
+			preferred[p.PreferredLeader]++
+			if p.Leader != p.PreferredLeader {
+				imbalanced[p.PreferredLeader] = append(imbalanced[p.PreferredLeader], p)
+			}
+		}
+	}
+	b.RUnlock()
+
+	for id, partitions := range imbalanced {
+		ratio := float64(len(partitions)) / float64(preferred[id]) * 100
+		if ratio <= b.leaderImbalancePercentage {
+			continue
+		}
+		if b.clusterMember(id) == nil {
+			continue
+		}
+		b.logger.Info("leadership imbalance of broker %d is %.0f%%, electing it leader of its preferred partitions", id, ratio)
+		for _, p := range partitions {
+			if !p.InISR(id) {
+				continue
+			}
+			if err := b.raftApply(electLeader, &jocko.Partition{Topic: p.Topic, ID: p.ID, Leader: id}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// electLeader is used to make the given broker the partition's leader on this broker, becoming
+// the partition's leader or following the new leader if this broker's a replica. A leader of -1
+// means no broker could be elected, the partition's marked offline.
+func (b *Broker) electLeader(elected *jocko.Partition) protocol.Error {
+	p, err := b.partition(elected.Topic, elected.ID)
+	if err != protocol.ErrNone {
+		return err
+	}
+	b.Lock()
+	p.LeaderEpoch++
+	p.PartitionEpoch++
+	if elected.Leader == -1 {
+		// the controller couldn't elect a leader, the partition's offline until it can.
+		defer b.Unlock()
+		p.Leader = -1
+		p.Offline = true
+		// stop replicating from the leader that left.
+		if r, ok := b.replicators[p]; ok {
+			delete(b.replicators, p)
+			if err := r.Close(); err != nil {
+				return protocol.ErrUnknown.WithErr(err)
+			}
+		}
+		return protocol.ErrNone
+	}
+	p.Offline = false
+	state := &protocol.PartitionState{
+		Topic:       p.Topic,
+		Partition:   p.ID,
+		Leader:      elected.Leader,
+		LeaderEpoch: p.LeaderEpoch,
+		ISR:         p.ISRSnapshot(),
+		Replicas:    p.Replicas,
+		ZKVersion:   p.LeaderAndISRVersionInZK,
+	}
+	b.Unlock()
+	switch {
+	case elected.Leader == b.id:
+		return b.becomeLeader(p.Topic, p.ID, state)
+	case contains(p.Replicas, b.id):
+		return b.becomeFollower(p.Topic, p.ID, state)
+	}
+	b.Lock()
+	p.Leader = elected.Leader
+	b.Unlock()
+	return protocol.ErrNone
+}
@@ -0,0 +1,97 @@
+package broker
+
+import (
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"github.com/travisjeffery/jocko"
+)
+
+// recoverLogs is used to open the logs of the partitions in the log dir when the broker starts,
+// recovering the ones that weren't flushed, numRecoveryThreads at a time. Otherwise they'd be
+// opened one after another as raft replays the partitions' creation. The opened logs are used
+// when the partitions' replicas are started. Partitions whose logs fail to open are logged and
+// left offline, unless recoveryFailureThreshold or more fail, when it returns an error.
+func (b *Broker) recoverLogs() error {
+	partitions, err := logDirPartitions(b.logDir)
+	if err != nil {
+		return errors.Wrapf(err, "log dir %s can't be read", b.logDir)
+	}
+	type recovered struct {
+		path string
+		log  jocko.CommitLog
+		err  error
+	}
+	partitionCh := make(chan *jocko.Partition)
+	recoveredCh := make(chan recovered)
+	n := b.numRecoveryThreads
+	if n < 1 {
+		n = 1
+	}
+	for i := 0; i < n; i++ {
+		go func() {
+			for p := range partitionCh {
+				r := recovered{path: path.Join(b.logDir, p.String())}
+				var recoveryPoint, logStartOffset int64
+				if _, recoveryPoint, logStartOffset, r.err = b.checkpointedOffsets(p); r.err == nil {
+					r.log, r.err = b.openCommitLog(r.path, recoveryPoint, logStartOffset)
+				}
+				recoveredCh <- r
+			}
+		}()
+	}
+	go func() {
+		for _, p := range partitions {
+			partitionCh <- p
+		}
+		close(partitionCh)
+	}()
+
+	logs := make(map[string]jocko.CommitLog)
+	failures := make(map[string]error)
+	for range partitions {
+		r := <-recoveredCh
+		if r.err != nil {
+			b.logger.Info("failed to recover log %s, leaving it offline: %v", r.path, r.err)
+			failures[r.path] = r.err
+			continue
+		}
+		logs[r.path] = r.log
+	}
+	if b.recoveryFailureThreshold > 0 && len(failures) >= b.recoveryFailureThreshold {
+		return errors.Errorf("%d of %d partitions' logs failed to recover", len(failures), len(partitions))
+	}
+	b.logger.Info("recovered %d of %d partitions' logs", len(logs), len(partitions))
+	b.recoveredLogs = logs
+	b.recoveryFailures = failures
+	return nil
+}
+
+// logDirPartitions returns the partitions whose logs are in the log dir, at <topic>/<partition>.
+func logDirPartitions(logDir string) ([]*jocko.Partition, error) {
+	topics, err := ioutil.ReadDir(logDir)
+	if err != nil {
+		return nil, err
+	}
+	var partitions []*jocko.Partition
+	for _, t := range topics {
+		if !t.IsDir() {
+			continue
+		}
+		ids, err := ioutil.ReadDir(filepath.Join(logDir, t.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range ids {
+			n, err := strconv.ParseInt(id.Name(), 10, 32)
+			if err != nil || !id.IsDir() {
+				continue
+			}
+			partitions = append(partitions, jocko.NewPartition(t.Name(), int32(n)))
+		}
+	}
+	return partitions, nil
+}
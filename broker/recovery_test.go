@@ -0,0 +1,159 @@
+package broker
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/travisjeffery/jocko"
+	"github.com/travisjeffery/jocko/protocol"
+	"github.com/travisjeffery/jocko/testutil/mock"
+)
+
+func TestBroker_recoverLogs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recover-logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for i := 0; i < 4; i++ {
+		if err := os.MkdirAll(filepath.Join(dir, "the-topic", fmt.Sprint(i)), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// not partitions' logs.
+	if err := os.MkdirAll(filepath.Join(dir, "the-topic", "not-a-partition"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "a-file"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	f := newFields()
+	f.serf.MemberFn = func(id int32) *jocko.ClusterMember {
+		return &jocko.ClusterMember{ID: id}
+	}
+	b := &Broker{
+		logger:             f.logger,
+		id:                 f.id,
+		topicMap:           make(map[string][]*jocko.Partition),
+		replicators:        f.replicators,
+		logDir:             dir,
+		raft:               f.raft,
+		serf:               f.serf,
+		numRecoveryThreads: 4,
+	}
+	// each open waits on the others, so the logs only recover if they're opened in parallel.
+	var mu sync.Mutex
+	var opened []string
+	all := make(chan struct{})
+	b.newCommitLog = func(path string) (jocko.CommitLog, error) {
+		mu.Lock()
+		opened = append(opened, path)
+		if len(opened) == 4 {
+			close(all)
+		}
+		mu.Unlock()
+		select {
+		case <-all:
+			return &mock.CommitLog{}, nil
+		case <-time.After(5 * time.Second):
+			return nil, errors.New("logs weren't opened in parallel")
+		}
+	}
+	if err := b.recoverLogs(); err != nil {
+		t.Fatalf("recoverLogs() err = %v", err)
+	}
+	if len(b.recoveryFailures) != 0 {
+		t.Fatalf("recoveryFailures = %v, want none", b.recoveryFailures)
+	}
+	if len(b.recoveredLogs) != 4 {
+		t.Fatalf("recovered %d logs, want 4", len(b.recoveredLogs))
+	}
+
+	for i := int32(0); i < 4; i++ {
+		p := &jocko.Partition{Topic: "the-topic", ID: i, Leader: f.id, Replicas: []int32{f.id}}
+		want := b.recoveredLogs[filepath.Join(dir, p.String())]
+		if got := b.startReplica(p); got != protocol.ErrNone {
+			t.Fatalf("startReplica(%d) = %v, want %v", i, got, protocol.ErrNone)
+		}
+		if p.CommitLog != want {
+			t.Errorf("startReplica(%d) didn't use the recovered log", i)
+		}
+	}
+	if len(opened) != 4 {
+		t.Errorf("opened %d logs, want 4", len(opened))
+	}
+	if len(b.recoveredLogs) != 0 {
+		t.Errorf("recoveredLogs = %v, want them all used", b.recoveredLogs)
+	}
+}
+
+func TestBroker_recoverLogs_failures(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recover-logs-failures")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for i := 0; i < 2; i++ {
+		if err := os.MkdirAll(filepath.Join(dir, "the-topic", fmt.Sprint(i)), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	broken := filepath.Join(dir, "the-topic", "1")
+	newBroker := func(threshold int) *Broker {
+		f := newFields()
+		f.serf.MemberFn = func(id int32) *jocko.ClusterMember {
+			return &jocko.ClusterMember{ID: id}
+		}
+		b := &Broker{
+			logger:                   f.logger,
+			id:                       f.id,
+			topicMap:                 make(map[string][]*jocko.Partition),
+			replicators:              f.replicators,
+			logDir:                   dir,
+			raft:                     f.raft,
+			serf:                     f.serf,
+			recoveryFailureThreshold: threshold,
+		}
+		b.newCommitLog = func(path string) (jocko.CommitLog, error) {
+			if path == broken {
+				return nil, errors.New("corrupt segment")
+			}
+			return &mock.CommitLog{}, nil
+		}
+		return b
+	}
+
+	t.Run("offline partition", func(t *testing.T) {
+		b := newBroker(0)
+		if err := b.recoverLogs(); err != nil {
+			t.Fatalf("recoverLogs() err = %v", err)
+		}
+		if _, ok := b.recoveryFailures[broken]; !ok {
+			t.Fatalf("recoveryFailures = %v, want %s", b.recoveryFailures, broken)
+		}
+		p := &jocko.Partition{Topic: "the-topic", ID: 1, Leader: b.id, Replicas: []int32{b.id}}
+		if got := b.startReplica(p); got.Code() != protocol.ErrKafkaStorageError.Code() {
+			t.Errorf("startReplica() = %v, want %v", got, protocol.ErrKafkaStorageError)
+		}
+		if p.IsOpen() {
+			t.Errorf("startReplica() opened the offline partition's log")
+		}
+		p = &jocko.Partition{Topic: "the-topic", ID: 0, Leader: b.id, Replicas: []int32{b.id}}
+		if got := b.startReplica(p); got != protocol.ErrNone {
+			t.Errorf("startReplica() = %v, want %v", got, protocol.ErrNone)
+		}
+	})
+
+	t.Run("over threshold", func(t *testing.T) {
+		if err := newBroker(1).recoverLogs(); err == nil {
+			t.Errorf("recoverLogs() err = nil, want the broker to fail to start")
+		}
+	})
+}
@@ -0,0 +1,90 @@
+package broker
+
+import (
+	"time"
+)
+
+// brokerRegistrationInterval is how often the controller checks for brokers that need to be
+// registered.
+const brokerRegistrationInterval = time.Second
+
+// brokerRegistration is a broker's registration with the controller. Each time a broker's
+// registered, e.g. after it's restarted, it's given a new broker epoch greater than any before,
+// so requests it sent before it restarted can be told apart and rejected.
+type brokerRegistration struct {
+	ID          int32 `json:"id"`
+	Incarnation int64 `json:"incarnation"`
+	Epoch       int64 `json:"epoch"`
+}
+
+// registerBrokers is used to periodically register cluster members that haven't been registered
+// since they started, give the cluster an ID if it hasn't got one, and elect leaders for partitions
+// whose leaders have left, while this broker's the controller, until it shuts down.
+func (b *Broker) registerBrokers() {
+	ticker := time.NewTicker(brokerRegistrationInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if !b.isController() {
+				continue
+			}
+			if err := b.checkRegistrations(); err != nil {
+				b.logger.Info("failed to register brokers: %v", err)
+			}
+			if err := b.checkClusterID(); err != nil {
+				b.logger.Info("failed to generate cluster id: %v", err)
+			}
+			if err := b.checkPartitionLeaders(); err != nil {
+				b.logger.Info("failed to elect partition leaders: %v", err)
+			}
+		case <-b.shutdownCh:
+			return
+		}
+	}
+}
+
+// checkRegistrations is used to register the cluster members whose incarnation differs from
+// their registration's, i.e. they're new or have restarted.
+func (b *Broker) checkRegistrations() error {
+	for _, m := range b.clusterMembers() {
+		b.RLock()
+		r, ok := b.brokerRegistrations[m.ID]
+		b.RUnlock()
+		if ok && r.Incarnation == m.Incarnation {
+			continue
+		}
+		if err := b.raftApply(registerBroker, &brokerRegistration{ID: m.ID, Incarnation: m.Incarnation}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// registerBroker is used to apply the broker's registration, giving it the next broker epoch.
+// Registrations are applied in the same order on every broker, so they agree on the epochs.
+// Registering the same incarnation again is a no-op.
+func (b *Broker) registerBroker(r *brokerRegistration) {
+	b.Lock()
+	defer b.Unlock()
+	if prev, ok := b.brokerRegistrations[r.ID]; ok && prev.Incarnation == r.Incarnation {
+		return
+	}
+	if b.brokerRegistrations == nil {
+		b.brokerRegistrations = make(map[int32]brokerRegistration)
+	}
+	b.lastBrokerEpoch++
+	r.Epoch = b.lastBrokerEpoch
+	b.brokerRegistrations[r.ID] = *r
+	b.logger.Info("registered broker %d with epoch %d", r.ID, r.Epoch)
+}
+
+// brokerEpoch returns the broker's epoch, or -1 if it isn't registered.
+func (b *Broker) brokerEpoch(id int32) int64 {
+	b.RLock()
+	defer b.RUnlock()
+	if r, ok := b.brokerRegistrations[id]; ok {
+		return r.Epoch
+	}
+	return -1
+}
@@ -2,11 +2,19 @@ package broker
 
 import (
 	"fmt"
+	"net"
+	"sync"
+	"time"
 
 	"github.com/travisjeffery/jocko"
 	"github.com/travisjeffery/jocko/protocol"
+	"github.com/travisjeffery/jocko/server"
 )
 
+// reconnectBackoff is how long the replicator waits before redialing the leader after failing to
+// connect or fetch.
+const reconnectBackoff = 100 * time.Millisecond
+
 // Replicator fetches from the partition's leader producing to itself the follower, thereby replicating the partition.
 type Replicator struct {
 	replicaID           int32
@@ -19,17 +27,34 @@ type Replicator struct {
 	offset              int64
 	msgs                chan []byte
 	done                chan struct{}
+	closeOnce           sync.Once
+	fetchDone           chan struct{}
+	appendDone          chan struct{}
 	leader              jocko.Client
+
+	// dial is used to connect to the partition's leader. If set, the
+	// replicator reconnects when a fetch fails, e.g. times out.
+	dial    func() (net.Conn, error)
+	conn    net.Conn
+	timeout time.Duration
+
+	// throttle is used to limit the rate the replicator fetches at while
+	// throttled returns true, e.g. while the replica's configured as
+	// throttled. If nil, it isn't throttled.
+	throttle  *replicationThrottle
+	throttled func() bool
 }
 
 // NewReplicator returns a new replicator instance.
 func NewReplicator(partition *jocko.Partition, replicaID int32, opts ...ReplicatorFn) *Replicator {
 	r := &Replicator{
-		partition: partition,
-		replicaID: replicaID,
-		clientID:  fmt.Sprintf("Replicator-%d", replicaID),
-		done:      make(chan struct{}, 2),
-		msgs:      make(chan []byte, 2),
+		partition:  partition,
+		replicaID:  replicaID,
+		clientID:   fmt.Sprintf("Replicator-%d", replicaID),
+		done:       make(chan struct{}),
+		fetchDone:  make(chan struct{}),
+		appendDone: make(chan struct{}),
+		msgs:       make(chan []byte, 2),
 	}
 	for _, o := range opts {
 		o(r)
@@ -42,12 +67,23 @@ func NewReplicator(partition *jocko.Partition, replicaID int32, opts ...Replicat
 }
 
 func (r *Replicator) fetchMessages() {
+	defer close(r.fetchDone)
+	defer r.disconnect()
 	for {
 		select {
 		case <-r.done:
 			return
 		default:
+			if err := r.connect(); err != nil {
+				select {
+				case <-r.done:
+					return
+				case <-time.After(reconnectBackoff):
+				}
+				continue
+			}
 			fetchRequest := &protocol.FetchRequest{
+				APIVersion:  5,
 				ReplicaID:   r.replicaID,
 				MaxWaitTime: r.maxWaitTime,
 				MinBytes:    r.minBytes,
@@ -56,44 +92,133 @@ func (r *Replicator) fetchMessages() {
 					Partitions: []*protocol.FetchPartition{{
 						Partition:   r.partition.ID,
 						FetchOffset: r.offset,
+						MaxBytes:    r.fetchSize,
 					}},
 				}},
 			}
+			if r.conn != nil && r.timeout > 0 {
+				r.conn.SetDeadline(time.Now().Add(r.timeout))
+			}
 			fetchResponse, err := r.leader.FetchMessages(r.clientID, fetchRequest)
-			// TODO: probably shouldn't panic. just let this replica fall out of ISR.
 			if err != nil {
+				if r.dial != nil {
+					// the leader's dead or moved, reconnect to whoever's leader now.
+					r.disconnect()
+					select {
+					case <-r.done:
+						return
+					case <-time.After(reconnectBackoff):
+					}
+					continue
+				}
+				// TODO: probably shouldn't panic. just let this replica fall out of ISR.
 				panic(err)
 			}
+			fetched := 0
 			for _, resp := range fetchResponse.Responses {
 				for _, p := range resp.PartitionResponses {
+					fetched += len(p.RecordSet)
+					if p.ErrorCode == protocol.ErrOffsetOutOfRange.Code() {
+						// the leader's log no longer has our offset, skip past the deleted data.
+						if p.LogStartOffset > r.offset {
+							r.offset = p.LogStartOffset
+						}
+						continue
+					}
+					if len(p.RecordSet) == 0 {
+						continue
+					}
 					offset := int64(protocol.Encoding.Uint64(p.RecordSet[:8])) + 1
 					if offset > r.offset {
-						r.msgs <- p.RecordSet
+						select {
+						case r.msgs <- p.RecordSet:
+						case <-r.done:
+							return
+						}
 						r.highwaterMarkOffset = p.HighWatermark
 						r.offset = offset
 					}
 				}
 			}
+			if r.throttle == nil || r.throttled != nil && !r.throttled() {
+				continue
+			}
+			if d := r.throttle.record(fetched); d > 0 {
+				select {
+				case <-r.done:
+					return
+				case <-time.After(d):
+				}
+			}
 		}
 	}
 }
 
+// connect is used to connect to the partition's leader if the replicator dials
+// its leader and isn't connected.
+func (r *Replicator) connect() error {
+	if r.dial == nil || r.conn != nil {
+		return nil
+	}
+	conn, err := r.dial()
+	if err != nil {
+		return err
+	}
+	r.conn = conn
+	r.leader = server.NewClient(conn)
+	return nil
+}
+
+// disconnect is used to close the replicator's connection to the leader.
+func (r *Replicator) disconnect() {
+	if r.dial == nil || r.conn == nil {
+		return
+	}
+	r.conn.Close()
+	r.conn = nil
+}
+
+// appendMessages appends the fetched messages to the partition until the fetch
+// loop has stopped and every message it fetched has been appended.
 func (r *Replicator) appendMessages() {
+	defer close(r.appendDone)
 	for {
 		select {
-		case <-r.done:
-			return
 		case msg := <-r.msgs:
-			_, err := r.partition.Append(msg)
-			if err != nil {
-				panic(err)
+			r.append(msg)
+		case <-r.fetchDone:
+			for {
+				select {
+				case msg := <-r.msgs:
+					r.append(msg)
+				default:
+					return
+				}
 			}
 		}
 	}
 }
 
-// Close the replicator object when we are no longer following
+func (r *Replicator) append(msg []byte) {
+	if _, err := r.partition.Append(msg); err != nil {
+		panic(err)
+	}
+}
+
+// Close the replicator object when we are no longer following. Close doesn't
+// wait for the replicator to stop, use Drain for that.
 func (r *Replicator) Close() error {
-	close(r.done)
+	r.closeOnce.Do(func() {
+		close(r.done)
+	})
 	return nil
 }
+
+// Drain is used to cleanly stop the replicator. It stops fetching, finishes
+// appending the messages already fetched, and syncs the partition's commit
+// log, returning once the replicator has fully stopped.
+func (r *Replicator) Drain() error {
+	r.Close()
+	<-r.appendDone
+	return r.partition.CommitLog.Sync()
+}
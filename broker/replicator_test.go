@@ -2,18 +2,32 @@ package broker_test
 
 import (
 	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/travisjeffery/jocko"
 	"github.com/travisjeffery/jocko/broker"
+	"github.com/travisjeffery/jocko/protocol"
 	"github.com/travisjeffery/jocko/testutil"
 	"github.com/travisjeffery/jocko/testutil/mock"
 )
 
 func TestBroker_Replicate(t *testing.T) {
-	clog := mock.NewCommitLog()
+	var mu sync.Mutex
+	var appended [][]byte
+	clog := &mock.CommitLog{
+		AppendFn: func(b []byte) (int64, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			appended = append(appended, b)
+			return int64(len(appended) - 1), nil
+		},
+	}
 	leader := mock.NewClient(4)
 
 	p := &jocko.Partition{
@@ -31,7 +45,9 @@ func TestBroker_Replicate(t *testing.T) {
 		broker.ReplicatorLeader(leader))
 
 	testutil.WaitForResult(func() (bool, error) {
-		commitLog := clog.Log()
+		mu.Lock()
+		commitLog := append([][]byte{}, appended...)
+		mu.Unlock()
 		if len(commitLog) < 4 {
 			return false, nil
 		}
@@ -45,3 +61,193 @@ func TestBroker_Replicate(t *testing.T) {
 
 	assert.NoError(t, replicator.Close())
 }
+
+// truncatedLeader is a leader whose log starts at logStartOffset, so fetches
+// below it are out of range.
+type truncatedLeader struct {
+	logStartOffset int64
+	fetchOffsets   chan int64
+}
+
+func (l *truncatedLeader) FetchMessages(clientID string, req *protocol.FetchRequest) (*protocol.FetchResponses, error) {
+	offset := req.Topics[0].Partitions[0].FetchOffset
+	l.fetchOffsets <- offset
+	p := &protocol.FetchPartitionResponse{
+		LogStartOffset: l.logStartOffset,
+		HighWatermark:  l.logStartOffset,
+	}
+	if offset < l.logStartOffset {
+		p.ErrorCode = protocol.ErrOffsetOutOfRange.Code()
+	}
+	return &protocol.FetchResponses{
+		Responses: []*protocol.FetchResponse{{
+			Topic:              req.Topics[0].Topic,
+			PartitionResponses: []*protocol.FetchPartitionResponse{p},
+		}},
+	}, nil
+}
+
+func (l *truncatedLeader) CreateTopic(clientID string, req *protocol.CreateTopicRequest) (*protocol.CreateTopicsResponse, error) {
+	return nil, nil
+}
+
+func TestBroker_Replicate_logStartOffset(t *testing.T) {
+	leader := &truncatedLeader{logStartOffset: 10, fetchOffsets: make(chan int64)}
+	p := &jocko.Partition{
+		Topic:     "test",
+		ID:        0,
+		Leader:    0,
+		Replicas:  []int32{0},
+		CommitLog: &mock.CommitLog{},
+	}
+	replicator := broker.NewReplicator(p, 1, broker.ReplicatorLeader(leader))
+
+	assert.Equal(t, int64(0), <-leader.fetchOffsets)
+	// the follower should skip past the leader's deleted data.
+	assert.Equal(t, int64(10), <-leader.fetchOffsets)
+
+	assert.NoError(t, replicator.Close())
+	// unblock the in-flight fetch so the fetch loop can see it's closed.
+	select {
+	case <-leader.fetchOffsets:
+	case <-time.After(time.Second):
+	}
+}
+
+func TestReplicator_Drain(t *testing.T) {
+	appending := make(chan struct{})
+	release := make(chan struct{})
+	var appended, syncedAfterAppend bool
+	clog := &mock.CommitLog{
+		AppendFn: func(b []byte) (int64, error) {
+			close(appending)
+			<-release
+			appended = true
+			return 0, nil
+		},
+		SyncFn: func() error {
+			syncedAfterAppend = appended
+			return nil
+		},
+	}
+	p := &jocko.Partition{
+		Topic:     "test",
+		ID:        0,
+		Leader:    0,
+		Replicas:  []int32{0},
+		CommitLog: clog,
+	}
+	replicator := broker.NewReplicator(p, 1, broker.ReplicatorLeader(mock.NewClient(1)))
+	<-appending
+
+	drained := make(chan error)
+	go func() {
+		drained <- replicator.Drain()
+	}()
+	select {
+	case <-drained:
+		t.Fatal("Drain returned before the in-flight append completed")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	select {
+	case err := <-drained:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Drain didn't return after the in-flight append completed")
+	}
+	assert.True(t, appended)
+	assert.True(t, clog.SyncInvoked)
+	assert.True(t, syncedAfterAppend)
+}
+
+func TestReplicator_reconnectOnTimeout(t *testing.T) {
+	// the leader accepts connections but never responds to fetches.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(ioutil.Discard, conn)
+		}
+	}()
+
+	var mu sync.Mutex
+	var dials int
+	dial := func() (net.Conn, error) {
+		mu.Lock()
+		dials++
+		mu.Unlock()
+		return net.Dial("tcp", ln.Addr().String())
+	}
+	p := &jocko.Partition{
+		Topic:     "test",
+		ID:        0,
+		Leader:    0,
+		Replicas:  []int32{0},
+		CommitLog: &mock.CommitLog{},
+	}
+	replicator := broker.NewReplicator(p, 1,
+		broker.ReplicatorDial(dial),
+		broker.ReplicatorTimeout(50*time.Millisecond))
+	defer replicator.Close()
+
+	testutil.WaitForResult(func() (bool, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return dials >= 2, nil
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+}
+
+func TestReplicator_reconnectBackoff(t *testing.T) {
+	// the leader closes connections as soon as they're accepted, so every fetch fails.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	var mu sync.Mutex
+	var dials int
+	dial := func() (net.Conn, error) {
+		mu.Lock()
+		dials++
+		mu.Unlock()
+		return net.Dial("tcp", ln.Addr().String())
+	}
+	p := &jocko.Partition{
+		Topic:     "test",
+		ID:        0,
+		Leader:    0,
+		Replicas:  []int32{0},
+		CommitLog: &mock.CommitLog{},
+	}
+	replicator := broker.NewReplicator(p, 1, broker.ReplicatorDial(dial))
+	time.Sleep(250 * time.Millisecond)
+	replicator.Close()
+
+	// the replicator waits between redialing after failed fetches rather than spinning.
+	mu.Lock()
+	defer mu.Unlock()
+	if dials < 2 || dials > 4 {
+		t.Fatalf("dials = %d, want 2 to 4", dials)
+	}
+}
@@ -0,0 +1,54 @@
+package broker
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+// requestLogSampleRateConfig is the broker config setting how many requests one is logged in.
+const requestLogSampleRateConfig = "request.log.sample.rate"
+
+// logSampledRequest is used to log one in every request.log.sample.rate requests at debug, with
+// the partitions they were for and the errors they got, to see what the broker's handling without
+// logging every request. The rate's a dynamic broker config, so it can be changed at runtime.
+func (b *Broker) logSampledRequest(header *protocol.RequestHeader, resp protocol.ResponseBody) {
+	rate, err := strconv.ParseUint(b.brokerConfig(requestLogSampleRateConfig), 10, 32)
+	if err != nil || rate == 0 {
+		return
+	}
+	if atomic.AddUint32(&b.sampledRequests, 1)%uint32(rate) != 0 {
+		return
+	}
+	b.logger.Debug("request: api key: %d, api version: %d, correlation id: %d, client id: %s%s", header.APIKey, header.APIVersion, header.CorrelationID, header.ClientID, responseSummary(resp))
+}
+
+// responseSummary returns the topics and partitions the response is for, with their error codes,
+// for the responses that have them.
+func responseSummary(resp protocol.ResponseBody) string {
+	var partitions []string
+	switch r := resp.(type) {
+	case *protocol.ProduceResponses:
+		for _, t := range r.Responses {
+			for _, p := range t.PartitionResponses {
+				partitions = append(partitions, fmt.Sprintf("%s/%d: %d", t.Topic, p.Partition, p.ErrorCode))
+			}
+		}
+	case *protocol.FetchResponses:
+		for _, t := range r.Responses {
+			for _, p := range t.PartitionResponses {
+				partitions = append(partitions, fmt.Sprintf("%s/%d: %d", t.Topic, p.Partition, p.ErrorCode))
+			}
+		}
+	case *protocol.MetadataResponse:
+		for _, t := range r.TopicMetadata {
+			partitions = append(partitions, fmt.Sprintf("%s: %d", t.Topic, t.TopicErrorCode))
+		}
+	default:
+		return ""
+	}
+	return fmt.Sprintf(", error codes: [%s]", strings.Join(partitions, ", "))
+}
@@ -0,0 +1,51 @@
+package broker
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// joinSeedsRetryBackoff is how long the broker first waits before retrying to join the cluster
+	// through its seeds, doubling after each failure up to maxJoinSeedsRetryBackoff.
+	joinSeedsRetryBackoff    = 100 * time.Millisecond
+	maxJoinSeedsRetryBackoff = 5 * time.Second
+	// defaultSeedsJoinTimeout is how long the broker tries to join the cluster through its seeds
+	// before it fails to start.
+	defaultSeedsJoinTimeout = time.Minute
+)
+
+// joinSeeds is used to join the cluster through the broker's serf seeds when it starts, retrying
+// with backoff, e.g. while the seeds are starting too, until it's joined through one of them or the
+// timeout elapses. A broker without seeds bootstraps a new cluster.
+func (b *Broker) joinSeeds() error {
+	if len(b.seeds) == 0 {
+		return nil
+	}
+	deadline := time.Now().Add(b.seedsJoinTimeout)
+	backoff := joinSeedsRetryBackoff
+	for attempt := 1; ; attempt++ {
+		// serf errors if any seed can't be joined, the broker's joined if one could.
+		n, err := b.serf.Join(b.seeds...)
+		if n > 0 {
+			b.logger.Info("joined the cluster through %d of seeds %v", n, b.seeds)
+			return nil
+		}
+		if err == nil {
+			err = errors.New("no seeds could be joined")
+		}
+		if time.Now().Add(backoff).After(deadline) {
+			return errors.Wrapf(err, "join seeds %v failed after %d attempts", b.seeds, attempt)
+		}
+		b.logger.Info("failed to join seeds %v, attempt %d, retrying in %s: %v", b.seeds, attempt, backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-b.shutdownCh:
+			return errors.New("broker shut down")
+		}
+		if backoff *= 2; backoff > maxJoinSeedsRetryBackoff {
+			backoff = maxJoinSeedsRetryBackoff
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package broker
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestBroker_joinSeeds(t *testing.T) {
+	tests := []struct {
+		name string
+		// seeds are the broker's seeds, reachable is after how many attempts one can be joined,
+		// -1 if none ever can.
+		seeds     []string
+		reachable int
+		wantJoins int
+		wantErr   bool
+	}{
+		{name: "no seeds starts a new cluster", wantJoins: 0},
+		{name: "seed reachable", seeds: []string{"10.0.0.1:9094"}, reachable: 1, wantJoins: 1},
+		{name: "seed reachable after retries", seeds: []string{"10.0.0.1:9094", "10.0.0.2:9094"}, reachable: 3, wantJoins: 3},
+		{name: "seeds never reachable", seeds: []string{"10.0.0.1:9094"}, reachable: -1, wantJoins: 2, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFields()
+			var joins int
+			f.serf.JoinFn = func(addrs ...string) (int, error) {
+				joins++
+				if !reflect.DeepEqual(addrs, tt.seeds) {
+					t.Errorf("join addrs = %v, want %v", addrs, tt.seeds)
+				}
+				if tt.reachable < 0 || joins < tt.reachable {
+					return 0, errors.New("connection refused")
+				}
+				return 1, nil
+			}
+			b := &Broker{
+				logger:     f.logger,
+				id:         f.id,
+				serf:       f.serf,
+				shutdownCh: f.shutdownCh,
+				seeds:      tt.seeds,
+				// the first retry's after 100ms and the second after another 200ms.
+				seedsJoinTimeout: 250 * time.Millisecond,
+			}
+			if tt.reachable > 1 {
+				b.seedsJoinTimeout = time.Second
+			}
+			err := b.joinSeeds()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("joinSeeds() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if joins != tt.wantJoins {
+				t.Errorf("joins = %v, want %v", joins, tt.wantJoins)
+			}
+		})
+	}
+}
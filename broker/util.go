@@ -10,24 +10,28 @@ import (
 )
 
 const (
-	waitDelay = 100 * time.Millisecond
+	waitDelay    = 100 * time.Millisecond
+	maxWaitDelay = time.Second
 )
 
+// WaitForLeader is used to wait until raft has a leader, polling with backoff,
+// or until the timeout elapses. It returns the leader's raft address.
 func (s *Broker) WaitForLeader(timeout time.Duration) (string, error) {
-	tick := time.NewTicker(waitDelay)
-	defer tick.Stop()
-
 	timer := time.NewTimer(timeout)
 	defer timer.Stop()
 
+	delay := waitDelay
 	for {
+		if l := s.raft.LeaderID(); l != "" {
+			return l, nil
+		}
 		select {
-		case <-tick.C:
-			l := s.raft.LeaderID()
-			if l != "" {
-				return l, nil
-			}
+		case <-time.After(delay):
 		case <-timer.C:
+			return "", ErrLeaderTimeout
+		}
+		if delay *= 2; delay > maxWaitDelay {
+			delay = maxWaitDelay
 		}
 	}
 }
@@ -72,3 +76,52 @@ func unmarshalData(data *json.RawMessage, p interface{}) error {
 	}
 	return nil
 }
+
+// socketBufferSetter is implemented by conns whose socket buffers can be sized, e.g. *net.TCPConn.
+type socketBufferSetter interface {
+	SetReadBuffer(bytes int) error
+	SetWriteBuffer(bytes int) error
+}
+
+// setSocketBuffers is used to set the sizes of the conn's socket receive and send buffers. Sizes
+// that aren't positive, and conns whose buffers can't be sized, are left as they are.
+func setSocketBuffers(conn net.Conn, receive, send int) error {
+	c, ok := conn.(socketBufferSetter)
+	if !ok {
+		return nil
+	}
+	if receive > 0 {
+		if err := c.SetReadBuffer(receive); err != nil {
+			return errors.Wrap(err, "set socket receive buffer failed")
+		}
+	}
+	if send > 0 {
+		if err := c.SetWriteBuffer(send); err != nil {
+			return errors.Wrap(err, "set socket send buffer failed")
+		}
+	}
+	return nil
+}
+
+// keepAliveSetter is implemented by conns whose TCP keepalive can be set, e.g. *net.TCPConn.
+type keepAliveSetter interface {
+	SetKeepAlive(keepalive bool) error
+	SetKeepAlivePeriod(d time.Duration) error
+}
+
+// setKeepAlive is used to enable TCP keepalive on the conn, sending keepalives every period.
+// Negative periods disable keepalive. Zero, and conns whose keepalive can't be set, are left as
+// they are.
+func setKeepAlive(conn net.Conn, period time.Duration) error {
+	c, ok := conn.(keepAliveSetter)
+	if !ok || period == 0 {
+		return nil
+	}
+	if period < 0 {
+		return errors.Wrap(c.SetKeepAlive(false), "disable keepalive failed")
+	}
+	if err := c.SetKeepAlive(true); err != nil {
+		return errors.Wrap(err, "enable keepalive failed")
+	}
+	return errors.Wrap(c.SetKeepAlivePeriod(period), "set keepalive period failed")
+}
@@ -5,8 +5,11 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/tj/go-gracefully"
 	"github.com/travisjeffery/jocko/broker"
 	"github.com/travisjeffery/jocko/protocol"
@@ -21,14 +24,42 @@ var (
 	cli       = kingpin.New("jocko", "Jocko, Go implementation of Kafka")
 	debugLogs = cli.Flag("debug", "Enable debug logs").Default("false").Bool()
 
-	brokerCmd            = cli.Command("broker", "Run a Jocko broker")
-	brokerCmdRaftAddr    = brokerCmd.Flag("raft-addr", "Address for Raft to bind and advertise on").Default("127.0.0.1:9093").String()
-	brokerCmdLogDir      = brokerCmd.Flag("log-dir", "A comma separated list of directories under which to store log files").Default("/tmp/jocko").String()
-	brokerCmdBrokerAddr  = brokerCmd.Flag("broker-addr", "Address for broker to bind on").Default("0.0.0.0:9092").String()
-	brokerCmdSerfAddr    = brokerCmd.Flag("serf-addr", "Address for Serf to bind on").Default("0.0.0.0:9094").String()
-	brokerCmdHTTPAddr    = brokerCmd.Flag("http-addr", "Address for HTTP handlers to serve metrics on, like Prometheus").Default(":9095").String()
-	brokerCmdSerfMembers = brokerCmd.Flag("serf-members", "List of existing Serf members").Strings()
-	brokerCmdBrokerID    = brokerCmd.Flag("id", "Broker ID").Int32()
+	brokerCmd             = cli.Command("broker", "Run a Jocko broker")
+	brokerCmdRaftAddr     = brokerCmd.Flag("raft-addr", "Address for Raft to bind and advertise on").Default("127.0.0.1:9093").String()
+	brokerCmdLogDir       = brokerCmd.Flag("log-dir", "A comma separated list of directories under which to store log files").Default("/tmp/jocko").String()
+	brokerCmdBrokerAddr   = brokerCmd.Flag("broker-addr", "Address for broker to bind on").Default("0.0.0.0:9092").String()
+	brokerCmdAdvertised   = brokerCmd.Flag("advertised-addr", "Address for clients to connect to the broker at, defaults to the broker addr").Default("").String()
+	brokerCmdSerfAddr     = brokerCmd.Flag("serf-addr", "Address for Serf to bind on").Default("0.0.0.0:9094").String()
+	brokerCmdHTTPAddr     = brokerCmd.Flag("http-addr", "Address for HTTP handlers to serve metrics on, like Prometheus").Default(":9095").String()
+	brokerCmdSerfMembers  = brokerCmd.Flag("serf-members", "List of existing Serf members").Strings()
+	brokerCmdSerfSeeds    = brokerCmd.Flag("serf-seeds", "Serf addresses of brokers to join the cluster through, retried until one's joined, none starts a new cluster").Strings()
+	brokerCmdSeedsTimeout = brokerCmd.Flag("serf-seeds-join-timeout", "How long to try joining the cluster through the seeds before failing to start").Default("1m").Duration()
+	brokerCmdRaftRetries  = brokerCmd.Flag("raft-apply-retries", "Number of times to retry raft commands that were rejected without committing, e.g. during an election").Default("3").Int()
+	brokerCmdRaftBackoff  = brokerCmd.Flag("raft-apply-retry-backoff", "How long to first wait before checking whether a leader's been elected to retry a raft command, doubling after each check").Default("100ms").Duration()
+	brokerCmdBrokerID     = brokerCmd.Flag("id", "Broker ID").Int32()
+	brokerCmdMutationRate = brokerCmd.Flag("controller-mutation-rate", "Partitions per second each client can create or delete, 0 is unlimited").Default("0").Float64()
+	brokerCmdPartMetrics  = brokerCmd.Flag("partition-metrics", "Enable per-partition produce and fetch latency metrics").Default("false").Bool()
+	brokerCmdSlowRequest  = brokerCmd.Flag("slow-request-threshold", "Log requests taking longer than this to handle, 0 is disabled").Default("0s").Duration()
+	brokerCmdReplicaTO    = brokerCmd.Flag("replica-socket-timeout", "Read/write timeout of followers' connections to leaders").Default("30s").Duration()
+	brokerCmdSocketRecvBf = brokerCmd.Flag("socket-receive-buffer-bytes", "Size of connections' socket receive buffers, SO_RCVBUF, -1 leaves the OS's").Default("-1").Int()
+	brokerCmdSocketSendBf = brokerCmd.Flag("socket-send-buffer-bytes", "Size of connections' socket send buffers, SO_SNDBUF, -1 leaves the OS's").Default("-1").Int()
+	brokerCmdKeepAlive    = brokerCmd.Flag("socket-keepalive-period", "How often connections send TCP keepalives, negative disables them, 0 leaves Go's default").Default("0s").Duration()
+	brokerCmdHandlers     = brokerCmd.Flag("request-handler-threads", "Number of goroutines handling requests").Default("8").Int()
+	brokerCmdReplicaLag   = brokerCmd.Flag("replica-lag-time-max", "How long a follower can go without catching up before it's removed from the ISR, 0 is disabled").Default("30s").Duration()
+	brokerCmdProducerExp  = brokerCmd.Flag("producer-id-expiration", "How long an idempotent producer's sequences are kept after it last produced, 0 keeps them").Default("24h").Duration()
+	brokerCmdFollowerRate = brokerCmd.Flag("follower-replication-throttled-rate", "Bytes per second to replicate the replicas topics' follower.replication.throttled.replicas list, 0 is unlimited").Default("0").Float64()
+	brokerCmdLeaderRate   = brokerCmd.Flag("leader-replication-throttled-rate", "Bytes per second to serve followers the replicas topics' leader.replication.throttled.replicas list, 0 is unlimited").Default("0").Float64()
+	brokerCmdShutdownTry  = brokerCmd.Flag("controlled-shutdown-max-retries", "Number of times to ask the controller to move partition leadership off the broker when shutting down, 0 is disabled").Default("3").Int()
+	brokerCmdFlushEvery   = brokerCmd.Flag("flush-interval", "How often to flush partitions' logs to disk, 0 leaves it to the OS").Default("0s").Duration()
+	brokerCmdSingleWriter = brokerCmd.Flag("single-writer-logs", "Append to partitions' logs without locking until appends overlap, for topics with one producer").Default("false").Bool()
+	brokerCmdPreallocate  = brokerCmd.Flag("preallocate-segments", "Reserve log segments' files up to their max size when they're created").Default("false").Bool()
+	brokerCmdMaxTopicPart = brokerCmd.Flag("max-partitions-per-topic", "Most partitions a topic can be created with, 0 is unlimited").Default("0").Int32()
+	brokerCmdMaxPartition = brokerCmd.Flag("max-partitions-per-broker", "Most partition replicas a broker can host, 0 is unlimited").Default("0").Int()
+	brokerCmdRecoveryThds = brokerCmd.Flag("num-recovery-threads", "Number of goroutines recovering partitions' logs when starting").Default("1").Int()
+	brokerCmdAutoCreate   = brokerCmd.Flag("auto-create-topics", "Create topics that don't exist when they're requested in metadata or produced to").Default("false").Bool()
+	brokerCmdSSLAddr      = brokerCmd.Flag("ssl-addr", "Address for the SSL listener to bind and advertise on, empty is disabled").Default("").String()
+	brokerCmdSSLCertFile  = brokerCmd.Flag("ssl-cert-file", "PEM file of the SSL listener's certificate, reloaded on SIGHUP").Default("").String()
+	brokerCmdSSLKeyFile   = brokerCmd.Flag("ssl-key-file", "PEM file of the SSL listener's private key, reloaded on SIGHUP").Default("").String()
 
 	topicCmd                     = cli.Command("topic", "Manage topics")
 	createTopicCmd               = topicCmd.Command("create", "Create a topic")
@@ -70,25 +101,67 @@ func cmdBrokers(logger *simplelog.Logger) int {
 		raft.Logger(logger),
 		raft.DataDir(*brokerCmdLogDir),
 		raft.Addr(*brokerCmdRaftAddr),
+		raft.Metrics(prometheus.DefaultRegisterer),
 	)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "error starting raft: %v\n", err)
 		os.Exit(1)
 	}
 
-	store, err := broker.New(*brokerCmdBrokerID,
+	opts := []broker.BrokerFn{
 		broker.LogDir(*brokerCmdLogDir),
 		broker.Logger(logger),
 		broker.Addr(*brokerCmdBrokerAddr),
+		broker.AdvertisedAddr(*brokerCmdAdvertised),
 		broker.Serf(serf),
 		broker.Raft(raft),
-	)
+		broker.ControllerMutationRate(*brokerCmdMutationRate),
+		broker.SlowRequestThreshold(*brokerCmdSlowRequest),
+		broker.ReplicaSocketTimeout(*brokerCmdReplicaTO),
+		broker.ReplicaSocketBufferSizes(*brokerCmdSocketRecvBf, *brokerCmdSocketSendBf),
+		broker.ReplicaSocketKeepAlivePeriod(*brokerCmdKeepAlive),
+		broker.ReplicaLagTimeMax(*brokerCmdReplicaLag),
+		broker.ProducerIDExpiration(*brokerCmdProducerExp),
+		broker.FollowerReplicationThrottledRate(*brokerCmdFollowerRate),
+		broker.LeaderReplicationThrottledRate(*brokerCmdLeaderRate),
+		broker.RequestHandlerThreads(*brokerCmdHandlers),
+		broker.ControlledShutdownMaxRetries(*brokerCmdShutdownTry),
+		broker.AllowAutoTopicCreation(*brokerCmdAutoCreate),
+		broker.FlushInterval(*brokerCmdFlushEvery),
+		broker.SingleWriterLogs(*brokerCmdSingleWriter),
+		broker.PreallocateSegments(*brokerCmdPreallocate),
+		broker.MaxPartitionsPerTopic(*brokerCmdMaxTopicPart),
+		broker.MaxPartitionsPerBroker(*brokerCmdMaxPartition),
+		broker.NumRecoveryThreads(*brokerCmdRecoveryThds),
+		broker.Seeds(*brokerCmdSerfSeeds...),
+		broker.SeedsJoinTimeout(*brokerCmdSeedsTimeout),
+		broker.RaftApplyRetries(*brokerCmdRaftRetries),
+		broker.RaftApplyRetryBackoff(*brokerCmdRaftBackoff),
+	}
+	if *brokerCmdPartMetrics {
+		opts = append(opts, broker.PartitionMetrics(prometheus.DefaultRegisterer))
+	}
+	var certs *server.CertStore
+	if *brokerCmdSSLAddr != "" {
+		if certs, err = server.NewCertStore(*brokerCmdSSLCertFile, *brokerCmdSSLKeyFile); err != nil {
+			fmt.Fprintf(os.Stderr, "error loading ssl certificate: %v\n", err)
+			os.Exit(1)
+		}
+		opts = append(opts, broker.AdvertisedListener("SSL", *brokerCmdSSLAddr))
+	}
+	store, err := broker.New(*brokerCmdBrokerID, opts...)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "error starting broker: %v\n", err)
 		os.Exit(1)
 	}
 
 	srv := server.New(*brokerCmdBrokerAddr, store, *brokerCmdHTTPAddr, logger)
+	srv.SetSocketBufferSizes(*brokerCmdSocketRecvBf, *brokerCmdSocketSendBf)
+	srv.SetKeepAlivePeriod(*brokerCmdKeepAlive)
+	if certs != nil {
+		srv.AddListener("SSL", *brokerCmdSSLAddr, certs.TLSConfig())
+		go reloadCerts(logger, certs)
+	}
 	if err := srv.Start(context.Background()); err != nil {
 		fmt.Fprintf(os.Stderr, "error starting server: %v\n", err)
 		os.Exit(1)
@@ -107,6 +180,20 @@ func cmdBrokers(logger *simplelog.Logger) int {
 	return 0
 }
 
+// reloadCerts is used to reload the SSL listener's certificate each time the broker gets a SIGHUP,
+// so rotated certificates are used by new connections without restarting it.
+func reloadCerts(logger *simplelog.Logger, certs *server.CertStore) {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGHUP)
+	for range sigCh {
+		if err := certs.Reload(); err != nil {
+			logger.Info("failed to reload ssl certificate: %v", err)
+			continue
+		}
+		logger.Info("reloaded ssl certificate")
+	}
+}
+
 func cmdCreateTopic(logger *simplelog.Logger) int {
 	addr, err := net.ResolveTCPAddr("tcp", *createTopicBrokerAddr)
 	if err != nil {
@@ -5,6 +5,8 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -14,13 +16,16 @@ import (
 )
 
 var (
-	ErrSegmentNotFound = errors.New("segment not found")
-	Encoding           = binary.BigEndian
+	ErrSegmentNotFound  = errors.New("segment not found")
+	ErrCorruptMessage   = errors.New("corrupt message")
+	ErrOffsetOutOfRange = errors.New("offset out of range")
+	Encoding            = binary.BigEndian
 )
 
 const (
-	LogFileSuffix   = ".log"
-	IndexFileSuffix = ".index"
+	LogFileSuffix       = ".log"
+	IndexFileSuffix     = ".index"
+	TimeIndexFileSuffix = ".timeindex"
 )
 
 type CommitLog struct {
@@ -30,12 +35,44 @@ type CommitLog struct {
 	mu             sync.RWMutex
 	segments       []*Segment
 	vActiveSegment atomic.Value
+	recoveryPoint  int64
+	logStartOffset int64
+
+	// appendMu serializes appends, unless the log's single-writer and its one writer appends
+	// without it. appending is set while a message set's being appended, so a single-writer
+	// append and a locked append never run at the same time.
+	appendMu     sync.Mutex
+	singleWriter int32
+	appending    int32
 }
 
 type Options struct {
 	Path            string
 	MaxSegmentBytes int64
 	MaxLogBytes     int64
+	// RecoveryPoint is the offset up to which the log was synced, e.g. from a
+	// checkpoint. When the log's opened, segments wholly before it are assumed
+	// to be clean and only later segments are recovered.
+	RecoveryPoint int64
+	// LogStartOffset is the offset records were deleted up to, e.g. from a
+	// checkpoint. Records before it can't be read even if they're still in a
+	// segment.
+	LogStartOffset int64
+	// IndexIntervalBytes is how many bytes are appended to a segment between
+	// entries in its time index. Defaults to 4096.
+	IndexIntervalBytes int64
+	// SingleWriter is whether the log's appended to by one goroutine at a
+	// time, e.g. its topic has a single producer. Appends then skip the
+	// append lock. If appends do overlap the log falls back to locked appends.
+	SingleWriter bool
+	// PreallocateSegments is whether new segments' files are reserved up to
+	// MaxSegmentBytes when they're created, rather than grown as they're
+	// appended to, so they aren't fragmented. They're truncated to what was
+	// appended when they're rolled or closed.
+	PreallocateSegments bool
+	// OffsetAssigner assigns offsets to the message sets appended to the log.
+	// Defaults to SequentialAssigner.
+	OffsetAssigner OffsetAssigner
 }
 
 func New(opts Options) (*CommitLog, error) {
@@ -47,11 +84,24 @@ func New(opts Options) (*CommitLog, error) {
 		// TODO default here
 	}
 
+	if opts.IndexIntervalBytes == 0 {
+		opts.IndexIntervalBytes = defaultIndexIntervalBytes
+	}
+
+	if opts.OffsetAssigner == nil {
+		opts.OffsetAssigner = SequentialAssigner{}
+	}
+
 	path, _ := filepath.Abs(opts.Path)
 	l := &CommitLog{
-		Options: opts,
-		name:    filepath.Base(path),
-		cleaner: NewDeleteCleaner(opts.MaxLogBytes),
+		Options:        opts,
+		name:           filepath.Base(path),
+		cleaner:        NewDeleteCleaner(opts.MaxLogBytes),
+		recoveryPoint:  opts.RecoveryPoint,
+		logStartOffset: opts.LogStartOffset,
+	}
+	if opts.SingleWriter {
+		l.singleWriter = 1
 	}
 
 	if err := l.init(); err != nil {
@@ -78,6 +128,7 @@ func (l *CommitLog) open() error {
 	if err != nil {
 		return errors.Wrap(err, "read dir failed")
 	}
+	var baseOffsets []int64
 	for _, file := range files {
 		// if this file is an index file, make sure it has a corresponding .log file
 		if strings.HasSuffix(file.Name(), IndexFileSuffix) {
@@ -92,25 +143,65 @@ func (l *CommitLog) open() error {
 		} else if strings.HasSuffix(file.Name(), LogFileSuffix) {
 			offsetStr := strings.TrimSuffix(file.Name(), LogFileSuffix)
 			baseOffset, err := strconv.Atoi(offsetStr)
-			segment, err := NewSegment(l.Path, int64(baseOffset), l.MaxSegmentBytes)
 			if err != nil {
-				return err
+				return errors.Wrap(err, "parse segment base offset failed")
 			}
-			l.segments = append(l.segments, segment)
+			baseOffsets = append(baseOffsets, int64(baseOffset))
 		}
 	}
+	sort.Slice(baseOffsets, func(i, j int) bool { return baseOffsets[i] < baseOffsets[j] })
+	for i, baseOffset := range baseOffsets {
+		// a segment's clean if the next segment starts at or before the recovery point.
+		clean := i+1 < len(baseOffsets) && baseOffsets[i+1] <= l.Options.RecoveryPoint
+		segment, err := newSegment(l.Path, baseOffset, l.MaxSegmentBytes, l.IndexIntervalBytes, !clean, l.PreallocateSegments)
+		if err != nil {
+			return err
+		}
+		l.segments = append(l.segments, segment)
+	}
 	if len(l.segments) == 0 {
-		segment, err := NewSegment(l.Path, 0, l.MaxSegmentBytes)
+		segment, err := newSegment(l.Path, 0, l.MaxSegmentBytes, l.IndexIntervalBytes, true, l.PreallocateSegments)
 		if err != nil {
 			return err
 		}
 		l.segments = append(l.segments, segment)
 	}
-	l.vActiveSegment.Store(l.segments[len(l.segments)-1])
+	active := l.segments[len(l.segments)-1]
+	if err := active.reserve(); err != nil {
+		return err
+	}
+	l.vActiveSegment.Store(active)
 	return nil
 }
 
+// Append is used to append the message set to the log, returning its offset.
 func (l *CommitLog) Append(b []byte) (offset int64, err error) {
+	if atomic.LoadInt32(&l.singleWriter) == 1 {
+		if atomic.CompareAndSwapInt32(&l.appending, 0, 1) {
+			defer atomic.StoreInt32(&l.appending, 0)
+			return l.append(b)
+		}
+		// another append's running, the log isn't single-writer after all.
+		atomic.StoreInt32(&l.singleWriter, 0)
+	}
+	l.appendMu.Lock()
+	defer l.appendMu.Unlock()
+	// wait for a single-writer append that started before the fall back to finish.
+	for !atomic.CompareAndSwapInt32(&l.appending, 0, 1) {
+		runtime.Gosched()
+	}
+	defer atomic.StoreInt32(&l.appending, 0)
+	return l.append(b)
+}
+
+// SingleWriter returns whether appends skip the append lock, false once the log's fallen back to
+// locked appends.
+func (l *CommitLog) SingleWriter() bool {
+	return atomic.LoadInt32(&l.singleWriter) == 1
+}
+
+// append is used to append the message set to the active segment. Appends mustn't overlap.
+func (l *CommitLog) append(b []byte) (offset int64, err error) {
 	ms := MessageSet(b)
 	if l.checkSplit() {
 		if err := l.split(); err != nil {
@@ -118,11 +209,14 @@ func (l *CommitLog) Append(b []byte) (offset int64, err error) {
 		}
 	}
 	position := l.activeSegment().Position
-	offset = l.activeSegment().NextOffset
+	// the log stores each appended message set as a single entry.
+	offset, nextOffset := l.OffsetAssigner.Assign(l.activeSegment().NextOffset, 1)
 	ms.PutOffset(offset)
 	if _, err := l.activeSegment().Write(ms); err != nil {
 		return offset, err
 	}
+	// readers load the next offset without the append lock.
+	atomic.StoreInt64(&l.activeSegment().NextOffset, nextOffset)
 	e := Entry{
 		Offset:   offset,
 		Position: position,
@@ -130,6 +224,9 @@ func (l *CommitLog) Append(b []byte) (offset int64, err error) {
 	if err := l.activeSegment().Index.WriteEntry(e); err != nil {
 		return offset, err
 	}
+	if err := l.activeSegment().indexTimestamp(offset, ms.MaxTimestamp(), int64(len(ms))); err != nil {
+		return offset, err
+	}
 	return offset, nil
 }
 
@@ -140,15 +237,48 @@ func (l *CommitLog) Read(p []byte) (n int, err error) {
 }
 
 func (l *CommitLog) NewestOffset() int64 {
-	return l.activeSegment().NextOffset
+	return atomic.LoadInt64(&l.activeSegment().NextOffset)
 }
 
+// OldestOffset returns the log's start offset, the offset of the oldest
+// record that can be read.
 func (l *CommitLog) OldestOffset() int64 {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
+	if l.logStartOffset > l.segments[0].BaseOffset {
+		return l.logStartOffset
+	}
 	return l.segments[0].BaseOffset
 }
 
+// DeleteRecords advances the log's start offset to offset, deleting the
+// segments wholly before it. The records before offset in the segment
+// containing it are kept on disk until the segment's deleted but can't be
+// read. It returns ErrOffsetOutOfRange if offset is past the newest offset.
+func (l *CommitLog) DeleteRecords(offset int64) error {
+	if offset > l.NewestOffset() {
+		return ErrOffsetOutOfRange
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if offset <= l.logStartOffset {
+		return nil
+	}
+	l.logStartOffset = offset
+	var segments []*Segment
+	for i, segment := range l.segments {
+		if i+1 < len(l.segments) && l.segments[i+1].BaseOffset <= offset {
+			if err := segment.Delete(); err != nil {
+				return err
+			}
+		} else {
+			segments = append(segments, segment)
+		}
+	}
+	l.segments = segments
+	return nil
+}
+
 func (l *CommitLog) activeSegment() *Segment {
 	return l.vActiveSegment.Load().(*Segment)
 }
@@ -164,6 +294,64 @@ func (l *CommitLog) Close() error {
 	return nil
 }
 
+// Sync commits the log's segments to stable storage, advancing the log's
+// flushed offset to its newest offset. Segments wholly before the flushed
+// offset, e.g. those sealed when the log rolled, are already stable and
+// aren't synced again.
+func (l *CommitLog) Sync() error {
+	newest := l.NewestOffset()
+	flushed := l.FlushedOffset()
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for i, segment := range l.segments {
+		if i+1 < len(l.segments) && l.segments[i+1].BaseOffset <= flushed {
+			continue
+		}
+		if err := segment.Sync(); err != nil {
+			return err
+		}
+	}
+	l.setRecoveryPoint(newest)
+	return nil
+}
+
+// RecoveryPoint returns the offset up to which the log's been synced to
+// stable storage.
+func (l *CommitLog) RecoveryPoint() int64 {
+	return atomic.LoadInt64(&l.recoveryPoint)
+}
+
+// FlushedOffset returns the offset up to which the log's been flushed to
+// stable storage, which is its recovery point: records before it survive a
+// crash, and the log only recovers the segments after it when it's reopened.
+func (l *CommitLog) FlushedOffset() int64 {
+	return l.RecoveryPoint()
+}
+
+func (l *CommitLog) setRecoveryPoint(offset int64) {
+	for {
+		rp := atomic.LoadInt64(&l.recoveryPoint)
+		if offset <= rp || atomic.CompareAndSwapInt64(&l.recoveryPoint, rp, offset) {
+			return
+		}
+	}
+}
+
+// OffsetForTimestamp returns the offset and max timestamp, in milliseconds, of
+// the first message set whose max timestamp is at or after ts. It returns -1
+// for both if there isn't one.
+func (l *CommitLog) OffsetForTimestamp(ts int64) (int64, int64, error) {
+	l.mu.RLock()
+	segments := l.segments
+	l.mu.RUnlock()
+	for _, segment := range segments {
+		if segment.MaxTimestamp() >= ts {
+			return segment.findOffsetByTimestamp(ts)
+		}
+	}
+	return -1, -1, nil
+}
+
 func (l *CommitLog) Delete() error {
 	if err := l.Close(); err != nil {
 		return err
@@ -199,10 +387,18 @@ func (l *CommitLog) checkSplit() bool {
 }
 
 func (l *CommitLog) split() error {
-	segment, err := NewSegment(l.Path, l.NewestOffset(), l.MaxSegmentBytes)
+	// seal the full segment before rolling so it's clean if the log's reopened.
+	if err := l.activeSegment().seal(); err != nil {
+		return err
+	}
+	l.setRecoveryPoint(l.NewestOffset())
+	segment, err := newSegment(l.Path, l.NewestOffset(), l.MaxSegmentBytes, l.IndexIntervalBytes, true, l.PreallocateSegments)
 	if err != nil {
 		return err
 	}
+	if err := segment.reserve(); err != nil {
+		return err
+	}
 	l.mu.Lock()
 	segments := append(l.segments, segment)
 	segments, err = l.cleaner.Clean(segments)
@@ -3,9 +3,13 @@ package commitlog_test
 import (
 	"bytes"
 	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
 	"math/rand"
 	"os"
 	"path/filepath"
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -70,6 +74,129 @@ func BenchmarkCommitLog(b *testing.B) {
 	}
 }
 
+func BenchmarkCommitLog_Append(b *testing.B) {
+	for _, singleWriter := range []bool{false, true} {
+		name := "locked"
+		if singleWriter {
+			name = "single writer"
+		}
+		b.Run(name, func(b *testing.B) {
+			dir := filepath.Join(os.TempDir(), fmt.Sprintf("commitlogappendbench%d", rand.Int63()))
+			defer os.RemoveAll(dir)
+			l, err := commitlog.New(commitlog.Options{
+				Path:            dir,
+				MaxSegmentBytes: 1 << 30,
+				MaxLogBytes:     -1,
+				SingleWriter:    singleWriter,
+			})
+			if err != nil {
+				b.Fatal(err)
+			}
+			msgSet := commitlog.NewMessageSet(0, msgs...)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := l.Append(msgSet); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestSingleWriter(t *testing.T) {
+	newLog := func(t *testing.T) *commitlog.CommitLog {
+		dir := filepath.Join(os.TempDir(), fmt.Sprintf("commitlogsinglewritertest%d", rand.Int63()))
+		l, err := commitlog.New(commitlog.Options{
+			Path:            dir,
+			MaxSegmentBytes: 1024,
+			MaxLogBytes:     -1,
+			SingleWriter:    true,
+		})
+		assert.NoError(t, err)
+		return l
+	}
+
+	t.Run("one writer", func(t *testing.T) {
+		l := newLog(t)
+		defer l.Delete()
+		// the newest offset's read while the writer appends.
+		done := make(chan struct{})
+		readErr := make(chan error, 1)
+		go func() {
+			var last int64
+			for {
+				select {
+				case <-done:
+					readErr <- nil
+					return
+				default:
+				}
+				offset := l.NewestOffset()
+				if offset < last {
+					readErr <- fmt.Errorf("newest offset went back from %d to %d", last, offset)
+					return
+				}
+				last = offset
+			}
+		}()
+		for i := 0; i < 100; i++ {
+			offset, err := l.Append(commitlog.NewMessageSet(0, msgs...))
+			assert.NoError(t, err)
+			assert.Equal(t, int64(i), offset)
+		}
+		close(done)
+		assert.NoError(t, <-readErr)
+		assert.True(t, l.SingleWriter())
+		assert.Equal(t, int64(100), l.NewestOffset())
+
+		r, err := l.NewReader(0, int32(100*msgSets[0].Size()))
+		assert.NoError(t, err)
+		for i := 0; i < 100; i++ {
+			p := make([]byte, msgSets[0].Size())
+			_, err := io.ReadFull(r, p)
+			assert.NoError(t, err)
+			assert.Equal(t, int64(i), commitlog.MessageSet(p).Offset())
+		}
+	})
+
+	t.Run("overlapping writers", func(t *testing.T) {
+		l := newLog(t)
+		defer l.Delete()
+		const writers, appends = 8, 50
+		offsets := make(chan int64, writers*appends)
+		errs := make(chan error, writers*appends)
+		var wg sync.WaitGroup
+		for w := 0; w < writers; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < appends; i++ {
+					offset, err := l.Append(commitlog.NewMessageSet(0, msgs...))
+					if err != nil {
+						errs <- err
+						return
+					}
+					offsets <- offset
+				}
+			}()
+		}
+		wg.Wait()
+		close(offsets)
+		close(errs)
+		for err := range errs {
+			t.Fatal(err)
+		}
+		// each append got its own offset, as if they'd all been locked.
+		seen := make(map[int64]bool)
+		for offset := range offsets {
+			assert.False(t, seen[offset], "offset %d assigned twice", offset)
+			seen[offset] = true
+		}
+		assert.Equal(t, writers*appends, len(seen))
+		assert.Equal(t, int64(writers*appends), l.NewestOffset())
+	})
+}
+
 func TestTruncate(t *testing.T) {
 	var err error
 	l := setup(t)
@@ -154,3 +281,523 @@ func cleanup(t assert.TestingT) {
 	os.RemoveAll(path)
 	os.MkdirAll(path, 0755)
 }
+
+func TestRecoveryPoint(t *testing.T) {
+	dir := filepath.Join(os.TempDir(), fmt.Sprintf("commitlogrecoverytest%d", rand.Int63()))
+	defer os.RemoveAll(dir)
+	opts := commitlog.Options{
+		Path:            dir,
+		MaxSegmentBytes: 1,
+		MaxLogBytes:     -1,
+	}
+	l, err := commitlog.New(opts)
+	assert.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err = l.Append(commitlog.NewMessageSet(0, validMessage([]byte("hello"))))
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, 3, len(l.Segments()))
+	assert.NoError(t, l.Sync())
+	assert.Equal(t, int64(3), l.RecoveryPoint())
+	assert.NoError(t, l.Close())
+
+	// corrupt the first and last segments' messages.
+	for _, baseOffset := range []int64{0, 2} {
+		f, err := os.OpenFile(filepath.Join(dir, fmt.Sprintf("%020d.log", baseOffset)), os.O_RDWR, 0666)
+		assert.NoError(t, err)
+		_, err = f.WriteAt([]byte("x"), 20)
+		assert.NoError(t, err)
+		assert.NoError(t, f.Close())
+	}
+
+	// segments before the recovery point aren't recovered, so the first
+	// segment's corruption goes unnoticed while the last's is truncated.
+	opts.RecoveryPoint = 2
+	l, err = commitlog.New(opts)
+	assert.NoError(t, err)
+	defer l.Close()
+	segments := l.Segments()
+	assert.Equal(t, 3, len(segments))
+	assert.Equal(t, int64(1), segments[0].NextOffset)
+	assert.NotEqual(t, int64(0), segments[0].Position)
+	assert.Equal(t, int64(2), segments[2].NextOffset)
+	assert.Equal(t, int64(0), segments[2].Position)
+	assert.Equal(t, int64(2), l.NewestOffset())
+}
+
+func TestRecoverMultiMessageSets(t *testing.T) {
+	dir := filepath.Join(os.TempDir(), fmt.Sprintf("commitlogmultimessagetest%d", rand.Int63()))
+	defer os.RemoveAll(dir)
+	opts := commitlog.Options{
+		Path:            dir,
+		MaxSegmentBytes: 1024,
+		MaxLogBytes:     -1,
+	}
+	l, err := commitlog.New(opts)
+	assert.NoError(t, err)
+	sets := []commitlog.MessageSet{
+		commitlog.NewMessageSet(0, validMessage([]byte("one"))),
+		// an entry of several messages.
+		commitlog.NewMessageSet(0, validMessage([]byte("two")), validMessage([]byte("three"))),
+		// several entries, as producers send them, with the offsets they gave them.
+		append(commitlog.NewMessageSet(0, validMessage([]byte("four"))), commitlog.NewMessageSet(0, validMessage([]byte("five")))...),
+		commitlog.NewMessageSet(0, validMessage([]byte("six"))),
+	}
+	for _, ms := range sets {
+		_, err = l.Append(append([]byte(nil), ms...))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, l.Close())
+
+	// the last segment's recovered every time the log's opened.
+	l, err = commitlog.New(opts)
+	assert.NoError(t, err)
+	defer l.Close()
+	assert.Equal(t, int64(4), l.NewestOffset())
+	assert.Equal(t, int64(4), l.Segments()[0].Index.Entries())
+	r, err := l.NewReader(3, sets[3].Size())
+	assert.NoError(t, err)
+	p := make([]byte, sets[3].Size())
+	_, err = io.ReadFull(r, p)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), commitlog.MessageSet(p).Offset())
+	assert.Equal(t, sets[3].Payload(), commitlog.MessageSet(p).Payload())
+}
+
+func TestRecoverProducerOffsets(t *testing.T) {
+	dir := filepath.Join(os.TempDir(), fmt.Sprintf("commitlogproduceroffsetstest%d", rand.Int63()))
+	defer os.RemoveAll(dir)
+	opts := commitlog.Options{
+		Path:            dir,
+		MaxSegmentBytes: 1024,
+		MaxLogBytes:     -1,
+	}
+	l, err := commitlog.New(opts)
+	assert.NoError(t, err)
+	// several entries, with the sequential offsets producers gave them, above and below the log's.
+	sets := []commitlog.MessageSet{
+		append(commitlog.NewMessageSet(5, validMessage([]byte("one"))), commitlog.NewMessageSet(6, validMessage([]byte("two")))...),
+		append(commitlog.NewMessageSet(1, validMessage([]byte("three"))), commitlog.NewMessageSet(2, validMessage([]byte("four")))...),
+		commitlog.NewMessageSet(7, validMessage([]byte("five"))),
+	}
+	var appended []byte
+	for i, ms := range sets {
+		ms = append([]byte(nil), ms...)
+		offset, err := l.Append(ms)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(i), offset)
+		appended = append(appended, ms...)
+	}
+	assert.NoError(t, l.Close())
+
+	reopen := func() {
+		l, err = commitlog.New(opts)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(3), l.NewestOffset())
+		assert.Equal(t, int64(3), l.Segments()[0].Index.Entries())
+		r, err := l.NewReader(1, 1024)
+		assert.NoError(t, err)
+		read, err := ioutil.ReadAll(r)
+		assert.NoError(t, err)
+		// the sets' entries are all stored under their set's offset.
+		assert.Equal(t, appended[len(sets[0]):], read)
+		for b := commitlog.MessageSet(read[:len(sets[1])]); len(b) > 0; b = b[b.Size():] {
+			assert.Equal(t, int64(1), b.Offset())
+		}
+		assert.NoError(t, l.Close())
+	}
+	// the last segment's recovered when the log's opened.
+	reopen()
+	// the index is rebuilt from the log when it's corrupt.
+	assert.NoError(t, os.Truncate(filepath.Join(dir, fmt.Sprintf("%020d.index", 0)), 3))
+	opts.RecoveryPoint = 3
+	reopen()
+}
+
+func TestCorruptIndex(t *testing.T) {
+	tests := []struct {
+		name    string
+		corrupt func(t *testing.T, f *os.File)
+	}{
+		{
+			name: "torn entry",
+			corrupt: func(t *testing.T, f *os.File) {
+				_, err := f.Seek(0, io.SeekEnd)
+				assert.NoError(t, err)
+				_, err = f.Write([]byte{1, 2, 3})
+				assert.NoError(t, err)
+			},
+		},
+		{
+			name: "last entry doesn't match the log",
+			corrupt: func(t *testing.T, f *os.File) {
+				fi, err := f.Stat()
+				assert.NoError(t, err)
+				_, err = f.WriteAt([]byte{0, 0, 0, 9, 0, 0, 0, 3}, fi.Size()-8)
+				assert.NoError(t, err)
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := filepath.Join(os.TempDir(), fmt.Sprintf("commitlogcorruptindextest%d", rand.Int63()))
+			defer os.RemoveAll(dir)
+			setSize := commitlog.NewMessageSet(0, validMessage([]byte("hello"))).Size()
+			opts := commitlog.Options{
+				Path:            dir,
+				MaxSegmentBytes: 1024,
+				MaxLogBytes:     -1,
+			}
+			l, err := commitlog.New(opts)
+			assert.NoError(t, err)
+			for i := 0; i < 3; i++ {
+				_, err = l.Append(commitlog.NewMessageSet(0, validMessage([]byte("hello"))))
+				assert.NoError(t, err)
+			}
+			assert.NoError(t, l.Close())
+
+			f, err := os.OpenFile(filepath.Join(dir, fmt.Sprintf("%020d.index", 0)), os.O_RDWR, 0666)
+			assert.NoError(t, err)
+			tt.corrupt(t, f)
+			assert.NoError(t, f.Close())
+
+			// the index is rebuilt from the log rather than the log failing to open.
+			opts.RecoveryPoint = 3
+			l, err = commitlog.New(opts)
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer l.Close()
+			assert.Equal(t, int64(3), l.NewestOffset())
+			assert.Equal(t, int64(3), l.Segments()[0].Index.Entries())
+			r, err := l.NewReader(0, 3*setSize)
+			assert.NoError(t, err)
+			for offset := int64(0); offset < 3; offset++ {
+				p := make([]byte, setSize)
+				_, err = io.ReadFull(r, p)
+				assert.NoError(t, err)
+				assert.Equal(t, offset, commitlog.MessageSet(p).Offset())
+			}
+		})
+	}
+}
+
+func TestPreallocateSegments(t *testing.T) {
+	dir := filepath.Join(os.TempDir(), fmt.Sprintf("commitlogpreallocatetest%d", rand.Int63()))
+	defer os.RemoveAll(dir)
+	opts := commitlog.Options{
+		Path:                dir,
+		MaxSegmentBytes:     1024,
+		MaxLogBytes:         -1,
+		PreallocateSegments: true,
+	}
+	logSize := func(baseOffset int64) int64 {
+		fi, err := os.Stat(filepath.Join(dir, fmt.Sprintf("%020d.log", baseOffset)))
+		assert.NoError(t, err)
+		return fi.Size()
+	}
+	l, err := commitlog.New(opts)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1024), logSize(0))
+
+	var appended []byte
+	for i := 0; i < 2; i++ {
+		ms := commitlog.NewMessageSet(0, validMessage([]byte("hello")))
+		_, err = l.Append(ms)
+		assert.NoError(t, err)
+		appended = append(appended, ms...)
+	}
+	// the segment's reserved size doesn't change as it's appended to, and only what was appended's read.
+	assert.Equal(t, int64(1024), logSize(0))
+	r, err := l.NewReader(0, 1024)
+	assert.NoError(t, err)
+	read, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, appended, read)
+
+	assert.NoError(t, l.Close())
+	assert.Equal(t, int64(len(appended)), logSize(0))
+
+	// the reopened log's recovered from what was appended and its active segment's reserved again.
+	l, err = commitlog.New(opts)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), l.NewestOffset())
+	assert.Equal(t, int64(1024), logSize(0))
+	ms := commitlog.NewMessageSet(0, validMessage([]byte("hello")))
+	_, err = l.Append(ms)
+	assert.NoError(t, err)
+	appended = append(appended, ms...)
+	assert.Equal(t, int64(1024), logSize(0))
+	assert.NoError(t, l.Close())
+	assert.Equal(t, int64(len(appended)), logSize(0))
+
+	// a crash leaves the reserved zeros after what was appended, they're truncated when the log's
+	// recovered and the segment's reserved again.
+	assert.NoError(t, os.Truncate(filepath.Join(dir, fmt.Sprintf("%020d.log", 0)), 1024))
+	l, err = commitlog.New(opts)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), l.NewestOffset())
+	assert.Equal(t, int64(1024), logSize(0))
+	ms = commitlog.NewMessageSet(0, validMessage([]byte("hello")))
+	_, err = l.Append(ms)
+	assert.NoError(t, err)
+	appended = append(appended, ms...)
+	r, err = l.NewReader(0, 1024)
+	assert.NoError(t, err)
+	read, err = ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, appended, read)
+	assert.NoError(t, l.Close())
+	assert.Equal(t, int64(len(appended)), logSize(0))
+}
+
+func TestPreallocateSegments_roll(t *testing.T) {
+	dir := filepath.Join(os.TempDir(), fmt.Sprintf("commitlogpreallocaterolltest%d", rand.Int63()))
+	defer os.RemoveAll(dir)
+	size := int64(len(commitlog.NewMessageSet(0, validMessage([]byte("hello")))))
+	l, err := commitlog.New(commitlog.Options{
+		Path:                dir,
+		MaxSegmentBytes:     size + 10,
+		MaxLogBytes:         -1,
+		PreallocateSegments: true,
+	})
+	assert.NoError(t, err)
+	logSize := func(baseOffset int64) int64 {
+		fi, err := os.Stat(filepath.Join(dir, fmt.Sprintf("%020d.log", baseOffset)))
+		assert.NoError(t, err)
+		return fi.Size()
+	}
+	// the first segment's full after two message sets, the third rolls it.
+	for i := 0; i < 3; i++ {
+		_, err = l.Append(commitlog.NewMessageSet(0, validMessage([]byte("hello"))))
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, 2, len(l.Segments()))
+	// the rolled segment's truncated to what was appended, the new active one's reserved.
+	assert.Equal(t, 2*size, logSize(0))
+	assert.Equal(t, size+10, logSize(2))
+	assert.NoError(t, l.Close())
+	assert.Equal(t, size, logSize(2))
+}
+
+func TestSync(t *testing.T) {
+	dir := filepath.Join(os.TempDir(), fmt.Sprintf("commitlogsynctest%d", rand.Int63()))
+	defer os.RemoveAll(dir)
+	setSize := commitlog.NewMessageSet(0, validMessage([]byte("hello"))).Size()
+	opts := commitlog.Options{
+		Path:            dir,
+		MaxSegmentBytes: 2 * int64(setSize),
+		MaxLogBytes:     -1,
+	}
+	l, err := commitlog.New(opts)
+	assert.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err = l.Append(commitlog.NewMessageSet(0, validMessage([]byte("hello"))))
+		assert.NoError(t, err)
+	}
+	// the first segment was flushed when the log rolled, the active one hasn't been.
+	assert.Equal(t, int64(2), l.FlushedOffset())
+	assert.NoError(t, l.Sync())
+	assert.Equal(t, l.NewestOffset(), l.FlushedOffset())
+	assert.Equal(t, int64(3), l.FlushedOffset())
+	assert.NoError(t, l.Close())
+
+	// the flushed records are there when the log's reopened, without recovering it.
+	opts.RecoveryPoint = 3
+	l, err = commitlog.New(opts)
+	assert.NoError(t, err)
+	defer l.Close()
+	assert.Equal(t, int64(3), l.NewestOffset())
+	r, err := l.NewReader(2, setSize)
+	assert.NoError(t, err)
+	p := make([]byte, setSize)
+	_, err = r.Read(p)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), commitlog.MessageSet(p).Offset())
+}
+
+func TestReaderLen(t *testing.T) {
+	dir := filepath.Join(os.TempDir(), fmt.Sprintf("commitlogreaderlentest%d", rand.Int63()))
+	defer os.RemoveAll(dir)
+	setSize := commitlog.NewMessageSet(0, validMessage([]byte("hello"))).Size()
+	l, err := commitlog.New(commitlog.Options{
+		Path:            dir,
+		MaxSegmentBytes: 2 * int64(setSize),
+		MaxLogBytes:     -1,
+	})
+	assert.NoError(t, err)
+	defer l.Close()
+	for i := 0; i < 3; i++ {
+		_, err = l.Append(commitlog.NewMessageSet(0, validMessage([]byte("hello"))))
+		assert.NoError(t, err)
+	}
+	// the reader starts in the first segment and has the rest of the log, across segments, left.
+	r, err := l.NewReader(1, setSize)
+	assert.NoError(t, err)
+	lr := r.(interface{ Len() int })
+	assert.Equal(t, 2*int(setSize), lr.Len())
+
+	p := make([]byte, setSize)
+	_, err = io.ReadFull(r, p)
+	assert.NoError(t, err)
+	assert.Equal(t, int(setSize), lr.Len())
+
+	// appends after the reader's created are counted.
+	_, err = l.Append(commitlog.NewMessageSet(0, validMessage([]byte("hello"))))
+	assert.NoError(t, err)
+	assert.Equal(t, 2*int(setSize), lr.Len())
+}
+
+func TestDeleteRecords(t *testing.T) {
+	dir := filepath.Join(os.TempDir(), fmt.Sprintf("commitlogdeleterecordstest%d", rand.Int63()))
+	defer os.RemoveAll(dir)
+	setSize := int64(commitlog.NewMessageSet(0, validMessage([]byte("hello"))).Size())
+	opts := commitlog.Options{
+		Path:            dir,
+		MaxSegmentBytes: 2 * setSize,
+		MaxLogBytes:     -1,
+	}
+	l, err := commitlog.New(opts)
+	assert.NoError(t, err)
+	for i := 0; i < 6; i++ {
+		_, err = l.Append(commitlog.NewMessageSet(0, validMessage([]byte("hello"))))
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, 3, len(l.Segments()))
+
+	// the first segment's wholly before offset 3 so it's deleted, the second's kept.
+	assert.NoError(t, l.DeleteRecords(3))
+	assert.Equal(t, int64(3), l.OldestOffset())
+	assert.Equal(t, 2, len(l.Segments()))
+
+	// the log start offset doesn't move back.
+	assert.NoError(t, l.DeleteRecords(1))
+	assert.Equal(t, int64(3), l.OldestOffset())
+
+	assert.Equal(t, commitlog.ErrOffsetOutOfRange, l.DeleteRecords(7))
+	assert.NoError(t, l.Close())
+
+	opts.LogStartOffset = 3
+	l, err = commitlog.New(opts)
+	assert.NoError(t, err)
+	defer l.Close()
+	assert.Equal(t, int64(3), l.OldestOffset())
+}
+
+// validMessage returns a v0 Kafka message with the given value and a valid CRC.
+func validMessage(value []byte) commitlog.Message {
+	m := make([]byte, 14+len(value))
+	// magic and attributes are 0, the key's null.
+	commitlog.Encoding.PutUint32(m[6:10], 0xffffffff)
+	commitlog.Encoding.PutUint32(m[10:14], uint32(len(value)))
+	copy(m[14:], value)
+	commitlog.Encoding.PutUint32(m[0:4], crc32.ChecksumIEEE(m[4:]))
+	return commitlog.NewMessage(m)
+}
+
+func TestOffsetForTimestamp(t *testing.T) {
+	dir := filepath.Join(os.TempDir(), fmt.Sprintf("commitlogtimestamptest%d", rand.Int63()))
+	defer os.RemoveAll(dir)
+	setSize := int64(commitlog.NewMessageSet(0, timestampedMessage(0, []byte("hello"))).Size())
+	opts := commitlog.Options{
+		Path: dir,
+		// three message sets per segment, and a time index entry every other
+		// message set so lookups scan the log after the entry.
+		MaxSegmentBytes:    3 * setSize,
+		MaxLogBytes:        -1,
+		IndexIntervalBytes: 2 * setSize,
+	}
+	l, err := commitlog.New(opts)
+	assert.NoError(t, err)
+	for i := int64(1); i <= 10; i++ {
+		_, err = l.Append(commitlog.NewMessageSet(0, timestampedMessage(i*100, []byte("hello"))))
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, 4, len(l.Segments()))
+
+	tests := []struct {
+		ts            int64
+		want          int64
+		wantTimestamp int64
+	}{
+		{ts: 0, want: 0, wantTimestamp: 100},
+		{ts: 100, want: 0, wantTimestamp: 100},
+		{ts: 150, want: 1, wantTimestamp: 200},
+		{ts: 300, want: 2, wantTimestamp: 300},
+		{ts: 301, want: 3, wantTimestamp: 400},
+		{ts: 650, want: 6, wantTimestamp: 700},
+		{ts: 1000, want: 9, wantTimestamp: 1000},
+		{ts: 1001, want: -1, wantTimestamp: -1},
+	}
+	check := func(l *commitlog.CommitLog) {
+		for _, tt := range tests {
+			got, ts, err := l.OffsetForTimestamp(tt.ts)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got, "OffsetForTimestamp(%d)", tt.ts)
+			assert.Equal(t, tt.wantTimestamp, ts, "OffsetForTimestamp(%d) timestamp", tt.ts)
+		}
+	}
+	check(l)
+
+	// the time indexes are loaded or rebuilt when the log's reopened.
+	assert.NoError(t, l.Sync())
+	opts.RecoveryPoint = l.RecoveryPoint()
+	assert.NoError(t, l.Close())
+	l, err = commitlog.New(opts)
+	assert.NoError(t, err)
+	check(l)
+	assert.NoError(t, l.Close())
+
+	opts.RecoveryPoint = 0
+	l, err = commitlog.New(opts)
+	assert.NoError(t, err)
+	defer l.Close()
+	check(l)
+}
+
+// timestampedMessage returns a v1 Kafka message with the given timestamp and
+// value and a valid CRC.
+func timestampedMessage(ts int64, value []byte) commitlog.Message {
+	m := make([]byte, 22+len(value))
+	m[4] = 1
+	commitlog.Encoding.PutUint64(m[6:14], uint64(ts))
+	// the key's null.
+	commitlog.Encoding.PutUint32(m[14:18], 0xffffffff)
+	commitlog.Encoding.PutUint32(m[18:22], uint32(len(value)))
+	copy(m[22:], value)
+	commitlog.Encoding.PutUint32(m[0:4], crc32.ChecksumIEEE(m[4:]))
+	return commitlog.NewMessage(m)
+}
+
+// steppedAssigner assigns each record step offsets, so tests can tell its
+// offsets apart from the default assigner's.
+type steppedAssigner struct {
+	step  int64
+	calls int
+}
+
+func (a *steppedAssigner) Assign(leo int64, count int) (int64, int64) {
+	a.calls++
+	return leo, leo + a.step*int64(count)
+}
+
+func TestOffsetAssigner(t *testing.T) {
+	dir := filepath.Join(os.TempDir(), fmt.Sprintf("commitlogassignertest%d", rand.Int63()))
+	defer os.RemoveAll(dir)
+	a := &steppedAssigner{step: 2}
+	l, err := commitlog.New(commitlog.Options{
+		Path:            dir,
+		MaxSegmentBytes: 1024,
+		MaxLogBytes:     -1,
+		OffsetAssigner:  a,
+	})
+	assert.NoError(t, err)
+	defer l.Close()
+	for i := 0; i < 3; i++ {
+		offset, err := l.Append(commitlog.NewMessageSet(0, validMessage([]byte("hello"))))
+		assert.NoError(t, err)
+		assert.Equal(t, int64(2*i), offset)
+	}
+	assert.Equal(t, 3, a.calls)
+	assert.Equal(t, int64(6), l.NewestOffset())
+}
@@ -159,6 +159,13 @@ func (idx *index) Close() (err error) {
 	return idx.file.Close()
 }
 
+// Entries returns the number of entries in the index.
+func (idx *index) Entries() int64 {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	return idx.position / entryWidth
+}
+
 func (idx *index) Name() string {
 	return idx.file.Name()
 }
@@ -178,7 +185,7 @@ func (idx *index) SanityCheck() error {
 	defer idx.mu.RUnlock()
 	if idx.position == 0 {
 		return nil
-	} else if idx.position%entryWidth != 0 {
+	} else if idx.position%entryWidth != 0 || idx.position > int64(len(idx.mmap)) {
 		return ErrIndexCorrupt
 	} else {
 		//read last entry
@@ -1,9 +1,33 @@
 package commitlog
 
+import "hash/crc32"
+
 const (
 	offsetPos       = 0
 	sizePos         = 8
 	msgSetHeaderLen = 12
+
+	// positions in the message set's payload of the magic byte, of the
+	// partition leader epoch, CRC, attributes, last offset delta, first and
+	// max timestamps, and producer ID, epoch, and base sequence of v2 record
+	// batches, and of the attributes and timestamp of v1 messages.
+	magicPos                     = 4
+	batchPartitionLeaderEpochPos = 0
+	batchCRCPos                  = 5
+	batchAttributesPos           = 9
+	batchLastOffsetDeltaPos      = 11
+	batchFirstTimestampPos       = 15
+	batchMaxTimestampPos         = 23
+	batchProducerIDPos           = 31
+	batchProducerEpochPos        = 39
+	batchBaseSequencePos         = 41
+	msgAttributesPos             = 5
+	msgTimestampPos              = 6
+
+	// logAppendTimeAttribute is the attributes' bit, of both v2 record
+	// batches and v1 messages, set when their timestamps are the time they
+	// were appended to the log rather than the time they were created.
+	logAppendTimeAttribute = 1 << 3
 )
 
 type MessageSet []byte
@@ -24,8 +48,18 @@ func (ms MessageSet) Offset() int64 {
 	return int64(Encoding.Uint64(ms[offsetPos : offsetPos+8]))
 }
 
+// PutOffset sets the offset of each of the message set's [offset][size][message] entries, so a
+// set produced as several entries is stored under a single offset rather than the offsets the
+// producer gave its later entries.
 func (ms MessageSet) PutOffset(offset int64) {
-	Encoding.PutUint64(ms[offsetPos:offsetPos+8], uint64(offset))
+	for b := []byte(ms); len(b) >= msgSetHeaderLen; {
+		Encoding.PutUint64(b[offsetPos:offsetPos+8], uint64(offset))
+		n := msgSetHeaderLen + int(Encoding.Uint32(b[sizePos:sizePos+4]))
+		if n > len(b) {
+			break
+		}
+		b = b[n:]
+	}
 }
 
 func (ms MessageSet) Size() int32 {
@@ -35,3 +69,167 @@ func (ms MessageSet) Size() int32 {
 func (ms MessageSet) Payload() []byte {
 	return ms[msgSetHeaderLen:]
 }
+
+// MaxTimestamp returns the largest timestamp, in milliseconds, of the message
+// set's messages. For v2 record batches that's the batch header's max
+// timestamp, for v1 messages it's the largest of their timestamps. It returns
+// -1 if the messages don't have timestamps, e.g. they're v0 messages.
+func (ms MessageSet) MaxTimestamp() int64 {
+	max := int64(-1)
+	for b := []byte(ms); len(b) >= msgSetHeaderLen; {
+		n := msgSetHeaderLen + int(Encoding.Uint32(b[sizePos:sizePos+4]))
+		if n > len(b) {
+			break
+		}
+		if ts := maxTimestamp(b[msgSetHeaderLen:n]); ts > max {
+			max = ts
+		}
+		b = b[n:]
+	}
+	return max
+}
+
+// maxTimestamp returns the largest timestamp of the record batch or messages
+// of a message set's entry, or -1 if they don't have timestamps.
+func maxTimestamp(m []byte) int64 {
+	if len(m) <= magicPos {
+		return -1
+	}
+	if m[magicPos] == 2 {
+		if len(m) < batchMaxTimestampPos+8 {
+			return -1
+		}
+		return int64(Encoding.Uint64(m[batchMaxTimestampPos:]))
+	}
+	max := int64(-1)
+	// an entry can hold several messages one after another.
+	for len(m) >= msgTimestampPos+8 && m[magicPos] == 1 {
+		if ts := int64(Encoding.Uint64(m[msgTimestampPos:])); ts > max {
+			max = ts
+		}
+		n := messageLen(m)
+		if n < 0 {
+			break
+		}
+		m = m[n:]
+	}
+	return max
+}
+
+// messageLen returns the length of the v0 or v1 message at the start of m,
+// its crc, magic, attributes, timestamp if it's v1, key and value, or -1 if m
+// is too short to hold it.
+func messageLen(m []byte) int {
+	if len(m) <= msgAttributesPos {
+		return -1
+	}
+	n := msgAttributesPos + 1
+	if m[magicPos] == 1 {
+		n += 8
+	}
+	for i := 0; i < 2; i++ {
+		if len(m) < n+4 {
+			return -1
+		}
+		if l := int32(Encoding.Uint32(m[n:])); l > 0 {
+			n += int(l)
+		}
+		n += 4
+	}
+	if n > len(m) {
+		return -1
+	}
+	return n
+}
+
+// ProducerBatch is the producer of a v2 record batch and the sequences of its first and last
+// records, used to deduplicate idempotent producers' retries.
+type ProducerBatch struct {
+	ProducerID    int64
+	ProducerEpoch int16
+	BaseSequence  int32
+	LastSequence  int32
+}
+
+// ProducerBatch returns the producer and sequences of the message set's first
+// record batch, and false if it isn't a v2 record batch or its producer isn't
+// idempotent, i.e. its producer ID is -1.
+func (ms MessageSet) ProducerBatch() (ProducerBatch, bool) {
+	if len(ms) < msgSetHeaderLen+batchBaseSequencePos+4 {
+		return ProducerBatch{}, false
+	}
+	payload := ms[msgSetHeaderLen:]
+	if payload[magicPos] != 2 {
+		return ProducerBatch{}, false
+	}
+	batch := ProducerBatch{
+		ProducerID:    int64(Encoding.Uint64(payload[batchProducerIDPos:])),
+		ProducerEpoch: int16(Encoding.Uint16(payload[batchProducerEpochPos:])),
+		BaseSequence:  int32(Encoding.Uint32(payload[batchBaseSequencePos:])),
+	}
+	if batch.ProducerID < 0 {
+		return ProducerBatch{}, false
+	}
+	// sequences wrap around after the max int32.
+	batch.LastSequence = int32((int64(batch.BaseSequence) + int64(Encoding.Uint32(payload[batchLastOffsetDeltaPos:]))) % (1 << 31))
+	return batch, true
+}
+
+// PartitionLeaderEpoch returns the partition leader epoch of the message set's
+// first record batch, or -1 if it isn't a v2 record batch.
+func (ms MessageSet) PartitionLeaderEpoch() int32 {
+	if len(ms) <= msgSetHeaderLen+magicPos {
+		return -1
+	}
+	payload := ms[msgSetHeaderLen:]
+	if payload[magicPos] != 2 {
+		return -1
+	}
+	return int32(Encoding.Uint32(payload[batchPartitionLeaderEpochPos:]))
+}
+
+// SupportedFormat returns whether the message set's messages and record
+// batches are all in formats the log supports, with magic bytes 0, 1, or 2.
+// Message sets too short to have a magic byte aren't checked.
+func (ms MessageSet) SupportedFormat() bool {
+	for b := []byte(ms); len(b) > msgSetHeaderLen+magicPos; {
+		if magic := int8(b[msgSetHeaderLen+magicPos]); magic < 0 || magic > 2 {
+			return false
+		}
+		n := msgSetHeaderLen + int(Encoding.Uint32(b[sizePos:sizePos+4]))
+		if n > len(b) {
+			break
+		}
+		b = b[n:]
+	}
+	return true
+}
+
+// SetLogAppendTime sets the timestamps of the message set's messages to ts,
+// the time in milliseconds they're appended to the log, and marks them as log
+// append times. v2 record batches have their first and max timestamps set,
+// consumers take a marked batch's max timestamp as each of its records'
+// timestamp, and v1 messages have their timestamps set. Their CRCs are
+// recomputed. v0 messages don't have timestamps and are left as they are.
+func (ms MessageSet) SetLogAppendTime(ts int64) {
+	for b := []byte(ms); len(b) >= msgSetHeaderLen; {
+		n := msgSetHeaderLen + int(Encoding.Uint32(b[sizePos:sizePos+4]))
+		if n > len(b) {
+			return
+		}
+		m := b[msgSetHeaderLen:n]
+		switch {
+		case len(m) >= batchMaxTimestampPos+8 && m[magicPos] == 2:
+			attributes := Encoding.Uint16(m[batchAttributesPos:])
+			Encoding.PutUint16(m[batchAttributesPos:], attributes|logAppendTimeAttribute)
+			Encoding.PutUint64(m[batchFirstTimestampPos:], uint64(ts))
+			Encoding.PutUint64(m[batchMaxTimestampPos:], uint64(ts))
+			Encoding.PutUint32(m[batchCRCPos:], crc32.Checksum(m[batchCRCPos+4:], castagnoli))
+		case len(m) >= msgTimestampPos+8 && m[magicPos] == 1:
+			m[msgAttributesPos] |= logAppendTimeAttribute
+			Encoding.PutUint64(m[msgTimestampPos:], uint64(ts))
+			Encoding.PutUint32(m[:4], crc32.ChecksumIEEE(m[4:]))
+		}
+		b = b[n:]
+	}
+}
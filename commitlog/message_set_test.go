@@ -1,6 +1,7 @@
 package commitlog_test
 
 import (
+	"hash/crc32"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -24,3 +25,111 @@ func TestMessageSet(t *testing.T) {
 		offset += len(msg)
 	}
 }
+
+func TestMessageSet_MaxTimestamp(t *testing.T) {
+	// a v2 record batch's header, up to and including its max timestamp.
+	batch := make([]byte, 31)
+	batch[4] = 2
+	commitlog.Encoding.PutUint64(batch[15:23], 100)
+	commitlog.Encoding.PutUint64(batch[23:31], 200)
+	assert.Equal(t, int64(200), commitlog.NewMessageSet(0, batch).MaxTimestamp())
+
+	// messages without timestamps.
+	assert.Equal(t, int64(-1), commitlog.NewMessageSet(0, commitlog.NewMessage([]byte("hello"))).MaxTimestamp())
+
+	// v1 messages: their crc, magic, attributes, timestamp, key and value.
+	newMessage := func(ts byte) []byte {
+		return []byte{0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0, ts, 255, 255, 255, 255, 0, 0, 0, 5, 'h', 'e', 'l', 'l', 'o'}
+	}
+	var entries []byte
+	for i, ts := range []byte{100, 250, 200} {
+		entries = append(entries, commitlog.NewMessageSet(uint64(i), newMessage(ts))...)
+	}
+	assert.Equal(t, int64(250), commitlog.MessageSet(entries).MaxTimestamp(), "entries")
+	assert.Equal(t, int64(250), commitlog.NewMessageSet(0, newMessage(100), newMessage(250), newMessage(200)).MaxTimestamp(), "messages in one entry")
+}
+
+func TestMessageSet_SetLogAppendTime(t *testing.T) {
+	// a v2 record batch: its header, with create times, followed by its records.
+	batch := make([]byte, 61+len("records"))
+	batch[4] = 2
+	commitlog.Encoding.PutUint16(batch[9:11], 1) // gzip compressed
+	commitlog.Encoding.PutUint64(batch[15:23], 100)
+	commitlog.Encoding.PutUint64(batch[23:31], 200)
+	copy(batch[61:], "records")
+	// a v1 message: its crc, magic, attributes, timestamp, key and value.
+	msg := []byte{0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 100, 255, 255, 255, 255, 0, 0, 0, 5, 'h', 'e', 'l', 'l', 'o'}
+	ms := append(commitlog.NewMessageSet(0, batch), commitlog.NewMessageSet(1, msg)...)
+
+	commitlog.MessageSet(ms).SetLogAppendTime(300)
+
+	b := ms[12 : 12+len(batch)]
+	assert.Equal(t, uint16(1|1<<3), commitlog.Encoding.Uint16(b[9:11]), "batch attributes")
+	assert.Equal(t, uint64(300), commitlog.Encoding.Uint64(b[15:23]), "batch first timestamp")
+	assert.Equal(t, uint64(300), commitlog.Encoding.Uint64(b[23:31]), "batch max timestamp")
+	assert.Equal(t, crc32.Checksum(b[9:], crc32.MakeTable(crc32.Castagnoli)), commitlog.Encoding.Uint32(b[5:9]), "batch crc")
+	assert.Equal(t, "records", string(b[61:]))
+
+	m := ms[12+len(batch)+12:]
+	assert.Equal(t, byte(1<<3), m[5], "message attributes")
+	assert.Equal(t, uint64(300), commitlog.Encoding.Uint64(m[6:14]), "message timestamp")
+	assert.Equal(t, crc32.ChecksumIEEE(m[4:]), commitlog.Encoding.Uint32(m[:4]), "message crc")
+	assert.Equal(t, int64(300), commitlog.MessageSet(ms).MaxTimestamp())
+
+	// messages without timestamps are left as they are.
+	v0 := commitlog.NewMessageSet(0, commitlog.NewMessage([]byte("hello")))
+	want := append([]byte(nil), v0...)
+	v0.SetLogAppendTime(300)
+	assert.Equal(t, want, []byte(v0))
+}
+
+func TestMessageSet_SupportedFormat(t *testing.T) {
+	message := func(magic byte) commitlog.Message {
+		// a message's or record batch's first bytes, up to and including its magic byte.
+		return commitlog.NewMessage([]byte{0, 0, 0, 0, magic, 0, 0})
+	}
+	for magic := byte(0); magic <= 2; magic++ {
+		assert.True(t, commitlog.NewMessageSet(0, message(magic)).SupportedFormat(), "magic %d", magic)
+	}
+	assert.False(t, commitlog.NewMessageSet(0, message(3)).SupportedFormat())
+	assert.False(t, commitlog.NewMessageSet(0, message(0xff)).SupportedFormat())
+	// every message's checked, not just the first.
+	ms := append(commitlog.NewMessageSet(0, message(2)), commitlog.NewMessageSet(1, message(7))...)
+	assert.False(t, commitlog.MessageSet(ms).SupportedFormat())
+	// too short to have a magic byte.
+	assert.True(t, commitlog.MessageSet(nil).SupportedFormat())
+}
+
+func TestMessageSet_ProducerBatch(t *testing.T) {
+	// a v2 record batch's header, up to and including its base sequence.
+	batch := make([]byte, 45)
+	batch[4] = 2
+	commitlog.Encoding.PutUint32(batch[11:15], 2)       // last offset delta
+	commitlog.Encoding.PutUint64(batch[31:39], 7)       // producer id
+	commitlog.Encoding.PutUint16(batch[39:41], 1)       // producer epoch
+	commitlog.Encoding.PutUint32(batch[41:45], 1<<31-2) // base sequence
+	got, ok := commitlog.NewMessageSet(0, batch).ProducerBatch()
+	assert.True(t, ok)
+	assert.Equal(t, commitlog.ProducerBatch{ProducerID: 7, ProducerEpoch: 1, BaseSequence: 1<<31 - 2, LastSequence: 0}, got)
+
+	// batches of producers that aren't idempotent.
+	commitlog.Encoding.PutUint64(batch[31:39], ^uint64(0))
+	_, ok = commitlog.NewMessageSet(0, batch).ProducerBatch()
+	assert.False(t, ok)
+
+	// messages have no producer.
+	_, ok = commitlog.NewMessageSet(0, commitlog.NewMessage([]byte("hello"))).ProducerBatch()
+	assert.False(t, ok)
+}
+
+func TestMessageSet_PartitionLeaderEpoch(t *testing.T) {
+	// a v2 record batch's first bytes, up to and including its magic byte.
+	batch := []byte{0, 0, 0, 5, 2}
+	assert.Equal(t, int32(5), commitlog.NewMessageSet(0, batch).PartitionLeaderEpoch())
+	commitlog.Encoding.PutUint32(batch[:4], ^uint32(0))
+	assert.Equal(t, int32(-1), commitlog.NewMessageSet(0, batch).PartitionLeaderEpoch())
+
+	// messages have no partition leader epoch.
+	assert.Equal(t, int32(-1), commitlog.NewMessageSet(0, commitlog.NewMessage([]byte{0, 0, 0, 5, 1})).PartitionLeaderEpoch())
+	assert.Equal(t, int32(-1), commitlog.MessageSet(nil).PartitionLeaderEpoch())
+}
@@ -0,0 +1,22 @@
+package commitlog
+
+// OffsetAssigner is used to assign offsets to the records appended to a log.
+type OffsetAssigner interface {
+	// Assign returns the base offset of count records appended to a log whose
+	// log end offset is leo, and the log end offset after they're appended.
+	// Offsets must increase from one append to the next.
+	Assign(leo int64, count int) (baseOffset, nextLEO int64)
+}
+
+// SequentialAssigner assigns records consecutive offsets starting at the log
+// end offset. It's the log's assigner unless the options give another.
+type SequentialAssigner struct{}
+
+// Assign returns the log end offset as the records' base offset. Appending no
+// records assigns no offsets and leaves the log end offset unchanged.
+func (SequentialAssigner) Assign(leo int64, count int) (baseOffset, nextLEO int64) {
+	if count <= 0 {
+		return leo, leo
+	}
+	return leo, leo + int64(count)
+}
@@ -0,0 +1,51 @@
+package commitlog
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSequentialAssigner(t *testing.T) {
+	tests := []struct {
+		name        string
+		leo         int64
+		counts      []int
+		wantBases   []int64
+		wantNextLEO int64
+	}{
+		{
+			name:        "single batch",
+			leo:         0,
+			counts:      []int{3},
+			wantBases:   []int64{0},
+			wantNextLEO: 3,
+		},
+		{
+			name:        "multi batch",
+			leo:         10,
+			counts:      []int{1, 4, 2},
+			wantBases:   []int64{10, 11, 15},
+			wantNextLEO: 17,
+		},
+		{
+			name:        "empty batch",
+			leo:         5,
+			counts:      []int{0},
+			wantBases:   []int64{5},
+			wantNextLEO: 5,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var a SequentialAssigner
+			leo := tt.leo
+			for i, count := range tt.counts {
+				var base int64
+				base, leo = a.Assign(leo, count)
+				require.Equal(t, tt.wantBases[i], base)
+			}
+			require.Equal(t, tt.wantNextLEO, leo)
+		})
+	}
+}
@@ -0,0 +1,25 @@
+package commitlog
+
+import (
+	"os"
+)
+
+// preallocateChunkSize is how many zeros are written at a time when a file's preallocated by
+// writing to it.
+const preallocateChunkSize = 64 * 1024
+
+// writeZeros is used to preallocate the file from offset up to size bytes by writing zeros to it,
+// for filesystems and platforms without fallocate.
+func writeZeros(f *os.File, offset, size int64) error {
+	zeros := make([]byte, preallocateChunkSize)
+	for off := offset; off < size; off += preallocateChunkSize {
+		n := size - off
+		if n > preallocateChunkSize {
+			n = preallocateChunkSize
+		}
+		if _, err := f.WriteAt(zeros[:n], off); err != nil {
+			return err
+		}
+	}
+	return nil
+}
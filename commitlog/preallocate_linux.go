@@ -0,0 +1,16 @@
+package commitlog
+
+import (
+	"os"
+	"syscall"
+)
+
+// preallocateFile is used to reserve the file's bytes from offset up to size with fallocate,
+// falling back to writing zeros if the filesystem doesn't support it.
+func preallocateFile(f *os.File, offset, size int64) error {
+	err := syscall.Fallocate(int(f.Fd()), 0, offset, size-offset)
+	if err == syscall.EOPNOTSUPP || err == syscall.ENOSYS {
+		return writeZeros(f, offset, size)
+	}
+	return err
+}
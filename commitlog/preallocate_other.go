@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package commitlog
+
+import (
+	"os"
+)
+
+// preallocateFile is used to reserve the file's bytes from offset up to size by writing zeros to it.
+func preallocateFile(f *os.File, offset, size int64) error {
+	return writeZeros(f, offset, size)
+}
@@ -42,6 +42,22 @@ func (r *Reader) Read(p []byte) (n int, err error) {
 	return n, err
 }
 
+// Len returns the number of bytes from the reader's position to the end of the log, i.e. what
+// it reads before returning io.EOF unless more is appended.
+func (r *Reader) Len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	segments := r.commitlog.Segments()
+	var n int64
+	for i := r.idx; i < len(segments); i++ {
+		s := segments[i]
+		s.Lock()
+		n += s.Position
+		s.Unlock()
+	}
+	return int(n - r.position)
+}
+
 func (l *CommitLog) NewReader(offset int64, maxBytes int32) (io.Reader, error) {
 	segment, idx := findSegment(l.Segments(), offset)
 	if segment == nil {
@@ -3,6 +3,7 @@ package commitlog
 import (
 	"bytes"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"os"
 	"path/filepath"
@@ -13,10 +14,17 @@ import (
 )
 
 const (
-	logNameFormat   = "%020d.log"
-	indexNameFormat = "%020d.index"
+	logNameFormat       = "%020d.log"
+	indexNameFormat     = "%020d.index"
+	timeIndexNameFormat = "%020d.timeindex"
+
+	// defaultIndexIntervalBytes is how many bytes are appended to a segment
+	// between entries in its time index by default.
+	defaultIndexIntervalBytes = 4096
 )
 
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
 type Segment struct {
 	writer     io.Writer
 	reader     io.Reader
@@ -26,38 +34,79 @@ type Segment struct {
 	NextOffset int64
 	Position   int64
 	maxBytes   int64
+	// recover is whether to check the segment's messages when setting up its
+	// index, truncating the segment at the first corrupt or partial message.
+	recover bool
+	// preallocate is whether the segment's log was reserved up to its max
+	// bytes when it was created. It's written at its position rather than
+	// appended to, and truncated to its position when it's sealed or closed.
+	preallocate bool
+
+	TimeIndex *timeIndex
+	// maxTimestamp is the largest timestamp of the segment's messages, -1 if
+	// none of them have timestamps, and offsetOfMaxTimestamp the offset of the
+	// message set it's from.
+	maxTimestamp         int64
+	offsetOfMaxTimestamp int64
+	// indexIntervalBytes is how many bytes are appended between entries in the
+	// time index.
+	indexIntervalBytes       int64
+	bytesSinceTimeIndexEntry int64
 
 	sync.Mutex
 }
 
 func NewSegment(path string, baseOffset int64, maxBytes int64) (*Segment, error) {
+	return newSegment(path, baseOffset, maxBytes, defaultIndexIntervalBytes, true, false)
+}
+
+// newSegment is used to open the segment, recovering it if recover is true.
+// Segments that aren't recovered are assumed to be clean, e.g. they were
+// synced before the log was closed. If preallocate is true the log's written
+// at its position, and it's reserved up to max bytes by reserve once it's the
+// log's active segment.
+func newSegment(path string, baseOffset int64, maxBytes int64, indexIntervalBytes int64, recover bool, preallocate bool) (*Segment, error) {
 	logPath := filepath.Join(path, fmt.Sprintf(logNameFormat, baseOffset))
-	log, err := os.OpenFile(logPath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	flag := os.O_RDWR | os.O_CREATE | os.O_APPEND
+	if preallocate {
+		// the log's written at its position, its end is past it.
+		flag = os.O_RDWR | os.O_CREATE
+	}
+	log, err := os.OpenFile(logPath, flag, 0666)
 	if err != nil {
 		return nil, errors.Wrap(err, "open file failed")
 	}
 
 	s := &Segment{
-		log:        log,
-		writer:     log,
-		reader:     log,
-		maxBytes:   maxBytes,
-		BaseOffset: baseOffset,
-		NextOffset: baseOffset,
+		log:         log,
+		writer:      log,
+		reader:      log,
+		maxBytes:    maxBytes,
+		recover:     recover,
+		preallocate: preallocate,
+		BaseOffset:  baseOffset,
+		NextOffset:  baseOffset,
+
+		maxTimestamp:       -1,
+		indexIntervalBytes: indexIntervalBytes,
 	}
 	err = s.SetupIndex(path)
-	if err == io.EOF {
-		return s, nil
+	if err != nil && err != io.EOF {
+		return s, err
 	}
-
-	return s, err
+	return s, nil
 }
 
 // SetupIndex creates and initializes an index.
 // Initialization is:
-// - Sanity check of the loaded index
+// - Sanity check of the loaded index against the log
 // - Truncates the index (clears it)
 // - Reads the log file from the beginning and re-initializes the index
+// - If recovering, truncates the log at the first corrupt or partial message
+// - If recovering, or the time index or the index is empty or corrupt, rebuilds the time index
+//
+// A corrupt index, e.g. from a torn write, doesn't stop the segment opening: the log's the
+// source of truth and the index is rebuilt from it.
 func (s *Segment) SetupIndex(path string) (err error) {
 	indexPath := filepath.Join(path, fmt.Sprintf(indexNameFormat, s.BaseOffset))
 	s.Index, err = newIndex(options{
@@ -67,10 +116,13 @@ func (s *Segment) SetupIndex(path string) (err error) {
 	if err != nil {
 		return err
 	}
-	if err = s.Index.SanityCheck(); err != nil {
+	indexCorrupt := !s.indexMatchesLog()
+	if err := s.Index.TruncateEntries(0); err != nil {
 		return err
 	}
-	if err := s.Index.TruncateEntries(0); err != nil {
+	// the time index was written alongside the index, if the index is corrupt it can't be trusted either.
+	rebuildTimeIndex, err := s.setupTimeIndex(path, indexCorrupt)
+	if err != nil {
 		return err
 	}
 
@@ -82,42 +134,277 @@ func (s *Segment) SetupIndex(path string) (err error) {
 	b := new(bytes.Buffer)
 	for {
 		// get offset and size
-		_, err := io.CopyN(b, s.log, 8)
+		_, err := io.CopyN(b, s.log, msgSetHeaderLen)
 		if err != nil {
-			return err
+			return s.recoverFrom(err)
 		}
-		s.NextOffset = int64(Encoding.Uint64(b.Bytes()[0:8]))
+		offset := int64(Encoding.Uint64(b.Bytes()[offsetPos : offsetPos+8]))
+		size := int64(Encoding.Uint32(b.Bytes()[sizePos : sizePos+4]))
+		// the entries of a message set appended as several entries are all stored under the set's
+		// offset, entries after its first are part of the set rather than sets of their own.
+		continued := s.Position > 0 && offset == s.NextOffset-1
 
-		_, err = io.CopyN(b, s.log, 4)
+		if s.recover || rebuildTimeIndex {
+			_, err = io.CopyN(b, s.log, size)
+			if err == nil && s.recover && !validMessage(b.Bytes()[msgSetHeaderLen:]) {
+				err = ErrCorruptMessage
+			}
+		} else {
+			_, err = s.log.Seek(size, io.SeekCurrent)
+		}
 		if err != nil {
-			return err
+			return s.recoverFrom(err)
 		}
-		size := int64(Encoding.Uint32(b.Bytes()[8:12]))
 
-		_, err = io.CopyN(b, s.log, size)
-		if err != nil {
-			return err
+		if !continued {
+			err = s.Index.WriteEntry(Entry{
+				Offset:   offset,
+				Position: s.Position,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		if rebuildTimeIndex {
+			ts := MessageSet(b.Bytes()).MaxTimestamp()
+			if err := s.indexTimestamp(offset, ts, size+msgSetHeaderLen); err != nil {
+				return err
+			}
 		}
 
 		// Reset the buffer to not get an overflow
 		b.Truncate(0)
 
-		err = s.Index.WriteEntry(Entry{
-			Offset:   s.NextOffset,
-			Position: s.Position,
-		})
+		s.Position += size + msgSetHeaderLen
+		s.NextOffset = offset + 1
+	}
+}
+
+// indexMatchesLog is used to check the index is sane and its last entry is a message set in the log.
+func (s *Segment) indexMatchesLog() bool {
+	if err := s.Index.SanityCheck(); err != nil {
+		return false
+	}
+	entries := s.Index.Entries()
+	if entries == 0 {
+		return true
+	}
+	var e Entry
+	if err := s.Index.ReadEntry(&e, (entries-1)*entryWidth); err != nil {
+		return false
+	}
+	header := make([]byte, msgSetHeaderLen)
+	if _, err := s.log.ReadAt(header, e.Position); err != nil {
+		return false
+	}
+	return int64(Encoding.Uint64(header[offsetPos:offsetPos+8])) == e.Offset
+}
+
+// setupTimeIndex is used to open the segment's time index. It returns whether
+// the time index needs to be rebuilt from the log, because force is true or it
+// can't be loaded, otherwise the segment's max timestamp is loaded from the
+// time index's last entry.
+func (s *Segment) setupTimeIndex(path string, force bool) (rebuild bool, err error) {
+	timeIndexPath := filepath.Join(path, fmt.Sprintf(timeIndexNameFormat, s.BaseOffset))
+	s.TimeIndex, err = newTimeIndex(options{
+		path:       timeIndexPath,
+		baseOffset: s.BaseOffset,
+	})
+	if err != nil {
+		return false, err
+	}
+	var last TimeEntry
+	if !force && !s.recover && s.TimeIndex.SanityCheck() == nil && s.TimeIndex.LastEntry(&last) {
+		s.maxTimestamp = last.Timestamp
+		s.offsetOfMaxTimestamp = last.Offset
+		return false, nil
+	}
+	return true, s.TimeIndex.TruncateEntries(0)
+}
+
+// indexTimestamp is used to record the max timestamp of the message set of the
+// given size appended at the offset, adding an entry to the time index once
+// the index interval's worth of bytes have been appended since the last one.
+func (s *Segment) indexTimestamp(offset, timestamp, size int64) error {
+	s.Lock()
+	defer s.Unlock()
+	if timestamp > s.maxTimestamp {
+		s.maxTimestamp = timestamp
+		s.offsetOfMaxTimestamp = offset
+	}
+	s.bytesSinceTimeIndexEntry += size
+	if s.bytesSinceTimeIndexEntry < s.indexIntervalBytes {
+		return nil
+	}
+	return s.writeTimeIndexEntry()
+}
+
+// writeTimeIndexEntry is used to add the segment's max timestamp to the time
+// index, unless it's already been added. The caller must hold the lock.
+func (s *Segment) writeTimeIndexEntry() error {
+	var last TimeEntry
+	if s.maxTimestamp < 0 || s.TimeIndex.LastEntry(&last) && last.Timestamp >= s.maxTimestamp {
+		return nil
+	}
+	if err := s.TimeIndex.WriteEntry(TimeEntry{
+		Timestamp: s.maxTimestamp,
+		Offset:    s.offsetOfMaxTimestamp,
+	}); err != nil {
+		return err
+	}
+	s.bytesSinceTimeIndexEntry = 0
+	return nil
+}
+
+// MaxTimestamp returns the largest timestamp of the segment's messages, -1 if
+// none of them have timestamps.
+func (s *Segment) MaxTimestamp() int64 {
+	s.Lock()
+	defer s.Unlock()
+	return s.maxTimestamp
+}
+
+// seal is used when the segment stops being the log's active segment. It adds
+// the segment's max timestamp to its time index, so it can be loaded from the
+// index when the log's reopened, and syncs and trims the segment.
+func (s *Segment) seal() error {
+	s.Lock()
+	err := s.writeTimeIndexEntry()
+	if err == nil {
+		err = s.truncatePreallocated()
+	}
+	s.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := s.Sync(); err != nil {
+		return err
+	}
+	return s.TimeIndex.Trim()
+}
+
+// findOffsetByTimestamp is used to find the offset and max timestamp of the
+// first message set whose max timestamp is at or after ts. It returns -1 for
+// both if there isn't one.
+func (s *Segment) findOffsetByTimestamp(ts int64) (int64, int64, error) {
+	var position int64
+	var e TimeEntry
+	if s.TimeIndex.Lookup(&e, ts) {
+		// every message set up to the entry's offset is before ts, so start
+		// scanning the log there.
+		p, err := s.findPosition(e.Offset)
 		if err != nil {
-			return err
+			return -1, -1, err
+		}
+		position = p
+	}
+	header := make([]byte, msgSetHeaderLen)
+	for {
+		if _, err := s.ReadAt(header, position); err == io.EOF {
+			return -1, -1, nil
+		} else if err != nil {
+			return -1, -1, err
 		}
+		size := int64(Encoding.Uint32(header[sizePos : sizePos+4]))
+		ms := make(MessageSet, msgSetHeaderLen+size)
+		if _, err := s.ReadAt(ms, position); err == io.EOF {
+			return -1, -1, nil
+		} else if err != nil {
+			return -1, -1, err
+		}
+		if ms.MaxTimestamp() >= ts {
+			return ms.Offset(), ms.MaxTimestamp(), nil
+		}
+		position += int64(len(ms))
+	}
+}
 
-		s.Position += size + msgSetHeaderLen
-		s.NextOffset++
+// findPosition is used to find the position in the log of the message set
+// appended at the offset.
+func (s *Segment) findPosition(offset int64) (int64, error) {
+	e := &Entry{}
+	n := int(s.Index.Entries())
+	i := sort.Search(n, func(i int) bool {
+		_ = s.Index.ReadEntry(e, int64(i*entryWidth))
+		return e.Offset >= offset
+	})
+	if i == n {
+		return 0, errors.Errorf("offset %d not found in index", offset)
+	}
+	if err := s.Index.ReadEntry(e, int64(i*entryWidth)); err != nil {
+		return 0, err
+	}
+	if e.Offset != offset {
+		return 0, errors.Errorf("offset %d not found in index", offset)
+	}
+	return e.Position, nil
+}
 
-		_, err = s.log.Seek(size, 1)
-		if err != nil {
-			return err
+// recoverFrom is used to handle an error reading the segment's log when
+// setting up its index. When recovering, the log is truncated at the message
+// that failed, dropping it and any messages after it.
+func (s *Segment) recoverFrom(err error) error {
+	if !s.recover || err == io.EOF && s.atEnd() {
+		return err
+	}
+	if terr := s.log.Truncate(s.Position); terr != nil {
+		return errors.Wrap(terr, "log truncate failed")
+	}
+	return io.EOF
+}
+
+// truncatePreallocated is used to truncate a preallocated log to its position, releasing the
+// space reserved past it. The caller must hold the lock.
+func (s *Segment) truncatePreallocated() error {
+	if !s.preallocate {
+		return nil
+	}
+	if err := s.log.Truncate(s.Position); err != nil {
+		return errors.Wrap(err, "log truncate failed")
+	}
+	return nil
+}
+
+// reserve is used to reserve a preallocated log up to its max bytes, so appends don't fragment it.
+// It's called when the segment becomes the log's active segment, including when the log's reopened
+// and the active segment was truncated to its position when it was closed or recovered.
+func (s *Segment) reserve() error {
+	s.Lock()
+	defer s.Unlock()
+	if !s.preallocate || s.Position >= s.maxBytes {
+		return nil
+	}
+	if err := preallocateFile(s.log, s.Position, s.maxBytes); err != nil {
+		return errors.Wrap(err, "preallocate file failed")
+	}
+	return nil
+}
+
+// atEnd returns whether the segment's position is the end of its log.
+func (s *Segment) atEnd() bool {
+	fi, err := s.log.Stat()
+	return err == nil && fi.Size() == s.Position
+}
+
+// validMessage returns whether the CRCs of the entry's messages match their
+// contents. An entry's either a v2 record batch, whose CRC is a CRC-32C of the
+// batch from its attributes on, or one or more v0 or v1 messages, each with
+// its own CRC.
+func validMessage(m []byte) bool {
+	if len(m) < 5 {
+		return false
+	}
+	if m[magicPos] == 2 {
+		return len(m) > batchCRCPos+4 && Encoding.Uint32(m[batchCRCPos:]) == crc32.Checksum(m[batchCRCPos+4:], castagnoli)
+	}
+	for len(m) > 0 {
+		n := messageLen(m)
+		if n < 0 || Encoding.Uint32(m[:4]) != crc32.ChecksumIEEE(m[4:n]) {
+			return false
 		}
+		m = m[n:]
 	}
+	return true
 }
 
 func (s *Segment) IsFull() bool {
@@ -127,15 +414,18 @@ func (s *Segment) IsFull() bool {
 }
 
 // Write writes a byte slice to the log at the current position.
-// It increments the offset as well as sets the position to the new tail.
+// It sets the position to the new tail, the caller's responsible for advancing the offset.
 func (s *Segment) Write(p []byte) (n int, err error) {
 	s.Lock()
 	defer s.Unlock()
-	n, err = s.writer.Write(p)
+	if s.preallocate {
+		n, err = s.log.WriteAt(p, s.Position)
+	} else {
+		n, err = s.writer.Write(p)
+	}
 	if err != nil {
 		return n, errors.Wrap(err, "log write failed")
 	}
-	s.NextOffset++
 	s.Position += int64(n)
 	return n, nil
 }
@@ -146,19 +436,53 @@ func (s *Segment) Read(p []byte) (n int, err error) {
 	return s.reader.Read(p)
 }
 
+// ReadAt reads the log at the offset, up to the segment's position. A preallocated log's bytes
+// past its position haven't been written.
 func (s *Segment) ReadAt(p []byte, off int64) (n int, err error) {
 	s.Lock()
 	defer s.Unlock()
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if off >= s.Position {
+		return 0, io.EOF
+	}
+	if max := s.Position - off; int64(len(p)) > max {
+		n, err = s.log.ReadAt(p[:max], off)
+		if err == nil {
+			err = io.EOF
+		}
+		return n, err
+	}
 	return s.log.ReadAt(p, off)
 }
 
 func (s *Segment) Close() error {
 	s.Lock()
 	defer s.Unlock()
+	if err := s.truncatePreallocated(); err != nil {
+		return err
+	}
 	if err := s.log.Close(); err != nil {
 		return err
 	}
-	return s.Index.Close()
+	if err := s.Index.Close(); err != nil {
+		return err
+	}
+	return s.TimeIndex.Close()
+}
+
+// Sync commits the segment's log and indexes to stable storage.
+func (s *Segment) Sync() error {
+	s.Lock()
+	defer s.Unlock()
+	if err := s.log.Sync(); err != nil {
+		return errors.Wrap(err, "log sync failed")
+	}
+	if err := s.Index.Sync(); err != nil {
+		return err
+	}
+	return s.TimeIndex.Sync()
 }
 
 func (s *Segment) findEntry(offset int64) (e *Entry, err error) {
@@ -187,5 +511,8 @@ func (s *Segment) Delete() error {
 	if err := os.Remove(s.Index.Name()); err != nil {
 		return err
 	}
+	if err := os.Remove(s.TimeIndex.Name()); err != nil {
+		return err
+	}
 	return nil
 }
@@ -0,0 +1,203 @@
+package commitlog
+
+import (
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/tysontate/gommap"
+)
+
+const (
+	timestampWidth = 8
+	relOffsetWidth = 4
+
+	timeEntryWidth = timestampWidth + relOffsetWidth
+)
+
+// timeIndex maps timestamps to the offsets of the message sets containing
+// them, like Kafka's time index. Each entry is a segment's max timestamp so
+// far and the offset of the message set it was appended with, so entries'
+// timestamps and offsets are both increasing.
+type timeIndex struct {
+	options
+	mmap     gommap.MMap
+	file     *os.File
+	mu       sync.RWMutex
+	position int64
+}
+
+// TimeEntry is a timestamp, in milliseconds, and the offset of the message set
+// it's from.
+type TimeEntry struct {
+	Timestamp int64
+	Offset    int64
+}
+
+func newTimeIndex(opts options) (idx *timeIndex, err error) {
+	if opts.bytes == 0 {
+		opts.bytes = 10 * 1024 * 1024
+	}
+	if opts.path == "" {
+		return nil, errors.New("path is empty")
+	}
+	idx = &timeIndex{
+		options: opts,
+	}
+	idx.file, err = os.OpenFile(opts.path, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, errors.Wrap(err, "open file failed")
+	}
+	fi, err := idx.file.Stat()
+	if err != nil {
+		return nil, errors.Wrap(err, "stat file failed")
+	} else if fi.Size() > 0 {
+		idx.position = fi.Size()
+	}
+	if err := idx.file.Truncate(roundDown(opts.bytes, timeEntryWidth)); err != nil {
+		return nil, err
+	}
+
+	idx.mmap, err = gommap.Map(idx.file.Fd(), gommap.PROT_READ|gommap.PROT_WRITE, gommap.MAP_SHARED)
+	if err != nil {
+		return nil, errors.Wrap(err, "mmap file failed")
+	}
+	return idx, nil
+}
+
+// WriteEntry is used to append the entry to the index.
+func (idx *timeIndex) WriteEntry(e TimeEntry) error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if idx.position+timeEntryWidth > int64(len(idx.mmap)) {
+		return errors.New("time index is full")
+	}
+	b := idx.mmap[idx.position : idx.position+timeEntryWidth]
+	Encoding.PutUint64(b[:timestampWidth], uint64(e.Timestamp))
+	Encoding.PutUint32(b[timestampWidth:], uint32(e.Offset-idx.baseOffset))
+	idx.position += timeEntryWidth
+	return nil
+}
+
+// ReadEntry is used to read the n-th entry of the index.
+func (idx *timeIndex) ReadEntry(e *TimeEntry, n int64) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	idx.readEntry(e, n)
+}
+
+func (idx *timeIndex) readEntry(e *TimeEntry, n int64) {
+	b := idx.mmap[n*timeEntryWidth : (n+1)*timeEntryWidth]
+	e.Timestamp = int64(Encoding.Uint64(b[:timestampWidth]))
+	e.Offset = idx.baseOffset + int64(Encoding.Uint32(b[timestampWidth:]))
+}
+
+// Entries returns the number of entries in the index.
+func (idx *timeIndex) Entries() int64 {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	return idx.position / timeEntryWidth
+}
+
+// LastEntry is used to read the index's last entry. It returns false if the
+// index is empty.
+func (idx *timeIndex) LastEntry(e *TimeEntry) bool {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	if idx.position == 0 {
+		return false
+	}
+	idx.readEntry(e, idx.position/timeEntryWidth-1)
+	return true
+}
+
+// Lookup is used to find the last entry whose timestamp is before ts. It
+// returns false if there's no such entry.
+func (idx *timeIndex) Lookup(e *TimeEntry, ts int64) bool {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	n := int(idx.position / timeEntryWidth)
+	i := sort.Search(n, func(i int) bool {
+		idx.readEntry(e, int64(i))
+		return e.Timestamp >= ts
+	}) - 1
+	if i < 0 {
+		return false
+	}
+	idx.readEntry(e, int64(i))
+	return true
+}
+
+// TruncateEntries is used to truncate the index to its first number entries.
+func (idx *timeIndex) TruncateEntries(number int) error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if int64(number*timeEntryWidth) > idx.position {
+		return errors.New("bad truncate number")
+	}
+	idx.position = int64(number * timeEntryWidth)
+	return nil
+}
+
+// SanityCheck is used to check the index's size is a whole number of entries
+// and its entries are in order.
+func (idx *timeIndex) SanityCheck() error {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	if idx.position%timeEntryWidth != 0 || idx.position > int64(len(idx.mmap)) {
+		return ErrIndexCorrupt
+	}
+	var prev, e TimeEntry
+	for i := int64(0); i < idx.position/timeEntryWidth; i++ {
+		idx.readEntry(&e, i)
+		if i > 0 && (e.Timestamp <= prev.Timestamp || e.Offset < prev.Offset) {
+			return ErrIndexCorrupt
+		}
+		prev = e
+	}
+	return nil
+}
+
+// Trim is used to shrink the index's file to its entries once the index won't
+// be written to anymore, so it can be loaded as is when the log's reopened.
+func (idx *timeIndex) Trim() error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if err := idx.mmap.Sync(gommap.MS_SYNC); err != nil {
+		return errors.Wrap(err, "mmap sync failed")
+	}
+	if err := idx.file.Truncate(idx.position); err != nil {
+		return errors.Wrap(err, "file truncate failed")
+	}
+	if err := idx.file.Sync(); err != nil {
+		return errors.Wrap(err, "file sync failed")
+	}
+	return nil
+}
+
+func (idx *timeIndex) Sync() error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if err := idx.file.Sync(); err != nil {
+		return errors.Wrap(err, "file sync failed")
+	}
+	if err := idx.mmap.Sync(gommap.MS_SYNC); err != nil {
+		return errors.Wrap(err, "mmap sync failed")
+	}
+	return nil
+}
+
+func (idx *timeIndex) Close() (err error) {
+	if err = idx.Sync(); err != nil {
+		return
+	}
+	if err = idx.file.Truncate(idx.position); err != nil {
+		return
+	}
+	return idx.file.Close()
+}
+
+func (idx *timeIndex) Name() string {
+	return idx.file.Name()
+}
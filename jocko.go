@@ -3,9 +3,11 @@ package jocko
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"sync"
 
 	"github.com/travisjeffery/jocko/protocol"
 )
@@ -19,6 +21,11 @@ type CommitLog interface {
 	NewestOffset() int64
 	OldestOffset() int64
 	Append([]byte) (int64, error)
+	Sync() error
+	Close() error
+	RecoveryPoint() int64
+	DeleteRecords(int64) error
+	OffsetForTimestamp(int64) (int64, int64, error)
 }
 
 // Client is used to request other brokers.
@@ -36,11 +43,42 @@ type Partition struct {
 	ISR             []int32 `json:"isr"`
 	Leader          int32   `json:"leader"`
 	PreferredLeader int32   `json:"preferred_leader"`
+	// LeaderEpoch is bumped each time the partition's leader changes.
+	LeaderEpoch int32 `json:"leader_epoch"`
+	// PartitionEpoch is bumped each time the partition's leader or ISR changes.
+	PartitionEpoch int32 `json:"partition_epoch"`
+	// Offline is whether the partition has no leader, because none of its ISR is in the cluster to
+	// elect. It's set by the controller when an election fails and cleared when a leader's elected.
+	Offline bool `json:"offline"`
+	// LeaderEpochs is the partition's leader epoch cache, the epochs this broker's led the
+	// partition in and the offsets they started at, oldest first.
+	LeaderEpochs []EpochEntry `json:"-"`
 
 	LeaderAndISRVersionInZK int32     `json:"-"`
 	CommitLog               CommitLog `json:"-"`
 	// Conn is a connection to the broker that is this partition's leader, used for replication.
 	Conn io.ReadWriter `json:"-"`
+
+	// hw is the partition's high watermark if it's been set, e.g. restored
+	// from a checkpoint. Otherwise, and once the partition's appended to, the
+	// high watermark is the log end offset.
+	hw    int64
+	hwSet bool
+	hwMu  sync.RWMutex
+
+	// isrMu guards the ISR when it's read or changed with the partition's ISR methods.
+	isrMu sync.RWMutex
+
+	// appendWaiters are signalled when message sets are appended to the partition, e.g. to wake
+	// fetches waiting for records.
+	appendWaiters   map[chan<- struct{}]struct{}
+	appendWaitersMu sync.Mutex
+}
+
+// EpochEntry is a leader epoch and the offset of the first message appended in it.
+type EpochEntry struct {
+	Epoch       int32
+	StartOffset int64
 }
 
 // NewPartition is used to create a new partition.
@@ -90,16 +128,103 @@ func (r *Partition) IsFollowing(id int32) bool {
 	return false
 }
 
-// HighWatermark is used to get the newest offset of the partition.
+// InISR is used to check if the given broker ID's in the partition's ISR.
+func (p *Partition) InISR(id int32) bool {
+	p.isrMu.RLock()
+	defer p.isrMu.RUnlock()
+	for _, r := range p.ISR {
+		if r == id {
+			return true
+		}
+	}
+	return false
+}
+
+// ISRSnapshot is used to get a copy of the partition's ISR, safe to iterate over while it changes.
+func (p *Partition) ISRSnapshot() []int32 {
+	p.isrMu.RLock()
+	defer p.isrMu.RUnlock()
+	return append([]int32(nil), p.ISR...)
+}
+
+// SetISR is used to set the partition's ISR, e.g. when the controller changes it.
+func (p *Partition) SetISR(isr []int32) {
+	p.isrMu.Lock()
+	defer p.isrMu.Unlock()
+	p.ISR = isr
+}
+
+// AddToISR is used to add the given broker ID to the partition's ISR once it's caught up. The
+// ISR's replaced rather than appended to, since copies of it may be shared.
+func (p *Partition) AddToISR(id int32) {
+	p.isrMu.Lock()
+	defer p.isrMu.Unlock()
+	for _, r := range p.ISR {
+		if r == id {
+			return
+		}
+	}
+	isr := make([]int32, len(p.ISR), len(p.ISR)+1)
+	copy(isr, p.ISR)
+	p.ISR = append(isr, id)
+}
+
+// RemoveFromISR is used to remove the given broker ID from the partition's ISR when it's fallen
+// behind.
+func (p *Partition) RemoveFromISR(id int32) {
+	p.isrMu.Lock()
+	defer p.isrMu.Unlock()
+	isr := make([]int32, 0, len(p.ISR))
+	for _, r := range p.ISR {
+		if r != id {
+			isr = append(isr, r)
+		}
+	}
+	p.ISR = isr
+}
+
+// IsUnderReplicated is used to check if some of the partition's replicas aren't in its ISR.
+func (p *Partition) IsUnderReplicated() bool {
+	p.isrMu.RLock()
+	defer p.isrMu.RUnlock()
+	return len(p.ISR) < len(p.Replicas)
+}
+
+// HighWatermark is used to get the offset up to which the partition's messages
+// are committed. Unless it's been set, it's the partition's newest offset.
 func (p *Partition) HighWatermark() int64 {
+	p.hwMu.RLock()
+	defer p.hwMu.RUnlock()
+	if p.hwSet {
+		return p.hw
+	}
 	return p.CommitLog.NewestOffset()
 }
 
+// SetHighWatermark is used to set the partition's high watermark, e.g. when
+// it's restored from a checkpoint, clamped to the partition's newest offset.
+// Appending to the partition advances the high watermark to its newest offset.
+func (p *Partition) SetHighWatermark(hw int64) {
+	p.hwMu.Lock()
+	defer p.hwMu.Unlock()
+	if leo := p.CommitLog.NewestOffset(); hw > leo {
+		hw = leo
+	}
+	p.hw = hw
+	p.hwSet = true
+}
+
 // LowWatermark is used to oldest offset of the partition.
 func (p *Partition) LowWatermark() int64 {
 	return p.CommitLog.OldestOffset()
 }
 
+// DeleteRecords is used to advance the partition's log start offset to the given offset, so
+// records before it can't be fetched anymore.
+func (p *Partition) DeleteRecords(offset int64) error {
+	return p.CommitLog.DeleteRecords(offset)
+}
+
 // Truncate is used to truncate the partition's logs before the given offset.
 func (p *Partition) Truncate(offset int64) error {
 	return p.CommitLog.Truncate(offset)
@@ -117,7 +242,118 @@ func (p *Partition) Read(b []byte) (int, error) {
 
 // Append is used to append message sets to the partition.
 func (p *Partition) Append(ms []byte) (int64, error) {
-	return p.CommitLog.Append(ms)
+	offset, err := p.CommitLog.Append(ms)
+	if err == nil {
+		p.hwMu.Lock()
+		p.hwSet = false
+		p.hwMu.Unlock()
+		p.notifyAppend()
+	}
+	return offset, err
+}
+
+// NotifyAppend is used to have c signalled, without blocking, each time message sets are appended
+// to the partition until StopNotifyAppend is called with it.
+func (p *Partition) NotifyAppend(c chan<- struct{}) {
+	p.appendWaitersMu.Lock()
+	defer p.appendWaitersMu.Unlock()
+	if p.appendWaiters == nil {
+		p.appendWaiters = make(map[chan<- struct{}]struct{})
+	}
+	p.appendWaiters[c] = struct{}{}
+}
+
+// StopNotifyAppend is used to stop signalling c when message sets are appended to the partition.
+func (p *Partition) StopNotifyAppend(c chan<- struct{}) {
+	p.appendWaitersMu.Lock()
+	defer p.appendWaitersMu.Unlock()
+	delete(p.appendWaiters, c)
+}
+
+// notifyAppend is used to signal the partition's append waiters.
+func (p *Partition) notifyAppend() {
+	p.appendWaitersMu.Lock()
+	defer p.appendWaitersMu.Unlock()
+	for c := range p.appendWaiters {
+		select {
+		case c <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// AppendAsLeader is used by the partition's leader to append message sets to the partition. While
+// the leader's the only replica in the ISR the high watermark follows the log end offset, otherwise
+// it stays where it is until the followers have fetched the messages.
+func (p *Partition) AppendAsLeader(ms []byte) (int64, error) {
+	p.isrMu.RLock()
+	followers := len(p.ISR) > 1
+	p.isrMu.RUnlock()
+	if !followers {
+		return p.Append(ms)
+	}
+	p.hwMu.Lock()
+	if !p.hwSet {
+		p.hw = p.CommitLog.NewestOffset()
+		p.hwSet = true
+	}
+	offset, err := p.CommitLog.Append(ms)
+	p.hwMu.Unlock()
+	if err == nil {
+		p.notifyAppend()
+	}
+	return offset, err
+}
+
+// AdvanceHighWatermark is used to move the partition's high watermark forward to hw, clamped to
+// the partition's newest offset. It returns false, leaving the high watermark as it is, if hw
+// isn't past it.
+func (p *Partition) AdvanceHighWatermark(hw int64) bool {
+	p.hwMu.Lock()
+	defer p.hwMu.Unlock()
+	leo := p.CommitLog.NewestOffset()
+	if hw > leo {
+		hw = leo
+	}
+	current := leo
+	if p.hwSet {
+		current = p.hw
+	}
+	if hw <= current {
+		return false
+	}
+	p.hw = hw
+	p.hwSet = true
+	return true
+}
+
+// AssignLeaderEpoch is used to record in the leader epoch cache that the partition's leader
+// started appending at offset in the given epoch. Epochs that aren't newer than the cache's
+// latest are ignored.
+func (p *Partition) AssignLeaderEpoch(epoch int32, offset int64) {
+	if n := len(p.LeaderEpochs); n > 0 && p.LeaderEpochs[n-1].Epoch >= epoch {
+		return
+	}
+	p.LeaderEpochs = append(p.LeaderEpochs, EpochEntry{Epoch: epoch, StartOffset: offset})
+}
+
+// EpochForOffset returns the leader epoch the message at offset was appended in, from the leader
+// epoch cache. It returns -1 if the cache doesn't have an epoch that started at or before offset.
+func (p *Partition) EpochForOffset(offset int64) int32 {
+	epoch := int32(-1)
+	for _, e := range p.LeaderEpochs {
+		if e.StartOffset > offset {
+			break
+		}
+		epoch = e.Epoch
+	}
+	return epoch
+}
+
+// OffsetForTimestamp returns the offset and max timestamp, in milliseconds, of the first message
+// set whose max timestamp is at or after ts. It returns -1 for both if there isn't one.
+func (p *Partition) OffsetForTimestamp(ts int64) (int64, int64, error) {
+	return p.CommitLog.OffsetForTimestamp(ts)
 }
 
 // LeaderID is used to get the partition's leader broker ID.
@@ -156,6 +392,12 @@ type RaftCommand struct {
 	Data *json.RawMessage `json:"data"`
 }
 
+// ErrNotCommitted is returned by Raft's Apply when the command was rejected before it was added to
+// the log, e.g. because the node isn't the leader, so it's sure not to commit and can be applied
+// again. Errors after the command was added, e.g. because the node lost its leadership, don't
+// guarantee that and aren't ErrNotCommitted.
+var ErrNotCommitted = errors.New("raft command not committed")
+
 // Raft is the interface that wraps Raft's methods and is used to
 // manage consensus for the Jocko cluster.
 type Raft interface {
@@ -171,11 +413,27 @@ type Request struct {
 	Conn    io.ReadWriter
 	Header  *protocol.RequestHeader
 	Request interface{}
+	// Principal is the connection's authenticated principal, e.g. "User:alice",
+	// or AnonymousPrincipal if the connection isn't authenticated.
+	Principal string
+	// Listener is the name of the listener the request arrived on, e.g. "SSL",
+	// or empty if it arrived on the server's default listener.
+	Listener string
+	// Response is the channel to send the request's response on. If nil, the
+	// response is sent on the broker's shared response channel.
+	Response chan<- Response
+	// Context is done when the request's connection is closed, so requests
+	// waiting to respond, e.g. fetches waiting for records, stop. If nil, the
+	// request's only stopped when the broker is.
+	Context context.Context
 }
 
 type Response struct {
-	Conn     io.ReadWriter
-	Header   *protocol.RequestHeader
+	Conn   io.ReadWriter
+	Header *protocol.RequestHeader
+	// Response is the response to write to the conn. It's nil if the client
+	// doesn't expect a response, e.g. to produce requests with acks=0, and
+	// nothing's written.
 	Response interface{}
 }
 
@@ -186,6 +444,51 @@ type Broker interface {
 	Shutdown() error
 }
 
+// Operation is an operation a principal can be authorized to do, using Kafka's ACL operation codes.
+type Operation int8
+
+const (
+	OpAll             Operation = 2
+	OpRead            Operation = 3
+	OpWrite           Operation = 4
+	OpCreate          Operation = 5
+	OpDelete          Operation = 6
+	OpAlter           Operation = 7
+	OpDescribe        Operation = 8
+	OpClusterAction   Operation = 9
+	OpDescribeConfigs Operation = 10
+	OpAlterConfigs    Operation = 11
+)
+
+// ResourceType is the type of a resource, using Kafka's resource type codes.
+type ResourceType int8
+
+const (
+	ResourceTopic   ResourceType = 2
+	ResourceGroup   ResourceType = 3
+	ResourceCluster ResourceType = 4
+)
+
+// ClusterResourceName is the name of the cluster resource.
+const ClusterResourceName = "kafka-cluster"
+
+// Resource is a resource operations are authorized on, e.g. a topic.
+type Resource struct {
+	Type ResourceType
+	Name string
+}
+
+// Authorizer is the interface that wraps the Authorize method and is used
+// to authorize principals' requests.
+type Authorizer interface {
+	// Authorize returns whether the principal, e.g. "User:alice", is allowed
+	// to do the operation on the resource.
+	Authorize(principal string, operation Operation, resource Resource) bool
+}
+
+// AnonymousPrincipal is the principal of unauthenticated clients.
+const AnonymousPrincipal = "User:ANONYMOUS"
+
 // ClusterMember is used as a wrapper around a broker's info and a
 // connection to it.
 type ClusterMember struct {
@@ -196,15 +499,60 @@ type ClusterMember struct {
 	SerfPort int          `json:"-"`
 	RaftPort int          `json:"-"`
 	Status   MemberStatus `json:"-"`
+	// Incarnation identifies the member's process, so a broker that's
+	// restarted can be told apart from the broker before it restarted.
+	Incarnation int64 `json:"-"`
+	// AdvertisedHost and AdvertisedPort are the address clients should
+	// connect to the member at, e.g. when it's behind NAT. If unset, clients
+	// connect to the address the member's listening at.
+	AdvertisedHost string `json:"-"`
+	AdvertisedPort int    `json:"-"`
+	// Listeners are the endpoints clients connecting on the member's other
+	// listeners, e.g. "SSL", should connect to the member at, by listener name.
+	Listeners map[string]Endpoint `json:"-"`
 
 	conn net.Conn
 }
 
+// Endpoint is a host and port clients connect to a member at.
+type Endpoint struct {
+	Host string
+	Port int
+}
+
 // Addr is used to get the address of the member.
 func (b *ClusterMember) Addr() *net.TCPAddr {
 	return &net.TCPAddr{IP: net.ParseIP(b.IP), Port: b.Port}
 }
 
+// AdvertisedAddr is used to get the host and port clients should connect to
+// the member at, defaulting to the address the member's listening at.
+func (b *ClusterMember) AdvertisedAddr() (host string, port int) {
+	host, port = b.AdvertisedHost, b.AdvertisedPort
+	if host == "" {
+		host = b.IP
+	}
+	if port == 0 {
+		port = b.Port
+	}
+	return host, port
+}
+
+// ListenerAddr is used to get the host and port clients connecting on the
+// named listener should connect to the member at. If the member doesn't
+// advertise an endpoint for the listener, it's the member's advertised addr.
+func (b *ClusterMember) ListenerAddr(listener string) (host string, port int) {
+	if e, ok := b.Listeners[listener]; ok && listener != "" {
+		return e.Host, e.Port
+	}
+	return b.AdvertisedAddr()
+}
+
+// RaftAddr is used to get the address of the member's raft instance.
+func (b *ClusterMember) RaftAddr() string {
+	return (&net.TCPAddr{IP: net.ParseIP(b.IP), Port: b.RaftPort}).String()
+}
+
 // Write is used to write the member.
 func (b *ClusterMember) Write(p []byte) (int, error) {
 	if b.conn == nil {
@@ -0,0 +1,101 @@
+package jocko
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPartition_InISR(t *testing.T) {
+	p := &Partition{Replicas: []int32{1, 2, 3}, ISR: []int32{1, 2}}
+	for id, want := range map[int32]bool{1: true, 2: true, 3: false, 4: false} {
+		if got := p.InISR(id); got != want {
+			t.Errorf("InISR(%d) = %v, want %v", id, got, want)
+		}
+	}
+}
+
+func TestPartition_AddToISR(t *testing.T) {
+	isr := []int32{1, 2}
+	p := &Partition{Replicas: []int32{1, 2, 3}, ISR: isr[:1]}
+	p.AddToISR(3)
+	if want := []int32{1, 3}; !reflect.DeepEqual(p.ISR, want) {
+		t.Errorf("ISR = %v, want %v", p.ISR, want)
+	}
+	if isr[1] != 2 {
+		t.Errorf("AddToISR() changed a copy of the ISR, want it replaced")
+	}
+	// adding a broker that's in the ISR leaves it as it is.
+	p.AddToISR(1)
+	if want := []int32{1, 3}; !reflect.DeepEqual(p.ISR, want) {
+		t.Errorf("ISR = %v, want %v", p.ISR, want)
+	}
+}
+
+func TestPartition_RemoveFromISR(t *testing.T) {
+	isr := []int32{1, 2, 3}
+	p := &Partition{Replicas: []int32{1, 2, 3}, ISR: isr}
+	p.RemoveFromISR(2)
+	if want := []int32{1, 3}; !reflect.DeepEqual(p.ISR, want) {
+		t.Errorf("ISR = %v, want %v", p.ISR, want)
+	}
+	if want := []int32{1, 2, 3}; !reflect.DeepEqual(isr, want) {
+		t.Errorf("RemoveFromISR() changed a copy of the ISR to %v, want it replaced", isr)
+	}
+	// removing a broker that isn't in the ISR leaves it as it is.
+	p.RemoveFromISR(4)
+	if want := []int32{1, 3}; !reflect.DeepEqual(p.ISR, want) {
+		t.Errorf("ISR = %v, want %v", p.ISR, want)
+	}
+}
+
+func TestPartition_ISRSnapshot(t *testing.T) {
+	p := &Partition{Replicas: []int32{1, 2}, ISR: []int32{1, 2}}
+	isr := p.ISRSnapshot()
+	if want := []int32{1, 2}; !reflect.DeepEqual(isr, want) {
+		t.Errorf("ISRSnapshot() = %v, want %v", isr, want)
+	}
+	isr[0] = 3
+	if want := []int32{1, 2}; !reflect.DeepEqual(p.ISR, want) {
+		t.Errorf("ISR = %v, want %v, the snapshot should be a copy", p.ISR, want)
+	}
+}
+
+func TestPartition_SetISR(t *testing.T) {
+	p := &Partition{Replicas: []int32{1, 2}, ISR: []int32{1}}
+	p.SetISR([]int32{1, 2})
+	if want := []int32{1, 2}; !reflect.DeepEqual(p.ISR, want) {
+		t.Errorf("ISR = %v, want %v", p.ISR, want)
+	}
+}
+
+func TestPartition_IsUnderReplicated(t *testing.T) {
+	tests := []struct {
+		name     string
+		replicas []int32
+		isr      []int32
+		want     bool
+	}{
+		{name: "all replicas in sync", replicas: []int32{1, 2, 3}, isr: []int32{1, 2, 3}},
+		{name: "replica out of sync", replicas: []int32{1, 2, 3}, isr: []int32{1, 3}, want: true},
+		{name: "only the leader in sync", replicas: []int32{1, 2}, isr: []int32{1}, want: true},
+		{name: "single replica", replicas: []int32{1}, isr: []int32{1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &Partition{Replicas: tt.replicas, ISR: tt.isr}
+			if got := p.IsUnderReplicated(); got != tt.want {
+				t.Errorf("IsUnderReplicated() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+	// the ISR shrinking and growing back.
+	p := &Partition{Replicas: []int32{1, 2}, ISR: []int32{1, 2}}
+	p.RemoveFromISR(2)
+	if !p.IsUnderReplicated() {
+		t.Errorf("IsUnderReplicated() = false after removing a replica from the ISR, want true")
+	}
+	p.AddToISR(2)
+	if p.IsUnderReplicated() {
+		t.Errorf("IsUnderReplicated() = true after the replica rejoined the ISR, want false")
+	}
+}
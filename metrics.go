@@ -0,0 +1,16 @@
+package jocko
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// RegisterCollector is used to register the collector with r. If an equal
+// collector has been registered already, e.g. by another broker or server in
+// the same process, the existing collector is returned and used instead.
+func RegisterCollector(r prometheus.Registerer, c prometheus.Collector) prometheus.Collector {
+	if err := r.Register(c); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			return are.ExistingCollector
+		}
+		panic(err)
+	}
+	return c
+}
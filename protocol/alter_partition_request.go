@@ -0,0 +1,137 @@
+package protocol
+
+// AlterPartitionRequest is sent by partitions' leaders to the controller to
+// change their ISRs. It was called AlterIsr before Kafka 3.2. Every version
+// is flexible.
+type AlterPartitionRequest struct {
+	APIVersion int16
+
+	BrokerID    int32
+	BrokerEpoch int64
+	Topics      []*AlterPartitionTopic
+}
+
+type AlterPartitionTopic struct {
+	Topic      string
+	Partitions []*AlterPartitionPartition
+}
+
+type AlterPartitionPartition struct {
+	Partition   int32
+	LeaderEpoch int32
+	NewISR      []int32
+	// PartitionEpoch is the epoch of the partition state the leader's
+	// proposing a change to.
+	PartitionEpoch int32
+}
+
+func (r *AlterPartitionRequest) Encode(e PacketEncoder) (err error) {
+	e.PutInt32(r.BrokerID)
+	e.PutInt64(r.BrokerEpoch)
+	if err = e.PutCompactArrayLength(len(r.Topics)); err != nil {
+		return err
+	}
+	for _, t := range r.Topics {
+		if err = e.PutCompactString(t.Topic); err != nil {
+			return err
+		}
+		if err = e.PutCompactArrayLength(len(t.Partitions)); err != nil {
+			return err
+		}
+		for _, p := range t.Partitions {
+			e.PutInt32(p.Partition)
+			e.PutInt32(p.LeaderEpoch)
+			if err = putCompactInt32Array(e, p.NewISR); err != nil {
+				return err
+			}
+			e.PutInt32(p.PartitionEpoch)
+			e.PutEmptyTaggedFields()
+		}
+		e.PutEmptyTaggedFields()
+	}
+	e.PutEmptyTaggedFields()
+	return nil
+}
+
+func (r *AlterPartitionRequest) Decode(d PacketDecoder) (err error) {
+	if r.BrokerID, err = d.Int32(); err != nil {
+		return err
+	}
+	if r.BrokerEpoch, err = d.Int64(); err != nil {
+		return err
+	}
+	n, err := d.CompactArrayLength()
+	if err != nil {
+		return err
+	}
+	r.Topics = make([]*AlterPartitionTopic, n)
+	for i := range r.Topics {
+		t := new(AlterPartitionTopic)
+		if t.Topic, err = d.CompactString(); err != nil {
+			return err
+		}
+		pn, err := d.CompactArrayLength()
+		if err != nil {
+			return err
+		}
+		t.Partitions = make([]*AlterPartitionPartition, pn)
+		for j := range t.Partitions {
+			p := new(AlterPartitionPartition)
+			if p.Partition, err = d.Int32(); err != nil {
+				return err
+			}
+			if p.LeaderEpoch, err = d.Int32(); err != nil {
+				return err
+			}
+			if p.NewISR, err = compactInt32Array(d); err != nil {
+				return err
+			}
+			if p.PartitionEpoch, err = d.Int32(); err != nil {
+				return err
+			}
+			if err = d.TaggedFields(); err != nil {
+				return err
+			}
+			t.Partitions[j] = p
+		}
+		if err = d.TaggedFields(); err != nil {
+			return err
+		}
+		r.Topics[i] = t
+	}
+	return d.TaggedFields()
+}
+
+func (r *AlterPartitionRequest) Key() int16 {
+	return AlterPartitionKey
+}
+
+func (r *AlterPartitionRequest) Version() int16 {
+	return r.APIVersion
+}
+
+// putCompactInt32Array puts the array's compact length followed by its elements.
+func putCompactInt32Array(e PacketEncoder, in []int32) error {
+	if err := e.PutCompactArrayLength(len(in)); err != nil {
+		return err
+	}
+	for _, v := range in {
+		e.PutInt32(v)
+	}
+	return nil
+}
+
+// compactInt32Array decodes an array of int32s with a compact length.
+func compactInt32Array(d PacketDecoder) ([]int32, error) {
+	n, err := d.CompactArrayLength()
+	if err != nil {
+		return nil, err
+	}
+	a := make([]int32, n)
+	for i := range a {
+		if a[i], err = d.Int32(); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
@@ -0,0 +1,110 @@
+package protocol
+
+type AlterPartitionResponse struct {
+	APIVersion int16
+
+	ThrottleTimeMs int32
+	ErrorCode      int16
+	Topics         []*AlterPartitionTopicResponse
+}
+
+type AlterPartitionTopicResponse struct {
+	Topic      string
+	Partitions []*AlterPartitionPartitionResponse
+}
+
+// AlterPartitionPartitionResponse is the partition's state after the change,
+// or its error code if the change was rejected.
+type AlterPartitionPartitionResponse struct {
+	Partition      int32
+	ErrorCode      int16
+	LeaderID       int32
+	LeaderEpoch    int32
+	ISR            []int32
+	PartitionEpoch int32
+}
+
+func (r *AlterPartitionResponse) Encode(e PacketEncoder) (err error) {
+	e.PutInt32(r.ThrottleTimeMs)
+	e.PutInt16(r.ErrorCode)
+	if err = e.PutCompactArrayLength(len(r.Topics)); err != nil {
+		return err
+	}
+	for _, t := range r.Topics {
+		if err = e.PutCompactString(t.Topic); err != nil {
+			return err
+		}
+		if err = e.PutCompactArrayLength(len(t.Partitions)); err != nil {
+			return err
+		}
+		for _, p := range t.Partitions {
+			e.PutInt32(p.Partition)
+			e.PutInt16(p.ErrorCode)
+			e.PutInt32(p.LeaderID)
+			e.PutInt32(p.LeaderEpoch)
+			if err = putCompactInt32Array(e, p.ISR); err != nil {
+				return err
+			}
+			e.PutInt32(p.PartitionEpoch)
+			e.PutEmptyTaggedFields()
+		}
+		e.PutEmptyTaggedFields()
+	}
+	e.PutEmptyTaggedFields()
+	return nil
+}
+
+func (r *AlterPartitionResponse) Decode(d PacketDecoder) (err error) {
+	if r.ThrottleTimeMs, err = d.Int32(); err != nil {
+		return err
+	}
+	if r.ErrorCode, err = d.Int16(); err != nil {
+		return err
+	}
+	n, err := d.CompactArrayLength()
+	if err != nil {
+		return err
+	}
+	r.Topics = make([]*AlterPartitionTopicResponse, n)
+	for i := range r.Topics {
+		t := new(AlterPartitionTopicResponse)
+		if t.Topic, err = d.CompactString(); err != nil {
+			return err
+		}
+		pn, err := d.CompactArrayLength()
+		if err != nil {
+			return err
+		}
+		t.Partitions = make([]*AlterPartitionPartitionResponse, pn)
+		for j := range t.Partitions {
+			p := new(AlterPartitionPartitionResponse)
+			if p.Partition, err = d.Int32(); err != nil {
+				return err
+			}
+			if p.ErrorCode, err = d.Int16(); err != nil {
+				return err
+			}
+			if p.LeaderID, err = d.Int32(); err != nil {
+				return err
+			}
+			if p.LeaderEpoch, err = d.Int32(); err != nil {
+				return err
+			}
+			if p.ISR, err = compactInt32Array(d); err != nil {
+				return err
+			}
+			if p.PartitionEpoch, err = d.Int32(); err != nil {
+				return err
+			}
+			if err = d.TaggedFields(); err != nil {
+				return err
+			}
+			t.Partitions[j] = p
+		}
+		if err = d.TaggedFields(); err != nil {
+			return err
+		}
+		r.Topics[i] = t
+	}
+	return d.TaggedFields()
+}
@@ -23,4 +23,46 @@ const (
 	APIVersionsKey        = 18
 	CreateTopicsKey       = 19
 	DeleteTopicsKey       = 20
+	DeleteRecordsKey      = 21
+
+	DescribeConfigsKey         = 32
+	IncrementalAlterConfigsKey = 44
+	AlterPartitionKey          = 56
 )
+
+// flexibleVersions maps API keys to the first version of the API using the
+// flexible encoding, i.e. compact strings and arrays, and tagged fields. APIs
+// without an entry never use it.
+var flexibleVersions = map[int16]int16{
+	ProduceKey:            9,
+	FetchKey:              12,
+	OffsetsKey:            6,
+	MetadataKey:           9,
+	LeaderAndISRKey:       4,
+	StopReplicaKey:        2,
+	UpdateMetadataKey:     6,
+	ControlledShutdownKey: 3,
+	OffsetCommitKey:       8,
+	OffsetFetchKey:        6,
+	GroupCoordinatorKey:   3,
+	JoinGroupKey:          6,
+	HeartbeatKey:          4,
+	LeaveGroupKey:         4,
+	SyncGroupKey:          4,
+	DescribeGroupsKey:     5,
+	ListGroupsKey:         3,
+	APIVersionsKey:        3,
+	CreateTopicsKey:       5,
+	DeleteTopicsKey:       4,
+	DeleteRecordsKey:      2,
+
+	DescribeConfigsKey:         4,
+	IncrementalAlterConfigsKey: 1,
+	AlterPartitionKey:          0,
+}
+
+// IsFlexible returns whether the given version of the API uses the flexible encoding.
+func IsFlexible(key, version int16) bool {
+	v, ok := flexibleVersions[key]
+	return ok && version >= v
+}
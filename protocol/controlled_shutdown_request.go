@@ -0,0 +1,37 @@
+package protocol
+
+// ControlledShutdownRequest is sent by a broker to the controller before it
+// shuts down, to have the controller move the leadership of the partitions it
+// leads to other brokers.
+type ControlledShutdownRequest struct {
+	APIVersion int16
+
+	BrokerID    int32
+	BrokerEpoch int64 // v2+
+}
+
+func (r *ControlledShutdownRequest) Encode(e PacketEncoder) error {
+	e.PutInt32(r.BrokerID)
+	if r.APIVersion >= 2 {
+		e.PutInt64(r.BrokerEpoch)
+	}
+	return nil
+}
+
+func (r *ControlledShutdownRequest) Decode(d PacketDecoder) (err error) {
+	if r.BrokerID, err = d.Int32(); err != nil {
+		return err
+	}
+	if r.APIVersion >= 2 {
+		r.BrokerEpoch, err = d.Int64()
+	}
+	return err
+}
+
+func (r *ControlledShutdownRequest) Key() int16 {
+	return ControlledShutdownKey
+}
+
+func (r *ControlledShutdownRequest) Version() int16 {
+	return r.APIVersion
+}
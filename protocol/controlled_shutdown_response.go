@@ -0,0 +1,51 @@
+package protocol
+
+// ControlledShutdownResponse has the partitions the controller couldn't move
+// the leadership of, which are still led by the broker shutting down.
+type ControlledShutdownResponse struct {
+	APIVersion int16
+
+	ErrorCode           int16
+	RemainingPartitions []*ControlledShutdownPartition
+}
+
+type ControlledShutdownPartition struct {
+	Topic     string
+	Partition int32
+}
+
+func (r *ControlledShutdownResponse) Encode(e PacketEncoder) (err error) {
+	e.PutInt16(r.ErrorCode)
+	if err = e.PutArrayLength(len(r.RemainingPartitions)); err != nil {
+		return err
+	}
+	for _, p := range r.RemainingPartitions {
+		if err = e.PutString(p.Topic); err != nil {
+			return err
+		}
+		e.PutInt32(p.Partition)
+	}
+	return nil
+}
+
+func (r *ControlledShutdownResponse) Decode(d PacketDecoder) (err error) {
+	if r.ErrorCode, err = d.Int16(); err != nil {
+		return err
+	}
+	n, err := d.ArrayLength()
+	if err != nil {
+		return err
+	}
+	r.RemainingPartitions = make([]*ControlledShutdownPartition, n)
+	for i := range r.RemainingPartitions {
+		p := new(ControlledShutdownPartition)
+		if p.Topic, err = d.String(); err != nil {
+			return err
+		}
+		if p.Partition, err = d.Int32(); err != nil {
+			return err
+		}
+		r.RemainingPartitions[i] = p
+	}
+	return nil
+}
@@ -8,37 +8,64 @@ type CreateTopicRequest struct {
 	Configs           map[string]string
 }
 
+// CreateTopicRequests is used to create topics. v5+ are flexible.
 type CreateTopicRequests struct {
-	Requests []*CreateTopicRequest
-	Timeout  int32
+	APIVersion int16
+
+	Requests     []*CreateTopicRequest
+	Timeout      int32
+	ValidateOnly bool // v1+
 }
 
-func (c *CreateTopicRequests) Encode(e PacketEncoder) error {
-	e.PutArrayLength(len(c.Requests))
+func (c *CreateTopicRequests) Encode(e PacketEncoder) (err error) {
+	flexible := IsFlexible(CreateTopicsKey, c.APIVersion)
+	if err = putArrayLength(e, len(c.Requests), flexible); err != nil {
+		return err
+	}
 	for _, r := range c.Requests {
-		e.PutString(r.Topic)
+		if err = putString(e, r.Topic, flexible); err != nil {
+			return err
+		}
 		e.PutInt32(r.NumPartitions)
 		e.PutInt16(r.ReplicationFactor)
-		e.PutArrayLength(len(r.ReplicaAssignment))
+		if err = putArrayLength(e, len(r.ReplicaAssignment), flexible); err != nil {
+			return err
+		}
 		for pid, ass := range r.ReplicaAssignment {
 			e.PutInt32(pid)
+			if err = putArrayLength(e, len(ass), flexible); err != nil {
+				return err
+			}
 			for _, a := range ass {
 				e.PutInt32(a)
 			}
+			putTaggedFields(e, flexible)
+		}
+		if err = putArrayLength(e, len(r.Configs), flexible); err != nil {
+			return err
 		}
-		e.PutArrayLength(len(r.Configs))
 		for k, v := range r.Configs {
-			e.PutString(k)
-			e.PutString(v)
+			if err = putString(e, k, flexible); err != nil {
+				return err
+			}
+			if err = putNullableFlexibleString(e, v, flexible); err != nil {
+				return err
+			}
+			putTaggedFields(e, flexible)
 		}
+		putTaggedFields(e, flexible)
 	}
 	e.PutInt32(c.Timeout)
+	if c.APIVersion >= 1 {
+		e.PutBool(c.ValidateOnly)
+	}
+	putTaggedFields(e, flexible)
 	return nil
 }
 
-func (c *CreateTopicRequests) Decode(d PacketDecoder) error {
-	var err error
-	requestCount, err := d.ArrayLength()
+func (c *CreateTopicRequests) Decode(d PacketDecoder) (err error) {
+	flexible := IsFlexible(CreateTopicsKey, c.APIVersion)
+	requestCount, err := arrayLength(d, flexible)
 	if err != nil {
 		return err
 	}
@@ -47,7 +74,7 @@ func (c *CreateTopicRequests) Decode(d PacketDecoder) error {
 		req := new(CreateTopicRequest)
 		c.Requests[i] = req
 
-		req.Topic, err = d.String()
+		req.Topic, err = decodeString(d, flexible)
 		if err != nil {
 			return err
 		}
@@ -59,14 +86,17 @@ func (c *CreateTopicRequests) Decode(d PacketDecoder) error {
 		if err != nil {
 			return err
 		}
-		assignmentCount, err := d.ArrayLength()
+		assignmentCount, err := arrayLength(d, flexible)
+		if err != nil {
+			return err
+		}
 		ra := make(map[int32][]int32, assignmentCount)
 		for i := 0; i < assignmentCount; i++ {
 			pid, err := d.Int32()
 			if err != nil {
 				return err
 			}
-			replicaCount, err := d.ArrayLength()
+			replicaCount, err := arrayLength(d, flexible)
 			if err != nil {
 				return err
 			}
@@ -77,31 +107,47 @@ func (c *CreateTopicRequests) Decode(d PacketDecoder) error {
 					return err
 				}
 			}
+			if err = taggedFields(d, flexible); err != nil {
+				return err
+			}
 			ra[pid] = reps
 		}
 		req.ReplicaAssignment = ra
 
-		configCount, err := d.ArrayLength()
+		configCount, err := arrayLength(d, flexible)
 		if err != nil {
 			return err
 		}
 		c := make(map[string]string, configCount)
 		for j := 0; j < configCount; j++ {
-			k, err := d.String()
+			k, err := decodeString(d, flexible)
 			if err != nil {
 				return err
 			}
-			v, err := d.String()
+			v, err := decodeString(d, flexible)
 			if err != nil {
 				return err
 			}
+			if err = taggedFields(d, flexible); err != nil {
+				return err
+			}
 			c[k] = v
 		}
 		req.Configs = c
+		if err = taggedFields(d, flexible); err != nil {
+			return err
+		}
 	}
 	c.Timeout, err = d.Int32()
-
-	return err
+	if err != nil {
+		return err
+	}
+	if c.APIVersion >= 1 {
+		if c.ValidateOnly, err = d.Bool(); err != nil {
+			return err
+		}
+	}
+	return taggedFields(d, flexible)
 }
 
 func (c *CreateTopicRequests) Key() int16 {
@@ -109,5 +155,5 @@ func (c *CreateTopicRequests) Key() int16 {
 }
 
 func (c *CreateTopicRequests) Version() int16 {
-	return 0
+	return c.APIVersion
 }
@@ -1,42 +1,124 @@
 package protocol
 
 type TopicErrorCode struct {
-	Topic     string
-	ErrorCode int16
+	Topic        string
+	ErrorCode    int16
+	ErrorMessage string // create topics v1+, delete topics v5+
+	// NumPartitions and ReplicationFactor are the created topic's, create topics v5+.
+	NumPartitions     int32
+	ReplicationFactor int16
 }
 
+// CreateTopicsResponse is the response to CreateTopicRequests. v5+ are
+// flexible. The created topics' configs aren't returned, v5+ responses list
+// none.
 type CreateTopicsResponse struct {
+	APIVersion int16
+
+	ThrottleTimeMs  int32 // v2+
 	TopicErrorCodes []*TopicErrorCode
 }
 
-func (c *CreateTopicsResponse) Encode(e PacketEncoder) error {
-	e.PutArrayLength(len(c.TopicErrorCodes))
+func (c *CreateTopicsResponse) Encode(e PacketEncoder) (err error) {
+	flexible := IsFlexible(CreateTopicsKey, c.APIVersion)
+	if c.APIVersion >= 2 {
+		e.PutInt32(c.ThrottleTimeMs)
+	}
+	if err = putArrayLength(e, len(c.TopicErrorCodes), flexible); err != nil {
+		return err
+	}
 	for _, t := range c.TopicErrorCodes {
-		e.PutString(t.Topic)
+		if err = putString(e, t.Topic, flexible); err != nil {
+			return err
+		}
 		e.PutInt16(t.ErrorCode)
+		if c.APIVersion >= 1 {
+			if err = putNullableFlexibleString(e, t.ErrorMessage, flexible); err != nil {
+				return err
+			}
+		}
+		if c.APIVersion >= 5 {
+			e.PutInt32(t.NumPartitions)
+			e.PutInt16(t.ReplicationFactor)
+			if err = e.PutCompactArrayLength(0); err != nil {
+				return err
+			}
+		}
+		putTaggedFields(e, flexible)
 	}
+	putTaggedFields(e, flexible)
 	return nil
 }
 
 func (c *CreateTopicsResponse) Decode(d PacketDecoder) error {
-	l, err := d.ArrayLength()
+	var err error
+	flexible := IsFlexible(CreateTopicsKey, c.APIVersion)
+	if c.APIVersion >= 2 {
+		if c.ThrottleTimeMs, err = d.Int32(); err != nil {
+			return err
+		}
+	}
+	l, err := arrayLength(d, flexible)
 	if err != nil {
 		return err
 	}
 	c.TopicErrorCodes = make([]*TopicErrorCode, l)
 	for i := range c.TopicErrorCodes {
-		topic, err := d.String()
-		if err != nil {
+		t := new(TopicErrorCode)
+		if t.Topic, err = decodeString(d, flexible); err != nil {
+			return err
+		}
+		if t.ErrorCode, err = d.Int16(); err != nil {
 			return err
 		}
-		errorCode, err := d.Int16()
-		if err != nil {
+		if c.APIVersion >= 1 {
+			if t.ErrorMessage, err = decodeString(d, flexible); err != nil {
+				return err
+			}
+		}
+		if c.APIVersion >= 5 {
+			if t.NumPartitions, err = d.Int32(); err != nil {
+				return err
+			}
+			if t.ReplicationFactor, err = d.Int16(); err != nil {
+				return err
+			}
+			if err = skipCreatableTopicConfigs(d); err != nil {
+				return err
+			}
+		}
+		if err = taggedFields(d, flexible); err != nil {
 			return err
 		}
+		c.TopicErrorCodes[i] = t
+	}
+	return taggedFields(d, flexible)
+}
 
-		c.TopicErrorCodes[i] = &TopicErrorCode{
-			Topic:     topic,
-			ErrorCode: errorCode,
+// skipCreatableTopicConfigs skips the created topic's configs, which can be null.
+func skipCreatableTopicConfigs(d PacketDecoder) error {
+	n, err := d.CompactNullableArrayLength()
+	if err != nil {
+		return err
+	}
+	for i := 0; i < n; i++ {
+		if _, err = d.CompactString(); err != nil {
+			return err
+		}
+		if _, err = d.CompactString(); err != nil {
+			return err
+		}
+		if _, err = d.Bool(); err != nil {
+			return err
+		}
+		if _, err = d.Int8(); err != nil {
+			return err
+		}
+		if _, err = d.Bool(); err != nil {
+			return err
+		}
+		if err = d.TaggedFields(); err != nil {
+			return err
 		}
 	}
 	return nil
@@ -1,6 +1,7 @@
 package protocol
 
 import (
+	"encoding/binary"
 	"errors"
 	"math"
 )
@@ -9,6 +10,7 @@ var ErrInsufficientData = errors.New("kafka: insufficient data to decode packet,
 var ErrInvalidStringLength = errors.New("kafka: invalid string length")
 var ErrInvalidArrayLength = errors.New("kafka: invalid array length")
 var ErrInvalidByteSliceLength = errors.New("invalid byteslice length")
+var ErrVarintOverflow = errors.New("kafka: varint overflows a 64-bit integer")
 
 type PacketDecoder interface {
 	Bool() (bool, error)
@@ -18,10 +20,16 @@ type PacketDecoder interface {
 	Int64() (int64, error)
 	ArrayLength() (int, error)
 	Bytes() ([]byte, error)
+	RawBytes(n int) ([]byte, error)
 	String() (string, error)
 	Int32Array() ([]int32, error)
 	Int64Array() ([]int64, error)
 	StringArray() ([]string, error)
+	UVarint() (uint64, error)
+	CompactArrayLength() (int, error)
+	CompactNullableArrayLength() (int, error)
+	CompactString() (string, error)
+	TaggedFields() error
 	Push(pd PushDecoder) error
 	Pop() error
 	remaining() int
@@ -103,9 +111,12 @@ func (d *ByteDecoder) ArrayLength() (int, error) {
 		d.off = len(d.b)
 		return -1, ErrInsufficientData
 	}
-	tmp := int(Encoding.Uint32(d.b[d.off:]))
+	tmp := int(int32(Encoding.Uint32(d.b[d.off:])))
 	d.off += 4
-	if tmp > d.remaining() {
+	if tmp < 0 {
+		// nullable arrays are decoded by their requests, as with MetadataRequest's topics.
+		return -1, ErrInvalidArrayLength
+	} else if tmp > d.remaining() {
 		d.off = len(d.b)
 		return -1, ErrInsufficientData
 	} else if tmp > 2*math.MaxUint16 {
@@ -142,6 +153,19 @@ func (d *ByteDecoder) Bytes() ([]byte, error) {
 	return tmpStr, nil
 }
 
+func (d *ByteDecoder) RawBytes(n int) ([]byte, error) {
+	if n < 0 {
+		return nil, ErrInvalidByteSliceLength
+	}
+	if n > d.remaining() {
+		d.off = len(d.b)
+		return nil, ErrInsufficientData
+	}
+	tmp := d.b[d.off : d.off+n]
+	d.off += n
+	return tmp, nil
+}
+
 func (d *ByteDecoder) String() (string, error) {
 	tmp, err := d.Int16()
 
@@ -173,9 +197,13 @@ func (d *ByteDecoder) Int32Array() ([]int32, error) {
 		d.off = len(d.b)
 		return nil, ErrInsufficientData
 	}
-	n := int(Encoding.Uint32(d.b[d.off:]))
+	n := int(int32(Encoding.Uint32(d.b[d.off:])))
 	d.off += 4
 
+	if n < 0 {
+		return nil, ErrInvalidArrayLength
+	}
+
 	if d.remaining() < 4*n {
 		d.off = len(d.b)
 		return nil, ErrInsufficientData
@@ -185,10 +213,6 @@ func (d *ByteDecoder) Int32Array() ([]int32, error) {
 		return nil, nil
 	}
 
-	if n < 0 {
-		return nil, ErrInvalidArrayLength
-	}
-
 	ret := make([]int32, n)
 	for i := range ret {
 		ret[i] = int32(Encoding.Uint32(d.b[d.off:]))
@@ -202,9 +226,13 @@ func (d *ByteDecoder) Int64Array() ([]int64, error) {
 		d.off = len(d.b)
 		return nil, ErrInsufficientData
 	}
-	n := int(Encoding.Uint32(d.b[d.off:]))
+	n := int(int32(Encoding.Uint32(d.b[d.off:])))
 	d.off += 4
 
+	if n < 0 {
+		return nil, ErrInvalidArrayLength
+	}
+
 	if d.remaining() < 8*n {
 		d.off = len(d.b)
 		return nil, ErrInsufficientData
@@ -214,10 +242,6 @@ func (d *ByteDecoder) Int64Array() ([]int64, error) {
 		return nil, nil
 	}
 
-	if n < 0 {
-		return nil, ErrInvalidArrayLength
-	}
-
 	ret := make([]int64, n)
 	for i := range ret {
 		ret[i] = int64(Encoding.Uint64(d.b[d.off:]))
@@ -231,17 +255,23 @@ func (d *ByteDecoder) StringArray() ([]string, error) {
 		d.off = len(d.b)
 		return nil, ErrInsufficientData
 	}
-	n := int(Encoding.Uint32(d.b[d.off:]))
+	n := int(int32(Encoding.Uint32(d.b[d.off:])))
 	d.off += 4
 
-	if n == 0 {
-		return nil, nil
-	}
-
 	if n < 0 {
 		return nil, ErrInvalidArrayLength
 	}
 
+	// each string's at least its 2 byte length.
+	if d.remaining() < 2*n {
+		d.off = len(d.b)
+		return nil, ErrInsufficientData
+	}
+
+	if n == 0 {
+		return nil, nil
+	}
+
 	ret := make([]string, n)
 	for i := range ret {
 		if str, err := d.String(); err != nil {
@@ -253,6 +283,105 @@ func (d *ByteDecoder) StringArray() ([]string, error) {
 	return ret, nil
 }
 
+// flexible versions
+
+func (d *ByteDecoder) UVarint() (uint64, error) {
+	tmp, n := binary.Uvarint(d.b[d.off:])
+	if n == 0 {
+		d.off = len(d.b)
+		return 0, ErrInsufficientData
+	}
+	if n < 0 {
+		d.off -= n
+		return 0, ErrVarintOverflow
+	}
+	d.off += n
+	return tmp, nil
+}
+
+// CompactArrayLength returns the array's length, encoded as an unsigned varint
+// of the length plus one. Null arrays are invalid, use CompactNullableArrayLength
+// for arrays that can be null.
+func (d *ByteDecoder) CompactArrayLength() (int, error) {
+	n, err := d.CompactNullableArrayLength()
+	if err != nil {
+		return -1, err
+	}
+	if n < 0 {
+		return -1, ErrInvalidArrayLength
+	}
+	return n, nil
+}
+
+// CompactNullableArrayLength returns the array's length, encoded as an unsigned
+// varint of the length plus one. Null arrays are returned with a length of -1.
+func (d *ByteDecoder) CompactNullableArrayLength() (int, error) {
+	tmp, err := d.UVarint()
+	if err != nil {
+		return -1, err
+	}
+	// lengths too large for an int wrap around to below -1.
+	n := int(tmp) - 1
+	if n < -1 || tmp > math.MaxInt32 {
+		return -1, ErrInvalidArrayLength
+	} else if n > d.remaining() {
+		d.off = len(d.b)
+		return -1, ErrInsufficientData
+	} else if n > 2*math.MaxUint16 {
+		return -1, ErrInvalidArrayLength
+	}
+	return n, nil
+}
+
+// CompactString returns the string, encoded as an unsigned varint of the
+// string's length plus one followed by the string.
+func (d *ByteDecoder) CompactString() (string, error) {
+	tmp, err := d.UVarint()
+	if err != nil {
+		return "", err
+	}
+
+	n := int(tmp) - 1
+
+	switch {
+	case n < -1 || n > math.MaxInt16:
+		return "", ErrInvalidStringLength
+	case n <= 0:
+		return "", nil
+	case n > d.remaining():
+		d.off = len(d.b)
+		return "", ErrInsufficientData
+	}
+
+	tmpStr := string(d.b[d.off : d.off+n])
+	d.off += n
+	return tmpStr, nil
+}
+
+// TaggedFields reads the tagged fields section, skipping the fields since none
+// are supported yet.
+func (d *ByteDecoder) TaggedFields() error {
+	count, err := d.UVarint()
+	if err != nil {
+		return err
+	}
+	for i := uint64(0); i < count; i++ {
+		if _, err := d.UVarint(); err != nil {
+			return err
+		}
+		size, err := d.UVarint()
+		if err != nil {
+			return err
+		}
+		if size > uint64(d.remaining()) {
+			d.off = len(d.b)
+			return ErrInsufficientData
+		}
+		d.off += int(size)
+	}
+	return nil
+}
+
 func (d *ByteDecoder) Push(pd PushDecoder) error {
 	pd.SaveOffset(d.off)
 	reserved := pd.ReserveSize()
@@ -0,0 +1,135 @@
+package protocol
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCompactString(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want []byte
+	}{
+		{name: "empty", in: "", want: []byte{0x01}},
+		{name: "jocko", in: "jocko", want: []byte{0x06, 'j', 'o', 'c', 'k', 'o'}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lenEnc := new(LenEncoder)
+			if err := lenEnc.PutCompactString(tt.in); err != nil {
+				t.Fatalf("LenEncoder.PutCompactString() error = %v", err)
+			}
+			b := make([]byte, lenEnc.Length)
+			if err := NewByteEncoder(b).PutCompactString(tt.in); err != nil {
+				t.Fatalf("ByteEncoder.PutCompactString() error = %v", err)
+			}
+			if !reflect.DeepEqual(b, tt.want) {
+				t.Errorf("PutCompactString() = %v, want %v", b, tt.want)
+			}
+			got, err := NewDecoder(b).CompactString()
+			if err != nil {
+				t.Fatalf("CompactString() error = %v", err)
+			}
+			if got != tt.in {
+				t.Errorf("CompactString() = %v, want %v", got, tt.in)
+			}
+		})
+	}
+}
+
+func TestCompactArrayLength(t *testing.T) {
+	for _, n := range []int{-1, 0, 3} {
+		b := make([]byte, 1)
+		if err := NewByteEncoder(b).PutCompactArrayLength(n); err != nil {
+			t.Fatalf("PutCompactArrayLength() error = %v", err)
+		}
+		if b[0] != byte(n+1) {
+			t.Errorf("PutCompactArrayLength(%d) = %v, want %v", n, b[0], n+1)
+		}
+		// pad the buffer so the decoder doesn't see the array as truncated.
+		got, err := NewDecoder(append(b, 0, 0, 0)).CompactNullableArrayLength()
+		if err != nil {
+			t.Fatalf("CompactNullableArrayLength() error = %v", err)
+		}
+		if got != n {
+			t.Errorf("CompactNullableArrayLength() = %v, want %v", got, n)
+		}
+		got, err = NewDecoder(append(b, 0, 0, 0)).CompactArrayLength()
+		if n < 0 {
+			if err != ErrInvalidArrayLength {
+				t.Errorf("CompactArrayLength() of a null array error = %v, want %v", err, ErrInvalidArrayLength)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("CompactArrayLength() error = %v", err)
+		}
+		if got != n {
+			t.Errorf("CompactArrayLength() = %v, want %v", got, n)
+		}
+	}
+
+	// a max uint64 length wraps around to below -1.
+	b := []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}
+	if _, err := NewDecoder(b).CompactNullableArrayLength(); err != ErrInvalidArrayLength {
+		t.Errorf("CompactNullableArrayLength() of an oversized length error = %v, want %v", err, ErrInvalidArrayLength)
+	}
+}
+
+func TestArrayLength_negative(t *testing.T) {
+	// -1 and -2 as int32s.
+	for _, b := range [][]byte{{0xff, 0xff, 0xff, 0xff}, {0xff, 0xff, 0xff, 0xfe}} {
+		if _, err := NewDecoder(b).ArrayLength(); err != ErrInvalidArrayLength {
+			t.Errorf("ArrayLength(%v) error = %v, want %v", b, err, ErrInvalidArrayLength)
+		}
+		if _, err := NewDecoder(b).Int32Array(); err != ErrInvalidArrayLength {
+			t.Errorf("Int32Array(%v) error = %v, want %v", b, err, ErrInvalidArrayLength)
+		}
+		if _, err := NewDecoder(b).StringArray(); err != ErrInvalidArrayLength {
+			t.Errorf("StringArray(%v) error = %v, want %v", b, err, ErrInvalidArrayLength)
+		}
+	}
+	// MetadataRequest's topics are nullable, -1, but can't be shorter.
+	if err := (&MetadataRequest{APIVersion: 1}).Decode(NewDecoder([]byte{0xff, 0xff, 0xff, 0xfe})); err != ErrInvalidArrayLength {
+		t.Errorf("MetadataRequest.Decode() error = %v, want %v", err, ErrInvalidArrayLength)
+	}
+}
+
+func TestTaggedFields(t *testing.T) {
+	lenEnc := new(LenEncoder)
+	lenEnc.PutEmptyTaggedFields()
+	b := make([]byte, lenEnc.Length)
+	NewByteEncoder(b).PutEmptyTaggedFields()
+	if !reflect.DeepEqual(b, []byte{0x00}) {
+		t.Errorf("PutEmptyTaggedFields() = %v, want %v", b, []byte{0x00})
+	}
+	d := NewDecoder(b)
+	if err := d.TaggedFields(); err != nil {
+		t.Fatalf("TaggedFields() error = %v", err)
+	}
+	if d.remaining() != 0 {
+		t.Errorf("TaggedFields() remaining = %v, want %v", d.remaining(), 0)
+	}
+
+	// unknown fields are skipped: one field with tag 5 and a 2 byte value.
+	d = NewDecoder([]byte{0x01, 0x05, 0x02, 0xaa, 0xbb})
+	if err := d.TaggedFields(); err != nil {
+		t.Fatalf("TaggedFields() error = %v", err)
+	}
+	if d.remaining() != 0 {
+		t.Errorf("TaggedFields() remaining = %v, want %v", d.remaining(), 0)
+	}
+}
+
+func TestIsFlexible(t *testing.T) {
+	if IsFlexible(MetadataKey, 0) {
+		t.Errorf("IsFlexible(MetadataKey, 0) = true, want false")
+	}
+	if !IsFlexible(MetadataKey, 9) {
+		t.Errorf("IsFlexible(MetadataKey, 9) = false, want true")
+	}
+	if IsFlexible(SaslHandshakeKey, 1) {
+		t.Errorf("IsFlexible(SaslHandshakeKey, 1) = true, want false")
+	}
+}
@@ -0,0 +1,82 @@
+package protocol
+
+// DeleteRecordsRequest is used to delete the records before the given offsets
+// of partitions, advancing their log start offsets.
+type DeleteRecordsRequest struct {
+	APIVersion int16
+
+	Topics  []*DeleteRecordsTopic
+	Timeout int32
+}
+
+type DeleteRecordsTopic struct {
+	Topic      string
+	Partitions []*DeleteRecordsPartition
+}
+
+type DeleteRecordsPartition struct {
+	Partition int32
+	// Offset is the offset records are deleted before, or -1 to delete them up
+	// to the high watermark.
+	Offset int64
+}
+
+func (r *DeleteRecordsRequest) Encode(e PacketEncoder) (err error) {
+	if err = e.PutArrayLength(len(r.Topics)); err != nil {
+		return err
+	}
+	for _, t := range r.Topics {
+		if err = e.PutString(t.Topic); err != nil {
+			return err
+		}
+		if err = e.PutArrayLength(len(t.Partitions)); err != nil {
+			return err
+		}
+		for _, p := range t.Partitions {
+			e.PutInt32(p.Partition)
+			e.PutInt64(p.Offset)
+		}
+	}
+	e.PutInt32(r.Timeout)
+	return nil
+}
+
+func (r *DeleteRecordsRequest) Decode(d PacketDecoder) (err error) {
+	n, err := d.ArrayLength()
+	if err != nil {
+		return err
+	}
+	r.Topics = make([]*DeleteRecordsTopic, n)
+	for i := range r.Topics {
+		t := new(DeleteRecordsTopic)
+		if t.Topic, err = d.String(); err != nil {
+			return err
+		}
+		pn, err := d.ArrayLength()
+		if err != nil {
+			return err
+		}
+		t.Partitions = make([]*DeleteRecordsPartition, pn)
+		for j := range t.Partitions {
+			p := new(DeleteRecordsPartition)
+			if p.Partition, err = d.Int32(); err != nil {
+				return err
+			}
+			if p.Offset, err = d.Int64(); err != nil {
+				return err
+			}
+			t.Partitions[j] = p
+		}
+		r.Topics[i] = t
+	}
+	r.Timeout, err = d.Int32()
+	return err
+}
+
+func (r *DeleteRecordsRequest) Key() int16 {
+	return DeleteRecordsKey
+}
+
+func (r *DeleteRecordsRequest) Version() int16 {
+	return r.APIVersion
+}
@@ -0,0 +1,79 @@
+package protocol
+
+// DeleteRecordsResponse has the partitions' log start offsets after their
+// records were deleted.
+type DeleteRecordsResponse struct {
+	APIVersion int16
+
+	ThrottleTime int32
+	Topics       []*DeleteRecordsTopicResponse
+}
+
+type DeleteRecordsTopicResponse struct {
+	Topic      string
+	Partitions []*DeleteRecordsPartitionResponse
+}
+
+type DeleteRecordsPartitionResponse struct {
+	Partition    int32
+	LowWatermark int64
+	ErrorCode    int16
+}
+
+func (r *DeleteRecordsResponse) Encode(e PacketEncoder) (err error) {
+	e.PutInt32(r.ThrottleTime)
+	if err = e.PutArrayLength(len(r.Topics)); err != nil {
+		return err
+	}
+	for _, t := range r.Topics {
+		if err = e.PutString(t.Topic); err != nil {
+			return err
+		}
+		if err = e.PutArrayLength(len(t.Partitions)); err != nil {
+			return err
+		}
+		for _, p := range t.Partitions {
+			e.PutInt32(p.Partition)
+			e.PutInt64(p.LowWatermark)
+			e.PutInt16(p.ErrorCode)
+		}
+	}
+	return nil
+}
+
+func (r *DeleteRecordsResponse) Decode(d PacketDecoder) (err error) {
+	if r.ThrottleTime, err = d.Int32(); err != nil {
+		return err
+	}
+	n, err := d.ArrayLength()
+	if err != nil {
+		return err
+	}
+	r.Topics = make([]*DeleteRecordsTopicResponse, n)
+	for i := range r.Topics {
+		t := new(DeleteRecordsTopicResponse)
+		if t.Topic, err = d.String(); err != nil {
+			return err
+		}
+		pn, err := d.ArrayLength()
+		if err != nil {
+			return err
+		}
+		t.Partitions = make([]*DeleteRecordsPartitionResponse, pn)
+		for j := range t.Partitions {
+			p := new(DeleteRecordsPartitionResponse)
+			if p.Partition, err = d.Int32(); err != nil {
+				return err
+			}
+			if p.LowWatermark, err = d.Int64(); err != nil {
+				return err
+			}
+			if p.ErrorCode, err = d.Int16(); err != nil {
+				return err
+			}
+			t.Partitions[j] = p
+		}
+		r.Topics[i] = t
+	}
+	return nil
+}
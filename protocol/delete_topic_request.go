@@ -1,25 +1,44 @@
 package protocol
 
+// DeleteTopicsRequest is used to delete topics. v4+ are flexible.
 type DeleteTopicsRequest struct {
+	APIVersion int16
+
 	Topics  []string
 	Timeout int32
 }
 
 func (c *DeleteTopicsRequest) Encode(e PacketEncoder) (err error) {
-	if err = e.PutStringArray(c.Topics); err != nil {
+	flexible := IsFlexible(DeleteTopicsKey, c.APIVersion)
+	if err = putArrayLength(e, len(c.Topics), flexible); err != nil {
 		return err
 	}
+	for _, t := range c.Topics {
+		if err = putString(e, t, flexible); err != nil {
+			return err
+		}
+	}
 	e.PutInt32(c.Timeout)
+	putTaggedFields(e, flexible)
 	return nil
 }
 
 func (c *DeleteTopicsRequest) Decode(d PacketDecoder) (err error) {
-	c.Topics, err = d.StringArray()
+	flexible := IsFlexible(DeleteTopicsKey, c.APIVersion)
+	n, err := arrayLength(d, flexible)
 	if err != nil {
 		return err
 	}
-	c.Timeout, err = d.Int32()
-	return err
+	c.Topics = make([]string, n)
+	for i := range c.Topics {
+		if c.Topics[i], err = decodeString(d, flexible); err != nil {
+			return err
+		}
+	}
+	if c.Timeout, err = d.Int32(); err != nil {
+		return err
+	}
+	return taggedFields(d, flexible)
 }
 
 func (c *DeleteTopicsRequest) Key() int16 {
@@ -27,5 +46,5 @@ func (c *DeleteTopicsRequest) Key() int16 {
 }
 
 func (c *DeleteTopicsRequest) Version() int16 {
-	return 0
+	return c.APIVersion
 }
@@ -1,37 +1,67 @@
 package protocol
 
+// DeleteTopicsResponse is the response to DeleteTopicsRequest. v4+ are flexible.
 type DeleteTopicsResponse struct {
+	APIVersion int16
+
+	ThrottleTimeMs  int32 // v1+
 	TopicErrorCodes []*TopicErrorCode
 }
 
-func (c *DeleteTopicsResponse) Encode(e PacketEncoder) error {
-	e.PutArrayLength(len(c.TopicErrorCodes))
+func (c *DeleteTopicsResponse) Encode(e PacketEncoder) (err error) {
+	flexible := IsFlexible(DeleteTopicsKey, c.APIVersion)
+	if c.APIVersion >= 1 {
+		e.PutInt32(c.ThrottleTimeMs)
+	}
+	if err = putArrayLength(e, len(c.TopicErrorCodes), flexible); err != nil {
+		return err
+	}
 	for _, t := range c.TopicErrorCodes {
-		e.PutString(t.Topic)
+		if err = putString(e, t.Topic, flexible); err != nil {
+			return err
+		}
 		e.PutInt16(t.ErrorCode)
+		if c.APIVersion >= 5 {
+			if err = putNullableFlexibleString(e, t.ErrorMessage, flexible); err != nil {
+				return err
+			}
+		}
+		putTaggedFields(e, flexible)
 	}
+	putTaggedFields(e, flexible)
 	return nil
 }
 
 func (c *DeleteTopicsResponse) Decode(d PacketDecoder) error {
-	l, err := d.ArrayLength()
+	var err error
+	flexible := IsFlexible(DeleteTopicsKey, c.APIVersion)
+	if c.APIVersion >= 1 {
+		if c.ThrottleTimeMs, err = d.Int32(); err != nil {
+			return err
+		}
+	}
+	l, err := arrayLength(d, flexible)
 	if err != nil {
 		return err
 	}
 	c.TopicErrorCodes = make([]*TopicErrorCode, l)
 	for i := range c.TopicErrorCodes {
-		topic, err := d.String()
-		if err != nil {
+		t := new(TopicErrorCode)
+		if t.Topic, err = decodeString(d, flexible); err != nil {
 			return err
 		}
-		errorCode, err := d.Int16()
-		if err != nil {
+		if t.ErrorCode, err = d.Int16(); err != nil {
 			return err
 		}
-		c.TopicErrorCodes[i] = &TopicErrorCode{
-			Topic:     topic,
-			ErrorCode: errorCode,
+		if c.APIVersion >= 5 {
+			if t.ErrorMessage, err = decodeString(d, flexible); err != nil {
+				return err
+			}
 		}
+		if err = taggedFields(d, flexible); err != nil {
+			return err
+		}
+		c.TopicErrorCodes[i] = t
 	}
-	return nil
+	return taggedFields(d, flexible)
 }
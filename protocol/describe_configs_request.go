@@ -0,0 +1,81 @@
+package protocol
+
+// DescribeConfigsRequest is used to describe resources' configs, with their
+// values and where the values come from.
+type DescribeConfigsRequest struct {
+	APIVersion int16
+
+	Resources       []*DescribeConfigsResource
+	IncludeSynonyms bool // v1+
+}
+
+type DescribeConfigsResource struct {
+	Type int8
+	Name string
+	// ConfigNames are the configs to describe, nil is all of them.
+	ConfigNames []string
+}
+
+func (r *DescribeConfigsRequest) Encode(e PacketEncoder) (err error) {
+	if err = e.PutArrayLength(len(r.Resources)); err != nil {
+		return err
+	}
+	for _, res := range r.Resources {
+		e.PutInt8(res.Type)
+		if err = e.PutString(res.Name); err != nil {
+			return err
+		}
+		if res.ConfigNames == nil {
+			e.PutInt32(-1)
+		} else if err = e.PutStringArray(res.ConfigNames); err != nil {
+			return err
+		}
+	}
+	if r.APIVersion >= 1 {
+		e.PutBool(r.IncludeSynonyms)
+	}
+	return nil
+}
+
+func (r *DescribeConfigsRequest) Decode(d PacketDecoder) (err error) {
+	n, err := d.ArrayLength()
+	if err != nil {
+		return err
+	}
+	r.Resources = make([]*DescribeConfigsResource, n)
+	for i := range r.Resources {
+		res := new(DescribeConfigsResource)
+		if res.Type, err = d.Int8(); err != nil {
+			return err
+		}
+		if res.Name, err = d.String(); err != nil {
+			return err
+		}
+		// the config names are nullable, so they're decoded here rather than with StringArray.
+		cn, err := d.Int32()
+		if err != nil {
+			return err
+		}
+		if cn > 0 {
+			res.ConfigNames = make([]string, cn)
+			for j := range res.ConfigNames {
+				if res.ConfigNames[j], err = d.String(); err != nil {
+					return err
+				}
+			}
+		}
+		r.Resources[i] = res
+	}
+	if r.APIVersion >= 1 {
+		r.IncludeSynonyms, err = d.Bool()
+	}
+	return err
+}
+
+func (r *DescribeConfigsRequest) Key() int16 {
+	return DescribeConfigsKey
+}
+
+func (r *DescribeConfigsRequest) Version() int16 {
+	return r.APIVersion
+}
@@ -0,0 +1,177 @@
+package protocol
+
+// Config sources, where configs' values come from.
+const (
+	ConfigSourceUnknown                    int8 = 0
+	ConfigSourceDynamicTopicConfig         int8 = 1
+	ConfigSourceDynamicBrokerConfig        int8 = 2
+	ConfigSourceDynamicDefaultBrokerConfig int8 = 3
+	ConfigSourceStaticBrokerConfig         int8 = 4
+	ConfigSourceDefaultConfig              int8 = 5
+)
+
+type DescribeConfigsResponse struct {
+	APIVersion int16
+
+	ThrottleTimeMs int32
+	Results        []*DescribeConfigsResult
+}
+
+type DescribeConfigsResult struct {
+	ErrorCode    int16
+	ErrorMessage string // empty is null
+	Type         int8
+	Name         string
+	Configs      []*DescribeConfigsEntry
+}
+
+type DescribeConfigsEntry struct {
+	Name     string
+	Value    string
+	ReadOnly bool
+	// IsDefault is whether the value is the default, v0 only. From v1 it's
+	// whether Source is ConfigSourceDefaultConfig.
+	IsDefault   bool
+	Source      int8 // v1+
+	IsSensitive bool
+	Synonyms    []*DescribeConfigsSynonym // v1+
+}
+
+// DescribeConfigsSynonym is a value of the config, or a config it inherits its
+// value from, in order of precedence.
+type DescribeConfigsSynonym struct {
+	Name   string
+	Value  string
+	Source int8
+}
+
+func (r *DescribeConfigsResponse) Encode(e PacketEncoder) (err error) {
+	e.PutInt32(r.ThrottleTimeMs)
+	if err = e.PutArrayLength(len(r.Results)); err != nil {
+		return err
+	}
+	for _, res := range r.Results {
+		e.PutInt16(res.ErrorCode)
+		if err = putNullableString(e, res.ErrorMessage); err != nil {
+			return err
+		}
+		e.PutInt8(res.Type)
+		if err = e.PutString(res.Name); err != nil {
+			return err
+		}
+		if err = e.PutArrayLength(len(res.Configs)); err != nil {
+			return err
+		}
+		for _, c := range res.Configs {
+			if err = e.PutString(c.Name); err != nil {
+				return err
+			}
+			if err = putNullableString(e, c.Value); err != nil {
+				return err
+			}
+			e.PutBool(c.ReadOnly)
+			if r.APIVersion >= 1 {
+				e.PutInt8(c.Source)
+			} else {
+				e.PutBool(c.IsDefault)
+			}
+			e.PutBool(c.IsSensitive)
+			if r.APIVersion < 1 {
+				continue
+			}
+			if err = e.PutArrayLength(len(c.Synonyms)); err != nil {
+				return err
+			}
+			for _, s := range c.Synonyms {
+				if err = e.PutString(s.Name); err != nil {
+					return err
+				}
+				if err = putNullableString(e, s.Value); err != nil {
+					return err
+				}
+				e.PutInt8(s.Source)
+			}
+		}
+	}
+	return nil
+}
+
+func (r *DescribeConfigsResponse) Decode(d PacketDecoder) (err error) {
+	if r.ThrottleTimeMs, err = d.Int32(); err != nil {
+		return err
+	}
+	n, err := d.ArrayLength()
+	if err != nil {
+		return err
+	}
+	r.Results = make([]*DescribeConfigsResult, n)
+	for i := range r.Results {
+		res := new(DescribeConfigsResult)
+		if res.ErrorCode, err = d.Int16(); err != nil {
+			return err
+		}
+		if res.ErrorMessage, err = d.String(); err != nil {
+			return err
+		}
+		if res.Type, err = d.Int8(); err != nil {
+			return err
+		}
+		if res.Name, err = d.String(); err != nil {
+			return err
+		}
+		cn, err := d.ArrayLength()
+		if err != nil {
+			return err
+		}
+		res.Configs = make([]*DescribeConfigsEntry, cn)
+		for j := range res.Configs {
+			c := new(DescribeConfigsEntry)
+			if c.Name, err = d.String(); err != nil {
+				return err
+			}
+			if c.Value, err = d.String(); err != nil {
+				return err
+			}
+			if c.ReadOnly, err = d.Bool(); err != nil {
+				return err
+			}
+			if r.APIVersion >= 1 {
+				if c.Source, err = d.Int8(); err != nil {
+					return err
+				}
+			} else if c.IsDefault, err = d.Bool(); err != nil {
+				return err
+			}
+			if c.IsSensitive, err = d.Bool(); err != nil {
+				return err
+			}
+			res.Configs[j] = c
+			if r.APIVersion < 1 {
+				continue
+			}
+			sn, err := d.ArrayLength()
+			if err != nil {
+				return err
+			}
+			if sn == 0 {
+				continue
+			}
+			c.Synonyms = make([]*DescribeConfigsSynonym, sn)
+			for k := range c.Synonyms {
+				s := new(DescribeConfigsSynonym)
+				if s.Name, err = d.String(); err != nil {
+					return err
+				}
+				if s.Value, err = d.String(); err != nil {
+					return err
+				}
+				if s.Source, err = d.Int8(); err != nil {
+					return err
+				}
+				c.Synonyms[k] = s
+			}
+		}
+		r.Results[i] = res
+	}
+	return nil
+}
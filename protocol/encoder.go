@@ -1,6 +1,10 @@
 package protocol
 
-import "math"
+import (
+	"encoding/binary"
+	"io"
+	"math"
+)
 
 type PacketEncoder interface {
 	PutBool(in bool)
@@ -15,6 +19,12 @@ type PacketEncoder interface {
 	PutStringArray(in []string) error
 	PutInt32Array(in []int32) error
 	PutInt64Array(in []int64) error
+	PutUVarint(in uint64)
+	PutCompactArrayLength(in int) error
+	PutCompactString(in string) error
+	PutEmptyTaggedFields()
+	// PutReader puts the next n bytes read from in, e.g. a record set read from a partition's log.
+	PutReader(in io.Reader, n int) error
 	Push(pe PushEncoder)
 	Pop()
 }
@@ -46,9 +56,26 @@ func Encode(e Encoder) ([]byte, error) {
 	return b, nil
 }
 
+// EncodeTo is used to encode e to w. Unlike Encode, the bytes put from readers,
+// e.g. fetched record sets, aren't buffered but copied to w in chunks, so only
+// the rest of e is held in memory. It returns the number of bytes written.
+func EncodeTo(w io.Writer, e Encoder) (int64, error) {
+	lenEnc := new(LenEncoder)
+	if err := e.Encode(lenEnc); err != nil {
+		return 0, err
+	}
+	streamEnc := &streamEncoder{ByteEncoder: NewByteEncoder(make([]byte, lenEnc.Length-lenEnc.streamed))}
+	if err := e.Encode(streamEnc); err != nil {
+		return 0, err
+	}
+	return streamEnc.writeTo(w)
+}
+
 type LenEncoder struct {
 	Length int
 	stack  []int
+	// streamed is the number of bytes put from readers.
+	streamed int
 }
 
 func (e *LenEncoder) PutBool(in bool) {
@@ -143,6 +170,43 @@ func (e *LenEncoder) PutInt64Array(in []int64) error {
 	return nil
 }
 
+// flexible versions
+
+func (e *LenEncoder) PutUVarint(in uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	e.Length += binary.PutUvarint(buf[:], in)
+}
+
+func (e *LenEncoder) PutCompactArrayLength(in int) error {
+	if in > math.MaxInt32 {
+		return ErrInvalidArrayLength
+	}
+	e.PutUVarint(uint64(in + 1))
+	return nil
+}
+
+func (e *LenEncoder) PutCompactString(in string) error {
+	if len(in) > math.MaxInt16 {
+		return ErrInvalidStringLength
+	}
+	e.PutUVarint(uint64(len(in) + 1))
+	e.Length += len(in)
+	return nil
+}
+
+func (e *LenEncoder) PutEmptyTaggedFields() {
+	e.PutUVarint(0)
+}
+
+func (e *LenEncoder) PutReader(in io.Reader, n int) error {
+	if n > math.MaxInt32 {
+		return ErrInvalidByteSliceLength
+	}
+	e.Length += n
+	e.streamed += n
+	return nil
+}
+
 func (e *LenEncoder) Push(pe PushEncoder) {
 	e.Length += pe.ReserveSize()
 }
@@ -256,6 +320,42 @@ func (e *ByteEncoder) PutInt64Array(in []int64) error {
 	return nil
 }
 
+// flexible versions
+
+func (e *ByteEncoder) PutUVarint(in uint64) {
+	e.off += binary.PutUvarint(e.b[e.off:], in)
+}
+
+// PutCompactArrayLength puts the array's length plus one, as an unsigned varint.
+// Null arrays, with a length of -1, are encoded as 0.
+func (e *ByteEncoder) PutCompactArrayLength(in int) error {
+	e.PutUVarint(uint64(in + 1))
+	return nil
+}
+
+// PutCompactString puts the string's length plus one, as an unsigned varint,
+// followed by the string.
+func (e *ByteEncoder) PutCompactString(in string) error {
+	e.PutUVarint(uint64(len(in) + 1))
+	copy(e.b[e.off:], in)
+	e.off += len(in)
+	return nil
+}
+
+// PutEmptyTaggedFields puts a tagged fields section with no fields.
+func (e *ByteEncoder) PutEmptyTaggedFields() {
+	e.PutUVarint(0)
+}
+
+// PutReader reads the n bytes from in into the encoder's buffer.
+func (e *ByteEncoder) PutReader(in io.Reader, n int) error {
+	if _, err := io.ReadFull(in, e.b[e.off:e.off+n]); err != nil {
+		return err
+	}
+	e.off += n
+	return nil
+}
+
 func (e *ByteEncoder) Push(pe PushEncoder) {
 	pe.SaveOffset(e.off)
 	e.off += pe.ReserveSize()
@@ -268,3 +368,65 @@ func (e *ByteEncoder) Pop() {
 	e.stack = e.stack[:len(e.stack)-1]
 	pe.Fill(e.off, e.b)
 }
+
+// streamEncoder is a ByteEncoder that doesn't read the readers put into it, just
+// where they go, and copies them to the writer between its buffer's bytes when
+// it's written.
+type streamEncoder struct {
+	*ByteEncoder
+	readers []streamedReader
+	// streamed is the number of bytes put from readers so far, and pushed what
+	// it was when each encoder on the stack was pushed.
+	streamed int
+	pushed   []int
+}
+
+type streamedReader struct {
+	off int
+	r   io.Reader
+	n   int
+}
+
+func (e *streamEncoder) PutReader(in io.Reader, n int) error {
+	e.readers = append(e.readers, streamedReader{off: e.off, r: in, n: n})
+	e.streamed += n
+	return nil
+}
+
+func (e *streamEncoder) Push(pe PushEncoder) {
+	e.pushed = append(e.pushed, e.streamed)
+	e.ByteEncoder.Push(pe)
+}
+
+// Pop fills the pushed encoder as if the bytes of the readers put since it was
+// pushed were in the buffer, so size fields count them. Encoders that need the
+// bytes themselves, like CRC fields, can't be pushed around readers.
+func (e *streamEncoder) Pop() {
+	streamed := e.streamed - e.pushed[len(e.pushed)-1]
+	e.pushed = e.pushed[:len(e.pushed)-1]
+	pe := e.stack[len(e.stack)-1]
+	e.stack = e.stack[:len(e.stack)-1]
+	pe.Fill(e.off+streamed, e.b)
+}
+
+// writeTo writes the encoder's buffer to w, copying each reader's bytes to w
+// where it was put.
+func (e *streamEncoder) writeTo(w io.Writer) (int64, error) {
+	var n int64
+	var off int
+	for _, r := range e.readers {
+		nn, err := w.Write(e.b[off:r.off])
+		n += int64(nn)
+		if err != nil {
+			return n, err
+		}
+		copied, err := io.CopyN(w, r.r, int64(r.n))
+		n += copied
+		if err != nil {
+			return n, err
+		}
+		off = r.off
+	}
+	nn, err := w.Write(e.b[off:])
+	return n + int64(nn), err
+}
@@ -0,0 +1,121 @@
+package protocol
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+// patternReader reads n bytes of a repeating pattern, without holding them in memory.
+type patternReader struct {
+	n, off int
+}
+
+func (r *patternReader) Read(p []byte) (int, error) {
+	if r.off == r.n {
+		return 0, io.EOF
+	}
+	if len(p) > r.n-r.off {
+		p = p[:r.n-r.off]
+	}
+	for i := range p {
+		p[i] = byte((r.off + i) % 251)
+	}
+	r.off += len(p)
+	return len(p), nil
+}
+
+// trackingWriter keeps the bytes written to it, up to the given number, and the size of the
+// largest write.
+type trackingWriter struct {
+	keep     int
+	head     bytes.Buffer
+	n        int
+	maxWrite int
+}
+
+func (w *trackingWriter) Write(p []byte) (int, error) {
+	if len(p) > w.maxWrite {
+		w.maxWrite = len(p)
+	}
+	if w.head.Len() < w.keep {
+		rest := w.keep - w.head.Len()
+		if rest > len(p) {
+			rest = len(p)
+		}
+		w.head.Write(p[:rest])
+	}
+	w.n += len(p)
+	return len(p), nil
+}
+
+func TestEncodeTo(t *testing.T) {
+	const size = 8 << 20
+	resp := func(rs *patternReader) *Response {
+		return &Response{
+			CorrelationID: 7,
+			Body: &FetchResponses{
+				APIVersion: 5,
+				Responses: []*FetchResponse{{
+					Topic: "the-topic",
+					PartitionResponses: []*FetchPartitionResponse{
+						{Partition: 0, HighWatermark: 10, RecordSetReader: rs, RecordSetSize: size},
+						{Partition: 1, HighWatermark: 3, RecordSet: []byte("hello")},
+					},
+				}},
+			},
+		}
+	}
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	w := &trackingWriter{keep: 64}
+	n, err := EncodeTo(w, resp(&patternReader{n: size}))
+	runtime.ReadMemStats(&after)
+	if err != nil {
+		t.Fatalf("EncodeTo() error = %v", err)
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > size/4 {
+		t.Errorf("EncodeTo() allocated %d bytes, want the %d byte record set streamed", allocated, size)
+	}
+	if w.maxWrite > size/4 {
+		t.Errorf("largest write = %d bytes, want the record set written in chunks", w.maxWrite)
+	}
+
+	// it's encoded the same as if the record set were buffered.
+	want, err := Encode(resp(&patternReader{n: size}))
+	if err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+	if n != int64(len(want)) || w.n != len(want) {
+		t.Errorf("EncodeTo() wrote %d bytes, returned %d, want %d", w.n, n, len(want))
+	}
+	if !bytes.Equal(w.head.Bytes(), want[:w.keep]) {
+		t.Errorf("EncodeTo() header = %v, want %v", w.head.Bytes(), want[:w.keep])
+	}
+
+	var buf bytes.Buffer
+	if _, err := EncodeTo(&buf, resp(&patternReader{n: size})); err != nil {
+		t.Fatalf("EncodeTo() error = %v", err)
+	}
+	if !reflect.DeepEqual(buf.Bytes(), want) {
+		t.Errorf("EncodeTo() and Encode() differ")
+	}
+	d := NewDecoder(buf.Bytes()[4:])
+	if correlationID, err := d.Int32(); err != nil || correlationID != 7 {
+		t.Fatalf("correlation ID = %v, %v, want 7", correlationID, err)
+	}
+	got := &FetchResponses{APIVersion: 5}
+	if err := got.Decode(d); err != nil {
+		t.Fatalf("FetchResponses.Decode() error = %v", err)
+	}
+	if rs := got.Responses[0].PartitionResponses[0].RecordSet; len(rs) != size || rs[size-1] != byte((size-1)%251) {
+		t.Errorf("decoded record set is %d bytes, want %d", len(rs), size)
+	}
+	if rs := got.Responses[0].PartitionResponses[1].RecordSet; string(rs) != "hello" {
+		t.Errorf("decoded record set = %s, want hello", rs)
+	}
+}
@@ -60,6 +60,13 @@ var (
 	ErrTransactionalIdAuthorizationFailed = Error{code: 53, msg: "transactional id authorization failed"}
 	ErrSecurityDisabled                   = Error{code: 54, msg: "security disabled"}
 	ErrOperationNotAttempted              = Error{code: 55, msg: "operation not attempted"}
+	ErrKafkaStorageError                  = Error{code: 56, msg: "kafka storage error"}
+	ErrFetchSessionIDNotFound             = Error{code: 70, msg: "fetch session id not found"}
+	ErrFencedLeaderEpoch                  = Error{code: 74, msg: "fenced leader epoch"}
+	ErrUnknownLeaderEpoch                 = Error{code: 75, msg: "unknown leader epoch"}
+	ErrStaleBrokerEpoch                   = Error{code: 77, msg: "stale broker epoch"}
+	ErrThrottlingQuotaExceeded            = Error{code: 89, msg: "throttling quota exceeded"}
+	ErrInvalidUpdateVersion               = Error{code: 95, msg: "invalid update version"}
 
 	// Errs maps err codes to their errs.
 	Errs = map[int16]Error{
@@ -120,6 +127,13 @@ var (
 		53: ErrTransactionalIdAuthorizationFailed,
 		54: ErrSecurityDisabled,
 		55: ErrOperationNotAttempted,
+		56: ErrKafkaStorageError,
+		70: ErrFetchSessionIDNotFound,
+		74: ErrFencedLeaderEpoch,
+		75: ErrUnknownLeaderEpoch,
+		77: ErrStaleBrokerEpoch,
+		89: ErrThrottlingQuotaExceeded,
+		95: ErrInvalidUpdateVersion,
 	}
 )
 
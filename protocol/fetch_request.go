@@ -1,9 +1,14 @@
 package protocol
 
 type FetchPartition struct {
-	Partition   int32
-	FetchOffset int64
-	MaxBytes    int32
+	Partition int32
+	// CurrentLeaderEpoch is the fetcher's current leader epoch of the partition, v9+, used to
+	// fence fetchers with stale metadata. Fetchers that don't know it send -1.
+	CurrentLeaderEpoch int32
+	FetchOffset        int64
+	// LogStartOffset is the follower's log start offset, v5+. Clients send -1.
+	LogStartOffset int64
+	MaxBytes       int32
 }
 
 type FetchTopic struct {
@@ -11,12 +16,29 @@ type FetchTopic struct {
 	Partitions []*FetchPartition
 }
 
+// ForgottenTopic is a topic's partitions to remove from an incremental fetch session, v7+.
+type ForgottenTopic struct {
+	Topic      string
+	Partitions []int32
+}
+
 type FetchRequest struct {
+	APIVersion int16
+
 	ReplicaID   int32
 	MaxWaitTime int32
 	MinBytes    int32
-	// MaxBytes    int32
-	Topics []*FetchTopic
+	// MaxBytes is the max bytes to return for the whole response, v3+.
+	MaxBytes int32
+	// IsolationLevel is 0 for read uncommitted and 1 for read committed, v4+.
+	IsolationLevel int8
+	// SessionID and SessionEpoch identify the fetch session and the request's place in it, v7+.
+	// Full fetches that don't use a session send 0 and -1.
+	SessionID    int32
+	SessionEpoch int32
+	Topics       []*FetchTopic
+	// ForgottenTopics are the partitions to remove from the fetch session, v7+.
+	ForgottenTopics []*ForgottenTopic
 }
 
 func (r *FetchRequest) Encode(e PacketEncoder) error {
@@ -27,17 +49,39 @@ func (r *FetchRequest) Encode(e PacketEncoder) error {
 	}
 	e.PutInt32(r.MaxWaitTime)
 	e.PutInt32(r.MinBytes)
-	// e.PutInt32(r.MaxBytes)
+	if r.APIVersion >= 3 {
+		e.PutInt32(r.MaxBytes)
+	}
+	if r.APIVersion >= 4 {
+		e.PutInt8(r.IsolationLevel)
+	}
+	if r.APIVersion >= 7 {
+		e.PutInt32(r.SessionID)
+		e.PutInt32(r.SessionEpoch)
+	}
 	e.PutArrayLength(len(r.Topics))
 	for _, t := range r.Topics {
 		e.PutString(t.Topic)
 		e.PutArrayLength(len(t.Partitions))
 		for _, p := range t.Partitions {
 			e.PutInt32(p.Partition)
+			if r.APIVersion >= 9 {
+				e.PutInt32(p.CurrentLeaderEpoch)
+			}
 			e.PutInt64(p.FetchOffset)
+			if r.APIVersion >= 5 {
+				e.PutInt64(p.LogStartOffset)
+			}
 			e.PutInt32(p.MaxBytes)
 		}
 	}
+	if r.APIVersion >= 7 {
+		e.PutArrayLength(len(r.ForgottenTopics))
+		for _, t := range r.ForgottenTopics {
+			e.PutString(t.Topic)
+			e.PutInt32Array(t.Partitions)
+		}
+	}
 	return nil
 }
 
@@ -55,10 +99,26 @@ func (r *FetchRequest) Decode(d PacketDecoder) error {
 	if err != nil {
 		return err
 	}
-	// r.MaxBytes, err = d.Int32()
-	// if err != nil {
-	// 	return err
-	// }
+	if r.APIVersion >= 3 {
+		r.MaxBytes, err = d.Int32()
+		if err != nil {
+			return err
+		}
+	}
+	if r.APIVersion >= 4 {
+		r.IsolationLevel, err = d.Int8()
+		if err != nil {
+			return err
+		}
+	}
+	if r.APIVersion >= 7 {
+		if r.SessionID, err = d.Int32(); err != nil {
+			return err
+		}
+		if r.SessionEpoch, err = d.Int32(); err != nil {
+			return err
+		}
+	}
 	topicCount, err := d.ArrayLength()
 	if err != nil {
 		return err
@@ -81,10 +141,22 @@ func (r *FetchRequest) Decode(d PacketDecoder) error {
 			if err != nil {
 				return err
 			}
+			if r.APIVersion >= 9 {
+				p.CurrentLeaderEpoch, err = d.Int32()
+				if err != nil {
+					return err
+				}
+			}
 			p.FetchOffset, err = d.Int64()
 			if err != nil {
 				return err
 			}
+			if r.APIVersion >= 5 {
+				p.LogStartOffset, err = d.Int64()
+				if err != nil {
+					return err
+				}
+			}
 			p.MaxBytes, err = d.Int32()
 			if err != nil {
 				return err
@@ -95,6 +167,22 @@ func (r *FetchRequest) Decode(d PacketDecoder) error {
 		topics[i] = t
 	}
 	r.Topics = topics
+	if r.APIVersion >= 7 {
+		forgottenCount, err := d.ArrayLength()
+		if err != nil {
+			return err
+		}
+		for i := 0; i < forgottenCount; i++ {
+			t := &ForgottenTopic{}
+			if t.Topic, err = d.String(); err != nil {
+				return err
+			}
+			if t.Partitions, err = d.Int32Array(); err != nil {
+				return err
+			}
+			r.ForgottenTopics = append(r.ForgottenTopics, t)
+		}
+	}
 	return nil
 }
 
@@ -102,6 +190,11 @@ func (r *FetchRequest) Key() int16 {
 	return FetchKey
 }
 
+// Version returns the request's version. Requests without a version are sent
+// as v1, the oldest version whose response this package decodes.
 func (r *FetchRequest) Version() int16 {
-	return 1
+	if r.APIVersion < 1 {
+		return 1
+	}
+	return r.APIVersion
 }
@@ -1,10 +1,29 @@
 package protocol
 
+import "io"
+
+// AbortedTransaction is a transaction aborted in the fetched range, v4+.
+type AbortedTransaction struct {
+	ProducerID  int64
+	FirstOffset int64
+}
+
 type FetchPartitionResponse struct {
 	Partition     int32
 	ErrorCode     int16
 	HighWatermark int64
-	RecordSet     []byte
+	// LastStableOffset is the offset below which all transactions are decided, v4+.
+	LastStableOffset int64
+	// LogStartOffset is the partition's current log start offset, v5+. Fetchers
+	// use it to learn the log was truncated or retention deleted their data.
+	LogStartOffset      int64
+	AbortedTransactions []*AbortedTransaction
+	RecordSet           []byte
+	// RecordSetReader, if set, is encoded as the record set instead of RecordSet,
+	// reading RecordSetSize bytes from it. EncodeTo streams it rather than
+	// buffering it, so fetched records are copied from the log to the conn.
+	RecordSetReader io.Reader
+	RecordSetSize   int32
 }
 
 type FetchResponse struct {
@@ -13,27 +32,59 @@ type FetchResponse struct {
 }
 
 type FetchResponses struct {
-	ThrottleTimeMs int32
-	Responses      []*FetchResponse
+	APIVersion int16
+
+	ThrottleTimeMs int32 // v1+
+	// ErrorCode is the error of the whole fetch, v7+, e.g. when its session wasn't found.
+	ErrorCode int16
+	// SessionID is the fetch session's ID, v7+, 0 if the broker didn't create one.
+	SessionID int32
+	Responses []*FetchResponse
 }
 
 func (r *FetchResponses) Encode(e PacketEncoder) (err error) {
-	e.PutInt32(r.ThrottleTimeMs)
+	if r.APIVersion >= 1 {
+		e.PutInt32(r.ThrottleTimeMs)
+	}
+	if r.APIVersion >= 7 {
+		e.PutInt16(r.ErrorCode)
+		e.PutInt32(r.SessionID)
+	}
 	if err = e.PutArrayLength(len(r.Responses)); err != nil {
 		return err
 	}
-	for _, r := range r.Responses {
-		if err = e.PutString(r.Topic); err != nil {
+	for _, resp := range r.Responses {
+		if err = e.PutString(resp.Topic); err != nil {
 			return err
 		}
-		if err = e.PutArrayLength(len(r.PartitionResponses)); err != nil {
+		if err = e.PutArrayLength(len(resp.PartitionResponses)); err != nil {
 			return err
 		}
-		for _, p := range r.PartitionResponses {
+		for _, p := range resp.PartitionResponses {
 			e.PutInt32(p.Partition)
 			e.PutInt16(p.ErrorCode)
 			e.PutInt64(p.HighWatermark)
-			if err = e.PutBytes(p.RecordSet); err != nil {
+			if r.APIVersion >= 4 {
+				e.PutInt64(p.LastStableOffset)
+			}
+			if r.APIVersion >= 5 {
+				e.PutInt64(p.LogStartOffset)
+			}
+			if r.APIVersion >= 4 {
+				if err = e.PutArrayLength(len(p.AbortedTransactions)); err != nil {
+					return err
+				}
+				for _, t := range p.AbortedTransactions {
+					e.PutInt64(t.ProducerID)
+					e.PutInt64(t.FirstOffset)
+				}
+			}
+			if p.RecordSetReader != nil {
+				e.PutInt32(p.RecordSetSize)
+				if err = e.PutReader(p.RecordSetReader, int(p.RecordSetSize)); err != nil {
+					return err
+				}
+			} else if err = e.PutBytes(p.RecordSet); err != nil {
 				return err
 			}
 		}
@@ -43,9 +94,19 @@ func (r *FetchResponses) Encode(e PacketEncoder) (err error) {
 
 func (r *FetchResponses) Decode(d PacketDecoder) error {
 	var err error
-	r.ThrottleTimeMs, err = d.Int32()
-	if err != nil {
-		return err
+	if r.APIVersion >= 1 {
+		r.ThrottleTimeMs, err = d.Int32()
+		if err != nil {
+			return err
+		}
+	}
+	if r.APIVersion >= 7 {
+		if r.ErrorCode, err = d.Int16(); err != nil {
+			return err
+		}
+		if r.SessionID, err = d.Int32(); err != nil {
+			return err
+		}
 	}
 	responseCount, err := d.ArrayLength()
 	r.Responses = make([]*FetchResponse, responseCount)
@@ -72,6 +133,37 @@ func (r *FetchResponses) Decode(d PacketDecoder) error {
 			if err != nil {
 				return err
 			}
+			if r.APIVersion >= 4 {
+				p.LastStableOffset, err = d.Int64()
+				if err != nil {
+					return err
+				}
+			}
+			if r.APIVersion >= 5 {
+				p.LogStartOffset, err = d.Int64()
+				if err != nil {
+					return err
+				}
+			}
+			if r.APIVersion >= 4 {
+				abortedCount, err := d.ArrayLength()
+				if err != nil {
+					return err
+				}
+				if abortedCount > 0 {
+					p.AbortedTransactions = make([]*AbortedTransaction, abortedCount)
+				}
+				for k := 0; k < abortedCount; k++ {
+					t := &AbortedTransaction{}
+					if t.ProducerID, err = d.Int64(); err != nil {
+						return err
+					}
+					if t.FirstOffset, err = d.Int64(); err != nil {
+						return err
+					}
+					p.AbortedTransactions[k] = t
+				}
+			}
 			p.RecordSet, err = d.Bytes()
 			if err != nil {
 				return err
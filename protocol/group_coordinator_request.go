@@ -1,20 +1,43 @@
 package protocol
 
+// Coordinator types of find coordinator requests.
+const (
+	CoordinatorGroup       int8 = 0
+	CoordinatorTransaction int8 = 1
+)
+
+// GroupCoordinatorRequest is the find coordinator request. Its key is GroupID
+// for historical reasons: from v1 it's the transactional ID when the
+// coordinator type is CoordinatorTransaction.
 type GroupCoordinatorRequest struct {
-	GroupID string
+	APIVersion int16
+
+	GroupID         string
+	CoordinatorType int8 // v1+
 }
 
 func (r *GroupCoordinatorRequest) Encode(e PacketEncoder) error {
-	return e.PutString(r.GroupID)
+	if err := e.PutString(r.GroupID); err != nil {
+		return err
+	}
+	if r.APIVersion >= 1 {
+		e.PutInt8(r.CoordinatorType)
+	}
+	return nil
 }
 
 func (r *GroupCoordinatorRequest) Decode(d PacketDecoder) (err error) {
-	r.GroupID, err = d.String()
+	if r.GroupID, err = d.String(); err != nil {
+		return err
+	}
+	if r.APIVersion >= 1 {
+		r.CoordinatorType, err = d.Int8()
+	}
 	return err
 }
 
 func (r *GroupCoordinatorRequest) Version() int16 {
-	return 0
+	return r.APIVersion
 }
 
 func (r *GroupCoordinatorRequest) Key() int16 {
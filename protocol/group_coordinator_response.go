@@ -7,12 +7,24 @@ type Coordinator struct {
 }
 
 type GroupCoordinatorResponse struct {
-	ErrorCode   int16
-	Coordinator *Coordinator
+	APIVersion int16
+
+	ThrottleTimeMs int32 // v1+
+	ErrorCode      int16
+	ErrorMessage   string // v1+
+	Coordinator    *Coordinator
 }
 
 func (r *GroupCoordinatorResponse) Encode(e PacketEncoder) error {
+	if r.APIVersion >= 1 {
+		e.PutInt32(r.ThrottleTimeMs)
+	}
 	e.PutInt16(r.ErrorCode)
+	if r.APIVersion >= 1 {
+		if err := e.PutString(r.ErrorMessage); err != nil {
+			return err
+		}
+	}
 	e.PutInt32(r.Coordinator.NodeID)
 	if err := e.PutString(r.Coordinator.Host); err != nil {
 		return err
@@ -22,9 +34,19 @@ func (r *GroupCoordinatorResponse) Encode(e PacketEncoder) error {
 }
 
 func (r *GroupCoordinatorResponse) Decode(d PacketDecoder) (err error) {
+	if r.APIVersion >= 1 {
+		if r.ThrottleTimeMs, err = d.Int32(); err != nil {
+			return err
+		}
+	}
 	if r.ErrorCode, err = d.Int16(); err != nil {
 		return err
 	}
+	if r.APIVersion >= 1 {
+		if r.ErrorMessage, err = d.String(); err != nil {
+			return err
+		}
+	}
 	r.Coordinator = new(Coordinator)
 	if r.Coordinator.NodeID, err = d.Int32(); err != nil {
 		return err
@@ -0,0 +1,112 @@
+package protocol
+
+// Config resource types.
+const (
+	ConfigResourceTopic  int8 = 2
+	ConfigResourceBroker int8 = 4
+)
+
+// Incremental alter configs operations.
+const (
+	ConfigOperationSet      int8 = 0
+	ConfigOperationDelete   int8 = 1
+	ConfigOperationAppend   int8 = 2
+	ConfigOperationSubtract int8 = 3
+)
+
+// IncrementalAlterConfigsRequest is used to change resources' config entries
+// one at a time, unlike AlterConfigs which replaces all of a resource's
+// entries. Only v0 is supported, v1+ are flexible.
+type IncrementalAlterConfigsRequest struct {
+	APIVersion int16
+
+	Resources    []*AlterConfigsResource
+	ValidateOnly bool
+}
+
+type AlterConfigsResource struct {
+	Type    int8
+	Name    string
+	Configs []*AlterableConfig
+}
+
+// AlterableConfig is an operation on a config entry. Value is ignored by
+// deletes, and is a comma-separated list of values to add or remove by
+// appends and subtracts.
+type AlterableConfig struct {
+	Name      string
+	Operation int8
+	Value     string // empty is null
+}
+
+func (r *IncrementalAlterConfigsRequest) Encode(e PacketEncoder) (err error) {
+	if err = e.PutArrayLength(len(r.Resources)); err != nil {
+		return err
+	}
+	for _, res := range r.Resources {
+		e.PutInt8(res.Type)
+		if err = e.PutString(res.Name); err != nil {
+			return err
+		}
+		if err = e.PutArrayLength(len(res.Configs)); err != nil {
+			return err
+		}
+		for _, c := range res.Configs {
+			if err = e.PutString(c.Name); err != nil {
+				return err
+			}
+			e.PutInt8(c.Operation)
+			if err = putNullableString(e, c.Value); err != nil {
+				return err
+			}
+		}
+	}
+	e.PutBool(r.ValidateOnly)
+	return nil
+}
+
+func (r *IncrementalAlterConfigsRequest) Decode(d PacketDecoder) (err error) {
+	n, err := d.ArrayLength()
+	if err != nil {
+		return err
+	}
+	r.Resources = make([]*AlterConfigsResource, n)
+	for i := range r.Resources {
+		res := new(AlterConfigsResource)
+		if res.Type, err = d.Int8(); err != nil {
+			return err
+		}
+		if res.Name, err = d.String(); err != nil {
+			return err
+		}
+		cn, err := d.ArrayLength()
+		if err != nil {
+			return err
+		}
+		res.Configs = make([]*AlterableConfig, cn)
+		for j := range res.Configs {
+			c := new(AlterableConfig)
+			if c.Name, err = d.String(); err != nil {
+				return err
+			}
+			if c.Operation, err = d.Int8(); err != nil {
+				return err
+			}
+			if c.Value, err = d.String(); err != nil {
+				return err
+			}
+			res.Configs[j] = c
+		}
+		r.Resources[i] = res
+	}
+	r.ValidateOnly, err = d.Bool()
+	return err
+}
+
+func (r *IncrementalAlterConfigsRequest) Key() int16 {
+	return IncrementalAlterConfigsKey
+}
+
+func (r *IncrementalAlterConfigsRequest) Version() int16 {
+	return r.APIVersion
+}
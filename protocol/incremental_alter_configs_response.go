@@ -0,0 +1,61 @@
+package protocol
+
+type IncrementalAlterConfigsResponse struct {
+	APIVersion int16
+
+	ThrottleTimeMs int32
+	Resources      []*AlterConfigsResourceResponse
+}
+
+type AlterConfigsResourceResponse struct {
+	ErrorCode    int16
+	ErrorMessage string // empty is null
+	Type         int8
+	Name         string
+}
+
+func (r *IncrementalAlterConfigsResponse) Encode(e PacketEncoder) (err error) {
+	e.PutInt32(r.ThrottleTimeMs)
+	if err = e.PutArrayLength(len(r.Resources)); err != nil {
+		return err
+	}
+	for _, res := range r.Resources {
+		e.PutInt16(res.ErrorCode)
+		if err = putNullableString(e, res.ErrorMessage); err != nil {
+			return err
+		}
+		e.PutInt8(res.Type)
+		if err = e.PutString(res.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *IncrementalAlterConfigsResponse) Decode(d PacketDecoder) (err error) {
+	if r.ThrottleTimeMs, err = d.Int32(); err != nil {
+		return err
+	}
+	n, err := d.ArrayLength()
+	if err != nil {
+		return err
+	}
+	r.Resources = make([]*AlterConfigsResourceResponse, n)
+	for i := range r.Resources {
+		res := new(AlterConfigsResourceResponse)
+		if res.ErrorCode, err = d.Int16(); err != nil {
+			return err
+		}
+		if res.ErrorMessage, err = d.String(); err != nil {
+			return err
+		}
+		if res.Type, err = d.Int8(); err != nil {
+			return err
+		}
+		if res.Name, err = d.String(); err != nil {
+			return err
+		}
+		r.Resources[i] = res
+	}
+	return nil
+}
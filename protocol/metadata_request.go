@@ -1,17 +1,52 @@
 package protocol
 
 type MetadataRequest struct {
+	APIVersion int16
+
+	// Topics to get metadata for. In v1+ nil means all topics, while in v0
+	// empty means all topics.
 	Topics []string
 }
 
 func (r *MetadataRequest) Encode(e PacketEncoder) error {
-	e.PutStringArray(r.Topics)
-	return nil
+	if r.APIVersion >= 1 && r.Topics == nil {
+		e.PutInt32(-1)
+		return nil
+	}
+	return e.PutStringArray(r.Topics)
 }
 
 func (r *MetadataRequest) Decode(d PacketDecoder) (err error) {
-	r.Topics, err = d.StringArray()
-	return err
+	if r.APIVersion < 1 {
+		r.Topics, err = d.StringArray()
+		return err
+	}
+	n, err := d.Int32()
+	if err != nil {
+		return err
+	}
+	if n == -1 {
+		r.Topics = nil
+		return nil
+	}
+	if n < -1 || int(n) > d.remaining() {
+		return ErrInvalidArrayLength
+	}
+	r.Topics = make([]string, n)
+	for i := range r.Topics {
+		if r.Topics[i], err = d.String(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AllTopics returns whether the request is for all topics' metadata.
+func (r *MetadataRequest) AllTopics() bool {
+	if r.APIVersion >= 1 {
+		return r.Topics == nil
+	}
+	return len(r.Topics) == 0
 }
 
 func (r *MetadataRequest) Key() int16 {
@@ -19,5 +54,5 @@ func (r *MetadataRequest) Key() int16 {
 }
 
 func (r *MetadataRequest) Version() int16 {
-	return 0
+	return r.APIVersion
 }
@@ -4,7 +4,7 @@ type Broker struct {
 	NodeID int32
 	Host   string
 	Port   int32
-	// unsupported: Rack *string
+	Rack   string // v1+, empty is null
 }
 
 type PartitionMetadata struct {
@@ -18,13 +18,16 @@ type PartitionMetadata struct {
 type TopicMetadata struct {
 	TopicErrorCode    int16
 	Topic             string
+	IsInternal        bool // v1+
 	PartitionMetadata []*PartitionMetadata
 }
 
 type MetadataResponse struct {
-	Brokers []*Broker
-	// unsupported: ClusterID *string
-	// unsupported: ControllerID string
+	APIVersion int16
+
+	Brokers       []*Broker
+	ClusterID     string // v2+, empty is null
+	ControllerID  int32  // v1+, -1 if there isn't a controller
 	TopicMetadata []*TopicMetadata
 }
 
@@ -38,6 +41,19 @@ func (r *MetadataResponse) Encode(e PacketEncoder) (err error) {
 			return err
 		}
 		e.PutInt32(b.Port)
+		if r.APIVersion >= 1 {
+			if err = putNullableString(e, b.Rack); err != nil {
+				return err
+			}
+		}
+	}
+	if r.APIVersion >= 2 {
+		if err = putNullableString(e, r.ClusterID); err != nil {
+			return err
+		}
+	}
+	if r.APIVersion >= 1 {
+		e.PutInt32(r.ControllerID)
 	}
 	if err = e.PutArrayLength(len(r.TopicMetadata)); err != nil {
 		return err
@@ -47,6 +63,9 @@ func (r *MetadataResponse) Encode(e PacketEncoder) (err error) {
 		if err = e.PutString(t.Topic); err != nil {
 			return err
 		}
+		if r.APIVersion >= 1 {
+			e.PutBool(t.IsInternal)
+		}
 		if err = e.PutArrayLength(len(t.PartitionMetadata)); err != nil {
 			return err
 		}
@@ -81,10 +100,27 @@ func (r *MetadataResponse) Decode(d PacketDecoder) error {
 		if err != nil {
 			return err
 		}
+		var rack string
+		if r.APIVersion >= 1 {
+			if rack, err = d.String(); err != nil {
+				return err
+			}
+		}
 		r.Brokers[i] = &Broker{
 			NodeID: nodeID,
 			Host:   host,
 			Port:   port,
+			Rack:   rack,
+		}
+	}
+	if r.APIVersion >= 2 {
+		if r.ClusterID, err = d.String(); err != nil {
+			return err
+		}
+	}
+	if r.APIVersion >= 1 {
+		if r.ControllerID, err = d.Int32(); err != nil {
+			return err
 		}
 	}
 	topicCount, err := d.ArrayLength()
@@ -99,6 +135,11 @@ func (r *MetadataResponse) Decode(d PacketDecoder) error {
 		if err != nil {
 			return err
 		}
+		if r.APIVersion >= 1 {
+			if m.IsInternal, err = d.Bool(); err != nil {
+				return err
+			}
+		}
 		partitionCount, err := d.ArrayLength()
 		if err != nil {
 			return err
@@ -130,3 +171,12 @@ func (r *MetadataResponse) Decode(d PacketDecoder) error {
 	}
 	return nil
 }
+
+// putNullableString puts the string, or null if it's empty.
+func putNullableString(e PacketEncoder, in string) error {
+	if in == "" {
+		e.PutInt16(-1)
+		return nil
+	}
+	return e.PutString(in)
+}
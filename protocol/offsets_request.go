@@ -2,7 +2,10 @@ package protocol
 
 type OffsetsPartition struct {
 	Partition int32
-	Timestamp int64 // -1 to receive latest offset, -2 to receive earliest offset
+	// CurrentLeaderEpoch is the client's current leader epoch of the partition, v4+, used to
+	// fence clients with stale metadata. Clients that don't know it send -1.
+	CurrentLeaderEpoch int32
+	Timestamp          int64 // -1 to receive latest offset, -2 to receive earliest offset
 }
 
 type OffsetsTopic struct {
@@ -11,14 +14,23 @@ type OffsetsTopic struct {
 }
 
 type OffsetsRequest struct {
-	ReplicaID     int32
-	Topics        []*OffsetsTopic
+	APIVersion int16
+
+	// ReplicaID is the ID of the broker sending the request, -1 for clients.
+	ReplicaID int32
+	// IsolationLevel is 0 for read uncommitted and 1 for read committed, v2+.
+	IsolationLevel int8
+	Topics         []*OffsetsTopic
+	// MaxNumOffsets is the max number of offsets to return, v0 only.
 	MaxNumOffsets int32
 }
 
 func (r *OffsetsRequest) Encode(e PacketEncoder) error {
 	var err error
-	e.PutInt32(-1)
+	e.PutInt32(r.ReplicaID)
+	if r.APIVersion >= 2 {
+		e.PutInt8(r.IsolationLevel)
+	}
 	err = e.PutArrayLength(len(r.Topics))
 	if err != nil {
 		return err
@@ -34,10 +46,15 @@ func (r *OffsetsRequest) Encode(e PacketEncoder) error {
 		}
 		for _, p := range t.Partitions {
 			e.PutInt32(p.Partition)
+			if r.APIVersion >= 4 {
+				e.PutInt32(p.CurrentLeaderEpoch)
+			}
 			e.PutInt64(p.Timestamp)
 		}
 	}
-	e.PutInt32(r.MaxNumOffsets)
+	if r.APIVersion == 0 {
+		e.PutInt32(r.MaxNumOffsets)
+	}
 	return nil
 }
 
@@ -47,6 +64,12 @@ func (r *OffsetsRequest) Decode(d PacketDecoder) error {
 	if err != nil {
 		return err
 	}
+	if r.APIVersion >= 2 {
+		r.IsolationLevel, err = d.Int8()
+		if err != nil {
+			return err
+		}
+	}
 	topicCount, err := d.ArrayLength()
 	if err != nil {
 		return err
@@ -69,6 +92,12 @@ func (r *OffsetsRequest) Decode(d PacketDecoder) error {
 			if err != nil {
 				return err
 			}
+			if r.APIVersion >= 4 {
+				p.CurrentLeaderEpoch, err = d.Int32()
+				if err != nil {
+					return err
+				}
+			}
 			p.Timestamp, err = d.Int64()
 			if err != nil {
 				return err
@@ -77,7 +106,9 @@ func (r *OffsetsRequest) Decode(d PacketDecoder) error {
 		}
 		r.Topics[i] = ot
 	}
-	r.MaxNumOffsets, err = d.Int32()
+	if r.APIVersion == 0 {
+		r.MaxNumOffsets, err = d.Int32()
+	}
 	return err
 }
 
@@ -86,5 +117,5 @@ func (r *OffsetsRequest) Key() int16 {
 }
 
 func (r *OffsetsRequest) Version() int16 {
-	return 0
+	return r.APIVersion
 }
@@ -3,8 +3,13 @@ package protocol
 type PartitionResponse struct {
 	Partition int32
 	ErrorCode int16
-	// Timestamp int64
+	// Offsets are the partition's offsets before the requested timestamp, v0 only.
 	Offsets []int64
+	// Timestamp and Offset are the timestamp and offset found for the requested timestamp, v1+.
+	Timestamp int64
+	Offset    int64
+	// LeaderEpoch is the leader epoch of the found offset, v4+, -1 if it isn't known.
+	LeaderEpoch int32
 }
 
 type OffsetResponse struct {
@@ -13,20 +18,33 @@ type OffsetResponse struct {
 }
 
 type OffsetsResponse struct {
-	Responses []*OffsetResponse
+	APIVersion int16
+
+	// ThrottleTimeMs is the time the request was throttled for, v2+.
+	ThrottleTimeMs int32
+	Responses      []*OffsetResponse
 }
 
 func (r *OffsetsResponse) Encode(e PacketEncoder) error {
+	if r.APIVersion >= 2 {
+		e.PutInt32(r.ThrottleTimeMs)
+	}
 	e.PutArrayLength(len(r.Responses))
-	for _, r := range r.Responses {
-		e.PutString(r.Topic)
-		e.PutArrayLength(len(r.PartitionResponses))
-		for _, p := range r.PartitionResponses {
+	for _, resp := range r.Responses {
+		e.PutString(resp.Topic)
+		e.PutArrayLength(len(resp.PartitionResponses))
+		for _, p := range resp.PartitionResponses {
 			e.PutInt32(p.Partition)
 			e.PutInt16(p.ErrorCode)
-			// e.PutInt64(p.Timestamp)
-			e.PutInt64Array(p.Offsets)
-			// e.PutInt64(p.Offset)
+			if r.APIVersion == 0 {
+				e.PutInt64Array(p.Offsets)
+				continue
+			}
+			e.PutInt64(p.Timestamp)
+			e.PutInt64(p.Offset)
+			if r.APIVersion >= 4 {
+				e.PutInt32(p.LeaderEpoch)
+			}
 		}
 	}
 	return nil
@@ -34,6 +52,12 @@ func (r *OffsetsResponse) Encode(e PacketEncoder) error {
 
 func (r *OffsetsResponse) Decode(d PacketDecoder) error {
 	var err error
+	if r.APIVersion >= 2 {
+		r.ThrottleTimeMs, err = d.Int32()
+		if err != nil {
+			return err
+		}
+	}
 	l, err := d.ArrayLength()
 	if err != nil {
 		return err
@@ -61,23 +85,31 @@ func (r *OffsetsResponse) Decode(d PacketDecoder) error {
 			if err != nil {
 				return err
 			}
-			// v1:
-			// p.Timestamp, err = d.Int64()
-			// if err != nil {
-			// 	return err
-			// }
-			p.Offsets, err = d.Int64Array()
-			// v1:
-			// p.Offset, err = d.Int64()
+			if r.APIVersion == 0 {
+				p.Offsets, err = d.Int64Array()
+				if err != nil {
+					return err
+				}
+				ps[j] = p
+				continue
+			}
+			p.Timestamp, err = d.Int64()
+			if err != nil {
+				return err
+			}
+			p.Offset, err = d.Int64()
 			if err != nil {
 				return err
 			}
+			if r.APIVersion >= 4 {
+				p.LeaderEpoch, err = d.Int32()
+				if err != nil {
+					return err
+				}
+			}
 			ps[j] = p
 		}
 		resp.PartitionResponses = ps
 	}
-	if err != nil {
-		return err
-	}
 	return nil
 }
@@ -11,12 +11,20 @@ type TopicData struct {
 }
 
 type ProduceRequest struct {
-	Acks      int16
-	Timeout   int32
-	TopicData []*TopicData
+	APIVersion int16
+
+	TransactionalID string // v3+
+	Acks            int16
+	Timeout         int32
+	TopicData       []*TopicData
 }
 
 func (r *ProduceRequest) Encode(e PacketEncoder) (err error) {
+	if r.APIVersion >= 3 {
+		if err = putNullableString(e, r.TransactionalID); err != nil {
+			return err
+		}
+	}
 	e.PutInt16(r.Acks)
 	e.PutInt32(r.Timeout)
 	if err = e.PutArrayLength(len(r.TopicData)); err != nil {
@@ -40,6 +48,12 @@ func (r *ProduceRequest) Encode(e PacketEncoder) (err error) {
 }
 
 func (r *ProduceRequest) Decode(d PacketDecoder) (err error) {
+	if r.APIVersion >= 3 {
+		r.TransactionalID, err = d.String()
+		if err != nil {
+			return err
+		}
+	}
 	r.Acks, err = d.Int16()
 	if err != nil {
 		return err
@@ -49,6 +63,9 @@ func (r *ProduceRequest) Decode(d PacketDecoder) (err error) {
 		return err
 	}
 	topicCount, err := d.ArrayLength()
+	if err != nil {
+		return err
+	}
 	r.TopicData = make([]*TopicData, topicCount)
 	for i := range r.TopicData {
 		td := new(TopicData)
@@ -83,5 +100,8 @@ func (r *ProduceRequest) Key() int16 {
 }
 
 func (r *ProduceRequest) Version() int16 {
-	return 2
+	if r.APIVersion < 2 {
+		return 2
+	}
+	return r.APIVersion
 }
@@ -0,0 +1,682 @@
+package protocol
+
+import (
+	"reflect"
+	"testing"
+)
+
+type encodeDecoder interface {
+	Encoder
+	Decoder
+}
+
+func TestProtocol_RoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		in   encodeDecoder
+		out  encodeDecoder
+	}{
+		{
+			name: "produce request",
+			in: &ProduceRequest{
+				Acks:    -1,
+				Timeout: 1000,
+				TopicData: []*TopicData{{
+					Topic: "test",
+					Data: []*Data{
+						{Partition: 0, RecordSet: []byte("hello")},
+						{Partition: 1, RecordSet: []byte("world")},
+					},
+				}},
+			},
+			out: new(ProduceRequest),
+		},
+		{
+			name: "produce request v3",
+			in: &ProduceRequest{
+				APIVersion:      3,
+				TransactionalID: "txn",
+				Acks:            -1,
+				Timeout:         1000,
+				TopicData: []*TopicData{{
+					Topic: "test",
+					Data:  []*Data{{Partition: 0, RecordSet: []byte("hello")}},
+				}},
+			},
+			out: &ProduceRequest{APIVersion: 3},
+		},
+		{
+			name: "produce response",
+			in: &ProduceResponses{
+				Responses: []*ProduceResponse{{
+					Topic: "test",
+					PartitionResponses: []*ProducePartitionResponse{{
+						Partition:  1,
+						ErrorCode:  ErrNotLeaderForPartition.Code(),
+						BaseOffset: 42,
+						Timestamp:  1500000000,
+					}},
+				}},
+				ThrottleTimeMs: 5,
+			},
+			out: new(ProduceResponses),
+		},
+		{
+			name: "fetch request",
+			in: &FetchRequest{
+				ReplicaID:   2,
+				MaxWaitTime: 500,
+				MinBytes:    1,
+				Topics: []*FetchTopic{{
+					Topic: "test",
+					Partitions: []*FetchPartition{
+						{Partition: 0, FetchOffset: 10, MaxBytes: 1024},
+						{Partition: 3, FetchOffset: 7, MaxBytes: 2048},
+					},
+				}},
+			},
+			out: new(FetchRequest),
+		},
+		{
+			name: "fetch response",
+			in: &FetchResponses{
+				APIVersion:     1,
+				ThrottleTimeMs: 5,
+				Responses: []*FetchResponse{{
+					Topic: "test",
+					PartitionResponses: []*FetchPartitionResponse{{
+						Partition:     0,
+						ErrorCode:     ErrOffsetOutOfRange.Code(),
+						HighWatermark: 100,
+						RecordSet:     []byte("hello"),
+					}},
+				}},
+			},
+			out: &FetchResponses{APIVersion: 1},
+		},
+		{
+			// v0 responses have no throttle time.
+			name: "fetch response v0",
+			in: &FetchResponses{
+				Responses: []*FetchResponse{{
+					Topic: "test",
+					PartitionResponses: []*FetchPartitionResponse{{
+						Partition:     0,
+						HighWatermark: 100,
+						RecordSet:     []byte("hello"),
+					}},
+				}},
+			},
+			out: new(FetchResponses),
+		},
+		{
+			name: "fetch request v5",
+			in: &FetchRequest{
+				APIVersion:     5,
+				ReplicaID:      2,
+				MaxWaitTime:    500,
+				MinBytes:       1,
+				MaxBytes:       4096,
+				IsolationLevel: 1,
+				Topics: []*FetchTopic{{
+					Topic: "test",
+					Partitions: []*FetchPartition{
+						{Partition: 0, FetchOffset: 10, LogStartOffset: 4, MaxBytes: 1024},
+					},
+				}},
+			},
+			out: &FetchRequest{APIVersion: 5},
+		},
+		{
+			name: "fetch response v5",
+			in: &FetchResponses{
+				APIVersion:     5,
+				ThrottleTimeMs: 5,
+				Responses: []*FetchResponse{{
+					Topic: "test",
+					PartitionResponses: []*FetchPartitionResponse{{
+						Partition:           0,
+						ErrorCode:           ErrNone.Code(),
+						HighWatermark:       100,
+						LastStableOffset:    100,
+						LogStartOffset:      20,
+						AbortedTransactions: []*AbortedTransaction{{ProducerID: 7, FirstOffset: 30}},
+						RecordSet:           []byte("hello"),
+					}},
+				}},
+			},
+			out: &FetchResponses{APIVersion: 5},
+		},
+		{
+			name: "fetch request v9",
+			in: &FetchRequest{
+				APIVersion:     9,
+				ReplicaID:      -1,
+				MaxWaitTime:    500,
+				MinBytes:       1,
+				MaxBytes:       4096,
+				IsolationLevel: 1,
+				SessionID:      0,
+				SessionEpoch:   -1,
+				Topics: []*FetchTopic{{
+					Topic: "test",
+					Partitions: []*FetchPartition{
+						{Partition: 0, CurrentLeaderEpoch: 3, FetchOffset: 10, LogStartOffset: -1, MaxBytes: 1024},
+					},
+				}},
+				ForgottenTopics: []*ForgottenTopic{{Topic: "other", Partitions: []int32{1, 2}}},
+			},
+			out: &FetchRequest{APIVersion: 9},
+		},
+		{
+			name: "fetch response v9",
+			in: &FetchResponses{
+				APIVersion:     9,
+				ThrottleTimeMs: 5,
+				ErrorCode:      ErrNone.Code(),
+				SessionID:      0,
+				Responses: []*FetchResponse{{
+					Topic: "test",
+					PartitionResponses: []*FetchPartitionResponse{{
+						Partition:        0,
+						ErrorCode:        ErrFencedLeaderEpoch.Code(),
+						HighWatermark:    100,
+						LastStableOffset: 100,
+						LogStartOffset:   20,
+						RecordSet:        []byte("hello"),
+					}},
+				}},
+			},
+			out: &FetchResponses{APIVersion: 9},
+		},
+		{
+			name: "metadata request",
+			in:   &MetadataRequest{Topics: []string{"test", "other"}},
+			out:  new(MetadataRequest),
+		},
+		{
+			name: "metadata response",
+			in: &MetadataResponse{
+				Brokers: []*Broker{
+					{NodeID: 1, Host: "localhost", Port: 9092},
+					{NodeID: 2, Host: "localhost", Port: 9093},
+				},
+				TopicMetadata: []*TopicMetadata{{
+					TopicErrorCode: ErrNone.Code(),
+					Topic:          "test",
+					PartitionMetadata: []*PartitionMetadata{{
+						PartitionErrorCode: ErrNone.Code(),
+						ParititionID:       0,
+						Leader:             1,
+						Replicas:           []int32{1, 2},
+						ISR:                []int32{1},
+					}},
+				}},
+			},
+			out: new(MetadataResponse),
+		},
+		{
+			name: "metadata request v1",
+			in:   &MetadataRequest{APIVersion: 1, Topics: []string{}},
+			out:  &MetadataRequest{APIVersion: 1},
+		},
+		{
+			name: "metadata request v1 all topics",
+			in:   &MetadataRequest{APIVersion: 1},
+			out:  &MetadataRequest{APIVersion: 1},
+		},
+		{
+			name: "metadata response v1",
+			in: &MetadataResponse{
+				APIVersion: 1,
+				Brokers: []*Broker{
+					{NodeID: 1, Host: "localhost", Port: 9092, Rack: "rack-a"},
+					{NodeID: 2, Host: "localhost", Port: 9093},
+				},
+				ControllerID: 2,
+				TopicMetadata: []*TopicMetadata{{
+					TopicErrorCode: ErrNone.Code(),
+					Topic:          "test",
+					IsInternal:     true,
+					PartitionMetadata: []*PartitionMetadata{{
+						PartitionErrorCode: ErrNone.Code(),
+						ParititionID:       0,
+						Leader:             1,
+						Replicas:           []int32{1, 2},
+						ISR:                []int32{1},
+					}},
+				}},
+			},
+			out: &MetadataResponse{APIVersion: 1},
+		},
+		{
+			name: "metadata response v2",
+			in: &MetadataResponse{
+				APIVersion: 2,
+				Brokers: []*Broker{
+					{NodeID: 1, Host: "localhost", Port: 9092},
+				},
+				ClusterID:    "the-cluster-id",
+				ControllerID: 1,
+				TopicMetadata: []*TopicMetadata{{
+					TopicErrorCode: ErrNone.Code(),
+					Topic:          "test",
+					PartitionMetadata: []*PartitionMetadata{{
+						PartitionErrorCode: ErrNone.Code(),
+						ParititionID:       0,
+						Leader:             1,
+						Replicas:           []int32{1},
+						ISR:                []int32{1},
+					}},
+				}},
+			},
+			out: &MetadataResponse{APIVersion: 2},
+		},
+		{
+			name: "offsets request",
+			in: &OffsetsRequest{
+				ReplicaID: -1,
+				Topics: []*OffsetsTopic{{
+					Topic: "test",
+					Partitions: []*OffsetsPartition{
+						{Partition: 0, Timestamp: -1},
+						{Partition: 1, Timestamp: -2},
+					},
+				}},
+				MaxNumOffsets: 1,
+			},
+			out: new(OffsetsRequest),
+		},
+		{
+			// broker 0's ID is encoded as is rather than as a client's.
+			name: "offsets request from replica 0",
+			in: &OffsetsRequest{
+				ReplicaID: 0,
+				Topics: []*OffsetsTopic{{
+					Topic:      "test",
+					Partitions: []*OffsetsPartition{{Partition: 0, Timestamp: -1}},
+				}},
+				MaxNumOffsets: 1,
+			},
+			out: new(OffsetsRequest),
+		},
+		{
+			name: "offsets response",
+			in: &OffsetsResponse{
+				Responses: []*OffsetResponse{{
+					Topic: "test",
+					PartitionResponses: []*PartitionResponse{{
+						Partition: 1,
+						ErrorCode: ErrNone.Code(),
+						Offsets:   []int64{0, 12},
+					}},
+				}},
+			},
+			out: new(OffsetsResponse),
+		},
+		{
+			name: "offsets request v4",
+			in: &OffsetsRequest{
+				APIVersion:     4,
+				ReplicaID:      1,
+				IsolationLevel: 1,
+				Topics: []*OffsetsTopic{{
+					Topic: "test",
+					Partitions: []*OffsetsPartition{
+						{Partition: 0, CurrentLeaderEpoch: 3, Timestamp: -1},
+						{Partition: 1, CurrentLeaderEpoch: -1, Timestamp: 1500000000000},
+					},
+				}},
+			},
+			out: &OffsetsRequest{APIVersion: 4},
+		},
+		{
+			name: "offsets response v1",
+			in: &OffsetsResponse{
+				APIVersion: 1,
+				Responses: []*OffsetResponse{{
+					Topic: "test",
+					PartitionResponses: []*PartitionResponse{{
+						Partition: 1,
+						ErrorCode: ErrNone.Code(),
+						Timestamp: -1,
+						Offset:    12,
+					}},
+				}},
+			},
+			out: &OffsetsResponse{APIVersion: 1},
+		},
+		{
+			name: "offsets response v4",
+			in: &OffsetsResponse{
+				APIVersion:     4,
+				ThrottleTimeMs: 10,
+				Responses: []*OffsetResponse{{
+					Topic: "test",
+					PartitionResponses: []*PartitionResponse{{
+						Partition:   1,
+						ErrorCode:   ErrNone.Code(),
+						Timestamp:   1500000000000,
+						Offset:      12,
+						LeaderEpoch: 3,
+					}},
+				}},
+			},
+			out: &OffsetsResponse{APIVersion: 4},
+		},
+		{
+			name: "leader and isr request",
+			in: &LeaderAndISRRequest{
+				ControllerID:    1,
+				ControllerEpoch: 3,
+				PartitionStates: []*PartitionState{{
+					Topic:           "test",
+					Partition:       0,
+					ControllerEpoch: 3,
+					Leader:          1,
+					LeaderEpoch:     2,
+					ISR:             []int32{1, 2},
+					ZKVersion:       1,
+					Replicas:        []int32{1, 2, 3},
+				}},
+				LiveLeaders: []*LiveLeader{{ID: 1, Host: "localhost", Port: 9092}},
+			},
+			out: new(LeaderAndISRRequest),
+		},
+		{
+			name: "find coordinator request v1",
+			in: &GroupCoordinatorRequest{
+				APIVersion:      1,
+				GroupID:         "the-transactional-id",
+				CoordinatorType: CoordinatorTransaction,
+			},
+			out: &GroupCoordinatorRequest{APIVersion: 1},
+		},
+		{
+			name: "find coordinator response v1",
+			in: &GroupCoordinatorResponse{
+				APIVersion:     1,
+				ThrottleTimeMs: 5,
+				ErrorCode:      ErrCoordinatorNotAvailable.Code(),
+				ErrorMessage:   ErrCoordinatorNotAvailable.Error(),
+				Coordinator:    &Coordinator{NodeID: -1, Port: -1},
+			},
+			out: &GroupCoordinatorResponse{APIVersion: 1},
+		},
+		{
+			name: "alter partition request",
+			in: &AlterPartitionRequest{
+				BrokerID:    1,
+				BrokerEpoch: 5,
+				Topics: []*AlterPartitionTopic{{
+					Topic: "test",
+					Partitions: []*AlterPartitionPartition{
+						{Partition: 0, LeaderEpoch: 2, NewISR: []int32{1, 2, 3}, PartitionEpoch: 4},
+						{Partition: 1, LeaderEpoch: 1, NewISR: []int32{1}, PartitionEpoch: 7},
+					},
+				}},
+			},
+			out: new(AlterPartitionRequest),
+		},
+		{
+			name: "alter partition response",
+			in: &AlterPartitionResponse{
+				ThrottleTimeMs: 5,
+				Topics: []*AlterPartitionTopicResponse{{
+					Topic: "test",
+					Partitions: []*AlterPartitionPartitionResponse{
+						{Partition: 0, LeaderID: 1, LeaderEpoch: 2, ISR: []int32{1, 2, 3}, PartitionEpoch: 5},
+						{Partition: 1, ErrorCode: ErrFencedLeaderEpoch.Code(), LeaderID: 1, LeaderEpoch: 2, ISR: []int32{1}, PartitionEpoch: 7},
+					},
+				}},
+			},
+			out: new(AlterPartitionResponse),
+		},
+		{
+			name: "incremental alter configs request",
+			in: &IncrementalAlterConfigsRequest{
+				Resources: []*AlterConfigsResource{{
+					Type: ConfigResourceTopic,
+					Name: "test",
+					Configs: []*AlterableConfig{
+						{Name: "retention.ms", Operation: ConfigOperationSet, Value: "1000"},
+						{Name: "retention.bytes", Operation: ConfigOperationDelete},
+					},
+				}},
+				ValidateOnly: true,
+			},
+			out: new(IncrementalAlterConfigsRequest),
+		},
+		{
+			name: "incremental alter configs response",
+			in: &IncrementalAlterConfigsResponse{
+				ThrottleTimeMs: 5,
+				Resources: []*AlterConfigsResourceResponse{
+					{Type: ConfigResourceTopic, Name: "test"},
+					{ErrorCode: ErrInvalidConfig.Code(), ErrorMessage: "invalid config", Type: ConfigResourceBroker, Name: "1"},
+				},
+			},
+			out: new(IncrementalAlterConfigsResponse),
+		},
+		{
+			name: "describe configs request v1",
+			in: &DescribeConfigsRequest{
+				APIVersion: 1,
+				Resources: []*DescribeConfigsResource{
+					{Type: ConfigResourceTopic, Name: "test", ConfigNames: []string{"retention.ms"}},
+					{Type: ConfigResourceBroker, Name: "1"},
+				},
+				IncludeSynonyms: true,
+			},
+			out: &DescribeConfigsRequest{APIVersion: 1},
+		},
+		{
+			name: "describe configs response v0",
+			in: &DescribeConfigsResponse{
+				Results: []*DescribeConfigsResult{{
+					Type: ConfigResourceTopic,
+					Name: "test",
+					Configs: []*DescribeConfigsEntry{
+						{Name: "retention.ms", Value: "604800000", IsDefault: true},
+					},
+				}},
+			},
+			out: new(DescribeConfigsResponse),
+		},
+		{
+			name: "describe configs response v1",
+			in: &DescribeConfigsResponse{
+				APIVersion: 1,
+				Results: []*DescribeConfigsResult{{
+					Type: ConfigResourceTopic,
+					Name: "test",
+					Configs: []*DescribeConfigsEntry{{
+						Name:   "retention.ms",
+						Value:  "1000",
+						Source: ConfigSourceDynamicTopicConfig,
+						Synonyms: []*DescribeConfigsSynonym{
+							{Name: "retention.ms", Value: "1000", Source: ConfigSourceDynamicTopicConfig},
+							{Name: "retention.ms", Value: "604800000", Source: ConfigSourceDefaultConfig},
+						},
+					}},
+				}},
+			},
+			out: &DescribeConfigsResponse{APIVersion: 1},
+		},
+		{
+			name: "controlled shutdown request v2",
+			in:   &ControlledShutdownRequest{APIVersion: 2, BrokerID: 1, BrokerEpoch: 5},
+			out:  &ControlledShutdownRequest{APIVersion: 2},
+		},
+		{
+			name: "controlled shutdown response",
+			in: &ControlledShutdownResponse{
+				RemainingPartitions: []*ControlledShutdownPartition{
+					{Topic: "test", Partition: 0},
+					{Topic: "test", Partition: 2},
+				},
+			},
+			out: new(ControlledShutdownResponse),
+		},
+		{
+			name: "delete records request",
+			in: &DeleteRecordsRequest{
+				Topics: []*DeleteRecordsTopic{{
+					Topic:      "test",
+					Partitions: []*DeleteRecordsPartition{{Partition: 0, Offset: 3}, {Partition: 1, Offset: -1}},
+				}},
+				Timeout: 1000,
+			},
+			out: new(DeleteRecordsRequest),
+		},
+		{
+			name: "delete records response",
+			in: &DeleteRecordsResponse{
+				ThrottleTime: 5,
+				Topics: []*DeleteRecordsTopicResponse{{
+					Topic: "test",
+					Partitions: []*DeleteRecordsPartitionResponse{
+						{Partition: 0, LowWatermark: 3},
+						{Partition: 1, LowWatermark: -1, ErrorCode: ErrOffsetOutOfRange.Code()},
+					},
+				}},
+			},
+			out: new(DeleteRecordsResponse),
+		},
+		{
+			name: "create topics request v2",
+			in: &CreateTopicRequests{
+				APIVersion: 2,
+				Requests: []*CreateTopicRequest{{
+					Topic:             "test",
+					NumPartitions:     -1,
+					ReplicationFactor: -1,
+					ReplicaAssignment: map[int32][]int32{0: {1, 2}},
+					Configs:           map[string]string{"retention.ms": "1000"},
+				}},
+				Timeout:      1000,
+				ValidateOnly: true,
+			},
+			out: &CreateTopicRequests{APIVersion: 2},
+		},
+		{
+			name: "create topics request v6",
+			in: &CreateTopicRequests{
+				APIVersion: 6,
+				Requests: []*CreateTopicRequest{{
+					Topic:             "test",
+					NumPartitions:     -1,
+					ReplicationFactor: -1,
+					ReplicaAssignment: map[int32][]int32{0: {1, 2}},
+					Configs:           map[string]string{"retention.ms": "1000"},
+				}},
+				Timeout:      1000,
+				ValidateOnly: true,
+			},
+			out: &CreateTopicRequests{APIVersion: 6},
+		},
+		{
+			name: "create topics response v6",
+			in: &CreateTopicsResponse{
+				APIVersion:     6,
+				ThrottleTimeMs: 5,
+				TopicErrorCodes: []*TopicErrorCode{
+					{Topic: "created", ErrorCode: ErrNone.Code(), NumPartitions: 3, ReplicationFactor: 2},
+					{Topic: "throttled", ErrorCode: ErrThrottlingQuotaExceeded.Code(), ErrorMessage: "throttling quota exceeded"},
+				},
+			},
+			out: &CreateTopicsResponse{APIVersion: 6},
+		},
+		{
+			name: "delete topics request v5",
+			in: &DeleteTopicsRequest{
+				APIVersion: 5,
+				Topics:     []string{"first", "second"},
+				Timeout:    1000,
+			},
+			out: &DeleteTopicsRequest{APIVersion: 5},
+		},
+		{
+			name: "delete topics response v5",
+			in: &DeleteTopicsResponse{
+				APIVersion:     5,
+				ThrottleTimeMs: 5,
+				TopicErrorCodes: []*TopicErrorCode{
+					{Topic: "deleted", ErrorCode: ErrNone.Code()},
+					{Topic: "throttled", ErrorCode: ErrThrottlingQuotaExceeded.Code(), ErrorMessage: "throttling quota exceeded"},
+				},
+			},
+			out: &DeleteTopicsResponse{APIVersion: 5},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := Encode(tt.in)
+			if err != nil {
+				t.Fatalf("Encode() error = %v", err)
+			}
+			if err = Decode(b, tt.out); err != nil {
+				t.Fatalf("Decode() error = %v", err)
+			}
+			if !reflect.DeepEqual(tt.in, tt.out) {
+				t.Errorf("Decode(Encode()) = %+v, want %+v", tt.out, tt.in)
+			}
+		})
+	}
+}
+
+func TestAlterPartition_nullArrays(t *testing.T) {
+	tests := []struct {
+		name string
+		b    []byte
+		out  Decoder
+	}{
+		// broker id, broker epoch, and null topics.
+		{name: "request topics", b: []byte{0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 1, 0}, out: new(AlterPartitionRequest)},
+		// broker id, broker epoch, a topic "t", and null partitions.
+		{name: "request partitions", b: []byte{0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 1, 2, 2, 't', 0}, out: new(AlterPartitionRequest)},
+		// throttle time, error code, and null topics.
+		{name: "response topics", b: []byte{0, 0, 0, 0, 0, 0, 0}, out: new(AlterPartitionResponse)},
+		// throttle time, error code, a topic "t", and null partitions.
+		{name: "response partitions", b: []byte{0, 0, 0, 0, 0, 0, 2, 2, 't', 0}, out: new(AlterPartitionResponse)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.out.Decode(NewDecoder(tt.b)); err != ErrInvalidArrayLength {
+				t.Errorf("Decode() error = %v, want %v", err, ErrInvalidArrayLength)
+			}
+		})
+	}
+}
+
+func TestDescribeConfigsResponse_redactedValueNull(t *testing.T) {
+	b, err := Encode(&DescribeConfigsResponse{
+		Results: []*DescribeConfigsResult{{
+			Type: ConfigResourceBroker,
+			Name: "1",
+			Configs: []*DescribeConfigsEntry{
+				{Name: "p", IsSensitive: true},
+			},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the throttle time, results length, error code, null error message, type, name, configs
+	// length, and config name come before the config's value.
+	n := 4 + 4 + 2 + 2 + 1 + 3 + 4 + 3
+	if got := int16(Encoding.Uint16(b[n:])); got != -1 {
+		t.Errorf("redacted value length = %v, want -1, null", got)
+	}
+}
+
+func TestFetchResponses_v0NoThrottleTime(t *testing.T) {
+	b, err := Encode(&FetchResponses{Responses: []*FetchResponse{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// just the responses' length.
+	if len(b) != 4 {
+		t.Errorf("len(v0 response) = %v, want 4", len(b))
+	}
+}
@@ -21,6 +21,9 @@ func (r *Request) Encode(pe PacketEncoder) (err error) {
 	if err != nil {
 		return err
 	}
+	if RequestHeaderVersion(r.Body.Key(), r.Body.Version()) >= 2 {
+		pe.PutEmptyTaggedFields()
+	}
 	r.Body.Encode(pe)
 	pe.Pop()
 	return nil
@@ -11,6 +11,8 @@ type RequestHeader struct {
 	CorrelationID int32
 	// Size of the Client ID
 	ClientID string
+	// Tagged fields of v2 headers, used by flexible versions
+	TaggedFields TaggedFields
 }
 
 func (r *RequestHeader) Encode(e PacketEncoder) {
@@ -19,6 +21,9 @@ func (r *RequestHeader) Encode(e PacketEncoder) {
 	e.PutInt16(r.APIVersion)
 	e.PutInt32(r.CorrelationID)
 	e.PutString(r.ClientID)
+	if RequestHeaderVersion(r.APIKey, r.APIVersion) >= 2 {
+		r.TaggedFields.Encode(e)
+	}
 }
 
 func (r *RequestHeader) Decode(d PacketDecoder) error {
@@ -40,5 +45,11 @@ func (r *RequestHeader) Decode(d PacketDecoder) error {
 		return err
 	}
 	r.ClientID, err = d.String()
-	return err
+	if err != nil {
+		return err
+	}
+	if RequestHeaderVersion(r.APIKey, r.APIVersion) >= 2 {
+		return r.TaggedFields.Decode(d)
+	}
+	return nil
 }
@@ -0,0 +1,104 @@
+package protocol
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRequestHeader_V2(t *testing.T) {
+	b := []byte{
+		0x00, 0x00, 0x00, 0x14, // size
+		0x00, 0x03, // api key: metadata
+		0x00, 0x09, // api version: 9, a flexible version
+		0x00, 0x00, 0x00, 0x07, // correlation id
+		0x00, 0x03, 'c', 'l', 'i', // client id
+		0x01,       // one tagged field
+		0x05,       // tag
+		0x02,       // size
+		0xaa, 0xbb, // data
+	}
+	header := new(RequestHeader)
+	d := NewDecoder(b)
+	if err := header.Decode(d); err != nil {
+		t.Fatalf("Decode() error = %v", err)
+	}
+	if d.remaining() != 0 {
+		t.Errorf("Decode() remaining = %v, want %v", d.remaining(), 0)
+	}
+	want := &RequestHeader{
+		Size:          20,
+		APIKey:        MetadataKey,
+		APIVersion:    9,
+		CorrelationID: 7,
+		ClientID:      "cli",
+		TaggedFields:  TaggedFields{{Tag: 5, Data: []byte{0xaa, 0xbb}}},
+	}
+	if !reflect.DeepEqual(header, want) {
+		t.Errorf("Decode() = %+v, want %+v", header, want)
+	}
+
+	lenEnc := new(LenEncoder)
+	header.Encode(lenEnc)
+	got := make([]byte, lenEnc.Length)
+	header.Encode(NewByteEncoder(got))
+	if !reflect.DeepEqual(got, b) {
+		t.Errorf("Encode() = %v, want %v", got, b)
+	}
+}
+
+func TestRequestHeader_V1(t *testing.T) {
+	header := &RequestHeader{
+		Size:          13,
+		APIKey:        MetadataKey,
+		APIVersion:    0,
+		CorrelationID: 7,
+		ClientID:      "cli",
+		// ignored by v1 headers
+		TaggedFields: TaggedFields{{Tag: 5, Data: []byte{0xaa}}},
+	}
+	lenEnc := new(LenEncoder)
+	header.Encode(lenEnc)
+	if lenEnc.Length != 17 {
+		t.Errorf("Encode() length = %v, want %v", lenEnc.Length, 17)
+	}
+}
+
+func TestResponseHeaderVersion(t *testing.T) {
+	if v := ResponseHeaderVersion(MetadataKey, 9); v != 1 {
+		t.Errorf("ResponseHeaderVersion(MetadataKey, 9) = %v, want %v", v, 1)
+	}
+	if v := ResponseHeaderVersion(APIVersionsKey, 3); v != 0 {
+		t.Errorf("ResponseHeaderVersion(APIVersionsKey, 3) = %v, want %v", v, 0)
+	}
+}
+
+func TestRequest_flexibleHeader(t *testing.T) {
+	body := &AlterPartitionRequest{
+		BrokerID:    1,
+		BrokerEpoch: 2,
+		Topics: []*AlterPartitionTopic{{
+			Topic:      "test",
+			Partitions: []*AlterPartitionPartition{{Partition: 0, LeaderEpoch: 1, NewISR: []int32{1, 2}, PartitionEpoch: 3}},
+		}},
+	}
+	b, err := Encode(&Request{CorrelationID: 7, ClientID: "cli", Body: body})
+	if err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+	// a flexible request's header ends with tagged fields, which the server decodes before the body.
+	d := NewDecoder(b)
+	header := new(RequestHeader)
+	if err := header.Decode(d); err != nil {
+		t.Fatalf("Decode() error = %v", err)
+	}
+	if header.APIKey != AlterPartitionKey || header.CorrelationID != 7 || header.ClientID != "cli" {
+		t.Errorf("Decode() = %+v", header)
+	}
+	got := new(AlterPartitionRequest)
+	if err := got.Decode(d); err != nil {
+		t.Fatalf("Decode() error = %v", err)
+	}
+	if !reflect.DeepEqual(got, body) {
+		t.Errorf("Decode() = %+v, want %+v", got, body)
+	}
+}
@@ -8,14 +8,20 @@ type ResponseBody interface {
 type Response struct {
 	Size          int32
 	CorrelationID int32
+	// HeaderVersion is the version of the response header, v1 headers end
+	// with tagged fields
+	HeaderVersion int16
+	TaggedFields  TaggedFields
 	Body          ResponseBody
 }
 
 func (r *Response) Encode(pe PacketEncoder) (err error) {
 	pe.Push(&SizeField{})
 	pe.PutInt32(r.CorrelationID)
-	if err != nil {
-		return err
+	if r.HeaderVersion >= 1 {
+		if err = r.TaggedFields.Encode(pe); err != nil {
+			return err
+		}
 	}
 	err = r.Body.Encode(pe)
 	if err != nil {
@@ -31,6 +37,14 @@ func (r *Response) Decode(pd PacketDecoder) (err error) {
 		return err
 	}
 	r.CorrelationID, err = pd.Int32()
+	if err != nil {
+		return err
+	}
+	if r.HeaderVersion >= 1 {
+		if err = r.TaggedFields.Decode(pd); err != nil {
+			return err
+		}
+	}
 	if r.Body != nil {
 		r.Body.Decode(pd)
 	}
@@ -0,0 +1,135 @@
+package protocol
+
+// TaggedField is a field in a flexible version's tagged fields section.
+type TaggedField struct {
+	Tag  uint64
+	Data []byte
+}
+
+// TaggedFields is the tagged fields section that ends flexible versions'
+// headers and structures. Since no tags are supported yet, fields are kept as
+// raw bytes so they're passed through unchanged.
+type TaggedFields []TaggedField
+
+func (t TaggedFields) Encode(e PacketEncoder) (err error) {
+	e.PutUVarint(uint64(len(t)))
+	for _, f := range t {
+		e.PutUVarint(f.Tag)
+		e.PutUVarint(uint64(len(f.Data)))
+		if err = e.PutRawBytes(f.Data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *TaggedFields) Decode(d PacketDecoder) error {
+	count, err := d.UVarint()
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		*t = nil
+		return nil
+	}
+	if count > uint64(d.remaining()) {
+		return ErrInsufficientData
+	}
+	fields := make(TaggedFields, count)
+	for i := range fields {
+		if fields[i].Tag, err = d.UVarint(); err != nil {
+			return err
+		}
+		size, err := d.UVarint()
+		if err != nil {
+			return err
+		}
+		if size > uint64(d.remaining()) {
+			return ErrInsufficientData
+		}
+		if fields[i].Data, err = d.RawBytes(int(size)); err != nil {
+			return err
+		}
+	}
+	*t = fields
+	return nil
+}
+
+// RequestHeaderVersion returns the version of the request header used by the
+// given version of the API.
+func RequestHeaderVersion(key, version int16) int16 {
+	if IsFlexible(key, version) {
+		return 2
+	}
+	return 1
+}
+
+// ResponseHeaderVersion returns the version of the response header used by the
+// given version of the API. API versions responses always use v0 so clients
+// can parse them before knowing which versions the broker supports.
+func ResponseHeaderVersion(key, version int16) int16 {
+	if key != APIVersionsKey && IsFlexible(key, version) {
+		return 1
+	}
+	return 0
+}
+
+// putArrayLength puts the array's length, compact if the version's flexible.
+func putArrayLength(e PacketEncoder, in int, flexible bool) error {
+	if flexible {
+		return e.PutCompactArrayLength(in)
+	}
+	return e.PutArrayLength(in)
+}
+
+// putString puts the string, compact if the version's flexible.
+func putString(e PacketEncoder, in string, flexible bool) error {
+	if flexible {
+		return e.PutCompactString(in)
+	}
+	return e.PutString(in)
+}
+
+// putNullableFlexibleString puts the string, or null if it's empty, compact if the version's
+// flexible.
+func putNullableFlexibleString(e PacketEncoder, in string, flexible bool) error {
+	if !flexible {
+		return putNullableString(e, in)
+	}
+	if in == "" {
+		e.PutUVarint(0)
+		return nil
+	}
+	return e.PutCompactString(in)
+}
+
+// putTaggedFields puts an empty tagged fields section if the version's flexible.
+func putTaggedFields(e PacketEncoder, flexible bool) {
+	if flexible {
+		e.PutEmptyTaggedFields()
+	}
+}
+
+// arrayLength decodes the array's length, compact if the version's flexible.
+func arrayLength(d PacketDecoder, flexible bool) (int, error) {
+	if flexible {
+		return d.CompactArrayLength()
+	}
+	return d.ArrayLength()
+}
+
+// decodeString decodes the string, compact if the version's flexible. Null strings are empty.
+func decodeString(d PacketDecoder, flexible bool) (string, error) {
+	if flexible {
+		return d.CompactString()
+	}
+	return d.String()
+}
+
+// taggedFields skips the tagged fields section if the version's flexible.
+func taggedFields(d PacketDecoder, flexible bool) error {
+	if flexible {
+		return d.TaggedFields()
+	}
+	return nil
+}
@@ -3,6 +3,7 @@ package raft
 import (
 	"encoding/json"
 	"io"
+	"sync"
 
 	"github.com/hashicorp/raft"
 	"github.com/travisjeffery/jocko"
@@ -12,23 +13,49 @@ import (
 type fsm struct {
 	logger    *simplelog.Logger
 	commandCh chan<- jocko.RaftCommand
+
+	// commands are the commands applied so far. The broker's state, e.g. its topics and the
+	// cluster's ID, is built from them, so they're what's snapshotted and replayed on restore.
+	mu       sync.Mutex
+	commands []jocko.RaftCommand
 }
 
+// Restore replays the snapshot's commands to the broker, in the order they were applied.
 func (s *fsm) Restore(rc io.ReadCloser) error {
+	defer rc.Close()
+	var commands []jocko.RaftCommand
+	// snapshots taken before commands were snapshotted are empty.
+	if err := json.NewDecoder(rc).Decode(&commands); err != nil && err != io.EOF {
+		return err
+	}
+	s.mu.Lock()
+	s.commands = commands
+	s.mu.Unlock()
+	for _, c := range commands {
+		s.commandCh <- c
+	}
 	return nil
 }
 
 type FSMSnapshot struct {
+	commands []jocko.RaftCommand
 }
 
 func (f *FSMSnapshot) Persist(sink raft.SnapshotSink) error {
+	if err := json.NewEncoder(sink).Encode(f.commands); err != nil {
+		sink.Cancel()
+		return err
+	}
 	return nil
 }
 
 func (f *FSMSnapshot) Release() {}
 
 func (s *fsm) Snapshot() (raft.FSMSnapshot, error) {
-	return &FSMSnapshot{}, nil
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// commands are only appended to, so the snapshot can share them.
+	return &FSMSnapshot{commands: s.commands[:len(s.commands):len(s.commands)]}, nil
 }
 
 // Apply forwards the commands received over command channel to be
@@ -39,6 +66,9 @@ func (s *fsm) Apply(l *raft.Log) interface{} {
 		s.logger.Info("json unmarshal failed: bad raft command")
 		return nil
 	}
+	s.mu.Lock()
+	s.commands = append(s.commands, c)
+	s.mu.Unlock()
 	s.commandCh <- c
 	return nil
 }
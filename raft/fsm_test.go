@@ -0,0 +1,70 @@
+package raft
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/raft"
+	"github.com/travisjeffery/jocko"
+	"github.com/travisjeffery/simplelog"
+)
+
+type snapshotSink struct {
+	bytes.Buffer
+}
+
+func (s *snapshotSink) ID() string    { return "the-snapshot" }
+func (s *snapshotSink) Cancel() error { return nil }
+func (s *snapshotSink) Close() error  { return nil }
+
+func TestFSM_snapshotRestore(t *testing.T) {
+	logger := simplelog.New(ioutil.Discard, simplelog.DEBUG, "jocko/rafttest")
+	commandCh := make(chan jocko.RaftCommand, 2)
+	s := &fsm{logger: logger, commandCh: commandCh}
+	var commands []jocko.RaftCommand
+	for i, data := range []string{`{"id":"the-cluster-id"}`, `{"topic":"the-topic"}`} {
+		raw := json.RawMessage(data)
+		c := jocko.RaftCommand{Cmd: jocko.RaftCmdType(i), Data: &raw}
+		b, err := json.Marshal(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.Apply(&raft.Log{Data: b})
+		commands = append(commands, <-commandCh)
+	}
+
+	snapshot, err := s.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := new(snapshotSink)
+	if err := snapshot.Persist(sink); err != nil {
+		t.Fatal(err)
+	}
+
+	// the restored broker's applied the same commands, e.g. setting the same cluster id.
+	restored := &fsm{logger: logger, commandCh: commandCh}
+	if err := restored.Restore(ioutil.NopCloser(&sink.Buffer)); err != nil {
+		t.Fatal(err)
+	}
+	close(commandCh)
+	var got []jocko.RaftCommand
+	for c := range commandCh {
+		got = append(got, c)
+	}
+	if !reflect.DeepEqual(got, commands) {
+		t.Errorf("restored commands = %v, want %v", got, commands)
+	}
+	if !reflect.DeepEqual(restored.commands, s.commands) {
+		t.Errorf("restored fsm's commands = %v, want %v", restored.commands, s.commands)
+	}
+
+	// snapshots taken before commands were snapshotted are empty.
+	empty := &fsm{logger: logger}
+	if err := empty.Restore(ioutil.NopCloser(new(bytes.Buffer))); err != nil {
+		t.Errorf("Restore() of an empty snapshot err = %v", err)
+	}
+}
@@ -1,7 +1,6 @@
 package raft
 
 import (
-	"net"
 	"time"
 
 	"github.com/travisjeffery/jocko"
@@ -14,6 +13,7 @@ func (b *Raft) monitorLeadership(notifyCh <-chan bool, serfEventCh <-chan *jocko
 	for {
 		select {
 		case isLeader := <-notifyCh:
+			b.metrics.setLeader(isLeader)
 			if isLeader {
 				stopCh = make(chan struct{})
 				go b.leaderLoop(stopCh, serfEventCh)
@@ -24,6 +24,7 @@ func (b *Raft) monitorLeadership(notifyCh <-chan bool, serfEventCh <-chan *jocko
 				b.logger.Info("cluster leadership lost")
 			}
 		case <-b.shutdownCh:
+			b.metrics.setLeader(false)
 			return
 		}
 	}
@@ -107,8 +108,7 @@ func (b *Raft) reconcileMember(member *jocko.ClusterMember) error {
 	var err error
 	switch member.Status {
 	case jocko.StatusAlive:
-		addr := &net.TCPAddr{IP: net.ParseIP(member.IP), Port: member.RaftPort}
-		err = b.addPeer(addr.String())
+		err = b.addPeer(member.RaftAddr())
 	case jocko.StatusLeft, jocko.StatusReap:
 		err = b.removePeer(member.IP)
 	}
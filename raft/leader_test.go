@@ -0,0 +1,63 @@
+package raft
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/travisjeffery/jocko"
+	"github.com/travisjeffery/jocko/testutil"
+	"github.com/travisjeffery/simplelog"
+)
+
+func TestMetrics_setLeader(t *testing.T) {
+	m := newMetrics(prometheus.NewRegistry())
+	for _, isLeader := range []bool{true, false} {
+		m.setLeader(isLeader)
+		want := 0.0
+		if isLeader {
+			want = 1
+		}
+		if got := activeController(t, m); got != want {
+			t.Errorf("setLeader(%v): active controller = %v, want %v", isLeader, got, want)
+		}
+	}
+}
+
+func TestRaft_monitorLeadership_stepDown(t *testing.T) {
+	b := &Raft{
+		logger:     simplelog.New(ioutil.Discard, simplelog.DEBUG, "jocko/rafttest"),
+		shutdownCh: make(chan struct{}),
+	}
+	Metrics(prometheus.NewRegistry())(b)
+	b.metrics.setLeader(true)
+	notifyCh := make(chan bool)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		b.monitorLeadership(notifyCh, make(chan *jocko.ClusterMember))
+	}()
+
+	notifyCh <- false
+	testutil.WaitForResult(func() (bool, error) {
+		return activeController(t, b.metrics) == 0, nil
+	}, func(err error) {
+		t.Fatalf("active controller not 0 after stepping down: %v", err)
+	})
+
+	b.metrics.setLeader(true)
+	close(b.shutdownCh)
+	<-done
+	if got := activeController(t, b.metrics); got != 0 {
+		t.Errorf("active controller after shutdown = %v, want 0", got)
+	}
+}
+
+func activeController(t *testing.T, m *metrics) float64 {
+	d := &dto.Metric{}
+	if err := m.activeController.Write(d); err != nil {
+		t.Fatalf("Gauge.Write() error = %v", err)
+	}
+	return d.GetGauge().GetValue()
+}
@@ -0,0 +1,48 @@
+package raft
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// metrics are the raft instance's metrics, enabled with the Metrics option.
+type metrics struct {
+	// activeController is 1 while this broker's the raft leader, i.e. the cluster controller, and
+	// 0 otherwise. Summed across a healthy cluster it's exactly 1.
+	activeController prometheus.Gauge
+}
+
+func newMetrics(r prometheus.Registerer) *metrics {
+	m := &metrics{
+		activeController: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "active_controller_count",
+			Help: "Whether this broker is the cluster controller.",
+		}),
+	}
+	if r != nil {
+		m.activeController = register(r, m.activeController).(prometheus.Gauge)
+	}
+	return m
+}
+
+// setLeader is used to record whether this broker's the raft leader.
+func (m *metrics) setLeader(isLeader bool) {
+	if m == nil {
+		return
+	}
+	if isLeader {
+		m.activeController.Set(1)
+	} else {
+		m.activeController.Set(0)
+	}
+}
+
+// register is used to register the collector with r. If an equal collector
+// has been registered already, e.g. by another raft instance in the same
+// process, the existing collector is returned and used instead.
+func register(r prometheus.Registerer, c prometheus.Collector) prometheus.Collector {
+	if err := r.Register(c); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			return are.ExistingCollector
+		}
+		panic(err)
+	}
+	return c
+}
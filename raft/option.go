@@ -2,6 +2,7 @@ package raft
 
 import (
 	"github.com/hashicorp/raft"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/travisjeffery/simplelog"
 )
 
@@ -30,3 +31,11 @@ func Config(raft *raft.Config) OptionFn {
 		b.config = raft
 	}
 }
+
+// Metrics is used to collect the raft instance's metrics, e.g. whether it's the
+// active controller, registered with r.
+func Metrics(r prometheus.Registerer) OptionFn {
+	return func(b *Raft) {
+		b.metrics = newMetrics(r)
+	}
+}
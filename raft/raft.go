@@ -2,9 +2,9 @@ package raft
 
 import (
 	"encoding/json"
-	"net"
 	"os"
 	"path/filepath"
+	"sync"
 	"time"
 
 	"github.com/hashicorp/raft"
@@ -33,7 +33,10 @@ type Raft struct {
 
 	serf              jocko.Serf
 	reconcileInterval time.Duration
+	metrics           *metrics
 	shutdownCh        chan struct{}
+	shutdown          bool
+	shutdownLock      sync.Mutex
 }
 
 // New Raft object
@@ -67,8 +70,7 @@ func (b *Raft) Bootstrap(serf jocko.Serf, serfEventCh <-chan *jocko.ClusterMembe
 
 	var peersAddrs []string
 	for _, p := range serf.Cluster() {
-		addr := &net.TCPAddr{IP: net.ParseIP(p.IP), Port: p.RaftPort}
-		peersAddrs = append(peersAddrs, addr.String())
+		peersAddrs = append(peersAddrs, p.RaftAddr())
 	}
 	raftPeers := raft.NewJSONPeers(path, b.transport)
 	if err = raftPeers.SetPeers(peersAddrs); err != nil {
@@ -120,7 +122,13 @@ func (b *Raft) Apply(cmd jocko.RaftCommand) error {
 		return err
 	}
 	f := b.raft.Apply(c, timeout)
-	return f.Error()
+	switch err := f.Error(); err {
+	case raft.ErrNotLeader, raft.ErrEnqueueTimeout:
+		// the command never made it into the log.
+		return jocko.ErrNotCommitted
+	default:
+		return err
+	}
 }
 
 // IsLeader checks if this broker is the cluster controller
@@ -176,9 +184,25 @@ func (b *Raft) leave() error {
 	return nil
 }
 
-// Shutdown raft agent
+// Shutdown raft agent. It's safe to call more than once, or if bootstrapping failed.
 func (b *Raft) Shutdown() error {
+	b.shutdownLock.Lock()
+	defer b.shutdownLock.Unlock()
+	if b.shutdown {
+		return nil
+	}
+	b.shutdown = true
 	close(b.shutdownCh)
+	if b.raft == nil {
+		// bootstrap failed or wasn't called, close whatever it opened.
+		if b.transport != nil {
+			b.transport.Close()
+		}
+		if b.store != nil {
+			return b.store.Close()
+		}
+		return nil
+	}
 
 	if err := b.leave(); err != nil {
 		return err
@@ -0,0 +1,52 @@
+package raft
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/travisjeffery/simplelog"
+)
+
+func TestRaft_Shutdown_bootstrapFailed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jocko-raft")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// the data dir's a file, so bootstrapping fails after the transport's listening.
+	dataDir := filepath.Join(dir, "data")
+	if err := ioutil.WriteFile(dataDir, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	b, err := New(
+		Logger(simplelog.New(ioutil.Discard, simplelog.DEBUG, "jocko/rafttest")),
+		DataDir(dataDir),
+		Addr(addr),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Bootstrap(nil, nil, nil); err == nil {
+		t.Fatal("bootstrap succeeded, want error")
+	}
+	for i := 0; i < 2; i++ {
+		if err := b.Shutdown(); err != nil {
+			t.Fatalf("shutdown %d: %v", i, err)
+		}
+	}
+	// the transport's closed, so its address can be listened on again.
+	ln, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("transport's still listening: %v", err)
+	}
+	ln.Close()
+}
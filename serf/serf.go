@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"net"
 	"strconv"
+	"strings"
 	"sync"
 
 	"github.com/hashicorp/serf/serf"
@@ -13,6 +14,9 @@ import (
 
 const (
 	statusReap = serf.MemberStatus(-1)
+	// listenerTagPrefix prefixes the names of the tags with the endpoints
+	// members advertise for their listeners.
+	listenerTagPrefix = "listener_"
 )
 
 // Serf manages membership of Jocko cluster using Hashicorp Serf
@@ -25,6 +29,9 @@ type Serf struct {
 	initMembers []string
 	shutdownCh  chan struct{}
 
+	shutdown     bool
+	shutdownLock sync.Mutex
+
 	peers    map[int32]*jocko.ClusterMember
 	peerLock sync.RWMutex
 }
@@ -66,6 +73,16 @@ func (s *Serf) Bootstrap(node *jocko.ClusterMember, reconcileCh chan<- *jocko.Cl
 	conf.Tags["id"] = strconv.Itoa(int(node.ID))
 	conf.Tags["port"] = strconv.Itoa(node.Port)
 	conf.Tags["raft_port"] = strconv.Itoa(node.RaftPort)
+	conf.Tags["incarnation"] = strconv.FormatInt(node.Incarnation, 10)
+	if node.AdvertisedHost != "" {
+		conf.Tags["advertised_host"] = node.AdvertisedHost
+	}
+	if node.AdvertisedPort != 0 {
+		conf.Tags["advertised_port"] = strconv.Itoa(node.AdvertisedPort)
+	}
+	for name, e := range node.Listeners {
+		conf.Tags[listenerTagPrefix+name] = net.JoinHostPort(e.Host, strconv.Itoa(e.Port))
+	}
 	sserf, err := serf.Create(conf)
 	if err != nil {
 		return err
@@ -198,9 +215,19 @@ func (s *Serf) leave() error {
 	return nil
 }
 
-// Shutdown Serf agent
+// Shutdown Serf agent. It's safe to call more than once, or if the agent never started.
 func (s *Serf) Shutdown() error {
+	s.shutdownLock.Lock()
+	defer s.shutdownLock.Unlock()
+	if s.shutdown {
+		return nil
+	}
+	s.shutdown = true
 	close(s.shutdownCh)
+	if s.serf == nil {
+		// the agent never started.
+		return nil
+	}
 	if err := s.leave(); err != nil {
 		return err
 	}
@@ -229,12 +256,50 @@ func clusterMember(m serf.Member) (*jocko.ClusterMember, error) {
 		return nil, err
 	}
 
+	// members running older versions don't have an incarnation.
+	var incarnation int64
+	if incarnationStr, ok := m.Tags["incarnation"]; ok {
+		if incarnation, err = strconv.ParseInt(incarnationStr, 10, 64); err != nil {
+			return nil, err
+		}
+	}
+
+	var advertisedPort int
+	if advertisedPortStr, ok := m.Tags["advertised_port"]; ok {
+		if advertisedPort, err = strconv.Atoi(advertisedPortStr); err != nil {
+			return nil, err
+		}
+	}
+
+	var listeners map[string]jocko.Endpoint
+	for tag, addr := range m.Tags {
+		if !strings.HasPrefix(tag, listenerTagPrefix) {
+			continue
+		}
+		host, portStr, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		port, err := strconv.Atoi(portStr)
+		if err != nil {
+			return nil, err
+		}
+		if listeners == nil {
+			listeners = make(map[string]jocko.Endpoint)
+		}
+		listeners[strings.TrimPrefix(tag, listenerTagPrefix)] = jocko.Endpoint{Host: host, Port: port}
+	}
+
 	conn := &jocko.ClusterMember{
-		IP:       m.Addr.String(),
-		ID:       int32(id),
-		RaftPort: raftPort,
-		Port:     port,
-		Status:   status(m.Status),
+		IP:             m.Addr.String(),
+		ID:             int32(id),
+		RaftPort:       raftPort,
+		Port:           port,
+		Status:         status(m.Status),
+		Incarnation:    incarnation,
+		AdvertisedHost: m.Tags["advertised_host"],
+		AdvertisedPort: advertisedPort,
+		Listeners:      listeners,
 	}
 
 	return conn, nil
@@ -60,6 +60,17 @@ func Test_Membership(t *testing.T) {
 	require.NoError(t, s0.Shutdown())
 }
 
+func Test_ShutdownNotStarted(t *testing.T) {
+	s, err := serf.New(
+		serf.Logger(logger),
+		serf.Addr(getSerfAddr()),
+	)
+	require.NoError(t, err)
+	// the agent never bootstrapped, and shutting it down again's a no-op.
+	require.NoError(t, s.Shutdown())
+	require.NoError(t, s.Shutdown())
+}
+
 func getSerf(id int32) (*serf.Serf, error) {
 	s, err := serf.New(
 		serf.Logger(logger),
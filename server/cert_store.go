@@ -0,0 +1,58 @@
+package server
+
+import (
+	"crypto/tls"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// CertStore holds the certificate a TLS listener presents, loaded from PEM files, so it can be
+// reloaded when the certificate's rotated without restarting the broker. New connections are
+// handshaken with the certificate loaded last, existing connections keep the one they used.
+type CertStore struct {
+	certFile string
+	keyFile  string
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+// NewCertStore is used to create a store of the certificate and key in the given PEM files.
+func NewCertStore(certFile, keyFile string) (*CertStore, error) {
+	s := &CertStore{certFile: certFile, keyFile: keyFile}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload is used to load the certificate and key from their files again, e.g. on SIGHUP after
+// they've been rotated. If they can't be loaded the store keeps the certificate it has.
+func (s *CertStore) Reload() error {
+	cert, err := tls.LoadX509KeyPair(s.certFile, s.keyFile)
+	if err != nil {
+		return errors.Wrap(err, "load x509 key pair failed")
+	}
+	s.SetCertificate(&cert)
+	return nil
+}
+
+// SetCertificate is used to replace the store's certificate.
+func (s *CertStore) SetCertificate(cert *tls.Certificate) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cert = cert
+}
+
+// GetCertificate returns the store's certificate, it's the tls.Config callback handshakes use.
+func (s *CertStore) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.cert, nil
+}
+
+// TLSConfig returns a TLS config presenting the store's certificate.
+func (s *CertStore) TLSConfig() *tls.Config {
+	return &tls.Config{GetCertificate: s.GetCertificate}
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCertStore_Reload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jocko-certs")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	certFile, keyFile := filepath.Join(dir, "broker.pem"), filepath.Join(dir, "broker-key.pem")
+	ca, caKey := newCert(t, "jocko-ca", nil, nil)
+	writeCert := func(cn string) {
+		cert, key := newCert(t, cn, ca, caKey)
+		writePEM(t, certFile, "CERTIFICATE", cert.Raw)
+		writePEM(t, keyFile, "EC PRIVATE KEY", marshalKey(t, key))
+	}
+
+	writeCert("broker-a")
+	certs, err := NewCertStore(certFile, keyFile)
+	require.NoError(t, err)
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", certs.TLSConfig())
+	require.NoError(t, err)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go conn.(*tls.Conn).Handshake()
+		}
+	}()
+	// handshake returns a conn handshaken with the listener, and the common name of the
+	// certificate the listener presented.
+	handshake := func() (*tls.Conn, string) {
+		conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+		require.NoError(t, err)
+		return conn, conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+	}
+	before, cn := handshake()
+	defer before.Close()
+	require.Equal(t, "broker-a", cn)
+
+	// the certificate's rotated.
+	writeCert("broker-b")
+	require.NoError(t, certs.Reload())
+	after, cn := handshake()
+	defer after.Close()
+	require.Equal(t, "broker-b", cn)
+	// the conn from before the reload keeps the certificate it was handshaken with.
+	require.Equal(t, "broker-a", before.ConnectionState().PeerCertificates[0].Subject.CommonName)
+
+	// a certificate that can't be loaded doesn't replace the one the store has.
+	require.NoError(t, ioutil.WriteFile(certFile, []byte("not a certificate"), 0600))
+	require.Error(t, certs.Reload())
+	conn, cn := handshake()
+	defer conn.Close()
+	require.Equal(t, "broker-b", cn)
+}
+
+func writePEM(t *testing.T, path, typ string, der []byte) {
+	require.NoError(t, ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600))
+}
+
+func marshalKey(t *testing.T, key *ecdsa.PrivateKey) []byte {
+	der, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	return der
+}
@@ -21,7 +21,8 @@ func NewClient(conn io.ReadWriter) *Client {
 }
 
 // makeRequest sends request req to server.
-// Server response is given to decoder to decode it as per request expectations
+// Server response is given to decoder to decode it as per request expectations,
+// if decoder is nil the server isn't expected to respond
 func (p *Client) makeRequest(req *protocol.Request, decoder protocol.Decoder) error {
 	b, err := protocol.Encode(req)
 	if err != nil {
@@ -30,6 +31,9 @@ func (p *Client) makeRequest(req *protocol.Request, decoder protocol.Decoder) er
 	if _, err = p.conn.Write(b); err != nil {
 		return err
 	}
+	if decoder == nil {
+		return nil
+	}
 	br := bytes.NewBuffer(make([]byte, 0, 8))
 	if _, err = io.CopyN(br, p.conn, 8); err != nil {
 		return err
@@ -43,12 +47,29 @@ func (p *Client) makeRequest(req *protocol.Request, decoder protocol.Decoder) er
 	if _, err = io.CopyN(buffer, p.conn, int64(header.Size-4)); err != nil {
 		return err
 	}
+	if protocol.ResponseHeaderVersion(req.Body.Key(), req.Body.Version()) >= 1 {
+		// the rest of a v1 response header is its tagged fields.
+		decoder = &taggedResponse{decoder}
+	}
 	if err = protocol.Decode(buffer.Bytes(), decoder); err != nil {
 		return err
 	}
 	return nil
 }
 
+// taggedResponse decodes the tagged fields that end a v1 response header before the response.
+type taggedResponse struct {
+	protocol.Decoder
+}
+
+func (r *taggedResponse) Decode(d protocol.PacketDecoder) error {
+	var fields protocol.TaggedFields
+	if err := fields.Decode(d); err != nil {
+		return err
+	}
+	return r.Decoder.Decode(d)
+}
+
 // FetchMessages of topics from server as per fetchRequest
 func (p *Client) FetchMessages(clientID string, fetchRequest *protocol.FetchRequest) (*protocol.FetchResponses, error) {
 	req := &protocol.Request{
@@ -56,7 +77,7 @@ func (p *Client) FetchMessages(clientID string, fetchRequest *protocol.FetchRequ
 		ClientID:      clientID,
 		Body:          fetchRequest,
 	}
-	fetchResponse := new(protocol.FetchResponses)
+	fetchResponse := &protocol.FetchResponses{APIVersion: fetchRequest.Version()}
 	if err := p.makeRequest(req, fetchResponse); err != nil {
 		return nil, err
 	}
@@ -79,3 +100,65 @@ func (p *Client) CreateTopic(clientID string, createRequest *protocol.CreateTopi
 	}
 	return createResponse, nil
 }
+
+// Produce sends request to server to append the produce request's record sets.
+// With acks=0 the server doesn't respond, and the returned response is nil
+func (p *Client) Produce(clientID string, produceRequest *protocol.ProduceRequest) (*protocol.ProduceResponses, error) {
+	req := &protocol.Request{
+		CorrelationID: rand.Int31(),
+		ClientID:      clientID,
+		Body:          produceRequest,
+	}
+	if produceRequest.Acks == 0 {
+		return nil, p.makeRequest(req, nil)
+	}
+	produceResponse := new(protocol.ProduceResponses)
+	if err := p.makeRequest(req, produceResponse); err != nil {
+		return nil, err
+	}
+	return produceResponse, nil
+}
+
+// ControlledShutdown sends request to the controller to move the leadership of the partitions the
+// broker leads to other brokers, before it shuts down
+func (p *Client) ControlledShutdown(clientID string, controlledShutdownRequest *protocol.ControlledShutdownRequest) (*protocol.ControlledShutdownResponse, error) {
+	req := &protocol.Request{
+		CorrelationID: rand.Int31(),
+		ClientID:      clientID,
+		Body:          controlledShutdownRequest,
+	}
+	controlledShutdownResponse := &protocol.ControlledShutdownResponse{APIVersion: controlledShutdownRequest.Version()}
+	if err := p.makeRequest(req, controlledShutdownResponse); err != nil {
+		return nil, err
+	}
+	return controlledShutdownResponse, nil
+}
+
+// AlterPartition sends request to the controller to change the ISRs of the partitions the broker
+// leads
+func (p *Client) AlterPartition(clientID string, alterPartitionRequest *protocol.AlterPartitionRequest) (*protocol.AlterPartitionResponse, error) {
+	req := &protocol.Request{
+		CorrelationID: rand.Int31(),
+		ClientID:      clientID,
+		Body:          alterPartitionRequest,
+	}
+	alterPartitionResponse := &protocol.AlterPartitionResponse{APIVersion: alterPartitionRequest.Version()}
+	if err := p.makeRequest(req, alterPartitionResponse); err != nil {
+		return nil, err
+	}
+	return alterPartitionResponse, nil
+}
+
+// Metadata sends request to server to describe the cluster's brokers and the given topics
+func (p *Client) Metadata(clientID string, metadataRequest *protocol.MetadataRequest) (*protocol.MetadataResponse, error) {
+	req := &protocol.Request{
+		CorrelationID: rand.Int31(),
+		ClientID:      clientID,
+		Body:          metadataRequest,
+	}
+	metadataResponse := new(protocol.MetadataResponse)
+	if err := p.makeRequest(req, metadataResponse); err != nil {
+		return nil, err
+	}
+	return metadataResponse, nil
+}
@@ -0,0 +1,106 @@
+package server_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/jocko/protocol"
+	"github.com/travisjeffery/jocko/testutil"
+	"github.com/travisjeffery/jocko/testutil/cluster"
+)
+
+func TestCluster_ProduceFetch(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping cluster integration test in short mode")
+	}
+	const clusterTopic = "cluster_topic"
+
+	c, err := cluster.New(3, nil)
+	require.NoError(t, err)
+	defer c.Close()
+
+	controller, err := c.Controller()
+	require.NoError(t, err)
+	client, conn, err := controller.Dial()
+	require.NoError(t, err)
+	createResp, err := client.CreateTopic(clientID, &protocol.CreateTopicRequest{
+		Topic:             clusterTopic,
+		NumPartitions:     1,
+		ReplicationFactor: 3,
+	})
+	conn.Close()
+	require.NoError(t, err)
+	require.Equal(t, protocol.ErrNone.Code(), createResp.TopicErrorCodes[0].ErrorCode)
+
+	// every broker should learn of the topic, and agree on its leader, through raft.
+	leaders := make(map[int32]int32)
+	for _, n := range c.Nodes {
+		client, conn, err := n.Dial()
+		require.NoError(t, err)
+		testutil.WaitForResult(func() (bool, error) {
+			resp, err := client.Metadata(clientID, &protocol.MetadataRequest{Topics: []string{clusterTopic}})
+			if err != nil {
+				return false, err
+			}
+			tm := resp.TopicMetadata[0]
+			if tm.TopicErrorCode != protocol.ErrNone.Code() || len(tm.PartitionMetadata) != 1 {
+				return false, nil
+			}
+			pm := tm.PartitionMetadata[0]
+			require.Equal(t, 3, len(pm.Replicas))
+			leaders[n.ID] = pm.Leader
+			return true, nil
+		}, func(err error) {
+			t.Fatalf("err: %v", err)
+		})
+		conn.Close()
+	}
+	leaderID := leaders[controller.ID]
+	for id, l := range leaders {
+		require.Equal(t, leaderID, l, "broker %d disagrees on the partition leader", id)
+	}
+	leader := c.Node(leaderID)
+	require.NotNil(t, leader)
+
+	recordSet, err := protocol.Encode(&protocol.MessageSet{
+		Messages: []*protocol.Message{{Value: []byte("Hello from a Jocko cluster!")}},
+	})
+	require.NoError(t, err)
+
+	client, conn, err = leader.Dial()
+	require.NoError(t, err)
+	defer conn.Close()
+
+	produceResp, err := client.Produce(clientID, &protocol.ProduceRequest{
+		Acks:    1,
+		Timeout: 1000,
+		TopicData: []*protocol.TopicData{{
+			Topic: clusterTopic,
+			Data:  []*protocol.Data{{Partition: 0, RecordSet: recordSet}},
+		}},
+	})
+	require.NoError(t, err)
+	pp := produceResp.Responses[0].PartitionResponses[0]
+	require.Equal(t, protocol.ErrNone.Code(), pp.ErrorCode)
+
+	fetchResp, err := client.FetchMessages(clientID, &protocol.FetchRequest{
+		MaxWaitTime: 1000,
+		MinBytes:    1,
+		Topics: []*protocol.FetchTopic{{
+			Topic: clusterTopic,
+			Partitions: []*protocol.FetchPartition{{
+				Partition:   0,
+				FetchOffset: pp.BaseOffset,
+				MaxBytes:    int32(len(recordSet)),
+			}},
+		}},
+	})
+	require.NoError(t, err)
+	fp := fetchResp.Responses[0].PartitionResponses[0]
+	require.Equal(t, protocol.ErrNone.Code(), fp.ErrorCode)
+
+	ms := new(protocol.MessageSet)
+	require.NoError(t, protocol.Decode(fp.RecordSet, ms))
+	require.Equal(t, 1, len(ms.Messages))
+	require.Equal(t, []byte("Hello from a Jocko cluster!"), ms.Messages[0].Value)
+}
@@ -0,0 +1,60 @@
+package server
+
+import (
+	"time"
+)
+
+const (
+	// badConnMinRequests is how many requests a connection sends before it's checked for being
+	// bad, so a connection's first few requests failing doesn't get it reported.
+	badConnMinRequests = 10
+	// badConnErrorRatio is the fraction of a connection's requests that can fail, e.g. because
+	// they can't be decoded, before it's reported as bad.
+	badConnErrorRatio = 0.5
+	// badConnRequestRate is how many requests per second a connection can send before it's
+	// reported as bad.
+	badConnRequestRate = 10000
+)
+
+// connStats are the counters of a connection's requests, used to find misbehaving clients.
+type connStats struct {
+	addr     string
+	clientID string
+	start    time.Time
+	requests int64
+	bytes    int64
+	errors   int64
+	// reported is whether the connection's been reported as bad, it's only reported once.
+	reported bool
+}
+
+func newConnStats(addr string, now time.Time) *connStats {
+	return &connStats{addr: addr, start: now}
+}
+
+// request is used to count a request of the given size read from the connection.
+func (c *connStats) request(size int) {
+	c.requests++
+	c.bytes += int64(size)
+}
+
+// error is used to count a request that failed, e.g. it couldn't be decoded.
+func (c *connStats) error() {
+	c.errors++
+}
+
+// bad returns why the connection's misbehaving, or empty if it isn't or it's been reported.
+func (c *connStats) bad(now time.Time) string {
+	if c.reported || c.requests < badConnMinRequests {
+		return ""
+	}
+	switch {
+	case float64(c.errors)/float64(c.requests) > badConnErrorRatio:
+		c.reported = true
+		return "high error rate"
+	case now.Sub(c.start) >= time.Second && float64(c.requests)/now.Sub(c.start).Seconds() > badConnRequestRate:
+		c.reported = true
+		return "high request rate"
+	}
+	return ""
+}
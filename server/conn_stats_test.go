@@ -0,0 +1,141 @@
+package server
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/jocko"
+	"github.com/travisjeffery/jocko/protocol"
+	"github.com/travisjeffery/simplelog"
+)
+
+func TestServer_handleRequest_badConnection(t *testing.T) {
+	buf := new(bytes.Buffer)
+	s := &Server{
+		logger:     simplelog.New(buf, simplelog.DEBUG, "jocko/servertest"),
+		shutdownCh: make(chan struct{}),
+		requestCh:  make(chan jocko.Request, 1),
+		metrics:    newMetrics(prometheus.NewRegistry()),
+	}
+	defer close(s.shutdownCh)
+
+	server, client := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.handleRequest(server, "")
+	}()
+
+	b, err := protocol.Encode(&protocol.Request{
+		CorrelationID: 1,
+		ClientID:      "bad-client",
+		Body: &protocol.ProduceRequest{Acks: 1, TopicData: []*protocol.TopicData{{
+			Topic: "the-topic",
+			Data:  []*protocol.Data{{Partition: 0, RecordSet: []byte("hello")}},
+		}}},
+	})
+	require.NoError(t, err)
+	// the request's cut short, so its body can't be decoded.
+	b = b[:len(b)-8]
+	protocol.Encoding.PutUint32(b, uint32(len(b)-4))
+	for i := 0; i < 2*badConnMinRequests; i++ {
+		_, err = client.Write(b)
+		require.NoError(t, err)
+	}
+	client.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("handleRequest didn't return after the client closed the conn: %s", buf.String())
+	}
+
+	log := buf.String()
+	require.Equal(t, 1, strings.Count(log, "warning: bad connection"), log)
+	require.Contains(t, log, "warning: bad connection, high error rate: addr [pipe], client id [bad-client], requests [10], bytes [")
+	require.Contains(t, log, "errors [10]")
+	m := &dto.Metric{}
+	require.NoError(t, s.metrics.requestErrors.Write(m))
+	require.Equal(t, float64(2*badConnMinRequests), m.GetCounter().GetValue())
+}
+
+func TestServer_handleRequest_connClosed(t *testing.T) {
+	s := &Server{
+		logger:     simplelog.New(new(bytes.Buffer), simplelog.DEBUG, "jocko/servertest"),
+		shutdownCh: make(chan struct{}),
+		requestCh:  make(chan jocko.Request, 1),
+		metrics:    newMetrics(prometheus.NewRegistry()),
+	}
+	defer close(s.shutdownCh)
+
+	server, client := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.handleRequest(server, "")
+	}()
+
+	b, err := protocol.Encode(&protocol.Request{
+		CorrelationID: 1,
+		ClientID:      "test",
+		Body:          &protocol.FetchRequest{ReplicaID: -1, MaxWaitTime: 10000, MinBytes: 1},
+	})
+	require.NoError(t, err)
+	_, err = client.Write(b)
+	require.NoError(t, err)
+
+	// the broker waits on the fetch without responding, until the client closes the conn.
+	req := <-s.requestCh
+	select {
+	case <-req.Context.Done():
+		t.Fatal("request's context done before the conn was closed")
+	case <-time.After(10 * time.Millisecond):
+	}
+	client.Close()
+	select {
+	case <-req.Context.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("request's context wasn't done after the client closed the conn")
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handleRequest didn't return after the client closed the conn")
+	}
+}
+
+func TestConnStats_bad(t *testing.T) {
+	start := time.Now()
+	tests := []struct {
+		name     string
+		requests int
+		errors   int
+		elapsed  time.Duration
+		want     string
+	}{
+		{name: "too few requests", requests: badConnMinRequests - 1, errors: badConnMinRequests - 1, elapsed: time.Second},
+		{name: "some errors", requests: 100, errors: 10, elapsed: time.Minute},
+		{name: "high error rate", requests: 100, errors: 60, elapsed: time.Minute, want: "high error rate"},
+		{name: "high request rate", requests: 2 * badConnRequestRate, elapsed: time.Second, want: "high request rate"},
+		{name: "burst", requests: 2 * badConnRequestRate, elapsed: time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newConnStats("127.0.0.1:9092", start)
+			for i := 0; i < tt.requests; i++ {
+				c.request(64)
+			}
+			for i := 0; i < tt.errors; i++ {
+				c.error()
+			}
+			require.Equal(t, tt.want, c.bad(start.Add(tt.elapsed)))
+			// a bad connection's only reported once.
+			require.Equal(t, "", c.bad(start.Add(tt.elapsed)))
+		})
+	}
+}
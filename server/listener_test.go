@@ -0,0 +1,91 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// socketConn is a TCP conn recording the socket options set on it.
+type socketConn struct {
+	*net.TCPConn
+	readBuffer, writeBuffer int
+	keepAlive               *bool
+	keepAlivePeriod         time.Duration
+}
+
+func (c *socketConn) SetReadBuffer(bytes int) error {
+	c.readBuffer = bytes
+	return c.TCPConn.SetReadBuffer(bytes)
+}
+
+func (c *socketConn) SetWriteBuffer(bytes int) error {
+	c.writeBuffer = bytes
+	return c.TCPConn.SetWriteBuffer(bytes)
+}
+
+func (c *socketConn) SetKeepAlive(keepalive bool) error {
+	c.keepAlive = &keepalive
+	return c.TCPConn.SetKeepAlive(keepalive)
+}
+
+func (c *socketConn) SetKeepAlivePeriod(d time.Duration) error {
+	c.keepAlivePeriod = d
+	return c.TCPConn.SetKeepAlivePeriod(d)
+}
+
+// socketListener is a TCP listener wrapping the conns it accepts in socketConns.
+type socketListener struct {
+	*net.TCPListener
+}
+
+func (l *socketListener) Accept() (net.Conn, error) {
+	conn, err := l.AcceptTCP()
+	if err != nil {
+		return nil, err
+	}
+	return &socketConn{TCPConn: conn}, nil
+}
+
+// acceptConn returns a conn accepted by the server's listener, with its socket options set.
+func acceptConn(t *testing.T, s *Server) *socketConn {
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer ln.Close()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	conn, err := s.setSocketOptions(&socketListener{ln}).Accept()
+	require.NoError(t, err)
+	conn.Close()
+	return conn.(*socketConn)
+}
+
+func TestServer_setSocketOptions(t *testing.T) {
+	s := &Server{}
+	s.SetSocketBufferSizes(1<<20, 2<<20)
+	s.SetKeepAlivePeriod(30 * time.Second)
+	conn := acceptConn(t, s)
+	require.Equal(t, 1<<20, conn.readBuffer)
+	require.Equal(t, 2<<20, conn.writeBuffer)
+	require.NotNil(t, conn.keepAlive)
+	require.True(t, *conn.keepAlive)
+	require.Equal(t, 30*time.Second, conn.keepAlivePeriod)
+
+	// keepalive can be disabled.
+	s = &Server{}
+	s.SetKeepAlivePeriod(-1)
+	conn = acceptConn(t, s)
+	require.NotNil(t, conn.keepAlive)
+	require.False(t, *conn.keepAlive)
+
+	// by default the OS's and Go's are left as they are.
+	s = &Server{}
+	s.SetSocketBufferSizes(-1, -1)
+	conn = acceptConn(t, s)
+	require.Equal(t, 0, conn.readBuffer)
+	require.Equal(t, 0, conn.writeBuffer)
+	require.Nil(t, conn.keepAlive)
+}
@@ -1,9 +1,20 @@
 package server
 
-import "github.com/prometheus/client_golang/prometheus"
+import (
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/travisjeffery/jocko"
+)
+
+// sizeBuckets are the buckets of the request and response size histograms, from 64B to 16MiB.
+var sizeBuckets = prometheus.ExponentialBuckets(64, 4, 10)
 
 type metrics struct {
 	requestsHandled prometheus.Counter
+	requestErrors   prometheus.Counter
+	requestSize     *prometheus.HistogramVec
+	responseSize    *prometheus.HistogramVec
 }
 
 func newMetrics(r prometheus.Registerer) *metrics {
@@ -12,11 +23,36 @@ func newMetrics(r prometheus.Registerer) *metrics {
 			Name: "requests_handled",
 			Help: "Number of requests handled by the server.",
 		}),
+		requestErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "request_errors",
+			Help: "Number of requests the server failed to decode.",
+		}),
+		requestSize: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "request_size_bytes",
+			Help:    "Size of the requests read by the server.",
+			Buckets: sizeBuckets,
+		}, []string{"api_key"}),
+		responseSize: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "response_size_bytes",
+			Help:    "Size of the responses written by the server.",
+			Buckets: sizeBuckets,
+		}, []string{"api_key"}),
 	}
 	if r != nil {
-		r.MustRegister(
-			m.requestsHandled,
-		)
+		m.requestsHandled = jocko.RegisterCollector(r, m.requestsHandled).(prometheus.Counter)
+		m.requestErrors = jocko.RegisterCollector(r, m.requestErrors).(prometheus.Counter)
+		m.requestSize = jocko.RegisterCollector(r, m.requestSize).(*prometheus.HistogramVec)
+		m.responseSize = jocko.RegisterCollector(r, m.responseSize).(*prometheus.HistogramVec)
 	}
 	return m
 }
+
+// observeRequest is used to record the size of a request with the given API key.
+func (m *metrics) observeRequest(apiKey int16, size int) {
+	m.requestSize.WithLabelValues(strconv.Itoa(int(apiKey))).Observe(float64(size))
+}
+
+// observeResponse is used to record the size of a response to a request with the given API key.
+func (m *metrics) observeResponse(apiKey int16, size int) {
+	m.responseSize.WithLabelValues(strconv.Itoa(int(apiKey))).Observe(float64(size))
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/jocko"
+	"github.com/travisjeffery/jocko/protocol"
+	"github.com/travisjeffery/jocko/testutil"
+	"github.com/travisjeffery/simplelog"
+)
+
+func TestServer_sizeMetrics(t *testing.T) {
+	s := &Server{
+		logger:     simplelog.New(ioutil.Discard, simplelog.DEBUG, "jocko/servertest"),
+		shutdownCh: make(chan struct{}),
+		requestCh:  make(chan jocko.Request, 1),
+		metrics:    newMetrics(prometheus.NewRegistry()),
+	}
+	defer close(s.shutdownCh)
+	go func() {
+		for req := range s.requestCh {
+			var body protocol.ResponseBody
+			switch req.Header.APIKey {
+			case protocol.ProduceKey:
+				body = &protocol.ProduceResponses{}
+			case protocol.FetchKey:
+				body = &protocol.FetchResponses{}
+			}
+			req.Response <- jocko.Response{
+				Conn:     req.Conn,
+				Header:   req.Header,
+				Response: &protocol.Response{CorrelationID: req.Header.CorrelationID, Body: body},
+			}
+		}
+	}()
+
+	server, client := net.Pipe()
+	defer client.Close()
+	go s.handleRequest(server, "")
+
+	requests := []protocol.Body{
+		&protocol.ProduceRequest{Acks: 1, Timeout: 100},
+		&protocol.FetchRequest{ReplicaID: -1, MinBytes: 1},
+	}
+	sizes := make(map[int16][2]int)
+	for i, body := range requests {
+		b, err := protocol.Encode(&protocol.Request{CorrelationID: int32(i), ClientID: "test", Body: body})
+		require.NoError(t, err)
+		_, err = client.Write(b)
+		require.NoError(t, err)
+
+		size := make([]byte, 4)
+		_, err = io.ReadFull(client, size)
+		require.NoError(t, err)
+		_, err = io.ReadFull(client, make([]byte, protocol.Encoding.Uint32(size)))
+		require.NoError(t, err)
+		sizes[body.Key()] = [2]int{len(b), 4 + int(protocol.Encoding.Uint32(size))}
+	}
+	// a response's size is recorded once it's written, after the client's read it.
+	testutil.WaitForResult(func() (bool, error) {
+		m := &dto.Metric{}
+		err := s.metrics.responseSize.WithLabelValues(strconv.Itoa(int(protocol.FetchKey))).Write(m)
+		return m.GetHistogram().GetSampleCount() == 1, err
+	}, func(err error) {
+		t.Fatalf("fetch response size not recorded: %v", err)
+	})
+
+	for key, size := range sizes {
+		for i, vec := range []*prometheus.HistogramVec{s.metrics.requestSize, s.metrics.responseSize} {
+			m := &dto.Metric{}
+			require.NoError(t, vec.WithLabelValues(strconv.Itoa(int(key))).Write(m))
+			require.Equal(t, uint64(1), m.GetHistogram().GetSampleCount(), "api key %d", key)
+			require.Equal(t, float64(size[i]), m.GetHistogram().GetSampleSum(), "api key %d", key)
+		}
+	}
+	m := &dto.Metric{}
+	require.NoError(t, s.metrics.requestSize.WithLabelValues(strconv.Itoa(int(protocol.MetadataKey))).Write(m))
+	require.Equal(t, uint64(0), m.GetHistogram().GetSampleCount())
+}
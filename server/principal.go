@@ -0,0 +1,27 @@
+package server
+
+import (
+	"crypto/tls"
+	"net"
+
+	"github.com/travisjeffery/jocko"
+)
+
+// connPrincipal is used to get the principal the connection's authenticated as.
+// TLS connections with a verified client certificate are authenticated as the
+// certificate's subject, like Kafka's default SSL principal builder, and every
+// other connection is anonymous.
+func connPrincipal(conn net.Conn) (string, error) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return jocko.AnonymousPrincipal, nil
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		return "", err
+	}
+	state := tlsConn.ConnectionState()
+	if len(state.VerifiedChains) == 0 || len(state.PeerCertificates) == 0 {
+		return jocko.AnonymousPrincipal, nil
+	}
+	return "User:" + state.PeerCertificates[0].Subject.String(), nil
+}
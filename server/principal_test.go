@@ -0,0 +1,85 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/jocko"
+)
+
+func TestConnPrincipal(t *testing.T) {
+	t.Run("plain conn is anonymous", func(t *testing.T) {
+		server, client := net.Pipe()
+		defer server.Close()
+		defer client.Close()
+		principal, err := connPrincipal(server)
+		require.NoError(t, err)
+		require.Equal(t, jocko.AnonymousPrincipal, principal)
+	})
+
+	t.Run("tls conn with client cert", func(t *testing.T) {
+		ca, caKey := newCert(t, "jocko-ca", nil, nil)
+		clientCert, clientKey := newCert(t, "alice", ca, caKey)
+		serverCert, serverKey := newCert(t, "broker", ca, caKey)
+		pool := x509.NewCertPool()
+		pool.AddCert(ca)
+
+		serverConn, clientConn := net.Pipe()
+		defer serverConn.Close()
+		defer clientConn.Close()
+		server := tls.Server(serverConn, &tls.Config{
+			Certificates: []tls.Certificate{{Certificate: [][]byte{serverCert.Raw}, PrivateKey: serverKey}},
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			ClientCAs:    pool,
+		})
+		client := tls.Client(clientConn, &tls.Config{
+			Certificates: []tls.Certificate{{Certificate: [][]byte{clientCert.Raw}, PrivateKey: clientKey}},
+			RootCAs:      pool,
+			ServerName:   "broker",
+		})
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- client.Handshake()
+		}()
+
+		principal, err := connPrincipal(server)
+		require.NoError(t, err)
+		require.NoError(t, <-errCh)
+		require.Equal(t, "User:CN=alice", principal)
+	})
+}
+
+// newCert is used to create a certificate with the given common name signed by
+// the parent, or self-signed if the parent is nil.
+func newCert(t *testing.T, cn string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     []string{cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+	}
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return cert, key
+}
@@ -1,7 +1,9 @@
 package server
 
 import (
+	"bufio"
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"io"
 	"net"
@@ -23,6 +25,7 @@ import (
 type Server struct {
 	protocolAddr string
 	protocolLn   *net.TCPListener
+	listeners    []*listener
 	httpAddr     string
 	httpLn       *net.TCPListener
 	logger       *simplelog.Logger
@@ -31,6 +34,14 @@ type Server struct {
 	metrics      *metrics
 	requestCh    chan jocko.Request
 	responseCh   chan jocko.Response
+
+	// socketReceiveBufferBytes and socketSendBufferBytes are the sizes of accepted connections'
+	// socket buffers. Sizes that aren't positive leave the OS's.
+	socketReceiveBufferBytes int
+	socketSendBufferBytes    int
+	// keepAlivePeriod is how often accepted connections send TCP keepalives. Negative periods
+	// disable them, zero leaves Go's default.
+	keepAlivePeriod time.Duration
 }
 
 func New(protocolAddr string, broker jocko.Broker, httpAddr string, logger *simplelog.Logger) *Server {
@@ -47,6 +58,36 @@ func New(protocolAddr string, broker jocko.Broker, httpAddr string, logger *simp
 	return s
 }
 
+// listener is a named listener the server accepts connections on besides its protocol addr.
+type listener struct {
+	name      string
+	addr      string
+	tlsConfig *tls.Config
+	ln        net.Listener
+}
+
+// AddListener is used to have the server also accept connections on the given addr, over TLS if
+// tlsConfig isn't nil. Requests are tagged with the listener's name, e.g. "SSL", so the broker
+// responds with the endpoints advertised for it. It must be called before Start.
+func (s *Server) AddListener(name, addr string, tlsConfig *tls.Config) {
+	s.listeners = append(s.listeners, &listener{name: name, addr: addr, tlsConfig: tlsConfig})
+}
+
+// SetSocketBufferSizes is used to set the sizes, in bytes, of the receive and send buffers of the
+// connections the server accepts, SO_RCVBUF and SO_SNDBUF. Sizes that aren't positive leave the
+// OS's. It must be called before Start.
+func (s *Server) SetSocketBufferSizes(receive, send int) {
+	s.socketReceiveBufferBytes = receive
+	s.socketSendBufferBytes = send
+}
+
+// SetKeepAlivePeriod is used to enable TCP keepalive on the connections the server accepts,
+// sending keepalives every period, so half-open connections are detected and closed. Negative
+// periods disable keepalive, zero leaves Go's default. It must be called before Start.
+func (s *Server) SetKeepAlivePeriod(period time.Duration) {
+	s.keepAlivePeriod = period
+}
+
 // Start starts the service.
 func (s *Server) Start(ctx context.Context) error {
 	protocolAddr, err := net.ResolveTCPAddr("tcp", s.protocolAddr)
@@ -56,6 +97,21 @@ func (s *Server) Start(ctx context.Context) error {
 	if s.protocolLn, err = net.ListenTCP("tcp", protocolAddr); err != nil {
 		return err
 	}
+	for _, l := range s.listeners {
+		addr, err := net.ResolveTCPAddr("tcp", l.addr)
+		if err != nil {
+			return err
+		}
+		ln, err := net.ListenTCP("tcp", addr)
+		if err != nil {
+			return err
+		}
+		// the socket options are set on the TCP conns, before they're wrapped in TLS.
+		l.ln = s.setSocketOptions(ln)
+		if l.tlsConfig != nil {
+			l.ln = tls.NewListener(l.ln, l.tlsConfig)
+		}
+	}
 
 	httpAddr, err := net.ResolveTCPAddr("tcp", s.httpAddr)
 	if err != nil {
@@ -71,39 +127,24 @@ func (s *Server) Start(ctx context.Context) error {
 	r.Path("/join").Methods("POST").HandlerFunc(s.handleJoin)
 	r.Handle("/metrics", promhttp.Handler())
 	r.PathPrefix("").HandlerFunc(s.handleNotFound)
-	http.Handle("/", r)
 
 	loggedRouter := handlers.LoggingHandler(os.Stdout, r)
 	server := http.Server{
 		Handler: loggedRouter,
 	}
 
-	go func() {
-		for {
-			select {
-			case <-ctx.Done():
-				break
-			case <-s.shutdownCh:
-				break
-			default:
-				conn, err := s.protocolLn.Accept()
-				if err != nil {
-					s.logger.Debug("listener accept failed: %v", err)
-					continue
-				}
-
-				go s.handleRequest(conn)
-			}
-		}
-	}()
+	go s.accept(ctx, s.setSocketOptions(s.protocolLn), "")
+	for _, l := range s.listeners {
+		go s.accept(ctx, l.ln, l.name)
+	}
 
 	go func() {
 		for {
 			select {
 			case <-ctx.Done():
-				break
+				return
 			case <-s.shutdownCh:
-				break
+				return
 			case resp := <-s.responseCh:
 				if err := s.write(resp); err != nil {
 					s.logger.Info("failed to write response: %v", err)
@@ -124,27 +165,142 @@ func (s *Server) Start(ctx context.Context) error {
 	return nil
 }
 
+// accept is used to accept connections on the named listener and handle their requests until the
+// server's closed.
+func (s *Server) accept(ctx context.Context, ln net.Listener, name string) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.shutdownCh:
+			return
+		default:
+			conn, err := ln.Accept()
+			if err != nil {
+				s.logger.Debug("listener accept failed: %v", err)
+				continue
+			}
+
+			go s.handleRequest(conn, name)
+		}
+	}
+}
+
+// setSocketOptions returns the listener with the server's socket buffer sizes and keepalive set on
+// the connections it accepts, or the listener as it is if they're left to the OS.
+func (s *Server) setSocketOptions(ln net.Listener) net.Listener {
+	if s.socketReceiveBufferBytes <= 0 && s.socketSendBufferBytes <= 0 && s.keepAlivePeriod == 0 {
+		return ln
+	}
+	return &socketOptionsListener{
+		Listener:  ln,
+		receive:   s.socketReceiveBufferBytes,
+		send:      s.socketSendBufferBytes,
+		keepAlive: s.keepAlivePeriod,
+	}
+}
+
+// socketOptionsConn is implemented by conns whose socket options can be set, e.g. *net.TCPConn.
+type socketOptionsConn interface {
+	SetReadBuffer(bytes int) error
+	SetWriteBuffer(bytes int) error
+	SetKeepAlive(keepalive bool) error
+	SetKeepAlivePeriod(d time.Duration) error
+}
+
+// socketOptionsListener is a listener that sets the socket buffer sizes and keepalive of the
+// connections it accepts.
+type socketOptionsListener struct {
+	net.Listener
+	receive, send int
+	keepAlive     time.Duration
+}
+
+// Accept waits for and returns the next connection, with its socket options set. Connections
+// whose socket options can't be set are returned as they are.
+func (l *socketOptionsListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	c, ok := conn.(socketOptionsConn)
+	if !ok {
+		return conn, nil
+	}
+	if err := l.setSocketOptions(c); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (l *socketOptionsListener) setSocketOptions(c socketOptionsConn) error {
+	if l.receive > 0 {
+		if err := c.SetReadBuffer(l.receive); err != nil {
+			return err
+		}
+	}
+	if l.send > 0 {
+		if err := c.SetWriteBuffer(l.send); err != nil {
+			return err
+		}
+	}
+	switch {
+	case l.keepAlive > 0:
+		if err := c.SetKeepAlive(true); err != nil {
+			return err
+		}
+		return c.SetKeepAlivePeriod(l.keepAlive)
+	case l.keepAlive < 0:
+		return c.SetKeepAlive(false)
+	}
+	return nil
+}
+
 // Close closes the service.
 func (s *Server) Close() {
 	close(s.shutdownCh)
 	s.protocolLn.Close()
+	for _, l := range s.listeners {
+		if l.ln != nil {
+			l.ln.Close()
+		}
+	}
+	s.httpLn.Close()
 	return
 }
 
-func (s *Server) handleRequest(conn net.Conn) {
+func (s *Server) handleRequest(conn net.Conn, listener string) {
 	s.metrics.requestsHandled.Inc()
 	defer conn.Close()
 
-	header := new(protocol.RequestHeader)
+	principal, err := connPrincipal(conn)
+	if err != nil {
+		s.logger.Info("failed to authenticate conn: %v", err)
+		return
+	}
+
 	p := make([]byte, 4)
+	// the connection's requests are handled one at a time, so its responses
+	// are written in the order of its requests however many handlers there are.
+	respCh := make(chan jocko.Response, 1)
+	// the connection's read through a buffer so it can be peeked while a
+	// request's handled, to tell whether the client's closed it.
+	r := bufio.NewReader(conn)
+
+	stats := newConnStats(conn.RemoteAddr().String(), time.Now())
+	defer func() {
+		s.logger.Debug("conn closed: addr [%s], client id [%s], requests [%d], bytes [%d], errors [%d]", stats.addr, stats.clientID, stats.requests, stats.bytes, stats.errors)
+	}()
 
 	for {
 		err := conn.SetReadDeadline(time.Now().Add(5 * time.Second))
 		if err != nil {
+			// the conn's closed.
 			s.logger.Info("read deadline failed: %v", err)
-			continue
+			break
 		}
-		_, err = io.ReadFull(conn, p[:])
+		_, err = io.ReadFull(r, p[:])
 		if err == io.EOF {
 			break
 		}
@@ -161,54 +317,152 @@ func (s *Server) handleRequest(conn net.Conn) {
 		b := make([]byte, size+4) //+4 since we're going to copy the size into b
 		copy(b, p)
 
-		if _, err = io.ReadFull(conn, b[4:]); err != nil {
+		if _, err = io.ReadFull(r, b[4:]); err != nil {
 			// TODO: handle request
 			s.logger.Info("failed to read from connection: %v", err)
 			panic(err)
 		}
 
+		stats.request(len(b))
+
 		d := protocol.NewDecoder(b)
+		header := new(protocol.RequestHeader)
 		if err := header.Decode(d); err != nil {
-			// TODO: handle err
+			// the request's been read whole, so the connection's next request can still be read.
 			s.logger.Info("failed to decode header: %v", err)
-			panic(err)
+			s.requestFailed(stats)
+			continue
 		}
+		stats.clientID = header.ClientID
 		s.logger.Debug("request: correlation id [%d], client id [%s], request size [%d], key [%d]", header.CorrelationID, header.ClientID, size, header.APIKey)
+		s.metrics.observeRequest(header.APIKey, len(b))
 
 		var req protocol.Decoder
 		switch header.APIKey {
 		case protocol.APIVersionsKey:
 			req = &protocol.APIVersionsRequest{}
 		case protocol.ProduceKey:
-			req = &protocol.ProduceRequest{}
+			req = &protocol.ProduceRequest{APIVersion: header.APIVersion}
 		case protocol.FetchKey:
-			req = &protocol.FetchRequest{}
+			req = &protocol.FetchRequest{APIVersion: header.APIVersion}
 		case protocol.OffsetsKey:
-			req = &protocol.OffsetsRequest{}
+			req = &protocol.OffsetsRequest{APIVersion: header.APIVersion}
 		case protocol.MetadataKey:
-			req = &protocol.MetadataRequest{}
+			req = &protocol.MetadataRequest{APIVersion: header.APIVersion}
 		case protocol.CreateTopicsKey:
-			req = &protocol.CreateTopicRequests{}
+			req = &protocol.CreateTopicRequests{APIVersion: header.APIVersion}
 		case protocol.DeleteTopicsKey:
-			req = &protocol.DeleteTopicsRequest{}
+			req = &protocol.DeleteTopicsRequest{APIVersion: header.APIVersion}
+		case protocol.DeleteRecordsKey:
+			req = &protocol.DeleteRecordsRequest{APIVersion: header.APIVersion}
 		case protocol.LeaderAndISRKey:
 			req = &protocol.LeaderAndISRRequest{}
+		case protocol.AlterPartitionKey:
+			req = &protocol.AlterPartitionRequest{APIVersion: header.APIVersion}
+		case protocol.DescribeConfigsKey:
+			req = &protocol.DescribeConfigsRequest{APIVersion: header.APIVersion}
+		case protocol.IncrementalAlterConfigsKey:
+			req = &protocol.IncrementalAlterConfigsRequest{APIVersion: header.APIVersion}
+		case protocol.ControlledShutdownKey:
+			req = &protocol.ControlledShutdownRequest{APIVersion: header.APIVersion}
+		case protocol.GroupCoordinatorKey:
+			req = &protocol.GroupCoordinatorRequest{APIVersion: header.APIVersion}
 		}
 
+		if req == nil {
+			s.logger.Info("unsupported api key: %d", header.APIKey)
+			s.requestFailed(stats)
+			continue
+		}
 		if err := req.Decode(d); err != nil {
-			// TODO: handle err
 			s.logger.Info("failed to decode request: %v", err)
-			panic(err)
+			s.requestFailed(stats)
+			continue
 		}
+		s.checkConn(stats)
 
+		ctx, cancel := context.WithCancel(context.Background())
+		stopWatching, err := watchConn(conn, r, cancel)
+		if err != nil {
+			cancel()
+			s.logger.Info("failed to watch conn: %v", err)
+			break
+		}
 		s.requestCh <- jocko.Request{
-			Header:  header,
-			Request: req,
-			Conn:    conn,
+			Header:    header,
+			Request:   req,
+			Conn:      conn,
+			Principal: principal,
+			Listener:  listener,
+			Response:  respCh,
+			Context:   ctx,
+		}
+		// the broker responds to every request, with a nil response if the client
+		// doesn't expect one, so the next request isn't read until this one's handled.
+		select {
+		case resp := <-respCh:
+			stopWatching()
+			cancel()
+			if err := s.write(resp); err != nil {
+				s.logger.Info("failed to write response: %v", err)
+			}
+		case <-ctx.Done():
+			// the client closed the conn, there's no one to respond to.
+			stopWatching()
+			return
+		case <-s.shutdownCh:
+			cancel()
+			return
 		}
 	}
 }
 
+// watchConn is used to cancel the request's context if the client closes the connection while the
+// request's handled. Peeking the connection doesn't consume the client's next request, if it's
+// sent one, though the connection's closing isn't noticed then until the request's read. The
+// returned func stops watching and must be called before the connection's read again.
+func watchConn(conn net.Conn, r *bufio.Reader, cancel context.CancelFunc) (func(), error) {
+	// handling the request can take longer than the read deadline, e.g. fetches waiting for
+	// records, and timing out isn't the client closing the conn.
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, err := r.Peek(1); err != nil && !isTimeout(err) {
+			cancel()
+		}
+	}()
+	return func() {
+		// wake the peek, the next read sets its own deadline.
+		conn.SetReadDeadline(time.Now())
+		<-done
+	}, nil
+}
+
+// isTimeout returns whether the error's a timeout, e.g. the conn's read deadline passed.
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+// requestFailed is used to count a request the connection sent that failed, e.g. it couldn't be
+// decoded, and check if the connection's misbehaving.
+func (s *Server) requestFailed(stats *connStats) {
+	stats.error()
+	s.metrics.requestErrors.Inc()
+	s.checkConn(stats)
+}
+
+// checkConn is used to log a warning identifying the connection's client if the connection's
+// misbehaving, e.g. most of its requests fail or it's sending requests abnormally fast.
+func (s *Server) checkConn(stats *connStats) {
+	if reason := stats.bad(time.Now()); reason != "" {
+		s.logger.Info("warning: bad connection, %s: addr [%s], client id [%s], requests [%d], bytes [%d], errors [%d]", reason, stats.addr, stats.clientID, stats.requests, stats.bytes, stats.errors)
+	}
+}
+
 func (s *Server) handleJoin(w http.ResponseWriter, r *http.Request) {
 	b := new(jocko.ClusterMember)
 	if err := json.NewDecoder(r.Body).Decode(&b); err != nil {
@@ -225,12 +479,14 @@ func (s *Server) handleJoin(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) write(resp jocko.Response) error {
-	s.logger.Debug("response: correlation id [%d], key [%d]", resp.Header.CorrelationID, resp.Header.APIKey)
-	b, err := protocol.Encode(resp.Response.(protocol.Encoder))
-	if err != nil {
-		return err
+	if resp.Response == nil {
+		// the client doesn't expect a response.
+		return nil
 	}
-	_, err = resp.Conn.Write(b)
+	s.logger.Debug("response: correlation id [%d], key [%d]", resp.Header.CorrelationID, resp.Header.APIKey)
+	// fetched record sets are copied from the log to the conn in chunks rather than buffered.
+	n, err := protocol.EncodeTo(resp.Conn, resp.Response.(protocol.Encoder))
+	s.metrics.observeResponse(resp.Header.APIKey, int(n))
 	return err
 }
 
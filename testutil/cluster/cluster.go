@@ -0,0 +1,244 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/travisjeffery/jocko/broker"
+	"github.com/travisjeffery/jocko/raft"
+	"github.com/travisjeffery/jocko/serf"
+	"github.com/travisjeffery/jocko/server"
+	"github.com/travisjeffery/simplelog"
+)
+
+const (
+	leaderTimeout = 10 * time.Second
+	joinTimeout   = 10 * time.Second
+	waitDelay     = 100 * time.Millisecond
+)
+
+// Node is a broker, and the server handling its connections, that's part of a
+// test cluster.
+type Node struct {
+	ID         int32
+	BrokerAddr string
+	SerfAddr   string
+	RaftAddr   string
+	HTTPAddr   string
+	Broker     *broker.Broker
+	Server     *server.Server
+
+	serf    *serf.Serf
+	dataDir string
+}
+
+// Cluster is used to run a cluster of real brokers, with their own serf and
+// raft instances, on ephemeral ports for integration testing.
+type Cluster struct {
+	Nodes []*Node
+
+	logger *simplelog.Logger
+	cancel context.CancelFunc
+}
+
+// New is used to start a cluster of the given size. Once New returns the nodes
+// have joined each other and the cluster has elected a controller. Call Close
+// to shut the cluster down and remove its data.
+func New(size int, logger *simplelog.Logger) (*Cluster, error) {
+	if logger == nil {
+		logger = simplelog.New(ioutil.Discard, simplelog.INFO, "jocko/cluster")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &Cluster{
+		logger: logger,
+		cancel: cancel,
+	}
+	for i := 0; i < size; i++ {
+		var seeds []string
+		if i > 0 {
+			seeds = []string{c.Nodes[0].SerfAddr}
+		}
+		n, err := c.startNode(ctx, int32(i), seeds)
+		if err != nil {
+			c.Close()
+			return nil, errors.Wrapf(err, "start node %d failed", i)
+		}
+		c.Nodes = append(c.Nodes, n)
+	}
+	if err := c.waitForMembers(joinTimeout); err != nil {
+		c.Close()
+		return nil, err
+	}
+	for _, n := range c.Nodes {
+		if _, err := n.Broker.WaitForLeader(leaderTimeout); err != nil {
+			c.Close()
+			return nil, errors.Wrapf(err, "node %d wait for leader failed", n.ID)
+		}
+	}
+	return c, nil
+}
+
+func (c *Cluster) startNode(ctx context.Context, id int32, seeds []string) (*Node, error) {
+	addrs, err := freeAddrs(4)
+	if err != nil {
+		return nil, err
+	}
+	dataDir, err := ioutil.TempDir("", fmt.Sprintf("jocko-cluster-%d", id))
+	if err != nil {
+		return nil, err
+	}
+	n := &Node{
+		ID:         id,
+		BrokerAddr: addrs[0],
+		SerfAddr:   addrs[1],
+		RaftAddr:   addrs[2],
+		HTTPAddr:   addrs[3],
+		dataDir:    dataDir,
+	}
+	n.serf, err = serf.New(
+		serf.Logger(c.logger),
+		serf.Addr(n.SerfAddr),
+		serf.InitMembers(seeds),
+	)
+	if err != nil {
+		os.RemoveAll(dataDir)
+		return nil, err
+	}
+	r, err := raft.New(
+		raft.Logger(c.logger),
+		raft.DataDir(dataDir),
+		raft.Addr(n.RaftAddr),
+	)
+	if err != nil {
+		n.serf.Shutdown()
+		os.RemoveAll(dataDir)
+		return nil, err
+	}
+	// stop is used to shut down whatever the node started if it fails to start.
+	// serf and raft can be shut down whether or not the broker started them.
+	stop := func() {
+		if n.Broker != nil {
+			n.Broker.Shutdown()
+		}
+		r.Shutdown()
+		n.serf.Shutdown()
+		os.RemoveAll(dataDir)
+	}
+	n.Broker, err = broker.New(id,
+		broker.LogDir(dataDir),
+		broker.Addr(n.BrokerAddr),
+		broker.Serf(n.serf),
+		broker.Raft(r),
+		broker.Logger(c.logger),
+	)
+	if err != nil {
+		stop()
+		return nil, err
+	}
+	n.Server = server.New(n.BrokerAddr, n.Broker, n.HTTPAddr, c.logger)
+	if err := n.Server.Start(ctx); err != nil {
+		stop()
+		return nil, err
+	}
+	return n, nil
+}
+
+// waitForMembers is used to wait until every node sees every other node as a
+// member of the cluster.
+func (c *Cluster) waitForMembers(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		joined := true
+		for _, n := range c.Nodes {
+			if len(n.serf.Cluster()) != len(c.Nodes) {
+				joined = false
+				break
+			}
+		}
+		if joined {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return errors.New("timed out waiting for nodes to join")
+		}
+		time.Sleep(waitDelay)
+	}
+}
+
+// Controller is used to get the node that's currently the cluster's controller.
+func (c *Cluster) Controller() (*Node, error) {
+	if len(c.Nodes) == 0 {
+		return nil, errors.New("cluster has no nodes")
+	}
+	leader, err := c.Nodes[0].Broker.WaitForLeader(leaderTimeout)
+	if err != nil {
+		return nil, err
+	}
+	for _, n := range c.Nodes {
+		if n.RaftAddr == leader {
+			return n, nil
+		}
+	}
+	return nil, errors.Errorf("no node with raft addr %s", leader)
+}
+
+// Node is used to get the node with the given broker ID.
+func (c *Cluster) Node(id int32) *Node {
+	for _, n := range c.Nodes {
+		if n.ID == id {
+			return n
+		}
+	}
+	return nil
+}
+
+// Dial is used to get a client connected to the given node.
+func (n *Node) Dial() (*server.Client, net.Conn, error) {
+	conn, err := net.Dial("tcp", n.BrokerAddr)
+	if err != nil {
+		return nil, nil, err
+	}
+	return server.NewClient(conn), conn, nil
+}
+
+// Close is used to shut down every node in the cluster and remove their data.
+func (c *Cluster) Close() error {
+	c.cancel()
+	var err error
+	for _, n := range c.Nodes {
+		n.Server.Close()
+		if serr := n.Broker.Shutdown(); serr != nil && err == nil {
+			err = serr
+		}
+		if rerr := os.RemoveAll(n.dataDir); rerr != nil && err == nil {
+			err = rerr
+		}
+	}
+	c.Nodes = nil
+	return err
+}
+
+// freeAddrs is used to get n loopback addresses whose ports are free to bind on.
+func freeAddrs(n int) ([]string, error) {
+	lns := make([]net.Listener, 0, n)
+	defer func() {
+		for _, ln := range lns {
+			ln.Close()
+		}
+	}()
+	addrs := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return nil, err
+		}
+		lns = append(lns, ln)
+		addrs = append(addrs, ln.Addr().String())
+	}
+	return addrs, nil
+}
@@ -0,0 +1,15 @@
+package mock
+
+import (
+	"github.com/travisjeffery/jocko"
+)
+
+type Authorizer struct {
+	AuthorizeFn      func(principal string, operation jocko.Operation, resource jocko.Resource) bool
+	AuthorizeInvoked bool
+}
+
+func (a *Authorizer) Authorize(principal string, operation jocko.Operation, resource jocko.Resource) bool {
+	a.AuthorizeInvoked = true
+	return a.AuthorizeFn(principal, operation, resource)
+}
@@ -2,49 +2,84 @@ package mock
 
 import (
 	"io"
-	"sync"
 )
 
 type CommitLog struct {
-	mu  sync.RWMutex
-	log [][]byte
+	DeleteFn                  func() error
+	DeleteInvoked             bool
+	NewReaderFn               func(offset int64, maxBytes int32) (io.Reader, error)
+	NewReaderInvoked          bool
+	TruncateFn                func(int64) error
+	TruncateInvoked           bool
+	NewestOffsetFn            func() int64
+	NewestOffsetInvoked       bool
+	OldestOffsetFn            func() int64
+	OldestOffsetInvoked       bool
+	AppendFn                  func([]byte) (int64, error)
+	AppendInvoked             bool
+	SyncFn                    func() error
+	SyncInvoked               bool
+	CloseFn                   func() error
+	CloseInvoked              bool
+	RecoveryPointFn           func() int64
+	RecoveryPointInvoked      bool
+	DeleteRecordsFn           func(int64) error
+	DeleteRecordsInvoked      bool
+	OffsetForTimestampFn      func(int64) (int64, int64, error)
+	OffsetForTimestampInvoked bool
 }
 
-func NewCommitLog() *CommitLog {
-	return &CommitLog{}
+func (c *CommitLog) Delete() error {
+	c.DeleteInvoked = true
+	return c.DeleteFn()
+}
+
+func (c *CommitLog) NewReader(offset int64, maxBytes int32) (io.Reader, error) {
+	c.NewReaderInvoked = true
+	return c.NewReaderFn(offset, maxBytes)
+}
+
+func (c *CommitLog) Truncate(offset int64) error {
+	c.TruncateInvoked = true
+	return c.TruncateFn(offset)
+}
+
+func (c *CommitLog) NewestOffset() int64 {
+	c.NewestOffsetInvoked = true
+	return c.NewestOffsetFn()
 }
 
-func (c *CommitLog) Log() [][]byte {
-	log := [][]byte{}
-	c.mu.RLock()
-	log = append(log, c.log...)
-	c.mu.RUnlock()
-	return log
+func (c *CommitLog) OldestOffset() int64 {
+	c.OldestOffsetInvoked = true
+	return c.OldestOffsetFn()
 }
 
 func (c *CommitLog) Append(b []byte) (int64, error) {
-	c.mu.Lock()
-	c.log = append(c.log, b)
-	c.mu.Unlock()
-	return 0, nil
+	c.AppendInvoked = true
+	return c.AppendFn(b)
 }
 
-func (c *CommitLog) Delete() error {
-	return nil
+func (c *CommitLog) Sync() error {
+	c.SyncInvoked = true
+	return c.SyncFn()
 }
 
-func (c *CommitLog) NewReader(offset int64, maxBytes int32) (io.Reader, error) {
-	return nil, nil
+func (c *CommitLog) Close() error {
+	c.CloseInvoked = true
+	return c.CloseFn()
 }
 
-func (c *CommitLog) Truncate(int64) error {
-	return nil
+func (c *CommitLog) RecoveryPoint() int64 {
+	c.RecoveryPointInvoked = true
+	return c.RecoveryPointFn()
 }
 
-func (c *CommitLog) NewestOffset() int64 {
-	return 0
+func (c *CommitLog) DeleteRecords(offset int64) error {
+	c.DeleteRecordsInvoked = true
+	return c.DeleteRecordsFn(offset)
 }
 
-func (c *CommitLog) OldestOffset() int64 {
-	return 0
+func (c *CommitLog) OffsetForTimestamp(ts int64) (int64, int64, error) {
+	c.OffsetForTimestampInvoked = true
+	return c.OffsetForTimestampFn(ts)
 }
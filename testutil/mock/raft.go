@@ -9,6 +9,7 @@ type Raft struct {
 	BootstrapInvoked bool
 	ApplyFn          func(cmd jocko.RaftCommand) error
 	ApplyInvoked     bool
+	ApplyCommands    []jocko.RaftCommand
 	IsLeaderFn       func() bool
 	IsLeaderInvoked  bool
 	LeaderIDFn       func() string
@@ -26,6 +27,7 @@ func (r *Raft) Bootstrap(serf jocko.Serf, serfEventCh <-chan *jocko.ClusterMembe
 
 func (r *Raft) Apply(cmd jocko.RaftCommand) error {
 	r.ApplyInvoked = true
+	r.ApplyCommands = append(r.ApplyCommands, cmd)
 	return r.ApplyFn(cmd)
 }
 